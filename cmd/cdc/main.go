@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/inhies/go-bytesize"
+
+	"in-memory-db/internal/cdc"
+	"in-memory-db/internal/network"
+	"in-memory-db/internal/storage/wal"
+)
+
+var address = flag.String("address", "127.0.0.1:3223", "server address")
+var output = flag.String("output", "-", "directory for change files, - for stdout")
+var maxFileSize = flag.String("max-file-size", "64MB", "start a new change file after this size")
+var checkpointPath = flag.String("checkpoint", "cdc.checkpoint", "file with the lsn of the last emitted change")
+var checkpointInterval = flag.Duration("checkpoint-interval", time.Second, "how often to flush output and save checkpoint")
+var reconnectDelay = flag.Duration("reconnect-delay", time.Second, "delay before reconnecting to the server")
+
+const usage = `usage: cdc [options]
+
+Follows the server WAL and prints one JSON object per change:
+  {"lsn":1,"ts":"2024-01-01T00:00:00Z","op":"set","db":0,"key":"k","value":"v"}
+The lsn of the last emitted change is saved to the checkpoint file,
+after a restart output continues from the next change.
+
+options:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	var sink cdc.Sink
+	if *output == "-" {
+		sink = cdc.NewWriterSink(os.Stdout)
+	} else {
+		size, err := bytesize.Parse(*maxFileSize)
+		if err != nil {
+			return err
+		}
+		if sink, err = cdc.NewFileSink(*output, int64(size)); err != nil {
+			return err
+		}
+	}
+
+	exporter, err := cdc.NewExporter(sink, *checkpointPath)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	go func() {
+		ticker := time.NewTicker(*checkpointInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := exporter.Checkpoint(); err != nil {
+					fmt.Fprintln(os.Stderr, "save checkpoint:", err)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	for ctx.Err() == nil {
+		err := follow(ctx, exporter)
+		// ошибки разбора и записи не исчезнут после переподключения
+		var fatal fatalError
+		if errors.As(err, &fatal) {
+			cancel()
+			return errors.Join(err, exporter.Checkpoint(), sink.Close())
+		}
+		if ctx.Err() == nil {
+			fmt.Fprintln(os.Stderr, "wal stream:", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(*reconnectDelay):
+			}
+		}
+	}
+
+	return errors.Join(exporter.Checkpoint(), sink.Close())
+}
+
+type fatalError struct {
+	error
+}
+
+// follow читает поток записей с сервера, начиная со следующей после последней выведенной
+func follow(ctx context.Context, exporter *cdc.Exporter) error {
+	client := network.NewClient(*address, 0, 0)
+	if err := client.Connect(); err != nil {
+		return err
+	}
+	defer client.Close()
+
+	stop := context.AfterFunc(ctx, client.Close)
+	defer stop()
+
+	err := client.Stream(fmt.Sprintf("WALSTREAM %d", exporter.LastLSN()+1), func(line string) error {
+		if msg, ok := strings.CutPrefix(line, "error: "); ok {
+			return errors.New(msg)
+		}
+		r, err := wal.DecodeRecord(line)
+		if err != nil {
+			return fatalError{err}
+		}
+		if err := exporter.Export(r); err != nil {
+			return fatalError{err}
+		}
+		return nil
+	})
+	if err == nil {
+		err = errors.New("connection closed by server")
+	}
+	return err
+}
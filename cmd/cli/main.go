@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	"in-memory-db/internal/config"
 	"in-memory-db/internal/network"
@@ -42,6 +43,18 @@ func main() {
 			return
 		}
 
+		if fields := strings.Fields(query); len(fields) > 0 && strings.EqualFold(fields[0], "WALSTREAM") {
+			// соединение остаётся в режиме потока до выхода из программы
+			err := client.Stream(query, func(line string) error {
+				fmt.Println(line)
+				return nil
+			})
+			if err != nil {
+				fmt.Printf("error > %s\n", err.Error())
+			}
+			return
+		}
+
 		res, err := client.Send(query)
 		if err != nil {
 			fmt.Printf("error > %s\n", err.Error())
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go.uber.org/zap"
+
+	"in-memory-db/internal/config"
+	intlogger "in-memory-db/internal/logger"
+	"in-memory-db/internal/network"
+	"in-memory-db/internal/proxy"
+)
+
+var configPath = flag.String("config", "config.yml", "Path to config file")
+
+const usage = `usage: proxy [-config path]
+
+Accepts client queries on network.address and routes GET, SET and DEL to the shard of the key,
+chosen by consistent hashing over the shards of the proxy section. MGET is split by shard
+and the values are returned in the order of the keys. Backends are checked with INFO,
+the failover setting decides what happens when the primary of a shard is down.
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if err := run(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	cfg, err := config.ParseConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	maxMessageSize, err := cfg.Network.MessageSizeToSizeInBytes()
+	if err != nil {
+		return err
+	}
+	failover, err := proxy.ParseFailoverPolicy(cfg.Proxy.Failover)
+	if err != nil {
+		return err
+	}
+
+	logger, err := intlogger.CreateLogger(cfg.Log)
+	if err != nil {
+		return err
+	}
+	defer logger.Sync()
+
+	shards := make([]proxy.Shard, len(cfg.Proxy.Shards))
+	for i, s := range cfg.Proxy.Shards {
+		shards[i] = proxy.Shard{Name: s.Name, Primary: s.Primary, Replicas: s.Replicas}
+	}
+	p, err := proxy.NewProxy(shards, logger,
+		proxy.WithProxyVirtualNodes(cfg.Proxy.VirtualNodes),
+		proxy.WithProxyHealthCheckInterval(cfg.Proxy.HealthCheckInterval),
+		proxy.WithProxyFailover(failover, cfg.Proxy.FailoverTimeout),
+		proxy.WithProxyBackendConnection(cfg.Network.IdleTimeout, maxMessageSize),
+	)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run(ctx)
+	}()
+
+	server := network.NewHandlerServer(ctx, cfg.Network.Address, p, logger,
+		network.WithServerIdleTimeout(cfg.Network.IdleTimeout),
+		network.WithServerBufferSize(maxMessageSize),
+		network.WithServerMaxConnectionsNumber(cfg.Network.MaxConnections),
+	)
+	logger.Info("proxy ready to run", zap.Int("shards", len(shards)), zap.String("failover", string(failover)))
+	err = server.Run()
+	cancel()
+	<-done
+	return err
+}
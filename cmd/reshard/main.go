@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"in-memory-db/internal/cluster"
+	"in-memory-db/internal/config"
+	"in-memory-db/internal/network"
+)
+
+var configPath = flag.String("config", "config.yml", "Path to config file")
+var address = flag.String("address", "127.0.0.1:3223", "address of any cluster node")
+var batch = flag.Int("batch", 100, "keys requested from the source node at a time")
+var dryRun = flag.Bool("dry-run", false, "print the plan without moving slots")
+
+const usage = `usage: reshard [-config path] [-address host:port] [-batch N] [-dry-run]
+
+Reads the cluster nodes from the node at address, plans moves that spread the assigned slots
+evenly across all nodes and migrates the slots one by one while the cluster serves traffic.
+Add a new node with CLUSTER MEET <id> <address> on every node before rebalancing.
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if err := run(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	cfg, err := config.ParseConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	maxMessageSize, err := cfg.Network.MessageSizeToSizeInBytes()
+	if err != nil {
+		return err
+	}
+	if *batch <= 0 {
+		return errors.New("batch must be positive")
+	}
+
+	r := &resharder{
+		clients:        make(map[string]*network.Client),
+		idleTimeout:    cfg.Network.IdleTimeout,
+		maxMessageSize: maxMessageSize,
+	}
+	defer r.close()
+
+	resp, err := r.send(*address, "CLUSTER NODES")
+	if err != nil {
+		return err
+	}
+	nodes, err := parseNodes(resp)
+	if err != nil {
+		return err
+	}
+	r.nodes = nodes
+
+	moves := cluster.Plan(nodes)
+	if len(moves) == 0 {
+		fmt.Println("slots are already balanced")
+		return nil
+	}
+	for _, m := range groupMoves(moves) {
+		fmt.Printf("move %s from %s to %s\n", m.slots, m.from, m.to)
+	}
+	if *dryRun {
+		return nil
+	}
+
+	for i, m := range moves {
+		start := time.Now()
+		migrated, err := r.moveSlot(m)
+		if err != nil {
+			return fmt.Errorf("move slot %d from %s to %s: %w", m.Slot, m.From, m.To, err)
+		}
+		fmt.Printf("[%d/%d] slot %d moved from %s to %s, %d keys in %s\n",
+			i+1, len(moves), m.Slot, m.From, m.To, migrated, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// parseNodes разбирает ответ CLUSTER NODES: строки <id узла> <адрес> [слоты]
+func parseNodes(resp string) ([]cluster.Node, error) {
+	var nodes []cluster.Node
+	for _, line := range strings.Split(resp, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("wrong cluster nodes line %q", line)
+		}
+		node := cluster.Node{ID: fields[0], Address: fields[1]}
+		if len(fields) == 3 {
+			slots, err := cluster.ParseSlotRanges(fields[2])
+			if err != nil {
+				return nil, err
+			}
+			node.Slots = slots
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+type moveGroup struct {
+	slots    cluster.SlotRange
+	from, to string
+}
+
+// groupMoves объединяет переносы соседних слотов между одними и теми же узлами
+func groupMoves(moves []cluster.Move) []moveGroup {
+	var groups []moveGroup
+	for _, m := range moves {
+		last := len(groups) - 1
+		if last >= 0 && groups[last].from == m.From && groups[last].to == m.To && groups[last].slots.To+1 == m.Slot {
+			groups[last].slots.To = m.Slot
+			continue
+		}
+		groups = append(groups, moveGroup{slots: cluster.SlotRange{From: m.Slot, To: m.Slot}, from: m.From, to: m.To})
+	}
+	return groups
+}
+
+// emptyResponse - ответ CLUSTER GETKEYSINSLOT, когда ключей в слоте не осталось
+const emptyResponse = "(empty)"
+
+var errConnectionClosed = errors.New("connection closed")
+
+type resharder struct {
+	nodes          []cluster.Node
+	clients        map[string]*network.Client
+	idleTimeout    time.Duration
+	maxMessageSize int
+}
+
+// moveSlot переносит слот по ключу и передаёт его новому владельцу, возвращает число перенесённых ключей
+func (r *resharder) moveSlot(m cluster.Move) (int, error) {
+	source, target := r.address(m.From), r.address(m.To)
+	if _, err := r.send(target, fmt.Sprintf("CLUSTER SETSLOT %d IMPORTING %s", m.Slot, m.From)); err != nil {
+		return 0, err
+	}
+	if _, err := r.send(source, fmt.Sprintf("CLUSTER SETSLOT %d MIGRATING %s", m.Slot, m.To)); err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for {
+		resp, err := r.send(source, fmt.Sprintf("CLUSTER GETKEYSINSLOT %d %d", m.Slot, *batch))
+		if err != nil {
+			return migrated, err
+		}
+		if resp == emptyResponse {
+			break
+		}
+		keys := strings.Fields(resp)
+		for len(keys) > 0 {
+			query, n := r.migrateQuery(keys)
+			if _, err := r.send(source, query); err != nil {
+				return migrated, err
+			}
+			keys = keys[n:]
+			migrated += n
+		}
+	}
+
+	// новый владелец получает слот первым, чтобы прежний не отправлял к нему клиентов до передачи
+	if _, err := r.send(target, fmt.Sprintf("CLUSTER SETSLOT %d NODE %s", m.Slot, m.To)); err != nil {
+		return migrated, err
+	}
+	if _, err := r.send(source, fmt.Sprintf("CLUSTER SETSLOT %d NODE %s", m.Slot, m.To)); err != nil {
+		return migrated, err
+	}
+	for _, n := range r.nodes {
+		if n.ID == m.From || n.ID == m.To {
+			continue
+		}
+		if _, err := r.send(n.Address, fmt.Sprintf("CLUSTER SETSLOT %d NODE %s", m.Slot, m.To)); err != nil {
+			return migrated, err
+		}
+	}
+	return migrated, nil
+}
+
+// migrateQuery возвращает запрос MIGRATE с первыми ключами, которые помещаются в сообщение, и их число
+func (r *resharder) migrateQuery(keys []string) (string, int) {
+	query := "MIGRATE " + keys[0]
+	n := 1
+	for ; n < len(keys); n++ {
+		if len(query)+len(keys[n])+1 >= r.maxMessageSize {
+			break
+		}
+		query += " " + keys[n]
+	}
+	return query, n
+}
+
+func (r *resharder) address(id string) string {
+	for _, n := range r.nodes {
+		if n.ID == id {
+			return n.Address
+		}
+	}
+	return ""
+}
+
+// send выполняет запрос на узле address. Соединения с узлами переиспользуются, запрос по закрытому
+// соединению повторяется по новому: все запросы переноса можно выполнить повторно.
+func (r *resharder) send(address, query string) (string, error) {
+	resp, err := r.sendOnce(address, query)
+	if err != nil {
+		resp, err = r.sendOnce(address, query)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", address, err)
+	}
+	if msg, ok := strings.CutPrefix(resp, "error: "); ok {
+		return "", fmt.Errorf("%s: %s: %s", address, query, msg)
+	}
+	return resp, nil
+}
+
+func (r *resharder) sendOnce(address, query string) (string, error) {
+	client, ok := r.clients[address]
+	if !ok {
+		client = network.NewClient(address, r.idleTimeout, r.maxMessageSize)
+		if err := client.Connect(); err != nil {
+			return "", err
+		}
+		r.clients[address] = client
+	}
+
+	resp, err := client.Send(query)
+	if err == nil && resp == "" {
+		err = errConnectionClosed
+	}
+	if err != nil {
+		client.Close()
+		delete(r.clients, address)
+		return "", err
+	}
+	return resp, nil
+}
+
+func (r *resharder) close() {
+	for _, client := range r.clients {
+		client.Close()
+	}
+}
@@ -2,23 +2,44 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
 	"syscall"
+	"time"
 
 	"go.uber.org/zap"
 	"in-memory-db/internal"
+	"in-memory-db/internal/cluster"
 	"in-memory-db/internal/compute"
 	"in-memory-db/internal/config"
 	intlogger "in-memory-db/internal/logger"
 	"in-memory-db/internal/network"
+	"in-memory-db/internal/raft"
+	"in-memory-db/internal/replication"
+	"in-memory-db/internal/storage/encryption"
 	inmemory "in-memory-db/internal/storage/in-memory"
 	"in-memory-db/internal/storage/wal"
 )
 
+// файл состояния репликации в директории данных, см. internal.WithDatabaseReplicationStateFile
+const replicationStateFile = "replication_state.json"
+
+// файл состояния узла Raft в директории данных
+const raftStateFile = "raft_state.json"
+
+// файл распределения слотов кластера в директории данных
+const clusterStateFile = "cluster_state.json"
+
 var configPath = flag.String("config", "config.yml", "Path to config file")
+var recoveryTargetLSN = flag.Uint64("recovery-target-lsn", 0, "Restore state up to and including this WAL LSN")
+var recoveryTargetTime = flag.String("recovery-target-time", "", "Restore state up to this time, RFC3339")
+var recoveryDryRun = flag.Bool("recovery-dry-run", false, "Print the state recovery would produce and exit")
 
 func main() {
 	flag.Parse()
@@ -48,21 +69,230 @@ func main() {
 		return
 	}
 
+	recoveryTarget := wal.RecoveryTarget{LSN: *recoveryTargetLSN}
+	if *recoveryTargetTime != "" {
+		recoveryTarget.Time, err = time.Parse(time.RFC3339Nano, *recoveryTargetTime)
+		if err != nil {
+			fmt.Println("wrong recovery target time:", err)
+			return
+		}
+	}
+
+	keyring, err := newKeyring(cfg.Wal.Encryption)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	queuePolicy := wal.QueuePolicy(cfg.Wal.Queue.Policy)
+	if queuePolicy == "" {
+		queuePolicy = wal.QueueBlock
+	}
+	if queuePolicy != wal.QueueBlock && queuePolicy != wal.QueueReject {
+		fmt.Println("wrong wal queue policy:", cfg.Wal.Queue.Policy)
+		return
+	}
+
+	minFreeSpace, err := cfg.Wal.DiskGuard.MinFreeSpaceToSizeInBytes()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	resumeFreeSpace, err := cfg.Wal.DiskGuard.ResumeFreeSpaceToSizeInBytes()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	diskGuard := wal.NewDiskGuard(cfg.Wal.DataDirectory, wal.DiskGuardPolicy{
+		MinFree:    int64(minFreeSpace),
+		ResumeFree: int64(resumeFreeSpace),
+	}, logger)
+
+	role := internal.Role(cfg.Replication.Role)
+	if role == "" {
+		role = internal.RolePrimary
+	}
+	if role != internal.RolePrimary && role != internal.RoleReplica {
+		fmt.Println("wrong replication role:", cfg.Replication.Role)
+		return
+	}
+	if role == internal.RoleReplica && cfg.Replication.PrimaryAddress == "" {
+		fmt.Println("replica requires replication.primary_address")
+		return
+	}
+	staleReads := internal.StaleReadPolicy(cfg.Replication.StaleReads)
+	if staleReads == "" {
+		staleReads = internal.StaleReadsError
+	}
+	if staleReads != internal.StaleReadsError && staleReads != internal.StaleReadsForward {
+		fmt.Println("wrong replication stale reads policy:", cfg.Replication.StaleReads)
+		return
+	}
+	var raftMembers []raft.Member
+	if cfg.Raft.Enabled {
+		if role == internal.RoleReplica {
+			fmt.Println("raft mode does not support replication.role replica")
+			return
+		}
+		if cfg.Raft.ID == "" || cfg.Raft.Address == "" {
+			fmt.Println("raft mode requires raft.id and raft.address")
+			return
+		}
+		raftMembers, err = raft.ParseMembers(cfg.Raft.Members)
+		if err != nil {
+			fmt.Println("wrong raft members:", err)
+			return
+		}
+	}
+	var clusterInst *cluster.Cluster
+	if cfg.Cluster.Enabled {
+		clusterInst, err = newCluster(cfg.Cluster, filepath.Join(cfg.Wal.DataDirectory, clusterStateFile))
+		if err != nil {
+			fmt.Println("wrong cluster config:", err)
+			return
+		}
+	}
+	// после REPLICAOF репликой может стать любой сервер
+	replicaID := cfg.Replication.ReplicaID
+	if replicaID == "" {
+		replicaID = cfg.Network.Address
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	e := inmemory.NewEngine()
 	p := compute.NewParser()
-	segment := wal.NewSegment(maxSegmentSize, cfg.Wal.DataDirectory)
-	walInst := wal.NewWal(ctx, cfg.Wal.FlushingBatchSize, cfg.Wal.FlushingBatchTimeout, segment, logger)
-	db := internal.NewDatabase(e, p, logger, walInst)
-	db.Init()
 
+	var segmentOptions []wal.SegmentOption
+	if keyring != nil {
+		segmentOptions = append(segmentOptions, wal.WithSegmentKeyring(keyring))
+	}
+
+	segment := wal.NewSegment(maxSegmentSize, cfg.Wal.DataDirectory, segmentOptions...)
+	walInst := wal.NewWal(ctx, cfg.Wal.FlushingBatchSize, cfg.Wal.FlushingBatchTimeout, segment, logger,
+		wal.WithWalRecoveryTarget(recoveryTarget, *recoveryDryRun),
+		wal.WithWalQueue(cfg.Wal.Queue.Size, queuePolicy, cfg.Wal.Queue.Timeout),
+		wal.WithWalDiskGuard(diskGuard),
+	)
+	dbOptions := []internal.DatabaseOption{
+		internal.WithDatabaseBackupDirectory(cfg.Wal.BackupDirectory),
+		internal.WithDatabaseRole(role),
+		internal.WithDatabaseWriteQuorum(cfg.Replication.WriteQuorum, cfg.Replication.QuorumTimeout, cfg.Replication.DegradeToAsync),
+		internal.WithDatabaseReplicationStateFile(filepath.Join(cfg.Wal.DataDirectory, replicationStateFile)),
+		internal.WithDatabaseStaleReads(staleReads),
+		internal.WithDatabaseWaitLSNTimeout(cfg.Replication.WaitLSNTimeout),
+	}
+	if role == internal.RoleReplica {
+		dbOptions = append(dbOptions, internal.WithDatabaseReplicaOf(cfg.Replication.PrimaryAddress))
+	}
+	if clusterInst != nil {
+		// MIGRATE передаёт ключи новому владельцу слота через Forward
+		forwarder := replication.NewReplicator(replicaID, logger)
+		dbOptions = append(dbOptions, internal.WithDatabaseCluster(ctx, clusterInst, forwarder))
+	}
+	var raftNode *raft.Node
+	// пробное восстановление не подключается к другим серверам
+	if !*recoveryDryRun && cfg.Raft.Enabled {
+		transport := raft.NewTCPTransport(0)
+		defer transport.Close()
+		raftNode = raft.NewNode(cfg.Raft.ID, filepath.Join(cfg.Wal.DataDirectory, raftStateFile), transport, logger,
+			raft.WithNodeBootstrap(raftMembers),
+			raft.WithNodeElectionTimeout(cfg.Raft.ElectionTimeout),
+			raft.WithNodeHeartbeatInterval(cfg.Raft.HeartbeatInterval),
+			raft.WithNodeSubmitTimeout(cfg.Raft.SubmitTimeout),
+		)
+		dbOptions = append(dbOptions, internal.WithDatabaseConsensus(ctx, raftNode))
+	} else if !*recoveryDryRun {
+		replicator := replication.NewReplicator(replicaID, logger,
+			replication.WithReplicatorReconnectDelay(cfg.Replication.ReconnectDelay),
+		)
+		dbOptions = append(dbOptions, internal.WithDatabaseReplicator(ctx, replicator))
+	}
+	db := internal.NewDatabase(e, p, logger, walInst, dbOptions...)
+
+	if *recoveryDryRun {
+		if err := db.Init(); err != nil {
+			fmt.Println("init database:", err)
+		} else {
+			printRecoveryReport(walInst.RecoveryReport(), e)
+		}
+		cancel()
+		return
+	}
+
+	// пробное восстановление только читает WAL, остальные режимы должны быть единственными владельцами директории
+	lock, err := wal.LockDataDirectory(cfg.Wal.DataDirectory)
+	if err != nil {
+		fmt.Println(err)
+		cancel()
+		return
+	}
+	defer func() {
+		if err := lock.Unlock(); err != nil {
+			logger.Error("unlock data directory", zap.Error(err))
+		}
+	}()
+
+	maxTotalSize, err := cfg.Wal.Retention.MaxTotalSizeToSizeInBytes()
+	if err != nil {
+		fmt.Println(err)
+		cancel()
+		return
+	}
+	retention := wal.RetentionPolicy{
+		MaxSegments:  cfg.Wal.Retention.MaxSegments,
+		MaxAge:       cfg.Wal.Retention.MaxAge,
+		MaxTotalSize: int64(maxTotalSize),
+	}
+	archive := wal.ArchivePolicy{
+		Mode:      wal.ArchiveMode(cfg.Wal.Archive.Mode),
+		Directory: cfg.Wal.Archive.Directory,
+		Command:   cfg.Wal.Archive.Command,
+	}
+	if archive.Mode == "off" {
+		archive.Mode = wal.ArchiveOff
+	}
+	// сегменты удаляются только после того, как их записи вошли в снимок
+	if retention.IsSet() && cfg.Wal.SnapshotInterval <= 0 {
+		fmt.Println("wal retention requires wal.snapshot_interval")
+		cancel()
+		return
+	}
+	var cleaner *wal.Cleaner
+	if retention.IsSet() || archive.Mode != wal.ArchiveOff {
+		cleaner, err = wal.NewCleaner(segment, retention, archive, logger)
+		if err != nil {
+			fmt.Println(err)
+			cancel()
+			return
+		}
+	}
+
+	if cfg.Metrics.Address != "" {
+		expvar.Publish("replication", expvar.Func(db.ReplicationMetrics))
+		go func() {
+			if err := http.ListenAndServe(cfg.Metrics.Address, nil); err != nil {
+				logger.Error("metrics server error", zap.Error(err))
+			}
+		}()
+	}
+
+	// соединения принимаются сразу, до окончания восстановления запросы получают ошибку LOADING
 	server := network.NewServer(ctx, cfg.Network.Address, db, logger,
 		network.WithServerIdleTimeout(cfg.Network.IdleTimeout),
 		network.WithServerBufferSize(maxMessageSize),
 		network.WithServerMaxConnectionsNumber(cfg.Network.MaxConnections),
+		network.WithServerHeartbeatInterval(cfg.Replication.HeartbeatInterval),
 	)
 
+	if raftNode != nil {
+		go func() {
+			if err := raft.ServeTCP(ctx, cfg.Raft.Address, raftNode, logger); err != nil {
+				logger.Error("raft server error", zap.Error(err))
+			}
+		}()
+	}
+
 	doneSignal := make(chan os.Signal, 1)
 	signal.Notify(doneSignal, os.Interrupt, syscall.SIGTERM)
 
@@ -76,9 +306,99 @@ func main() {
 		cancel()
 	}()
 
+	if err := diskGuard.Check(); err != nil {
+		logger.Error("check free disk space", zap.Error(err))
+	}
+	diskCheckInterval := cfg.Wal.DiskGuard.CheckInterval
+	if diskCheckInterval <= 0 {
+		diskCheckInterval = time.Second
+	}
+	go diskGuard.Run(ctx, diskCheckInterval)
+
+	if err := db.Init(); err != nil {
+		logger.Error("init database", zap.Error(err))
+		fmt.Println("init database:", err)
+		cancel()
+		return
+	}
+	logger.Info("database loaded")
+
+	report := walInst.RecoveryReport()
+	if report.Target.IsSet() {
+		logger.Info("recovered to target",
+			zap.Stringer("target", report.Target),
+			zap.Uint64("last_lsn", report.LastLSN),
+			zap.String("archive", report.ArchiveDirectory),
+		)
+	}
+
+	if cfg.Wal.SnapshotInterval > 0 {
+		go db.RunSnapshots(ctx, cfg.Wal.SnapshotInterval)
+	}
+	if cleaner != nil {
+		checkInterval := cfg.Wal.Retention.CheckInterval
+		if checkInterval <= 0 {
+			checkInterval = time.Minute
+		}
+		go cleaner.Run(ctx, checkInterval)
+	}
+
 	<-doneSignal
 
 	cancel()
 
+	if raftNode != nil {
+		raftNode.Wait()
+	}
 	walInst.WaitWrite()
 }
+
+func printRecoveryReport(report wal.RecoveryReport, e *inmemory.Engine) {
+	fmt.Printf("recovery target: %s\n", report.Target)
+	fmt.Printf("applied records: %d\n", report.AppliedRecords)
+	fmt.Printf("discarded records: %d\n", report.DiscardedRecords)
+	if report.LastTimestamp.IsZero() {
+		fmt.Printf("last lsn: %d\n", report.LastLSN)
+	} else {
+		fmt.Printf("last lsn: %d at %s\n", report.LastLSN, report.LastTimestamp.Format(time.RFC3339Nano))
+	}
+
+	var keys []string
+	values := make(map[string]string)
+	e.Range(func(key, val string) bool {
+		keys = append(keys, key)
+		values[key] = val
+		return true
+	})
+	slices.Sort(keys)
+
+	fmt.Printf("keys: %d\n", len(keys))
+	for _, key := range keys {
+		fmt.Printf("SET %s %s\n", key, values[key])
+	}
+}
+
+// newCluster возвращает распределение слотов из секции cluster или, после переноса слотов, из stateFile
+func newCluster(cfg config.ClusterConfig, stateFile string) (*cluster.Cluster, error) {
+	nodes := make([]cluster.Node, len(cfg.Nodes))
+	for i, n := range cfg.Nodes {
+		slots, err := cluster.ParseSlotRanges(n.Slots)
+		if err != nil {
+			return nil, err
+		}
+		nodes[i] = cluster.Node{ID: n.ID, Address: n.Address, Slots: slots}
+	}
+	return cluster.New(cfg.ID, nodes, cluster.WithClusterStateFile(stateFile))
+}
+
+// newKeyring загружает ключи шифрования из секции wal.encryption, nil - шифрование выключено
+func newKeyring(cfg config.EncryptionConfig) (*encryption.Keyring, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	keys, err := cfg.ReadKeys()
+	if err != nil {
+		return nil, err
+	}
+	return encryption.ParseKeyring(keys)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"in-memory-db/internal/config"
+	"in-memory-db/internal/storage/encryption"
+	"in-memory-db/internal/storage/filesystem"
+	"in-memory-db/internal/storage/wal"
+)
+
+var configPath = flag.String("config", "config.yml", "Path to config file")
+var dataDirectory = flag.String("dir", "", "WAL data directory, overrides wal.data_directory from config")
+
+const usage = `usage: walctl [-config path] [-dir path] <command> [options]
+
+commands:
+  list                              list segments with sizes and record counts
+  dump [-segment N] [-format F]     print records, F is text or json
+  verify                            check checksums and order of every record and the segment manifest
+  truncate -segment N -record I     keep only records before I in segment N
+  restore -from DIR                 verify backup DIR and copy it into an empty data directory
+  migrate -backup DIR               copy the data directory into DIR and convert it to the current format
+`
+
+type settings struct {
+	dataDirectory string
+	keyring       *encryption.Keyring
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	st, err := loadSettings()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	command, args := flag.Arg(0), flag.Args()[1:]
+	switch command {
+	case "list":
+		err = list(st)
+	case "dump":
+		err = dump(st, args)
+	case "verify":
+		err = verify(st)
+	case "truncate":
+		err = truncate(st, args)
+	case "restore":
+		err = restore(st, args)
+	case "migrate":
+		err = migrate(st, args)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func loadSettings() (settings, error) {
+	st := settings{dataDirectory: *dataDirectory}
+
+	// без конфигурации можно работать только с незашифрованными сегментами
+	if _, err := os.Stat(*configPath); err != nil && st.dataDirectory != "" {
+		return st, nil
+	}
+
+	cfg, err := config.ParseConfig(*configPath)
+	if err != nil {
+		return st, err
+	}
+
+	if st.dataDirectory == "" {
+		st.dataDirectory = cfg.Wal.DataDirectory
+	}
+
+	st.keyring, err = newKeyring(cfg.Wal.Encryption)
+	return st, err
+}
+
+func list(st settings) error {
+	files, err := wal.ListSegmentFiles(filesystem.OS{}, st.dataDirectory)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SEGMENT\tSIZE\tRECORDS\tFIRST LSN\tLAST LSN\tSTATUS")
+
+	decoder := wal.Decoder{}
+	for _, file := range files {
+		var count int
+		var firstLSN, lastLSN uint64
+		status := "ok"
+		err := wal.ReadSegmentFile(filesystem.OS{}, file.Path, st.keyring, &decoder, func(index int, r wal.Record) error {
+			if count == 0 {
+				firstLSN = r.LSN
+			}
+			lastLSN = r.LSN
+			count++
+			return nil
+		})
+		if err != nil {
+			status = err.Error()
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\n", file.Name, file.Size, count, firstLSN, lastLSN, status)
+	}
+
+	return w.Flush()
+}
+
+type dumpRecord struct {
+	Segment   string     `json:"segment"`
+	Index     int        `json:"index"`
+	LSN       uint64     `json:"lsn"`
+	Timestamp *time.Time `json:"ts"`
+	Query     string     `json:"query"`
+}
+
+func dump(st settings, args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	segmentNumber := fs.Int("segment", 0, "segment number, all segments if not set")
+	format := fs.String("format", "text", "output format: text or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	files, err := wal.ListSegmentFiles(filesystem.OS{}, st.dataDirectory)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	// LSN старых записей назначаются по порядку, поэтому читаем все сегменты,
+	// даже если нужно вывести только один
+	decoder := wal.Decoder{}
+	for _, file := range files {
+		if *segmentNumber != 0 && file.Number > *segmentNumber {
+			break
+		}
+
+		err := wal.ReadSegmentFile(filesystem.OS{}, file.Path, st.keyring, &decoder, func(index int, r wal.Record) error {
+			if *segmentNumber != 0 && file.Number != *segmentNumber {
+				return nil
+			}
+
+			if *format == "json" {
+				dr := dumpRecord{Segment: file.Name, Index: index, LSN: r.LSN, Query: r.Query}
+				if !r.Legacy() {
+					dr.Timestamp = &r.Timestamp
+				}
+				return encoder.Encode(dr)
+			}
+
+			ts := "-"
+			if !r.Legacy() {
+				ts = r.Timestamp.UTC().Format(time.RFC3339Nano)
+			}
+			_, err := fmt.Printf("%s\t%d\t%d\t%s\t%s\n", file.Name, index, r.LSN, ts, r.Query)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("segment %s: %w", file.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func verify(st settings) error {
+	files, err := wal.ListSegmentFiles(filesystem.OS{}, st.dataDirectory)
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	decoder := wal.Decoder{}
+	for _, file := range files {
+		var count int
+		err := wal.ReadSegmentFile(filesystem.OS{}, file.Path, st.keyring, &decoder, func(index int, r wal.Record) error {
+			count++
+			return nil
+		})
+		if err != nil {
+			failed++
+			fmt.Printf("%s: FAIL after %d records: %s\n", file.Name, count, err)
+			continue
+		}
+		fmt.Printf("%s: ok, %d records\n", file.Name, count)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d segments failed verification", failed, len(files))
+	}
+
+	return verifyManifest(st)
+}
+
+// verifyManifest сверяет закрытые сегменты с размерами и контрольными суммами из манифеста
+func verifyManifest(st settings) error {
+	manifest, err := wal.ReadSegmentManifest(filesystem.OS{}, st.dataDirectory)
+	if errors.Is(err, fs.ErrNotExist) {
+		fmt.Printf("%s: not found, segments are found by file names\n", wal.SegmentManifestName)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, info := range manifest.Segments {
+		if info.Active {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(st.dataDirectory, info.Name))
+		if err != nil {
+			return fmt.Errorf("%s: %w", wal.SegmentManifestName, err)
+		}
+		if int64(len(data)) != info.Size || crc32.ChecksumIEEE(data) != info.CRC32 {
+			return fmt.Errorf("%s: %w: %s", wal.SegmentManifestName, wal.ErrSegmentChecksum, info.Name)
+		}
+	}
+	fmt.Printf("%s: ok, %d segments\n", wal.SegmentManifestName, len(manifest.Segments))
+
+	return nil
+}
+
+func truncate(st settings, args []string) error {
+	fs := flag.NewFlagSet("truncate", flag.ExitOnError)
+	segmentNumber := fs.Int("segment", 0, "segment number")
+	recordIndex := fs.Int("record", -1, "index of the first record to remove")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *segmentNumber <= 0 || *recordIndex < 0 {
+		return fmt.Errorf("truncate requires -segment and -record")
+	}
+
+	// сегменты перечисляются под блокировкой, чтобы сервер не изменил их между чтением списка и обрезкой
+	lock, err := wal.LockDataDirectory(st.dataDirectory)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	files, err := wal.ListSegmentFiles(filesystem.OS{}, st.dataDirectory)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.Number != *segmentNumber {
+			continue
+		}
+
+		if err := wal.TruncateSegmentFile(filesystem.OS{}, file.Path, st.keyring, *recordIndex); err != nil {
+			return err
+		}
+		fmt.Printf("%s: truncated at record %d\n", file.Name, *recordIndex)
+		return nil
+	}
+
+	return fmt.Errorf("segment %d not found", *segmentNumber)
+}
+
+func restore(st settings, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	from := fs.String("from", "", "backup directory written by BACKUP")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" {
+		return fmt.Errorf("restore requires -from")
+	}
+
+	if err := os.MkdirAll(st.dataDirectory, 0755); err != nil {
+		return err
+	}
+	lock, err := wal.LockDataDirectory(st.dataDirectory)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	manifest, err := wal.RestoreBackup(filesystem.OS{}, *from, st.dataDirectory)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored backup %s into %s: lsn %d, %d files\n", *from, st.dataDirectory, manifest.LSN, len(manifest.Files))
+
+	return nil
+}
+
+func migrate(st settings, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	backup := fs.String("backup", "", "empty directory for a copy of the data directory before migration")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *backup == "" {
+		return fmt.Errorf("migrate requires -backup")
+	}
+
+	lock, err := wal.LockDataDirectory(st.dataDirectory)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	res, err := wal.MigrateDataDirectory(filesystem.OS{}, st.dataDirectory, *backup, st.keyring)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("backup of %d files written to %s\n", len(res.Backup.Files), *backup)
+	fmt.Printf("migrated to segment format %d and snapshot format %d: %d segments, %d snapshots, last lsn %d\n",
+		wal.SegmentFormatVersion, wal.SnapshotFormatVersion, len(res.Segments), len(res.Snapshots), res.LastLSN)
+
+	return nil
+}
+
+// newKeyring загружает ключи шифрования из секции wal.encryption, nil - шифрование выключено
+func newKeyring(cfg config.EncryptionConfig) (*encryption.Keyring, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	keys, err := cfg.ReadKeys()
+	if err != nil {
+		return nil, err
+	}
+	return encryption.ParseKeyring(keys)
+}
@@ -0,0 +1,126 @@
+package cdc
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"in-memory-db/internal/compute"
+	"in-memory-db/internal/storage/wal"
+	"in-memory-db/internal/testingh"
+)
+
+func TestNewChange(t *testing.T) {
+	ts := time.Unix(0, 1700000000000000000)
+
+	change, err := NewChange(wal.NewRecord(5, ts, "SET key val"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), change.LSN)
+	assert.True(t, ts.Equal(*change.Timestamp))
+	assert.Equal(t, OpSet, change.Op)
+	assert.Equal(t, "key", change.Key)
+	assert.Equal(t, "val", *change.Value)
+
+	change, err = NewChange(wal.NewRecord(6, time.Time{}, "DEL key"))
+	require.NoError(t, err)
+	assert.Equal(t, OpDel, change.Op)
+	assert.Nil(t, change.Timestamp)
+	assert.Nil(t, change.Value)
+
+	_, err = NewChange(wal.NewRecord(7, ts, "GET key"))
+	assert.ErrorIs(t, err, compute.ErrUnknownCommand)
+}
+
+func TestWriterSink(t *testing.T) {
+	out := bytes.Buffer{}
+	e, err := NewExporter(NewWriterSink(&out), t.TempDir()+"/checkpoint")
+	require.NoError(t, err)
+
+	require.NoError(t, e.Export(wal.NewRecord(1, time.Unix(0, 1700000000000000000), "SET key val")))
+	require.NoError(t, e.Export(wal.NewRecord(2, time.Time{}, "DEL key")))
+	require.NoError(t, e.Checkpoint())
+
+	assert.Equal(t, `{"lsn":1,"ts":"2023-11-14T22:13:20Z","op":"set","db":0,"key":"key","value":"val"}
+{"lsn":2,"ts":null,"op":"del","db":0,"key":"key","value":null}
+`, out.String())
+}
+
+type FileSinkSuite struct {
+	testingh.BaseDirSuite
+}
+
+func TestFileSinkSuite(t *testing.T) {
+	suite.Run(t, new(FileSinkSuite))
+}
+
+func (s *FileSinkSuite) SetupTest() {
+	s.BaseDir = testingh.GetBaseDir(runtime.Caller(0))
+	s.BaseDirSuite.SetupTest()
+}
+
+func (s *FileSinkSuite) export(e *Exporter, from, to uint64) {
+	for lsn := from; lsn <= to; lsn++ {
+		s.Require().NoError(e.Export(wal.NewRecord(lsn, time.Now(), "SET key val")))
+	}
+}
+
+func (s *FileSinkSuite) TestRotation() {
+	sink, err := NewFileSink(s.BaseDir+"out", 150)
+	s.Require().NoError(err)
+	e, err := NewExporter(sink, s.BaseDir+"checkpoint")
+	s.Require().NoError(err)
+
+	s.export(e, 1, 6)
+	s.NoError(e.Checkpoint())
+	s.NoError(sink.Close())
+
+	// в файл помещается два изменения
+	names, err := os.ReadDir(s.BaseDir + "out")
+	s.NoError(err)
+	s.Len(names, 3)
+	s.Equal("changes_00000000000000000001.jsonl", names[0].Name())
+	s.Equal("changes_00000000000000000005.jsonl", names[2].Name())
+	s.Len(s.ReadFileToSlice(s.BaseDir+"out/"+names[2].Name()), 2)
+
+	lsn, err := ReadCheckpoint(s.BaseDir + "checkpoint")
+	s.NoError(err)
+	s.Equal(uint64(6), lsn)
+}
+
+func (s *FileSinkSuite) TestResume() {
+	sink, err := NewFileSink(s.BaseDir+"out", 1<<20)
+	s.Require().NoError(err)
+	e, err := NewExporter(sink, s.BaseDir+"checkpoint")
+	s.Require().NoError(err)
+
+	s.export(e, 1, 3)
+	s.NoError(e.Checkpoint())
+	// изменения записаны, но контрольная точка не сохранена, последняя строка оборвана
+	s.export(e, 4, 5)
+	s.NoError(sink.Sync())
+	f, err := os.OpenFile(s.BaseDir+"out/changes_00000000000000000001.jsonl", os.O_APPEND|os.O_WRONLY, 0644)
+	s.Require().NoError(err)
+	_, err = f.WriteString(`{"lsn":6,"ts":`)
+	s.NoError(err)
+	s.NoError(f.Close())
+
+	sink, err = NewFileSink(s.BaseDir+"out", 1<<20)
+	s.Require().NoError(err)
+	e, err = NewExporter(sink, s.BaseDir+"checkpoint")
+	s.Require().NoError(err)
+	s.Equal(uint64(5), e.LastLSN())
+
+	// повторённые сервером записи пропускаются
+	s.export(e, 3, 6)
+	s.NoError(e.Checkpoint())
+	s.NoError(sink.Close())
+
+	lines := s.ReadFileToSlice(s.BaseDir + "out/changes_00000000000000000001.jsonl")
+	s.Len(lines, 6)
+	s.Contains(lines[5], `"lsn":6,`)
+}
@@ -0,0 +1,51 @@
+package cdc
+
+import (
+	"fmt"
+	"time"
+
+	"in-memory-db/internal/compute"
+	"in-memory-db/internal/storage/wal"
+)
+
+const (
+	OpSet = "set"
+	OpDel = "del"
+)
+
+// Change - изменение ключа, одна строка JSON в выводе.
+// База одна, поле db оставлено для совместимости с потребителями, ожидающими номер базы.
+type Change struct {
+	LSN       uint64     `json:"lsn"`
+	Timestamp *time.Time `json:"ts"`
+	Op        string     `json:"op"`
+	DB        int        `json:"db"`
+	Key       string     `json:"key"`
+	Value     *string    `json:"value"`
+}
+
+// NewChange разбирает запрос из записи WAL. Для записей старого формата ts не заполняется.
+func NewChange(r wal.Record) (Change, error) {
+	query, err := compute.NewParser().Parse(r.Query)
+	if err != nil {
+		return Change{}, fmt.Errorf("lsn %d: %w", r.LSN, err)
+	}
+
+	change := Change{LSN: r.LSN, Key: query.Args()[0]}
+	if !r.Legacy() {
+		ts := r.Timestamp.UTC()
+		change.Timestamp = &ts
+	}
+
+	switch query.Command() {
+	case compute.SetCommand:
+		change.Op = OpSet
+		change.Value = &query.Args()[1]
+	case compute.DelCommand:
+		change.Op = OpDel
+	default:
+		return Change{}, fmt.Errorf("lsn %d: %w: %s", r.LSN, compute.ErrUnknownCommand, query.Command())
+	}
+
+	return change, nil
+}
@@ -0,0 +1,79 @@
+package cdc
+
+import (
+	"sync"
+
+	"in-memory-db/internal/storage/wal"
+)
+
+// Exporter передаёт записи WAL в Sink и сохраняет LSN последнего выведенного изменения.
+// Контрольная точка сохраняется только после Sink.Sync, поэтому после перезапуска изменения не теряются,
+// а изменения, уже записанные в файлы FileSink, не повторяются.
+type Exporter struct {
+	sink           Sink
+	checkpointPath string
+
+	mu      sync.Mutex
+	lastLSN uint64
+	saved   uint64
+}
+
+func NewExporter(sink Sink, checkpointPath string) (*Exporter, error) {
+	saved, err := ReadCheckpoint(checkpointPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Exporter{
+		sink:           sink,
+		checkpointPath: checkpointPath,
+		lastLSN:        max(saved, sink.LastLSN()),
+		saved:          saved,
+	}, nil
+}
+
+// LastLSN возвращает LSN последнего выведенного изменения, продолжать нужно со следующего
+func (e *Exporter) LastLSN() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.lastLSN
+}
+
+// Export выводит изменение из записи. Уже выведенные записи, например повторенные после переподключения, пропускаются.
+func (e *Exporter) Export(r wal.Record) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if r.LSN <= e.lastLSN {
+		return nil
+	}
+	change, err := NewChange(r)
+	if err != nil {
+		return err
+	}
+	if err := e.sink.Write(change); err != nil {
+		return err
+	}
+	e.lastLSN = r.LSN
+
+	return nil
+}
+
+// Checkpoint сохраняет выведенные изменения и их LSN
+func (e *Exporter) Checkpoint() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.sink.Sync(); err != nil {
+		return err
+	}
+	if e.lastLSN == e.saved {
+		return nil
+	}
+	if err := WriteCheckpoint(e.checkpointPath, e.lastLSN); err != nil {
+		return err
+	}
+	e.saved = e.lastLSN
+
+	return nil
+}
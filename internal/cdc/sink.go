@@ -0,0 +1,202 @@
+package cdc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Sink записывает изменения. После Sync записанное сохранено и можно сохранять контрольную точку.
+type Sink interface {
+	Write(c Change) error
+	Sync() error
+	// LastLSN возвращает LSN последнего изменения, записанного до запуска, или 0, если он неизвестен
+	LastLSN() uint64
+	Close() error
+}
+
+// WriterSink пишет изменения в io.Writer, например в stdout
+type WriterSink struct {
+	w *bufio.Writer
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: bufio.NewWriter(w)}
+}
+
+func (s *WriterSink) Write(c Change) error {
+	return json.NewEncoder(s.w).Encode(c)
+}
+
+func (s *WriterSink) Sync() error {
+	return s.w.Flush()
+}
+
+func (s *WriterSink) LastLSN() uint64 {
+	return 0
+}
+
+func (s *WriterSink) Close() error {
+	return s.w.Flush()
+}
+
+const (
+	filePrefix = "changes_"
+	fileSuffix = ".jsonl"
+)
+
+// FileSink пишет изменения в файлы changes_<lsn первого изменения>.jsonl в директории
+// и начинает новый файл, когда размер текущего достигает maxSize
+type FileSink struct {
+	dir     string
+	maxSize int64
+
+	file    *os.File
+	w       *bufio.Writer
+	size    int64
+	lastLSN uint64
+}
+
+// NewFileSink продолжает запись в последний файл директории. Оборванная при сбое последняя строка удаляется.
+func NewFileSink(dir string, maxSize int64) (*FileSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &FileSink{dir: dir, maxSize: maxSize}
+
+	files, err := listFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return s, nil
+	}
+
+	path := filepath.Join(dir, files[len(files)-1])
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	complete := bytes.LastIndexByte(data, '\n') + 1
+	if complete > 0 {
+		lines := bytes.Split(data[:complete-1], []byte("\n"))
+		var last Change
+		if err := json.Unmarshal(lines[len(lines)-1], &last); err != nil {
+			return nil, fmt.Errorf("read %s: %w", path, err)
+		}
+		s.lastLSN = last.LSN
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if complete < len(data) {
+		if err := file.Truncate(int64(complete)); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	s.file, s.w, s.size = file, bufio.NewWriter(file), int64(complete)
+
+	return s, nil
+}
+
+func (s *FileSink) Write(c Change) error {
+	if s.file == nil || (s.size >= s.maxSize && s.maxSize > 0) {
+		if err := s.rotate(c.LSN); err != nil {
+			return err
+		}
+	}
+
+	line, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := s.w.Write(line); err != nil {
+		return err
+	}
+	s.size += int64(len(line))
+	s.lastLSN = c.LSN
+
+	return nil
+}
+
+func (s *FileSink) Sync() error {
+	if s.file == nil {
+		return nil
+	}
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *FileSink) LastLSN() uint64 {
+	return s.lastLSN
+}
+
+func (s *FileSink) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.Sync()
+	return errors.Join(err, s.file.Close())
+}
+
+func (s *FileSink) rotate(lsn uint64) error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, fmt.Sprintf("%s%020d%s", filePrefix, lsn, fileSuffix))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	s.file, s.w, s.size = file, bufio.NewWriter(file), 0
+
+	return syncDir(s.dir)
+}
+
+func listFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, filePrefix) || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		if _, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, filePrefix), fileSuffix), 10, 64); err != nil {
+			continue
+		}
+		files = append(files, name)
+	}
+	// номер дополнен нулями, поэтому порядок имён совпадает с порядком LSN
+	slices.Sort(files)
+
+	return files, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,308 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"in-memory-db/internal/cluster"
+	"in-memory-db/internal/compute"
+	"in-memory-db/internal/storage"
+)
+
+// Режим кластера: сервер выполняет запросы только к ключам своих хеш-слотов, на остальные отвечает
+// MOVED <слот> <адрес узла> (см. пакет cluster). Распределение слотов возвращает CLUSTER SLOTS.
+//
+// Слот переносится на другой узел без остановки записи:
+//
+//	CLUSTER SETSLOT <слот> IMPORTING <id прежнего владельца> - на новом владельце
+//	CLUSTER SETSLOT <слот> MIGRATING <id нового владельца> - на прежнем
+//	CLUSTER GETKEYSINSLOT <слот> <число> и MIGRATE <ключ> [ключ ...] на прежнем владельце, пока ключи не кончатся
+//	CLUSTER SETSLOT <слот> NODE <id нового владельца> - на новом владельце, прежнем и остальных узлах
+//
+// MIGRATE записывает ключ на новом владельце и удаляет его на этом узле. Пока ключ передаётся, чтения
+// выполняются на этом узле, а запись в ключ ждёт его удаления здесь и получает ASK, поэтому клиент видит
+// ключ только на одном из узлов. Остальные запросы, в том числе к ключам того же слота, не ждут.
+
+var (
+	ErrClusterDisabled     = errors.New("cluster mode is disabled")
+	ErrWrongClusterCommand = errors.New("wrong cluster command")
+	ErrSlotNotEmpty        = errors.New("slot still has keys on this node")
+	ErrSlotNotMigrating    = errors.New("slot is not being migrated from this node")
+)
+
+// подкоманды CLUSTER
+const (
+	// clusterSlotsCommand возвращает распределение слотов строками <слоты> <id узла> <адрес>
+	clusterSlotsCommand = "SLOTS"
+	// clusterNodesCommand возвращает узлы строками <id узла> <адрес> [слоты]
+	clusterNodesCommand = "NODES"
+	// clusterMeetCommand добавляет узел без слотов: CLUSTER MEET <id> <адрес>
+	clusterMeetCommand = "MEET"
+	// clusterSetSlotCommand меняет владельца слота или состояние его переноса:
+	// CLUSTER SETSLOT <слот> MIGRATING|IMPORTING|NODE <id> или CLUSTER SETSLOT <слот> STABLE
+	clusterSetSlotCommand = "SETSLOT"
+	// clusterGetKeysCommand возвращает ключи слота по строке на ключ: CLUSTER GETKEYSINSLOT <слот> <число>
+	clusterGetKeysCommand = "GETKEYSINSLOT"
+	// clusterCountKeysCommand возвращает число ключей слота: CLUSTER COUNTKEYSINSLOT <слот>
+	clusterCountKeysCommand = "COUNTKEYSINSLOT"
+
+	// emptyResponse - ответ без строк: клиент не отличит пустой ответ от отсутствия ответа
+	emptyResponse = "(empty)"
+	// nilValue - значение отсутствующего ключа в ответе MGET
+	nilValue = "(nil)"
+
+	slotMigrating = "MIGRATING"
+	slotImporting = "IMPORTING"
+	slotNode      = "NODE"
+	slotStable    = "STABLE"
+)
+
+// Forwarder выполняет запросы на других серверах, реализация - replication.Replicator
+type Forwarder interface {
+	// Forward выполняет запрос на сервере address и возвращает его ответ
+	Forward(ctx context.Context, address, query string) (string, error)
+}
+
+// WithDatabaseCluster включает режим кластера, f передаёт ключи на другие узлы, пока не завершится ctx
+func WithDatabaseCluster(ctx context.Context, c *cluster.Cluster, f Forwarder) DatabaseOption {
+	return func(d *Database) {
+		d.cluster = c
+		d.clusterCtx = ctx
+		d.forwarder = f
+		d.slotLocks = make([]sync.RWMutex, cluster.SlotCount)
+		d.migratingKeys = make(map[string]chan struct{})
+		d.slots = newSlotIndex(d.storage)
+		d.storage = d.slots
+	}
+}
+
+// lockSlot проверяет, что ключи запроса попадают в слот этого узла, и не даёт перенести их,
+// пока запрос не вызовет unlock. Запись в ключ, который MIGRATE передаёт на другой узел, ждёт конца передачи.
+func (d *Database) lockSlot(query compute.Query) (unlock func(), err error) {
+	if d.cluster == nil {
+		return func() {}, nil
+	}
+	var keys []string
+	switch query.Command() {
+	case compute.GetCommand, compute.SetCommand, compute.DelCommand:
+		keys = query.Args()[:1]
+	case compute.MGetCommand:
+		keys = query.Args()
+	default:
+		return func() {}, nil
+	}
+	write := query.Command() == compute.SetCommand || query.Command() == compute.DelCommand
+
+	// ключи разных слотов получат ErrCrossSlot, поэтому достаточно слота первого ключа
+	lock := &d.slotLocks[cluster.Slot(keys[0])]
+	for {
+		lock.RLock()
+		migrated := d.migration(keys[0])
+		if !write || migrated == nil {
+			break
+		}
+		lock.RUnlock()
+		<-migrated
+	}
+	err = d.cluster.Check(cluster.Request{Keys: keys, Asking: query.Asking(), Exists: d.exists})
+	if err != nil {
+		lock.RUnlock()
+		return nil, err
+	}
+	return lock.RUnlock, nil
+}
+
+// migration возвращает канал, который закроется после передачи ключа на другой узел, или nil,
+// если ключ не передаётся
+func (d *Database) migration(key string) chan struct{} {
+	d.migratingMu.Lock()
+	defer d.migratingMu.Unlock()
+	return d.migratingKeys[key]
+}
+
+func (d *Database) exists(key string) bool {
+	_, err := d.storage.Get(key)
+	return err == nil
+}
+
+// clusterCommand выполняет CLUSTER, args - подкоманда и её аргументы
+func (d *Database) clusterCommand(args []string) (string, error) {
+	if d.cluster == nil {
+		return "", ErrClusterDisabled
+	}
+	switch {
+	case args[0] == clusterSlotsCommand && len(args) == 1:
+		slots := d.cluster.Slots()
+		lines := make([]string, len(slots))
+		for i, s := range slots {
+			lines[i] = strings.Join([]string{s.Range.String(), s.Node.ID, s.Node.Address}, " ")
+		}
+		return linesResponse(lines), nil
+	case args[0] == clusterNodesCommand && len(args) == 1:
+		nodes := d.cluster.Nodes()
+		lines := make([]string, len(nodes))
+		for i, n := range nodes {
+			lines[i] = strings.TrimSpace(strings.Join([]string{n.ID, n.Address, cluster.FormatSlotRanges(n.Slots)}, " "))
+		}
+		return strings.Join(lines, "\n"), nil
+	case args[0] == clusterMeetCommand && len(args) == 3:
+		return okResponse(d.cluster.Meet(args[1], args[2]))
+	case args[0] == clusterSetSlotCommand && (len(args) == 3 || len(args) == 4):
+		slot, err := cluster.ParseSlot(args[1])
+		if err != nil {
+			return "", err
+		}
+		return okResponse(d.setSlot(slot, strings.ToUpper(args[2]), args[3:]))
+	case args[0] == clusterGetKeysCommand && len(args) == 3:
+		slot, err := cluster.ParseSlot(args[1])
+		if err != nil {
+			return "", err
+		}
+		count, err := strconv.Atoi(args[2])
+		if err != nil || count <= 0 {
+			return "", ErrWrongClusterCommand
+		}
+		return linesResponse(d.slots.Keys(slot, count)), nil
+	case args[0] == clusterCountKeysCommand && len(args) == 2:
+		slot, err := cluster.ParseSlot(args[1])
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(d.slots.Count(slot)), nil
+	}
+	return "", ErrWrongClusterCommand
+}
+
+func linesResponse(lines []string) string {
+	if len(lines) == 0 {
+		return emptyResponse
+	}
+	return strings.Join(lines, "\n")
+}
+
+func okResponse(err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	return "[ok]", nil
+}
+
+// setSlot выполняет CLUSTER SETSLOT, args - id узла, если он нужен
+func (d *Database) setSlot(slot uint16, state string, args []string) error {
+	if state == slotStable {
+		if len(args) != 0 {
+			return ErrWrongClusterCommand
+		}
+		return d.cluster.SetStable(slot)
+	}
+	if len(args) != 1 {
+		return ErrWrongClusterCommand
+	}
+	id := args[0]
+	switch state {
+	case slotMigrating:
+		return d.cluster.SetMigrating(slot, id)
+	case slotImporting:
+		return d.cluster.SetImporting(slot, id)
+	case slotNode:
+		// пока слот передаётся, в нём не могут появиться новые ключи
+		lock := &d.slotLocks[slot]
+		lock.Lock()
+		defer lock.Unlock()
+		if id != d.cluster.ID() && d.slots.Count(slot) > 0 {
+			return ErrSlotNotEmpty
+		}
+		return d.cluster.SetNode(slot, id)
+	}
+	return ErrWrongClusterCommand
+}
+
+// migrate выполняет MIGRATE: записывает ключи на узел, на который переносится их слот, и удаляет их на этом узле
+func (d *Database) migrate(keys []string) (string, error) {
+	if d.cluster == nil {
+		return "", ErrClusterDisabled
+	}
+	if d.consensus == nil && d.role() != RolePrimary {
+		return "", ErrReadOnly
+	}
+
+	for _, key := range keys {
+		if err := d.migrateKey(key); err != nil {
+			return "", err
+		}
+	}
+	return "[ok]", nil
+}
+
+// migrateKey записывает ключ на новом владельце слота и удаляет его на этом узле. Слот блокируется,
+// только пока читается значение и ключ отмечается переносимым: запись в отмеченный ключ ждёт конца
+// переноса, поэтому значение не меняется, пока оно передаётся на другой узел.
+func (d *Database) migrateKey(key string) error {
+	slot := cluster.Slot(key)
+	lock := &d.slotLocks[slot]
+	var target cluster.Node
+	var val string
+	for {
+		lock.Lock()
+		// ключ уже переносит другой MIGRATE
+		if migrated := d.migration(key); migrated != nil {
+			lock.Unlock()
+			<-migrated
+			continue
+		}
+		var ok bool
+		target, ok = d.cluster.MigratingTo(slot)
+		if !ok {
+			lock.Unlock()
+			return fmt.Errorf("%w: key %s", ErrSlotNotMigrating, key)
+		}
+		var err error
+		val, err = d.storage.Get(key)
+		if err != nil {
+			lock.Unlock()
+			if errors.Is(err, storage.ErrNotFound) {
+				return nil
+			}
+			return err
+		}
+		break
+	}
+	migrated := make(chan struct{})
+	d.migratingMu.Lock()
+	d.migratingKeys[key] = migrated
+	d.migratingMu.Unlock()
+	lock.Unlock()
+
+	defer func() {
+		d.migratingMu.Lock()
+		delete(d.migratingKeys, key)
+		d.migratingMu.Unlock()
+		close(migrated)
+	}()
+
+	query := fmt.Sprintf("%s %s %s %s", compute.AskingCommand, compute.SetCommand, key, val)
+	if _, err := d.forwarder.Forward(d.clusterCtx, target.Address, query); err != nil {
+		return fmt.Errorf("migrate %s to %s: %w", key, target.ID, err)
+	}
+	_, err := d.write(compute.NewQuery(compute.DelCommand, []string{key}))
+	return err
+}
+
+// mget выполняет MGET: значения ключей по строке на ключ, для отсутствующего ключа - (nil)
+func (d *Database) mget(keys []string) (string, error) {
+	vals := make([]string, len(keys))
+	for i, key := range keys {
+		val, err := d.storage.Get(key)
+		if errors.Is(err, storage.ErrNotFound) {
+			val = nilValue
+		} else if err != nil {
+			return "", err
+		}
+		vals[i] = val
+	}
+	return strings.Join(vals, "\n"), nil
+}
@@ -0,0 +1,339 @@
+package cluster
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// Режим кластера: пространство ключей разбито на SlotCount хеш-слотов, каждый слот обслуживает один узел.
+// Узел выполняет запросы только к своим слотам, на запрос к чужому слоту отвечает MOVED <слот> <адрес узла>,
+// и клиент повторяет запрос на этом узле. Все ключи команды должны попадать в один слот, ключи с одинаковым
+// хеш-тегом {...} всегда попадают в один слот. Каждый узел знает, какие слоты обслуживают остальные.
+//
+// Слот переносится на другой узел по ключу: прежний владелец помечает слот как migrating, новый - как importing.
+// Пока слот переносится, прежний владелец выполняет запросы к ключам, которые у него остались, а на запросы
+// к остальным отвечает ASK <слот> <адрес нового владельца>. Клиент повторяет такой запрос на новом владельце
+// один раз с префиксом ASKING. Когда ключей на прежнем владельце не осталось, слот назначается новому.
+
+var (
+	ErrCrossSlot     = errors.New("CROSSSLOT keys don't hash to the same slot")
+	ErrSlotNotServed = errors.New("CLUSTERDOWN hash slot is not served")
+	ErrTryAgain      = errors.New("TRYAGAIN some keys of the slot are being migrated")
+	ErrWrongNode     = errors.New("wrong cluster node")
+	ErrSlotNotOwned  = errors.New("slot is not served by this node")
+	ErrSlotOwned     = errors.New("slot is already served by this node")
+)
+
+// MovedError - ответ на запрос к слоту, который обслуживает другой узел
+type MovedError struct {
+	Slot    uint16
+	Address string
+}
+
+func (e *MovedError) Error() string {
+	return fmt.Sprintf("MOVED %d %s", e.Slot, e.Address)
+}
+
+// AskError - ответ на запрос к ключу слота, который уже перенесён на другой узел
+type AskError struct {
+	Slot    uint16
+	Address string
+}
+
+func (e *AskError) Error() string {
+	return fmt.Sprintf("ASK %d %s", e.Slot, e.Address)
+}
+
+// Node - узел кластера, Address - адрес, на котором узел принимает запросы клиентов
+type Node struct {
+	ID      string
+	Address string
+	Slots   []SlotRange
+}
+
+// Cluster - распределение слотов между узлами с точки зрения узла self
+type Cluster struct {
+	self      string
+	stateFile string
+
+	mu    sync.RWMutex
+	nodes map[string]Node
+	// owners - id узла, который обслуживает слот, пустая строка - слот никому не назначен
+	owners [SlotCount]string
+	// migrating - слоты этого узла, которые переносятся на другой узел, importing - слоты, которые
+	// переносятся на этот узел, значение - id другого узла
+	migrating map[uint16]string
+	importing map[uint16]string
+}
+
+type ClusterOption func(*Cluster)
+
+// WithClusterStateFile задаёт файл, в котором хранится распределение слотов после переноса.
+// Если файл есть, распределение слотов берётся из него, а не из nodes.
+func WithClusterStateFile(path string) ClusterOption {
+	return func(c *Cluster) {
+		c.stateFile = path
+	}
+}
+
+// New возвращает кластер узлов nodes, self - id этого узла. Слоты узлов не должны пересекаться.
+func New(self string, nodes []Node, options ...ClusterOption) (*Cluster, error) {
+	c := &Cluster{
+		self:      self,
+		nodes:     make(map[string]Node, len(nodes)),
+		migrating: make(map[uint16]string),
+		importing: make(map[uint16]string),
+	}
+	for _, option := range options {
+		option(c)
+	}
+
+	saved, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	if saved != nil {
+		// узлы, которых нет в файле, добавляются без слотов
+		for _, n := range nodes {
+			if !slices.ContainsFunc(saved, func(s Node) bool { return s.ID == n.ID }) {
+				saved = append(saved, Node{ID: n.ID, Address: n.Address})
+			}
+		}
+		nodes = saved
+	}
+
+	for _, n := range nodes {
+		if n.ID == "" || n.Address == "" {
+			return nil, fmt.Errorf("%w: node %q at %q", ErrWrongNode, n.ID, n.Address)
+		}
+		if _, ok := c.nodes[n.ID]; ok {
+			return nil, fmt.Errorf("%w: duplicate node %q", ErrWrongNode, n.ID)
+		}
+		c.nodes[n.ID] = Node{ID: n.ID, Address: n.Address}
+		for _, r := range n.Slots {
+			for slot := int(r.From); slot <= int(r.To); slot++ {
+				if owner := c.owners[slot]; owner != "" {
+					return nil, fmt.Errorf("%w: slot %d belongs to %q and %q", ErrWrongSlots, slot, owner, n.ID)
+				}
+				c.owners[slot] = n.ID
+			}
+		}
+	}
+	if _, ok := c.nodes[self]; !ok {
+		return nil, fmt.Errorf("%w: %q is not in the cluster", ErrWrongNode, self)
+	}
+	return c, nil
+}
+
+// ID возвращает id этого узла
+func (c *Cluster) ID() string {
+	return c.self
+}
+
+// Request - ключи запроса к узлу
+type Request struct {
+	Keys []string
+	// Asking - запрос повторён после ASK, узел выполняет его, если слот переносится на этот узел
+	Asking bool
+	// Exists сообщает, есть ли ключ на этом узле, нужна, пока слот переносится с этого узла
+	Exists func(key string) bool
+}
+
+// Check проверяет, что все ключи запроса попадают в один слот и этот узел может выполнить запрос.
+// Если слот обслуживает другой узел, возвращает *MovedError, если ключей уже нет на этом узле - *AskError.
+func (c *Cluster) Check(req Request) error {
+	if len(req.Keys) == 0 {
+		return nil
+	}
+	slot := Slot(req.Keys[0])
+	for _, key := range req.Keys[1:] {
+		if Slot(key) != slot {
+			return ErrCrossSlot
+		}
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	owner := c.owners[slot]
+	if owner == c.self {
+		target, ok := c.migrating[slot]
+		if !ok {
+			return nil
+		}
+		// ключи, которых нет на этом узле, уже перенесены или будут созданы на новом владельце
+		found := 0
+		for _, key := range req.Keys {
+			if req.Exists(key) {
+				found++
+			}
+		}
+		switch found {
+		case len(req.Keys):
+			return nil
+		case 0:
+			return &AskError{Slot: slot, Address: c.nodes[target].Address}
+		}
+		return ErrTryAgain
+	}
+	if _, ok := c.importing[slot]; ok && req.Asking {
+		return nil
+	}
+	if owner == "" {
+		return ErrSlotNotServed
+	}
+	return &MovedError{Slot: slot, Address: c.nodes[owner].Address}
+}
+
+// MigratingTo возвращает узел, на который переносится слот этого узла
+func (c *Cluster) MigratingTo(slot uint16) (Node, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	target, ok := c.migrating[slot]
+	return c.nodes[target], ok
+}
+
+// SetMigrating начинает перенос слота этого узла на узел id
+func (c *Cluster) SetMigrating(slot uint16, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.owners[slot] != c.self {
+		return ErrSlotNotOwned
+	}
+	if err := c.checkOtherNodeLocked(id); err != nil {
+		return err
+	}
+	c.migrating[slot] = id
+	return c.saveLocked()
+}
+
+// SetImporting начинает перенос на этот узел слота узла id
+func (c *Cluster) SetImporting(slot uint16, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.owners[slot] == c.self {
+		return ErrSlotOwned
+	}
+	if err := c.checkOtherNodeLocked(id); err != nil {
+		return err
+	}
+	c.importing[slot] = id
+	return c.saveLocked()
+}
+
+// SetStable отменяет перенос слота
+func (c *Cluster) SetStable(slot uint16) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.migrating, slot)
+	delete(c.importing, slot)
+	return c.saveLocked()
+}
+
+// SetNode назначает слот узлу id и завершает его перенос
+func (c *Cluster) SetNode(slot uint16, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.nodes[id]; !ok {
+		return fmt.Errorf("%w: unknown node %q", ErrWrongNode, id)
+	}
+	c.owners[slot] = id
+	delete(c.migrating, slot)
+	delete(c.importing, slot)
+	return c.saveLocked()
+}
+
+// Meet добавляет в кластер узел без слотов или меняет адрес известного узла
+func (c *Cluster) Meet(id, address string) error {
+	if id == "" || address == "" {
+		return fmt.Errorf("%w: node %q at %q", ErrWrongNode, id, address)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nodes[id] = Node{ID: id, Address: address}
+	return c.saveLocked()
+}
+
+func (c *Cluster) checkOtherNodeLocked(id string) error {
+	if _, ok := c.nodes[id]; !ok || id == c.self {
+		return fmt.Errorf("%w: %q", ErrWrongNode, id)
+	}
+	return nil
+}
+
+// SlotOwner - непрерывный диапазон слотов одного узла
+type SlotOwner struct {
+	Range SlotRange
+	Node  Node
+}
+
+// Slots возвращает назначенные слоты в порядке номеров, соседние слоты одного узла объединяются
+func (c *Cluster) Slots() []SlotOwner {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.slotsLocked()
+}
+
+func (c *Cluster) slotsLocked() []SlotOwner {
+	var res []SlotOwner
+	for slot := 0; slot < SlotCount; slot++ {
+		owner := c.owners[slot]
+		if owner == "" {
+			continue
+		}
+		if last := len(res) - 1; last >= 0 && res[last].Node.ID == owner && int(res[last].Range.To) == slot-1 {
+			res[last].Range.To = uint16(slot)
+			continue
+		}
+		res = append(res, SlotOwner{Range: SlotRange{From: uint16(slot), To: uint16(slot)}, Node: c.nodes[owner]})
+	}
+	return res
+}
+
+// Nodes возвращает узлы кластера с их слотами в порядке id
+func (c *Cluster) Nodes() []Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.nodesLocked()
+}
+
+func (c *Cluster) nodesLocked() []Node {
+	nodes := make([]Node, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		nodes = append(nodes, n)
+	}
+	slices.SortFunc(nodes, func(a, b Node) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	for _, s := range c.slotsLocked() {
+		i := slices.IndexFunc(nodes, func(n Node) bool { return n.ID == s.Node.ID })
+		nodes[i].Slots = append(nodes[i].Slots, s.Range)
+	}
+	return nodes
+}
+
+// Info возвращает поля состояния кластера в виде field:value
+func (c *Cluster) Info() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	served, assigned := 0, 0
+	for _, owner := range c.owners {
+		if owner != "" {
+			assigned++
+		}
+		if owner == c.self {
+			served++
+		}
+	}
+	return []string{
+		"cluster_id:" + c.self,
+		fmt.Sprintf("cluster_known_nodes:%d", len(c.nodes)),
+		fmt.Sprintf("cluster_slots_assigned:%d", assigned),
+		fmt.Sprintf("cluster_slots_served:%d", served),
+		fmt.Sprintf("cluster_slots_migrating:%d", len(c.migrating)),
+		fmt.Sprintf("cluster_slots_importing:%d", len(c.importing)),
+	}
+}
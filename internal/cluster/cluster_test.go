@@ -0,0 +1,203 @@
+package cluster
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlot(t *testing.T) {
+	assert.Equal(t, uint16(0x31C3), crc16("123456789"))
+	assert.Equal(t, uint16(12182), Slot("foo"))
+	assert.Equal(t, uint16(5061), Slot("bar"))
+
+	// ключи с одинаковым хеш-тегом попадают в один слот
+	assert.Equal(t, Slot("user1"), Slot("{user1}:name"))
+	assert.Equal(t, Slot("{user1}:name"), Slot("{user1}:age"))
+	// хешируется только первый тег
+	assert.Equal(t, Slot("a"), Slot("x{a}y{b}"))
+	// пустой тег и незакрытая скобка - часть ключа
+	assert.Equal(t, crc16("{}user")%SlotCount, Slot("{}user"))
+	assert.Equal(t, crc16("{user")%SlotCount, Slot("{user"))
+}
+
+func TestParseSlotRanges(t *testing.T) {
+	ranges, err := ParseSlotRanges("0-5460,5462,16000-16383")
+	require.NoError(t, err)
+	assert.Equal(t, []SlotRange{{0, 5460}, {5462, 5462}, {16000, 16383}}, ranges)
+	assert.Equal(t, "0-5460,5462,16000-16383", FormatSlotRanges(ranges))
+
+	for _, s := range []string{"16384", "10-5", "a-b", "1,", "-1"} {
+		_, err := ParseSlotRanges(s)
+		assert.ErrorIs(t, err, ErrWrongSlots, s)
+	}
+}
+
+func testCluster(t *testing.T, self string) *Cluster {
+	c, err := New(self, []Node{
+		{ID: "n1", Address: "10.0.0.1:3223", Slots: []SlotRange{{0, 5460}}},
+		{ID: "n2", Address: "10.0.0.2:3223", Slots: []SlotRange{{5461, 10922}}},
+		{ID: "n3", Address: "10.0.0.3:3223", Slots: []SlotRange{{10923, 16000}}},
+	})
+	require.NoError(t, err)
+	return c
+}
+
+func keys(keys ...string) Request {
+	return Request{Keys: keys}
+}
+
+func TestCluster_Check(t *testing.T) {
+	c := testCluster(t, "n1")
+
+	assert.NoError(t, c.Check(keys("bar")))
+	assert.NoError(t, c.Check(keys("{bar}:1", "{bar}:2")))
+	assert.ErrorIs(t, c.Check(keys("bar", "foo")), ErrCrossSlot)
+
+	err := c.Check(keys("foo"))
+	var moved *MovedError
+	require.ErrorAs(t, err, &moved)
+	assert.Equal(t, "MOVED 12182 10.0.0.3:3223", err.Error())
+
+	// слоты после 16000 никому не назначены
+	key := "key1"
+	for i := 2; Slot(key) <= 16000; i++ {
+		key = fmt.Sprintf("key%d", i)
+	}
+	assert.ErrorIs(t, c.Check(keys(key)), ErrSlotNotServed)
+}
+
+func TestCluster_Migration(t *testing.T) {
+	// слот bar - 5061, перенос с n1 на n2
+	source, target := testCluster(t, "n1"), testCluster(t, "n2")
+	require.NoError(t, target.SetImporting(5061, "n1"))
+	require.NoError(t, source.SetMigrating(5061, "n2"))
+	assert.ErrorIs(t, target.SetMigrating(5061, "n1"), ErrSlotNotOwned)
+	assert.ErrorIs(t, source.SetImporting(5061, "n2"), ErrSlotOwned)
+	assert.ErrorIs(t, source.SetMigrating(5061, "n1"), ErrWrongNode)
+	assert.ErrorIs(t, source.SetMigrating(5061, "n4"), ErrWrongNode)
+
+	node, ok := source.MigratingTo(5061)
+	assert.True(t, ok)
+	assert.Equal(t, "n2", node.ID)
+	_, ok = source.MigratingTo(5062)
+	assert.False(t, ok)
+
+	// прежний владелец выполняет запросы к оставшимся ключам, остальные отправляет новому
+	exists := func(key string) bool { return key == "{bar}:1" }
+	assert.NoError(t, source.Check(Request{Keys: []string{"{bar}:1"}, Exists: exists}))
+	err := source.Check(Request{Keys: []string{"{bar}:2"}, Exists: exists})
+	var ask *AskError
+	require.ErrorAs(t, err, &ask)
+	assert.Equal(t, "ASK 5061 10.0.0.2:3223", err.Error())
+	assert.ErrorIs(t, source.Check(Request{Keys: []string{"{bar}:1", "{bar}:2"}, Exists: exists}), ErrTryAgain)
+
+	// новый владелец выполняет только запросы после ASK
+	assert.EqualError(t, target.Check(keys("bar")), "MOVED 5061 10.0.0.1:3223")
+	assert.NoError(t, target.Check(Request{Keys: []string{"bar"}, Asking: true}))
+	assert.Contains(t, target.Info(), "cluster_slots_importing:1")
+
+	require.NoError(t, target.SetNode(5061, "n2"))
+	require.NoError(t, source.SetNode(5061, "n2"))
+	assert.NoError(t, target.Check(keys("bar")))
+	assert.EqualError(t, source.Check(keys("bar")), "MOVED 5061 10.0.0.2:3223")
+	assert.Contains(t, source.Info(), "cluster_slots_migrating:0")
+	assert.ErrorIs(t, source.SetNode(5061, "n4"), ErrWrongNode)
+
+	// отменённый перенос, слот baz - 4813
+	require.NoError(t, source.SetMigrating(4813, "n3"))
+	require.NoError(t, source.SetStable(4813))
+	assert.NoError(t, source.Check(keys("baz")))
+}
+
+func TestCluster_StateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cluster_state.json")
+	nodes := []Node{
+		{ID: "n1", Address: "a1", Slots: []SlotRange{{0, 8191}}},
+		{ID: "n2", Address: "a2", Slots: []SlotRange{{8192, 16383}}},
+	}
+	c, err := New("n1", nodes, WithClusterStateFile(path))
+	require.NoError(t, err)
+	require.NoError(t, c.SetNode(0, "n2"))
+	require.NoError(t, c.SetMigrating(1, "n2"))
+	require.NoError(t, c.Meet("n3", "a3"))
+
+	// распределение из файла важнее конфигурации, новые узлы конфигурации добавляются без слотов
+	c, err = New("n1", append(nodes, Node{ID: "n4", Address: "a4", Slots: []SlotRange{{0, 10}}}), WithClusterStateFile(path))
+	require.NoError(t, err)
+	assert.Equal(t, []Node{
+		{ID: "n1", Address: "a1", Slots: []SlotRange{{1, 8191}}},
+		{ID: "n2", Address: "a2", Slots: []SlotRange{{0, 0}, {8192, 16383}}},
+		{ID: "n3", Address: "a3"},
+		{ID: "n4", Address: "a4"},
+	}, c.Nodes())
+	node, ok := c.MigratingTo(1)
+	assert.True(t, ok)
+	assert.Equal(t, "n2", node.ID)
+}
+
+func TestPlan(t *testing.T) {
+	moves := Plan([]Node{
+		{ID: "n1", Slots: []SlotRange{{0, 9}}},
+		{ID: "n2", Slots: []SlotRange{{10, 11}}},
+		{ID: "n3"},
+	})
+	// 12 слотов по 4 на узел: n1 отдаёт последние 6 слотов
+	assert.Equal(t, []Move{
+		{Slot: 4, From: "n1", To: "n2"},
+		{Slot: 5, From: "n1", To: "n2"},
+		{Slot: 6, From: "n1", To: "n3"},
+		{Slot: 7, From: "n1", To: "n3"},
+		{Slot: 8, From: "n1", To: "n3"},
+		{Slot: 9, From: "n1", To: "n3"},
+	}, moves)
+
+	// остаток остаётся у узлов с большим числом слотов
+	assert.Empty(t, Plan([]Node{
+		{ID: "n1", Slots: []SlotRange{{0, 2}}},
+		{ID: "n2", Slots: []SlotRange{{3, 4}}},
+	}))
+	assert.Empty(t, Plan(nil))
+}
+
+func TestCluster_Slots(t *testing.T) {
+	c, err := New("n1", []Node{
+		{ID: "n1", Address: "a1", Slots: []SlotRange{{0, 99}, {100, 199}, {300, 300}}},
+		{ID: "n2", Address: "a2", Slots: []SlotRange{{200, 299}}},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []SlotOwner{
+		{Range: SlotRange{0, 199}, Node: Node{ID: "n1", Address: "a1"}},
+		{Range: SlotRange{200, 299}, Node: Node{ID: "n2", Address: "a2"}},
+		{Range: SlotRange{300, 300}, Node: Node{ID: "n1", Address: "a1"}},
+	}, c.Slots())
+	assert.Equal(t, []string{
+		"cluster_id:n1",
+		"cluster_known_nodes:2",
+		"cluster_slots_assigned:301",
+		"cluster_slots_served:201",
+		"cluster_slots_migrating:0",
+		"cluster_slots_importing:0",
+	}, c.Info())
+}
+
+func TestNew_Errors(t *testing.T) {
+	_, err := New("n1", []Node{
+		{ID: "n1", Address: "a1", Slots: []SlotRange{{0, 100}}},
+		{ID: "n2", Address: "a2", Slots: []SlotRange{{100, 200}}},
+	})
+	assert.ErrorIs(t, err, ErrWrongSlots)
+
+	_, err = New("n3", []Node{{ID: "n1", Address: "a1"}})
+	assert.ErrorIs(t, err, ErrWrongNode)
+
+	_, err = New("n1", []Node{{ID: "n1", Address: "a1"}, {ID: "n1", Address: "a2"}})
+	assert.ErrorIs(t, err, ErrWrongNode)
+
+	_, err = New("n1", []Node{{ID: "n1"}})
+	assert.ErrorIs(t, err, ErrWrongNode)
+}
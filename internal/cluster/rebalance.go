@@ -0,0 +1,70 @@
+package cluster
+
+import (
+	"cmp"
+	"slices"
+)
+
+// Move - перенос слота Slot с узла From на узел To
+type Move struct {
+	Slot     uint16
+	From, To string
+}
+
+// Plan возвращает переносы, после которых назначенные слоты распределены между nodes поровну.
+// Узлы, у которых слотов больше нормы, отдают слоты с конца своих диапазонов узлам, у которых слотов меньше.
+// Остаток от деления остаётся у узлов, у которых слотов больше всего, чтобы переносов было меньше.
+func Plan(nodes []Node) []Move {
+	if len(nodes) == 0 {
+		return nil
+	}
+	type nodeSlots struct {
+		id     string
+		slots  []uint16
+		target int
+	}
+	all := make([]*nodeSlots, len(nodes))
+	total := 0
+	for i, n := range nodes {
+		all[i] = &nodeSlots{id: n.ID}
+		for _, r := range n.Slots {
+			for slot := int(r.From); slot <= int(r.To); slot++ {
+				all[i].slots = append(all[i].slots, uint16(slot))
+			}
+		}
+		slices.Sort(all[i].slots)
+		total += len(all[i].slots)
+	}
+
+	slices.SortFunc(all, func(a, b *nodeSlots) int {
+		if c := cmp.Compare(len(b.slots), len(a.slots)); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.id, b.id)
+	})
+	for i, n := range all {
+		n.target = total / len(all)
+		if i < total%len(all) {
+			n.target++
+		}
+	}
+
+	var excess []Move
+	for _, n := range all {
+		if len(n.slots) > n.target {
+			for _, slot := range n.slots[n.target:] {
+				excess = append(excess, Move{Slot: slot, From: n.id})
+			}
+		}
+	}
+	var moves []Move
+	for _, n := range all {
+		for deficit := n.target - len(n.slots); deficit > 0; deficit-- {
+			move := excess[0]
+			excess = excess[1:]
+			move.To = n.id
+			moves = append(moves, move)
+		}
+	}
+	return moves
+}
@@ -0,0 +1,112 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SlotCount - количество хеш-слотов, на которые разбито пространство ключей
+const SlotCount = 16384
+
+var ErrWrongSlots = errors.New("wrong slot ranges")
+
+// Slot возвращает слот ключа: CRC16 ключа по модулю SlotCount. Если в ключе есть непустой хеш-тег -
+// часть между первой { и следующей за ней }, - хешируется только тег.
+func Slot(key string) uint16 {
+	return crc16(hashTag(key)) % SlotCount
+}
+
+func hashTag(key string) string {
+	start := strings.IndexByte(key, '{')
+	if start < 0 {
+		return key
+	}
+	end := strings.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
+
+// crc16 - CRC-16/XMODEM
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// SlotRange - слоты с From по To включительно
+type SlotRange struct {
+	From, To uint16
+}
+
+func (r SlotRange) String() string {
+	if r.From == r.To {
+		return strconv.Itoa(int(r.From))
+	}
+	return fmt.Sprintf("%d-%d", r.From, r.To)
+}
+
+// ParseSlotRanges разбирает слоты вида 0-5460,5462
+func ParseSlotRanges(s string) ([]SlotRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ranges []SlotRange
+	for _, part := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		if !isRange {
+			to = from
+		}
+		r, err := parseSlotRange(from, to)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrWrongSlots, part)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+func parseSlotRange(from, to string) (SlotRange, error) {
+	f, err := ParseSlot(from)
+	if err != nil {
+		return SlotRange{}, err
+	}
+	t, err := ParseSlot(to)
+	if err != nil {
+		return SlotRange{}, err
+	}
+	if f > t {
+		return SlotRange{}, ErrWrongSlots
+	}
+	return SlotRange{From: f, To: t}, nil
+}
+
+// ParseSlot разбирает номер слота
+func ParseSlot(s string) (uint16, error) {
+	slot, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+	if err != nil || slot >= SlotCount {
+		return 0, fmt.Errorf("%w: slot %q", ErrWrongSlots, s)
+	}
+	return uint16(slot), nil
+}
+
+// FormatSlotRanges возвращает слоты в виде, который принимает ParseSlotRanges
+func FormatSlotRanges(ranges []SlotRange) string {
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		parts[i] = r.String()
+	}
+	return strings.Join(parts, ",")
+}
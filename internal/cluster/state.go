@@ -0,0 +1,98 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// clusterState - содержимое файла состояния кластера
+type clusterState struct {
+	Nodes     []nodeState       `json:"nodes"`
+	Migrating map[uint16]string `json:"migrating,omitempty"`
+	Importing map[uint16]string `json:"importing,omitempty"`
+}
+
+type nodeState struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	Slots   string `json:"slots,omitempty"`
+}
+
+// load читает файл состояния и возвращает сохранённые узлы, nil - если файла нет
+func (c *Cluster) load() ([]Node, error) {
+	if c.stateFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(c.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var st clusterState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("read %s: %w", c.stateFile, err)
+	}
+	nodes := make([]Node, len(st.Nodes))
+	for i, n := range st.Nodes {
+		slots, err := ParseSlotRanges(n.Slots)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", c.stateFile, err)
+		}
+		nodes[i] = Node{ID: n.ID, Address: n.Address, Slots: slots}
+	}
+	for slot, id := range st.Migrating {
+		c.migrating[slot] = id
+	}
+	for slot, id := range st.Importing {
+		c.importing[slot] = id
+	}
+	return nodes, nil
+}
+
+// saveLocked заменяет файл состояния так, что после сбоя остаётся либо прежнее, либо новое содержимое
+func (c *Cluster) saveLocked() error {
+	if c.stateFile == "" {
+		return nil
+	}
+	st := clusterState{Migrating: c.migrating, Importing: c.importing}
+	for _, n := range c.nodesLocked() {
+		st.Nodes = append(st.Nodes, nodeState{ID: n.ID, Address: n.Address, Slots: FormatSlotRanges(n.Slots)})
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	tmp := c.stateFile + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.stateFile); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(c.stateFile))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
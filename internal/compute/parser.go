@@ -16,15 +16,51 @@ const (
 	GetCommand Command = "GET"
 	SetCommand Command = "SET"
 	DelCommand Command = "DEL"
+	// WalStreamCommand переводит соединение в режим потока записей WAL, начиная с указанного LSN
+	WalStreamCommand Command = "WALSTREAM"
+	// BackupCommand записывает резервную копию в поддиректорию директории резервных копий
+	BackupCommand Command = "BACKUP"
+	// InfoCommand возвращает состояние сервера строками вида field:value
+	InfoCommand Command = "INFO"
+	// ReplicateCommand - запрос реплики: REPLICATE <id реплики> <lsn> <эпоха>, дальше как WALSTREAM
+	ReplicateCommand Command = "REPLICATE"
+	// AckCommand - подтверждение реплики в потоке REPLICATE: ACK <lsn>, записи до lsn сохранены на диск реплики
+	AckCommand Command = "ACK"
+	// ReplicaOfCommand меняет роль сервера: REPLICAOF <host> <port> - реплика, REPLICAOF NO ONE - primary
+	ReplicaOfCommand Command = "REPLICAOF"
+	// FenceCommand - запрос нового primary прежнему: FENCE <эпоха>, primary с меньшей эпохой перестаёт принимать запись
+	FenceCommand Command = "FENCE"
+	// RaftCommand - команды режима Raft: RAFT ADD <id> <адрес> и RAFT REMOVE <id> меняют состав кластера,
+	// RAFT TERM <терм> и RAFT CONFIG <состав> записывает в лог сам узел
+	RaftCommand Command = "RAFT"
+	// MGetCommand читает несколько ключей: MGET <ключ> [ключ ...], значения возвращаются по строке на ключ
+	MGetCommand Command = "MGET"
+	// ClusterCommand - команды режима кластера: CLUSTER SLOTS возвращает распределение слотов между узлами,
+	// остальные подкоманды переносят слоты между узлами
+	ClusterCommand Command = "CLUSTER"
+	// MigrateCommand переносит ключи слота на узел, на который переносится слот: MIGRATE <ключ> [ключ ...]
+	MigrateCommand Command = "MIGRATE"
+	// AskingCommand - префикс запроса, повторённого после ответа ASK: ASKING <запрос>
+	AskingCommand Command = "ASKING"
 )
 
 const (
-	maxCommandParts          = 3
-	commandIndex             = 0
-	firstArgIndex            = 1
-	secondArgIndex           = 2
-	oneCommandArgPartNumber  = 2
-	twoCommandArgsPartNumber = 3
+	// MaxStaleOption ограничивает устаревание данных при чтении: GET <ключ> MAXSTALE <длительность>
+	MaxStaleOption = "MAXSTALE"
+	// WaitLSNOption откладывает чтение, пока не будет применена запись: GET <ключ> WAITLSN <lsn>
+	WaitLSNOption = "WAITLSN"
+)
+
+const (
+	maxCommandParts            = 4
+	commandIndex               = 0
+	firstArgIndex              = 1
+	secondArgIndex             = 2
+	thirdArgIndex              = 3
+	noCommandArgsPartNumber    = 1
+	oneCommandArgPartNumber    = 2
+	twoCommandArgsPartNumber   = 3
+	threeCommandArgsPartNumber = 4
 )
 
 type Parser struct{}
@@ -35,22 +71,76 @@ func NewParser() *Parser {
 
 func (p *Parser) Parse(cmd string) (Query, error) {
 	parts := strings.Fields(cmd)
-	if len(parts) == 0 || len(parts) > maxCommandParts {
+	if len(parts) == 0 {
 		return Query{}, ErrUnknownCommand
 	}
 
 	command := Command(strings.ToUpper(parts[commandIndex]))
+	// число аргументов этих команд не ограничено
 	switch command {
-	case GetCommand, DelCommand:
+	case AskingCommand:
+		if len(parts) < oneCommandArgPartNumber {
+			return Query{}, ErrWrongArgumentNumber
+		}
+		q, err := p.Parse(strings.Join(parts[firstArgIndex:], " "))
+		q.asking = err == nil
+		return q, err
+	case MGetCommand, MigrateCommand:
+		if len(parts) < oneCommandArgPartNumber {
+			return Query{}, ErrWrongArgumentNumber
+		}
+		return NewQuery(command, parts[firstArgIndex:]), nil
+	case ClusterCommand:
+		if len(parts) < oneCommandArgPartNumber {
+			return Query{}, ErrWrongArgumentNumber
+		}
+		// подкоманда в верхнем регистре, остальные аргументы как есть
+		args := append([]string{strings.ToUpper(parts[firstArgIndex])}, parts[secondArgIndex:]...)
+		return NewQuery(command, args), nil
+	}
+	if len(parts) > maxCommandParts {
+		return Query{}, ErrUnknownCommand
+	}
+
+	switch command {
+	case InfoCommand:
+		if len(parts) != noCommandArgsPartNumber {
+			return Query{}, ErrWrongArgumentNumber
+		}
+		return NewQuery(command, nil), nil
+	case GetCommand:
+		// аргументы чтения с условием - ключ, условие в верхнем регистре и его значение
+		if len(parts) == threeCommandArgsPartNumber {
+			option := strings.ToUpper(parts[secondArgIndex])
+			if option != MaxStaleOption && option != WaitLSNOption {
+				return Query{}, ErrWrongArgumentNumber
+			}
+			return NewQuery(command, []string{parts[firstArgIndex], option, parts[thirdArgIndex]}), nil
+		}
+		if len(parts) != oneCommandArgPartNumber {
+			return Query{}, ErrWrongArgumentNumber
+		}
+		return NewQuery(command, []string{parts[firstArgIndex]}), nil
+	case DelCommand, WalStreamCommand, BackupCommand, AckCommand, FenceCommand:
 		if len(parts) != oneCommandArgPartNumber {
 			return Query{}, ErrWrongArgumentNumber
 		}
 		return NewQuery(command, []string{parts[firstArgIndex]}), nil
-	case SetCommand:
+	case SetCommand, ReplicaOfCommand:
 		if len(parts) != twoCommandArgsPartNumber {
 			return Query{}, ErrWrongArgumentNumber
 		}
 		return NewQuery(command, parts[firstArgIndex:secondArgIndex+1]), nil
+	case ReplicateCommand:
+		if len(parts) != threeCommandArgsPartNumber {
+			return Query{}, ErrWrongArgumentNumber
+		}
+		return NewQuery(command, parts[firstArgIndex:thirdArgIndex+1]), nil
+	case RaftCommand:
+		if len(parts) != twoCommandArgsPartNumber && len(parts) != threeCommandArgsPartNumber {
+			return Query{}, ErrWrongArgumentNumber
+		}
+		return NewQuery(command, parts[firstArgIndex:]), nil
 	}
 
 	return Query{}, ErrUnknownCommand
@@ -34,6 +34,27 @@ func TestParseQuery(t *testing.T) {
 			cmd:           "GET ",
 			expectedError: ErrWrongArgumentNumber,
 		},
+		{
+			name: "correct get query with staleness bound",
+			cmd:  "GET config maxstale 500ms",
+			expectedQuery: Query{
+				command: GetCommand,
+				args:    []string{"config", MaxStaleOption, "500ms"},
+			},
+		},
+		{
+			name: "correct get query with lsn to wait for",
+			cmd:  "GET config WAITLSN 15",
+			expectedQuery: Query{
+				command: GetCommand,
+				args:    []string{"config", WaitLSNOption, "15"},
+			},
+		},
+		{
+			name:          "incorrect get query, unknown option",
+			cmd:           "GET config MAXLAG 500ms",
+			expectedError: ErrWrongArgumentNumber,
+		},
 		{
 			name: "correct set query",
 			cmd:  "SET config 123",
@@ -71,6 +92,153 @@ func TestParseQuery(t *testing.T) {
 				args:    []string{"config"},
 			},
 		},
+		{
+			name: "correct walstream query",
+			cmd:  "walstream 10",
+			expectedQuery: Query{
+				command: WalStreamCommand,
+				args:    []string{"10"},
+			},
+		},
+		{
+			name: "correct replicate query",
+			cmd:  "REPLICATE replica-1 10 2",
+			expectedQuery: Query{
+				command: ReplicateCommand,
+				args:    []string{"replica-1", "10", "2"},
+			},
+		},
+		{
+			name:          "incorrect replicate query, no epoch",
+			cmd:           "REPLICATE replica-1 10",
+			expectedError: ErrWrongArgumentNumber,
+		},
+		{
+			name: "correct replicaof query",
+			cmd:  "replicaof 10.0.0.1 3223",
+			expectedQuery: Query{
+				command: ReplicaOfCommand,
+				args:    []string{"10.0.0.1", "3223"},
+			},
+		},
+		{
+			name:          "incorrect replicaof query, no port",
+			cmd:           "REPLICAOF 10.0.0.1",
+			expectedError: ErrWrongArgumentNumber,
+		},
+		{
+			name: "correct fence query",
+			cmd:  "FENCE 3",
+			expectedQuery: Query{
+				command: FenceCommand,
+				args:    []string{"3"},
+			},
+		},
+		{
+			name: "correct raft add query",
+			cmd:  "raft ADD node-4 10.0.0.4:4000",
+			expectedQuery: Query{
+				command: RaftCommand,
+				args:    []string{"ADD", "node-4", "10.0.0.4:4000"},
+			},
+		},
+		{
+			name: "correct raft remove query",
+			cmd:  "RAFT REMOVE node-4",
+			expectedQuery: Query{
+				command: RaftCommand,
+				args:    []string{"REMOVE", "node-4"},
+			},
+		},
+		{
+			name:          "incorrect raft query, no args",
+			cmd:           "RAFT",
+			expectedError: ErrWrongArgumentNumber,
+		},
+		{
+			name: "correct mget query, more keys than other commands take",
+			cmd:  "MGET {user1}:name {user1}:age {user1}:city {user1}:email",
+			expectedQuery: Query{
+				command: MGetCommand,
+				args:    []string{"{user1}:name", "{user1}:age", "{user1}:city", "{user1}:email"},
+			},
+		},
+		{
+			name:          "incorrect mget query, no keys",
+			cmd:           "MGET",
+			expectedError: ErrWrongArgumentNumber,
+		},
+		{
+			name: "correct cluster query",
+			cmd:  "cluster slots",
+			expectedQuery: Query{
+				command: ClusterCommand,
+				args:    []string{"SLOTS"},
+			},
+		},
+		{
+			name: "correct cluster setslot query, more args than other commands take",
+			cmd:  "CLUSTER setslot 100 MIGRATING node-2",
+			expectedQuery: Query{
+				command: ClusterCommand,
+				args:    []string{"SETSLOT", "100", "MIGRATING", "node-2"},
+			},
+		},
+		{
+			name: "correct migrate query",
+			cmd:  "MIGRATE key1 key2 key3 key4",
+			expectedQuery: Query{
+				command: MigrateCommand,
+				args:    []string{"key1", "key2", "key3", "key4"},
+			},
+		},
+		{
+			name: "correct asking query",
+			cmd:  "asking SET config 123",
+			expectedQuery: Query{
+				command: SetCommand,
+				args:    []string{"config", "123"},
+				asking:  true,
+			},
+		},
+		{
+			name:          "incorrect asking query, wrong query",
+			cmd:           "ASKING SET config",
+			expectedError: ErrWrongArgumentNumber,
+		},
+		{
+			name: "correct ack query",
+			cmd:  "ACK 15",
+			expectedQuery: Query{
+				command: AckCommand,
+				args:    []string{"15"},
+			},
+		},
+		{
+			name: "correct backup query",
+			cmd:  "BACKUP daily",
+			expectedQuery: Query{
+				command: BackupCommand,
+				args:    []string{"daily"},
+			},
+		},
+		{
+			name: "correct info query",
+			cmd:  "info",
+			expectedQuery: Query{
+				command: InfoCommand,
+			},
+		},
+		{
+			name:          "incorrect info query, extra args",
+			cmd:           "INFO all",
+			expectedError: ErrWrongArgumentNumber,
+		},
+		{
+			name:          "incorrect set query, extra args",
+			cmd:           "SET a b c",
+			expectedError: ErrWrongArgumentNumber,
+		},
 		{
 			name:          "unknown command",
 			cmd:           "PUT a b",
@@ -3,6 +3,8 @@ package compute
 type Query struct {
 	command Command
 	args    []string
+	// asking - запрос с префиксом ASKING
+	asking bool
 }
 
 func NewQuery(command Command, args []string) Query {
@@ -20,6 +22,11 @@ func (q Query) Args() []string {
 	return q.args
 }
 
+// Asking сообщает, что запрос повторён после ответа ASK, префикс ASKING не входит в ToSting
+func (q Query) Asking() bool {
+	return q.asking
+}
+
 func (q Query) ToSting() string {
 	res := string(q.command)
 	for _, a := range q.args {
@@ -1,6 +1,10 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/inhies/go-bytesize"
@@ -11,6 +15,83 @@ type Config struct {
 	Network NetworkConfig `yaml:"network"`
 	Log     LogConfig     `yaml:"logging"`
 	Wal     WalConfig     `yaml:"wal"`
+	Metrics MetricsConfig `yaml:"metrics"`
+
+	Replication ReplicationConfig `yaml:"replication"`
+	Raft        RaftConfig        `yaml:"raft"`
+	Cluster     ClusterConfig     `yaml:"cluster"`
+	Proxy       ProxyConfig       `yaml:"proxy"`
+}
+
+// ProxyConfig - настройки cmd/proxy: ключи распределяются между shards консистентным хешированием,
+// у каждого шарда virtual_nodes точек на кольце. Раз в health_check_interval прокси проверяет серверы шардов,
+// failover задаёт, что делать, когда primary шарда недоступен: off (по умолчанию), reads - читать с реплик,
+// promote - как reads, а через failover_timeout назначить primary доступную реплику.
+// Прокси слушает network.address, max_message_size и idle_timeout используются и для соединений с серверами.
+type ProxyConfig struct {
+	Shards              []ProxyShardConfig `yaml:"shards"`
+	VirtualNodes        int                `yaml:"virtual_nodes"`
+	HealthCheckInterval time.Duration      `yaml:"health_check_interval"`
+	Failover            string             `yaml:"failover"`
+	FailoverTimeout     time.Duration      `yaml:"failover_timeout"`
+}
+
+type ProxyShardConfig struct {
+	Name     string   `yaml:"name"`
+	Primary  string   `yaml:"primary"`
+	Replicas []string `yaml:"replicas"`
+}
+
+// ClusterConfig включает режим кластера: сервер id обслуживает только ключи своих хеш-слотов.
+// nodes - все узлы кластера, включая этот, с адресами для клиентов и слотами вида 0-5460,5462.
+// После переноса слотов распределение берётся из файла состояния в директории данных, а узлы из nodes,
+// которых в нём нет, добавляются без слотов.
+type ClusterConfig struct {
+	Enabled bool                `yaml:"enabled"`
+	ID      string              `yaml:"id"`
+	Nodes   []ClusterNodeConfig `yaml:"nodes"`
+}
+
+type ClusterNodeConfig struct {
+	ID      string `yaml:"id"`
+	Address string `yaml:"address"`
+	Slots   string `yaml:"slots"`
+}
+
+// RaftConfig включает режим Raft: узлы сами выбирают лидера, секция replication не используется.
+// Узлы обмениваются запросами на address, members - начальный состав кластера вида id=адрес,id=адрес,
+// он нужен только при первом запуске, узел без members ждёт, пока лидер добавит его командой RAFT ADD.
+type RaftConfig struct {
+	Enabled           bool          `yaml:"enabled"`
+	ID                string        `yaml:"id"`
+	Address           string        `yaml:"address"`
+	Members           string        `yaml:"members"`
+	ElectionTimeout   time.Duration `yaml:"election_timeout"`
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+	SubmitTimeout     time.Duration `yaml:"submit_timeout"`
+}
+
+// ReplicationConfig задаёт роль сервера: primary (по умолчанию) или replica.
+// Реплика получает WAL от primary_address и отклоняет запросы на запись от клиентов,
+// replica_id отличает реплики на primary, по умолчанию - адрес сервера.
+// После смены роли командой REPLICAOF роль берётся из файла состояния в директории данных, а не отсюда.
+// Если write_quorum больше 0, primary отвечает на запись только после подтверждения write_quorum реплик,
+// по истечении quorum_timeout возвращает ошибку или, с degrade_to_async, перестаёт ждать реплики.
+// Раз в heartbeat_interval primary сообщает репликам свой последний LSN. stale_reads задаёт, что делает реплика
+// с чтением GET ... MAXSTALE, для которого её данные устарели: error (по умолчанию) или forward - читать с primary.
+// Чтение GET ... WAITLSN ждёт применения записи не дольше wait_lsn_timeout, затем обрабатывается так же.
+type ReplicationConfig struct {
+	Role           string        `yaml:"role"`
+	PrimaryAddress string        `yaml:"primary_address"`
+	ReplicaID      string        `yaml:"replica_id"`
+	ReconnectDelay time.Duration `yaml:"reconnect_delay"`
+	WriteQuorum    int           `yaml:"write_quorum"`
+	QuorumTimeout  time.Duration `yaml:"quorum_timeout"`
+	DegradeToAsync bool          `yaml:"degrade_to_async"`
+
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+	StaleReads        string        `yaml:"stale_reads"`
+	WaitLSNTimeout    time.Duration `yaml:"wait_lsn_timeout"`
 }
 
 type EngineConfig struct {
@@ -24,18 +105,73 @@ type NetworkConfig struct {
 	IdleTimeout    time.Duration `yaml:"idle_timeout"`
 }
 
+// MetricsConfig задаёт адрес HTTP сервера метрик, метрики отдаются в формате expvar на /debug/vars
+type MetricsConfig struct {
+	Address string `yaml:"address"`
+}
+
 type LogConfig struct {
 	Level  string `yaml:"level"`
 	Output string `yaml:"output"`
 }
 
 type WalConfig struct {
-	FlushingBatchSize    int           `yaml:"flushing_batch_size"`
-	FlushingBatchTimeout time.Duration `yaml:"flushing_batch_timeout"`
-	MaxSegmentSize       string        `yaml:"max_segment_size"`
-	DataDirectory        string        `yaml:"data_directory"`
+	FlushingBatchSize    int              `yaml:"flushing_batch_size"`
+	FlushingBatchTimeout time.Duration    `yaml:"flushing_batch_timeout"`
+	MaxSegmentSize       string           `yaml:"max_segment_size"`
+	DataDirectory        string           `yaml:"data_directory"`
+	Encryption           EncryptionConfig `yaml:"encryption"`
+	SnapshotInterval     time.Duration    `yaml:"snapshot_interval"`
+	Retention            RetentionConfig  `yaml:"retention"`
+	Archive              ArchiveConfig    `yaml:"archive"`
+	Queue                QueueConfig      `yaml:"queue"`
+	// BackupDirectory - директория для копий команды BACKUP, без неё команда отключена
+	BackupDirectory string          `yaml:"backup_directory"`
+	DiskGuard       DiskGuardConfig `yaml:"disk_guard"`
+}
+
+// DiskGuardConfig задаёт пороги свободного места в директории данных.
+// Запись отклоняется, когда места меньше min_free_space, и возобновляется, когда места не меньше resume_free_space.
+type DiskGuardConfig struct {
+	MinFreeSpace    string        `yaml:"min_free_space"`
+	ResumeFreeSpace string        `yaml:"resume_free_space"`
+	CheckInterval   time.Duration `yaml:"check_interval"`
+}
+
+// QueueConfig задаёт очередь записей, ожидающих fsync.
+// Policy - block (ждать не дольше timeout) или reject, в обоих случаях клиент получает ошибку BUSY.
+type QueueConfig struct {
+	Size    int           `yaml:"size"`
+	Policy  string        `yaml:"policy"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// RetentionConfig задаёт, сколько сегментов хранить в директории данных.
+// Удаляются только сегменты, полностью вошедшие в снимок.
+type RetentionConfig struct {
+	MaxSegments   int           `yaml:"max_segments"`
+	MaxAge        time.Duration `yaml:"max_age"`
+	MaxTotalSize  string        `yaml:"max_total_size"`
+	CheckInterval time.Duration `yaml:"check_interval"`
 }
 
+// ArchiveConfig задаёт архивирование сегментов: mode - off, copy или move
+type ArchiveConfig struct {
+	Mode      string `yaml:"mode"`
+	Directory string `yaml:"directory"`
+	Command   string `yaml:"command"`
+}
+
+// EncryptionConfig задаёт источник ключей шифрования WAL.
+// Ключи задаются в виде "id:hex" через перевод строки или запятую, последний ключ - активный.
+type EncryptionConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	KeyFile string `yaml:"key_file"`
+	KeyEnv  string `yaml:"key_env"`
+}
+
+var ErrEncryptionKeyMissing = errors.New("encryption is enabled, but no key is provided")
+
 func (nc NetworkConfig) MessageSizeToSizeInBytes() (int, error) {
 	return sizeInStringToBytes(nc.MaxMessageSize)
 }
@@ -44,6 +180,53 @@ func (wc WalConfig) MaxSegmentSizeToSizeInBytes() (int, error) {
 	return sizeInStringToBytes(wc.MaxSegmentSize)
 }
 
+// ReadKeys возвращает ключи шифрования из файла или переменной окружения.
+// Если задано и то и другое, ключи объединяются: сначала файл, затем переменная окружения.
+func (ec EncryptionConfig) ReadKeys() (string, error) {
+	var keys []string
+	if ec.KeyFile != "" {
+		data, err := os.ReadFile(ec.KeyFile)
+		if err != nil {
+			return "", fmt.Errorf("read encryption key file: %w", err)
+		}
+		keys = append(keys, string(data))
+	}
+
+	if ec.KeyEnv != "" {
+		if val := os.Getenv(ec.KeyEnv); val != "" {
+			keys = append(keys, val)
+		}
+	}
+
+	res := strings.TrimSpace(strings.Join(keys, "\n"))
+	if res == "" {
+		return "", ErrEncryptionKeyMissing
+	}
+
+	return res, nil
+}
+
+func (rc RetentionConfig) MaxTotalSizeToSizeInBytes() (int, error) {
+	if rc.MaxTotalSize == "" {
+		return 0, nil
+	}
+	return sizeInStringToBytes(rc.MaxTotalSize)
+}
+
+func (dc DiskGuardConfig) MinFreeSpaceToSizeInBytes() (int, error) {
+	if dc.MinFreeSpace == "" {
+		return 0, nil
+	}
+	return sizeInStringToBytes(dc.MinFreeSpace)
+}
+
+func (dc DiskGuardConfig) ResumeFreeSpaceToSizeInBytes() (int, error) {
+	if dc.ResumeFreeSpace == "" {
+		return 0, nil
+	}
+	return sizeInStringToBytes(dc.ResumeFreeSpace)
+}
+
 func sizeInStringToBytes(st string) (int, error) {
 	b, err := bytesize.Parse(st)
 	if err != nil {
@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"in-memory-db/internal/compute"
+	"in-memory-db/internal/storage/wal"
+)
+
+// Режим Raft: WAL служит логом Raft, LSN записи - её индекс в логе. Запись проходит через лидера:
+// он добавляет запрос в лог, а база применяет его только после коммита, когда запись сохранена
+// большинством узлов. Поэтому при старте из WAL восстанавливается только снимок, записи после него
+// применяются, когда узел узнает от лидера, что они закоммичены. Роли primary и replica,
+// REPLICAOF и FENCE в этом режиме не используются.
+
+var ErrConsensusMode = errors.New("command is not available in raft mode")
+
+// Consensus ведёт лог базы в режиме Raft, реализация - raft.Node
+type Consensus interface {
+	// Run ведёт лог базы, пока не завершится ctx
+	Run(ctx context.Context, db *Database)
+	// Submit добавляет запрос в лог через лидера и ждёт, пока запись будет применена на этом сервере,
+	// возвращает LSN записи
+	Submit(ctx context.Context, query string) (uint64, error)
+	// Info возвращает состояние узла строками вида field:value
+	Info() []string
+	// Staleness возвращает, насколько данные узла могут отставать от лидера, ok = false, если это неизвестно
+	Staleness() (time.Duration, bool)
+}
+
+// WithDatabaseConsensus включает режим Raft: лог ведёт c, пока не завершится ctx
+func WithDatabaseConsensus(ctx context.Context, c Consensus) DatabaseOption {
+	return func(d *Database) {
+		d.consensusCtx = ctx
+		d.consensus = c
+	}
+}
+
+// consensusReplay меняет replay так, что из WAL восстанавливается только снимок. Возвращает функцию,
+// которую нужно вызвать после Init: она запоминает LSN снимка как последний применённый.
+func (d *Database) consensusReplay(replay *wal.Replay) func() {
+	replayed := false
+	replay.Prepare = func(wal.Record) (any, error) {
+		return nil, nil
+	}
+	replay.Apply = func(r wal.Record, _ any) error {
+		// записи идут сразу за снимком
+		if !replayed {
+			replayed = true
+			d.setApplied(r.LSN - 1)
+		}
+		return nil
+	}
+	return func() {
+		if !replayed {
+			d.setApplied(d.wal.LastLSN())
+		}
+	}
+}
+
+// submit выполняет запрос на запись через Raft и возвращает LSN записи
+func (d *Database) submit(query string) (uint64, error) {
+	return d.consensus.Submit(context.Background(), query)
+}
+
+// AppendLog добавляет записи в WAL, не применяя их
+func (d *Database) AppendLog(records []wal.Record) error {
+	return d.wal.WriteRecords(records)
+}
+
+// TailLog возвращает Tailer для WAL, начиная с fromLSN
+func (d *Database) TailLog(fromLSN uint64) *wal.Tailer {
+	return d.wal.Tail(fromLSN)
+}
+
+// ApplyLog применяет закоммиченную запись WAL, запись должна идти сразу за последней применённой
+func (d *Database) ApplyLog(r wal.Record) error {
+	query, err := d.parser.Parse(r.Query)
+	if err != nil {
+		return fmt.Errorf("lsn %d: %w", r.LSN, err)
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if applied := d.applied.Load(); r.LSN != applied+1 {
+		return fmt.Errorf("%w: got %d after %d", ErrWrongLSN, r.LSN, applied)
+	}
+	if err := d.apply(query); err != nil {
+		return err
+	}
+	d.setApplied(r.LSN)
+	return nil
+}
+
+// Applied возвращает LSN последней применённой записи
+func (d *Database) Applied() uint64 {
+	return d.applied.Load()
+}
+
+// WaitApplied ждёт, пока будет применена запись lsn, или завершения ctx
+func (d *Database) WaitApplied(ctx context.Context, lsn uint64) error {
+	for {
+		d.appliedMu.Lock()
+		applied, ch := d.applied.Load(), d.appliedCh
+		d.appliedMu.Unlock()
+		if applied >= lsn {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ch:
+		}
+	}
+}
+
+func (d *Database) setApplied(lsn uint64) {
+	d.appliedMu.Lock()
+	defer d.appliedMu.Unlock()
+	d.applied.Store(lsn)
+	close(d.appliedCh)
+	d.appliedCh = make(chan struct{})
+}
+
+// TruncateLog удаляет из WAL записи после lsn. Удалять можно только неприменённые записи.
+func (d *Database) TruncateLog(lsn uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if applied := d.applied.Load(); lsn < applied {
+		return fmt.Errorf("%w: truncate after %d, applied %d", ErrWrongLSN, lsn, applied)
+	}
+	d.logResets.Add(1)
+	return d.wal.TruncateAfter(lsn)
+}
+
+// InstallState заменяет данные и WAL состоянием на момент lsn, полученным от лидера
+func (d *Database) InstallState(lsn uint64, keys, vals []string) error {
+	return d.replaceState(lsn, keys, vals)
+}
+
+// State возвращает копию состояния и LSN, которому оно соответствует
+func (d *Database) State() (uint64, []string, []string) {
+	lsn, pairs := d.copyState()
+	return lsn, pairs.keys, pairs.vals
+}
+
+// streamCommitted передаёт в f закоммиченные записи WAL, пропуская служебные записи Raft.
+// Если незакоммиченные записи были заменены, возвращает wal.ErrLSNNotAvailable.
+func (d *Database) streamCommitted(ctx context.Context, fromLSN uint64, f func(wal.Record) error) error {
+	resets := d.logResets.Load()
+	tailer := d.wal.Tail(fromLSN)
+	defer tailer.Close()
+	for {
+		r, err := tailer.Next(ctx)
+		if err != nil {
+			return err
+		}
+		if err := d.WaitApplied(ctx, r.LSN); err != nil {
+			return err
+		}
+		if d.logResets.Load() != resets {
+			return wal.ErrLSNNotAvailable
+		}
+		if strings.HasPrefix(r.Query, string(compute.RaftCommand)+" ") {
+			continue
+		}
+		if err := f(r); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"in-memory-db/internal/compute"
+)
+
+// Чтение своих записей: ответ на SET и DEL содержит LSN записи, [ok] lsn <N>. Чтение GET <ключ> WAITLSN <N>
+// сервер выполняет после того, как применит запись N, поэтому клиент, который читает с реплики, видит свою
+// запись на primary. Если запись не применена за waitLSNTimeout, сервер возвращает ErrLSNTimeout или,
+// с политикой StaleReadsForward, выполняет чтение на primary.
+
+var ErrLSNTimeout = errors.New("TIMEOUT lsn is not applied on this server yet")
+
+const defaultWaitLSNTimeout = time.Second
+
+// WithDatabaseWaitLSNTimeout задаёт, сколько чтение WAITLSN ждёт применения записи
+func WithDatabaseWaitLSNTimeout(timeout time.Duration) DatabaseOption {
+	return func(d *Database) {
+		d.waitLSNTimeout = timeout
+	}
+}
+
+// get выполняет GET, args - ключ и, возможно, условие чтения и его значение
+func (d *Database) get(args []string) (string, error) {
+	if len(args) == 1 {
+		return d.storage.Get(args[0])
+	}
+
+	key, option, value := args[0], args[1], args[2]
+	switch option {
+	case compute.MaxStaleOption:
+		bound, err := time.ParseDuration(value)
+		if err != nil || bound < 0 {
+			return "", ErrWrongStaleness
+		}
+		if staleness, ok := d.staleness(); !ok || staleness > bound {
+			return d.readPrimary(key, ErrStale)
+		}
+	case compute.WaitLSNOption:
+		lsn, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return "", ErrWrongLSN
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), d.waitLSNTimeout)
+		err = d.WaitApplied(ctx, lsn)
+		cancel()
+		if err != nil {
+			return d.readPrimary(key, ErrLSNTimeout)
+		}
+	}
+	return d.storage.Get(key)
+}
+
+// waitTurn ждёт, пока будут применены записи до lsn. Записи с LSN до lsn уже сохранены в WAL,
+// и их применяют писатели, которые держат d.mu так же, как вызывающий, поэтому ожидание конечно.
+func (d *Database) waitTurn(lsn uint64) {
+	_ = d.WaitApplied(context.Background(), lsn-1)
+}
+
+// advanceApplied запоминает, что применена запись lsn, если она новее уже применённых.
+// Вызывающий применил все записи до lsn, поэтому applied не обгоняет хранилище.
+func (d *Database) advanceApplied(lsn uint64) {
+	d.appliedMu.Lock()
+	defer d.appliedMu.Unlock()
+	if lsn <= d.applied.Load() {
+		return
+	}
+	d.applied.Store(lsn)
+	close(d.appliedCh)
+	d.appliedCh = make(chan struct{})
+}
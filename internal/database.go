@@ -1,29 +1,124 @@
 package internal
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 
+	"in-memory-db/internal/cluster"
 	"in-memory-db/internal/compute"
 	"in-memory-db/internal/storage"
+	"in-memory-db/internal/storage/wal"
 )
 
-var ErrInternal = errors.New("internal error")
+var (
+	ErrInternal = errors.New("internal error")
+	ErrLoading  = errors.New("LOADING database is loading data from wal")
+	ErrWrongLSN = errors.New("wrong lsn")
+
+	ErrBackupDisabled  = errors.New("backup directory is not configured")
+	ErrWrongBackupName = errors.New("wrong backup name")
+
+	ErrReadOnly   = errors.New("READONLY replica does not accept writes")
+	ErrNotReplica = errors.New("server is not a replica")
+)
+
+// Role - роль сервера в репликации
+type Role string
+
+const (
+	// RolePrimary принимает запросы на запись и отдаёт WAL репликам
+	RolePrimary Role = "primary"
+	// RoleReplica получает записи WAL от primary и отклоняет запросы на запись от клиентов
+	RoleReplica Role = "replica"
+)
 
 type Database struct {
 	storage storage.Engine
 	parser  Parser
 	logger  *zap.Logger
 	wal     Wal
+
+	// запись в WAL и применение к хранилищу выполняются под RLock,
+	// снимок берёт Lock, чтобы состояние соответствовало LastLSN
+	mu sync.RWMutex
+	// пока состояние восстанавливается из WAL, запросы не выполняются
+	loading atomic.Bool
+
+	backupDirectory string
+	replicas        *replicaTracker
+
+	// роль читается без блокировки, roleMu упорядочивает смену роли, stateMu - запись состояния
+	state         atomic.Pointer[replicationState]
+	roleMu        sync.Mutex
+	stateMu       sync.Mutex
+	stateFile     string
+	replicator    Replicator
+	replicatorCtx context.Context
+	stopLinks     func()
+	link          primaryLink
+	staleReads    StaleReadPolicy
+
+	// applied - LSN последней применённой записи, его ждут чтения WAITLSN
+	applied        atomic.Uint64
+	appliedMu      sync.Mutex
+	appliedCh      chan struct{}
+	waitLSNTimeout time.Duration
+
+	// в режиме Raft записи применяются после коммита,
+	// logResets меняется, когда неприменённые записи удаляются из WAL
+	consensus    Consensus
+	consensusCtx context.Context
+	logResets    atomic.Uint64
+
+	// в режиме кластера сервер обслуживает только ключи своих слотов,
+	// запросы к ключам берут RLock своего слота, перенос ключей слота на другой узел - Lock.
+	// migratingKeys - ключи, которые передаёт MIGRATE, канал закрывается после передачи
+	cluster       *cluster.Cluster
+	clusterCtx    context.Context
+	forwarder     Forwarder
+	slotLocks     []sync.RWMutex
+	slots         *slotIndex
+	migratingMu   sync.Mutex
+	migratingKeys map[string]chan struct{}
+}
+
+type DatabaseOption func(*Database)
+
+// WithDatabaseBackupDirectory задаёт директорию, в которую команда BACKUP записывает копии
+func WithDatabaseBackupDirectory(dir string) DatabaseOption {
+	return func(d *Database) {
+		d.backupDirectory = dir
+	}
+}
+
+// WithDatabaseRole задаёт роль сервера, по умолчанию RolePrimary
+func WithDatabaseRole(role Role) DatabaseOption {
+	return func(d *Database) {
+		d.state.Load().Role = role
+	}
 }
 
 type Wal interface {
-	Init(f func([]byte) error) error
+	Init(replay wal.Replay) error
 	Run() error
-	Write(query string) error
+	WriteLSN(query string) (uint64, error)
+	WriteRecords(records []wal.Record) error
+	LastLSN() uint64
+	WriteSnapshot(lsn uint64, rangeFn func(f func(key, val string) bool)) error
+	Reset(lsn uint64, rangeFn func(f func(key, val string) bool)) error
+	TruncateAfter(lsn uint64) error
+	Tail(fromLSN uint64) *wal.Tailer
+	Backup(dir string, lsn uint64) (wal.BackupManifest, error)
+	Stats() wal.Stats
 	Close() error
 }
 
@@ -31,48 +126,105 @@ type Parser interface {
 	Parse(cmd string) (compute.Query, error)
 }
 
-func NewDatabase(storage storage.Engine, parser Parser, logger *zap.Logger, wal Wal) *Database {
-	return &Database{
-		storage: storage,
-		parser:  parser,
-		logger:  logger,
-		wal:     wal,
+// batchEngine - хранилище, которое загружает пары снимка пачкой
+type batchEngine interface {
+	SetBatch(keys, vals []string) error
+}
+
+// clearEngine - хранилище, которое удаляет все ключи сразу
+type clearEngine interface {
+	Clear()
+}
+
+func NewDatabase(storage storage.Engine, parser Parser, logger *zap.Logger, wal Wal, options ...DatabaseOption) *Database {
+	db := &Database{
+		storage:   storage,
+		parser:    parser,
+		logger:    logger,
+		wal:       wal,
+		replicas:  newReplicaTracker(),
+		stopLinks: func() {},
+		appliedCh: make(chan struct{}),
 	}
+	db.state.Store(&replicationState{Role: RolePrimary})
+	db.loading.Store(true)
+
+	for _, option := range options {
+		option(db)
+	}
+
+	if db.replicas.timeout <= 0 {
+		db.replicas.timeout = defaultQuorumTimeout
+	}
+	if db.waitLSNTimeout <= 0 {
+		db.waitLSNTimeout = defaultWaitLSNTimeout
+	}
+
+	return db
 }
 
-func (d *Database) Init() {
-	if err := d.wal.Init(func(data []byte) error {
-		scanner := bufio.NewScanner(bytes.NewReader(data))
-		for scanner.Scan() {
-			query, err := d.parser.Parse(scanner.Text())
-			if err != nil {
-				return err
-			}
-			arguments := query.Args()
-			switch query.Command() {
-			case compute.SetCommand:
-				err := d.storage.Set(arguments[0], arguments[1])
-				if err != nil {
-					return err
-				}
-			case compute.DelCommand:
-				err := d.storage.Del(arguments[0])
-				if err != nil {
-					return err
-				}
-			}
-		}
-		return nil
-	}); err != nil {
-		return
+// Init восстанавливает состояние из WAL и запускает запись в WAL.
+// До завершения Init запросы возвращают ErrLoading.
+func (d *Database) Init() error {
+	var restoreBatch func(keys, vals []string) error
+	if engine, ok := d.storage.(batchEngine); ok {
+		restoreBatch = engine.SetBatch
 	}
 
+	if err := d.loadState(); err != nil {
+		return err
+	}
+	replay := wal.Replay{
+		Restore:      d.storage.Set,
+		RestoreBatch: restoreBatch,
+		Prepare: func(r wal.Record) (any, error) {
+			return d.parser.Parse(r.Query)
+		},
+		Apply: func(r wal.Record, prepared any) error {
+			return d.apply(prepared.(compute.Query))
+		},
+	}
+	replayed := func() {
+		d.setApplied(d.wal.LastLSN())
+	}
+	if d.consensus != nil {
+		replayed = d.consensusReplay(&replay)
+	}
+	if err := d.wal.Init(replay); err != nil {
+		return err
+	}
+	replayed()
+
 	go func() {
 		if err := d.wal.Run(); err != nil {
 			d.logger.Error("run wall error", zap.Error(err))
 			return
 		}
 	}()
+
+	d.loading.Store(false)
+
+	if d.consensus != nil {
+		go d.consensus.Run(d.consensusCtx, d)
+	}
+
+	d.roleMu.Lock()
+	d.startLinksLocked()
+	d.roleMu.Unlock()
+
+	return nil
+}
+
+// apply применяет к хранилищу запрос из записи WAL
+func (d *Database) apply(query compute.Query) error {
+	arguments := query.Args()
+	switch query.Command() {
+	case compute.SetCommand:
+		return d.storage.Set(arguments[0], arguments[1])
+	case compute.DelCommand:
+		return d.storage.Del(arguments[0])
+	}
+	return nil
 }
 
 func (d *Database) RunQuery(q string) (string, error) {
@@ -83,36 +235,354 @@ func (d *Database) RunQuery(q string) (string, error) {
 		return "", err
 	}
 
-	if query.Command() != compute.GetCommand {
-		if err = d.wal.Write(query.ToSting()); err != nil {
-			d.logger.Error("write to wal", zap.Error(err))
+	// состояние можно узнать и во время загрузки
+	if query.Command() == compute.InfoCommand {
+		return d.info(), nil
+	}
+	// прежний primary ограждается до того, как после загрузки начнёт принимать запись
+	if query.Command() == compute.FenceCommand {
+		if d.consensus != nil {
+			return "", ErrConsensusMode
+		}
+		return d.fence(query.Args()[0])
+	}
+
+	if d.loading.Load() {
+		return "", ErrLoading
+	}
+
+	unlock, err := d.lockSlot(query)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if query.Command() == compute.BackupCommand {
+		return d.backup(query.Args()[0])
+	}
+
+	if query.Command() == compute.SetCommand || query.Command() == compute.DelCommand {
+		return d.write(query)
+	}
+
+	if query.Command() == compute.ReplicaOfCommand {
+		if d.consensus != nil {
+			return "", ErrConsensusMode
+		}
+		return d.replicaOf(query.Args()[0], query.Args()[1])
+	}
+
+	if query.Command() == compute.RaftCommand {
+		if d.consensus == nil {
+			return "", ErrConsensusMode
+		}
+		if _, err := d.submit(query.ToSting()); err != nil {
 			return "", err
 		}
+		return "[ok]", nil
 	}
 
-	arguments := query.Args()
-	switch query.Command() {
-	case compute.GetCommand:
-		val, err := d.storage.Get(arguments[0])
+	if query.Command() == compute.GetCommand {
+		return d.get(query.Args())
+	}
+
+	if query.Command() == compute.MGetCommand {
+		return d.mget(query.Args())
+	}
+
+	if query.Command() == compute.ClusterCommand {
+		return d.clusterCommand(query.Args())
+	}
+
+	if query.Command() == compute.MigrateCommand {
+		return d.migrate(query.Args())
+	}
+
+	d.logger.Error("incorrect query", zap.String("query", q))
+
+	return "internal error", ErrInternal
+}
+
+// write записывает запрос в WAL, применяет его к хранилищу и, если задан кворум, ждёт подтверждения реплик.
+// Кворум ожидается без блокировки, чтобы долгое ожидание не задерживало снимки. Возвращает LSN записи.
+func (d *Database) write(query compute.Query) (string, error) {
+	if d.consensus != nil {
+		lsn, err := d.submit(query.ToSting())
 		if err != nil {
 			return "", err
 		}
-		return val, nil
-	case compute.SetCommand:
-		err := d.storage.Set(arguments[0], arguments[1])
+		return writeResponse(lsn), nil
+	}
+
+	d.mu.RLock()
+	// роль меняется под Lock, поэтому после смены роли запись не пройдёт
+	if d.role() != RolePrimary {
+		d.mu.RUnlock()
+		return "", ErrReadOnly
+	}
+	lsn, err := d.wal.WriteLSN(query.ToSting())
+	if err != nil {
+		d.mu.RUnlock()
+		d.logger.Error("write to wal", zap.Error(err))
+		return "", err
+	}
+	// записи одного пакета WAL завершаются одновременно, поэтому каждая ждёт применения предыдущей:
+	// хранилище меняется в порядке WAL, а WAITLSN не видит запись раньше предыдущих.
+	// LSN продвигается и после ошибки apply, иначе следующие записи ждали бы эту бесконечно.
+	d.waitTurn(lsn)
+	err = d.apply(query)
+	d.advanceApplied(lsn)
+	d.mu.RUnlock()
+	if err != nil {
+		return "", err
+	}
+
+	if err := d.replicas.wait(lsn, d.logger); err != nil {
+		d.logger.Warn("wait for replicas", zap.Uint64("lsn", lsn), zap.Error(err))
+		return "", err
+	}
+	return writeResponse(lsn), nil
+}
+
+// writeResponse - ответ на запись, LSN записи можно передать в GET ... WAITLSN
+func writeResponse(lsn uint64) string {
+	return fmt.Sprintf("[ok] lsn %d", lsn)
+}
+
+type infoField struct {
+	name  string
+	value any
+}
+
+// info возвращает состояние базы и WAL строками вида field:value
+func (d *Database) info() string {
+	stats := d.wal.Stats()
+	var fields []infoField
+	if d.consensus == nil {
+		fields = d.roleInfo(stats.LastLSN)
+	}
+	fields = append(fields, []infoField{
+		{"loading", boolToInt(d.loading.Load())},
+		{"last_lsn", stats.LastLSN},
+		{"synced_lsn", stats.SyncedLSN},
+		{"queue_depth", stats.QueueDepth},
+		{"queue_capacity", stats.QueueCapacity},
+		{"disk_full", boolToInt(stats.DiskFull)},
+		{"disk_free_bytes", stats.DiskFreeBytes},
+	}...)
+	if d.consensus == nil && d.role() == RolePrimary {
+		fields = append(fields, d.replicas.info(stats.LastLSN)...)
+	}
+
+	var lines []string
+	if d.consensus != nil {
+		lines = d.consensus.Info()
+	}
+	for _, f := range fields {
+		lines = append(lines, fmt.Sprintf("%s:%v", f.name, f.value))
+	}
+	if d.cluster != nil {
+		lines = append(lines, d.cluster.Info()...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// backup записывает копию состояния на последний LSN в поддиректорию name директории резервных копий.
+// Запись блокируется только на время чтения LSN: записи до него уже сохранены на диск.
+func (d *Database) backup(name string) (string, error) {
+	if d.backupDirectory == "" {
+		return "", ErrBackupDisabled
+	}
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return "", ErrWrongBackupName
+	}
+
+	d.mu.Lock()
+	lsn := d.wal.LastLSN()
+	if d.consensus != nil {
+		// незакоммиченные записи в копию не попадают
+		lsn = d.applied.Load()
+	}
+	d.mu.Unlock()
+
+	manifest, err := d.wal.Backup(filepath.Join(d.backupDirectory, name), lsn)
+	if err != nil {
+		d.logger.Error("write backup", zap.Error(err))
+		return "", err
+	}
+
+	return fmt.Sprintf("[ok] lsn %d", manifest.LSN), nil
+}
+
+// WalStream - запрос потока записей WAL
+type WalStream struct {
+	FromLSN uint64
+	// ReplicaID и Epoch заданы, если поток запросила реплика командой REPLICATE
+	ReplicaID string
+	Epoch     uint64
+}
+
+// ParseWalStream разбирает запросы WALSTREAM и REPLICATE, ok = false для остальных запросов
+func (d *Database) ParseWalStream(q string) (stream WalStream, ok bool, err error) {
+	query, err := d.parser.Parse(q)
+	if err != nil {
+		return WalStream{}, false, nil
+	}
+
+	lsn := ""
+	switch query.Command() {
+	case compute.WalStreamCommand:
+		lsn = query.Args()[0]
+	case compute.ReplicateCommand:
+		stream.ReplicaID, lsn = query.Args()[0], query.Args()[1]
+		stream.Epoch, err = strconv.ParseUint(query.Args()[2], 10, 64)
 		if err != nil {
-			return "", err
+			return WalStream{}, true, ErrWrongEpoch
 		}
-		return "[ok]", nil
-	case compute.DelCommand:
-		err := d.storage.Del(arguments[0])
+	default:
+		return WalStream{}, false, nil
+	}
+
+	stream.FromLSN, err = strconv.ParseUint(lsn, 10, 64)
+	if err != nil {
+		return WalStream{}, true, ErrWrongLSN
+	}
+	return stream, true, nil
+}
+
+// StreamWal передаёт в f записи WAL, начиная с fromLSN, по мере их записи на диск,
+// пока f не вернёт ошибку или не завершится ctx
+func (d *Database) StreamWal(ctx context.Context, fromLSN uint64, f func(wal.Record) error) error {
+	if d.loading.Load() {
+		return ErrLoading
+	}
+	if d.consensus != nil {
+		return d.streamCommitted(ctx, fromLSN, f)
+	}
+
+	tailer := d.wal.Tail(fromLSN)
+	defer tailer.Close()
+	for {
+		r, err := tailer.Next(ctx)
 		if err != nil {
-			return "", err
+			return err
+		}
+		if err := f(r); err != nil {
+			return err
 		}
-		return "[ok]", nil
 	}
+}
 
-	d.logger.Error("incorrect query", zap.String("query", q))
+// Replicate записывает в WAL записи, полученные репликой от primary, и применяет их к хранилищу.
+// Записи должны продолжать WAL реплики, уже полученные записи пропускаются.
+func (d *Database) Replicate(records []wal.Record) error {
+	if d.role() != RoleReplica {
+		return ErrNotReplica
+	}
+	if d.loading.Load() {
+		return ErrLoading
+	}
 
-	return "internal error", ErrInternal
+	queries := make([]compute.Query, len(records))
+	for i, r := range records {
+		query, err := d.parser.Parse(r.Query)
+		if err != nil {
+			return fmt.Errorf("lsn %d: %w", r.LSN, err)
+		}
+		queries[i] = query
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	lastLSN := d.wal.LastLSN()
+	if err := d.wal.WriteRecords(records); err != nil {
+		return err
+	}
+	for i, r := range records {
+		if r.LSN <= lastLSN {
+			continue
+		}
+		if err := d.apply(queries[i]); err != nil {
+			return err
+		}
+	}
+	if len(records) > 0 {
+		d.advanceApplied(records[len(records)-1].LSN)
+	}
+	return nil
+}
+
+// LastLSN возвращает LSN последней записи в WAL
+func (d *Database) LastLSN() uint64 {
+	return d.wal.LastLSN()
+}
+
+// Snapshot записывает снимок текущего состояния.
+// Запись блокируется только на время копирования состояния в память.
+func (d *Database) Snapshot() error {
+	lsn, pairs := d.copyState()
+	return d.wal.WriteSnapshot(lsn, pairs.rangeFn)
+}
+
+type statePairs struct {
+	keys, vals []string
+}
+
+func (p statePairs) rangeFn(f func(key, val string) bool) {
+	for i, key := range p.keys {
+		if !f(key, p.vals[i]) {
+			return
+		}
+	}
+}
+
+// copyState копирует состояние хранилища и LSN, которому оно соответствует
+func (d *Database) copyState() (uint64, statePairs) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	lsn := d.wal.LastLSN()
+	if d.consensus != nil {
+		lsn = d.applied.Load()
+	}
+	var pairs statePairs
+	d.storage.Range(func(key, val string) bool {
+		pairs.keys = append(pairs.keys, key)
+		pairs.vals = append(pairs.vals, val)
+		return true
+	})
+	return lsn, pairs
+}
+
+// RunSnapshots периодически записывает снимки, пока не завершится ctx
+func (d *Database) RunSnapshots(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastLSN uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// если с прошлого снимка ничего не изменилось, новый не нужен
+			lsn := d.wal.LastLSN()
+			if lsn == lastLSN {
+				continue
+			}
+			if err := d.Snapshot(); err != nil {
+				d.logger.Error("write snapshot", zap.Error(err))
+				continue
+			}
+			lastLSN = lsn
+		}
+	}
 }
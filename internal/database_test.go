@@ -1,16 +1,22 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/suite"
 	"go.uber.org/zap"
+	"in-memory-db/internal/cluster"
 	"in-memory-db/internal/compute"
 	"in-memory-db/internal/storage"
+	"in-memory-db/internal/storage/encryption"
+	"in-memory-db/internal/storage/filesystem"
 	inmemory "in-memory-db/internal/storage/in-memory"
 	"in-memory-db/internal/storage/wal"
 	"in-memory-db/internal/testingh"
@@ -30,20 +36,36 @@ func (s *DatabaseSuite) SetupTest() {
 	s.BaseDirSuite.SetupTest()
 }
 
-func (s *DatabaseSuite) createDataBaseForTest(segSize, batchSize int, tm time.Duration) *Database {
+func (s *DatabaseSuite) createDataBaseForTest(segSize, batchSize int, tm time.Duration, options ...wal.SegmentOption) *Database {
 	e := inmemory.NewEngine()
 	p := compute.NewParser()
-	segment := wal.NewSegment(segSize, s.BaseDir)
+	segment := wal.NewSegment(segSize, s.BaseDir, options...)
 	s.walInst = wal.NewWal(s.Ctx, batchSize, tm, segment, zap.NewNop())
 	return NewDatabase(e, p, zap.NewNop(), s.walInst)
 }
 
+// segmentRecords возвращает строки записей сегмента без строки версии формата
+func (s *DatabaseSuite) segmentRecords(name string) []string {
+	lines := s.ReadFileToSlice(s.BaseDir + name)
+	s.Require().NotEmpty(lines)
+	s.Equal(fmt.Sprintf("IMDBWAL %d", wal.SegmentFormatVersion), lines[0])
+	return lines[1:]
+}
+
+func (s *DatabaseSuite) recordQuery(line string, expectedLSN uint64) string {
+	r, err := wal.DecodeRecord(line)
+	s.NoError(err)
+	s.Equal(expectedLSN, r.LSN)
+	return r.Query
+}
+
 func (s *DatabaseSuite) TestDatabase_RunQuery_SetGetDel() {
 	db := s.createDataBaseForTest(100, 100, 100*time.Millisecond)
+	s.NoError(db.Init())
 
 	r, err := db.RunQuery("SET key val")
 	s.NoError(err)
-	s.Equal("[ok]", r)
+	s.Equal("[ok] lsn 1", r)
 
 	val, err := db.RunQuery("GET key")
 	s.NoError(err)
@@ -59,6 +81,19 @@ func (s *DatabaseSuite) TestDatabase_RunQuery_SetGetDel() {
 	s.ErrorIs(err, storage.ErrNotFound)
 }
 
+func (s *DatabaseSuite) TestDatabase_RunQuery_Loading() {
+	db := s.createDataBaseForTest(100, 100, 100*time.Millisecond)
+
+	_, err := db.RunQuery("SET key val")
+	s.ErrorIs(err, ErrLoading)
+	_, err = db.RunQuery("GET key")
+	s.ErrorIs(err, ErrLoading)
+
+	s.NoError(db.Init())
+	_, err = db.RunQuery("GET key")
+	s.ErrorIs(err, storage.ErrNotFound)
+}
+
 func (s *DatabaseSuite) TestDatabase_RunQuery_UnknownCommand() {
 	db := s.createDataBaseForTest(100, 100, 100*time.Millisecond)
 
@@ -67,60 +102,67 @@ func (s *DatabaseSuite) TestDatabase_RunQuery_UnknownCommand() {
 }
 
 func (s *DatabaseSuite) TestDatabase_RunQuery_WriteToWalByTimeout() {
-	db := s.createDataBaseForTest(4096, 4096, 100*time.Millisecond)
-	db.Init()
+	db := s.createDataBaseForTest(4096, 4096, 10*time.Millisecond)
+	s.NoError(db.Init())
 
 	const queryNumber = 10
 	for i := 0; i < queryNumber; i++ {
 		r, err := db.RunQuery(fmt.Sprintf("SET key%d val", i))
 		s.NoError(err)
-		s.Equal("[ok]", r)
+		s.Equal(fmt.Sprintf("[ok] lsn %d", i+1), r)
 	}
-	time.Sleep(200 * time.Millisecond)
 
 	fileNames := s.FileNamesInBaseDir()
-	s.ElementsMatch([]string{"data_1"}, fileNames)
+	s.ElementsMatch([]string{"data_1", wal.SegmentManifestName}, fileNames)
 
-	fileContent := s.ReadFileToSlice(s.BaseDir + "data_1")
+	fileContent := s.segmentRecords("data_1")
 	s.Equal(queryNumber, len(fileContent))
 	for i := 0; i < len(fileContent); i++ {
-		s.Equal(fmt.Sprintf("SET key%d val", i), fileContent[i])
+		s.Equal(fmt.Sprintf("SET key%d val", i), s.recordQuery(fileContent[i], uint64(i+1)))
 	}
 }
 
 func (s *DatabaseSuite) TestDatabase_RunQuery_WriteToWalByBatchSize() {
-	db := s.createDataBaseForTest(4096, 130, 1000*time.Millisecond)
-	db.Init()
+	db := s.createDataBaseForTest(4096, 130, time.Hour)
+	s.NoError(db.Init())
 
-	const queryNumber = 10
+	// запрос ждёт записи своей пачки на диск, поэтому пачку по размеру заполняют параллельные запросы
+	const queryNumber = 9
+	wg := sync.WaitGroup{}
 	for i := 0; i < queryNumber; i++ {
-		r, err := db.RunQuery(fmt.Sprintf("SET key%d val", i))
-		s.NoError(err)
-		s.Equal("[ok]", r)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := db.RunQuery(fmt.Sprintf("SET key%d val", i))
+			s.NoError(err)
+			s.Regexp(`^\[ok\] lsn [1-9]$`, r)
+		}()
 	}
-	s.CtxCancelFunc()
-	s.walInst.WaitWrite()
-	//time.Sleep(10 * time.Millisecond)
-	fileNames := s.FileNamesInBaseDir()
+	wg.Wait()
 
-	s.ElementsMatch([]string{"data_1"}, fileNames)
+	fileNames := s.FileNamesInBaseDir()
+	s.ElementsMatch([]string{"data_1", wal.SegmentManifestName}, fileNames)
 
-	fileContent := s.ReadFileToSlice(s.BaseDir + "data_1")
+	fileContent := s.segmentRecords("data_1")
 	s.Equal(queryNumber, len(fileContent))
+	var queries []string
 	for i := 0; i < len(fileContent); i++ {
-		s.Equal(fmt.Sprintf("SET key%d val", i), fileContent[i])
+		queries = append(queries, s.recordQuery(fileContent[i], uint64(i+1)))
+	}
+	for i := 0; i < queryNumber; i++ {
+		s.Contains(queries, fmt.Sprintf("SET key%d val", i))
 	}
 }
 
 func (s *DatabaseSuite) TestDatabase_RunQuery_WriteToWalTwoFiles() {
-	db := s.createDataBaseForTest(104, 90, 500*time.Millisecond)
-	db.Init()
+	db := s.createDataBaseForTest(300, 200, 10*time.Millisecond)
+	s.NoError(db.Init())
 
 	const queryNumber = 10
 	for i := 0; i < queryNumber; i++ {
 		r, err := db.RunQuery(fmt.Sprintf("SET key%d val", i))
 		s.NoError(err)
-		s.Equal("[ok]", r)
+		s.Equal(fmt.Sprintf("[ok] lsn %d", i+1), r)
 	}
 
 	s.CtxCancelFunc()
@@ -134,13 +176,13 @@ func (s *DatabaseSuite) TestDatabase_RunQuery_WriteToWalTwoFiles() {
 		fileNames = append(fileNames, file.Name())
 	}
 
-	s.ElementsMatch([]string{"data_1", "data_2"}, fileNames)
+	s.ElementsMatch([]string{"data_1", "data_2", wal.SegmentManifestName}, fileNames)
 
-	fileContent := s.ReadFileToSlice(s.BaseDir + "data_1")
-	fileContent = append(fileContent, s.ReadFileToSlice(s.BaseDir+"data_2")...)
+	fileContent := s.segmentRecords("data_1")
+	fileContent = append(fileContent, s.segmentRecords("data_2")...)
 	s.Equal(queryNumber, len(fileContent))
 	for i := 0; i < len(fileContent); i++ {
-		s.Equal(fmt.Sprintf("SET key%d val", i), fileContent[i])
+		s.Equal(fmt.Sprintf("SET key%d val", i), s.recordQuery(fileContent[i], uint64(i+1)))
 	}
 }
 
@@ -160,7 +202,7 @@ func (s *DatabaseSuite) TestDatabase_RunQuery_ReadWalInit() {
 		s.NoError(err)
 	}
 	db := s.createDataBaseForTest(104, 104, 500*time.Millisecond)
-	db.Init()
+	s.NoError(db.Init())
 
 	_, err := db.RunQuery("GET key1")
 	s.ErrorIs(err, storage.ErrNotFound)
@@ -171,6 +213,680 @@ func (s *DatabaseSuite) TestDatabase_RunQuery_ReadWalInit() {
 	val, err = db.RunQuery("GET key3")
 	s.Equal("444", val)
 
+	// нумерация новых записей продолжается после записей старого формата
+	_, err = db.RunQuery("SET key4 555")
+	s.NoError(err)
+
 	s.CtxCancelFunc()
 	s.walInst.WaitWrite()
+
+	// в сегмент старого формата не дописываем, новые записи идут в следующий сегмент
+	s.Equal([]string{"DEL key1", "SET key3 444"}, s.ReadFileToSlice(s.BaseDir+"data_2"))
+	fileContent := s.segmentRecords("data_3")
+	s.Equal(1, len(fileContent))
+	s.Equal("SET key4 555", s.recordQuery(fileContent[0], 6))
+}
+
+func (s *DatabaseSuite) TestDatabase_Init_EncryptedWal() {
+	keyring, err := encryption.ParseKeyring("k1:000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	s.Require().NoError(err)
+
+	db := s.createDataBaseForTest(4096, 4096, 10*time.Millisecond, wal.WithSegmentKeyring(keyring))
+	s.NoError(db.Init())
+	_, err = db.RunQuery("SET key secret")
+	s.NoError(err)
+	s.CtxCancelFunc()
+	s.walInst.WaitWrite()
+
+	s.NotContains(string(s.ReadFile(s.BaseDir+"data_1")), "secret")
+
+	s.Ctx, s.CtxCancelFunc = context.WithCancel(context.Background())
+	db = s.createDataBaseForTest(4096, 4096, 10*time.Millisecond, wal.WithSegmentKeyring(keyring))
+	s.NoError(db.Init())
+	val, err := db.RunQuery("GET key")
+	s.NoError(err)
+	s.Equal("secret", val)
+	s.CtxCancelFunc()
+	s.walInst.WaitWrite()
+
+	db = s.createDataBaseForTest(4096, 4096, 10*time.Millisecond)
+	s.ErrorIs(db.Init(), wal.ErrEncryptionNotConfigured)
+}
+
+func (s *DatabaseSuite) TestDatabase_Init_RecoveryTarget() {
+	db := s.createDataBaseForTest(4096, 4096, 10*time.Millisecond)
+	s.NoError(db.Init())
+	for _, q := range []string{"SET key good", "SET other 1", "SET key garbage", "DEL other"} {
+		_, err := db.RunQuery(q)
+		s.NoError(err)
+	}
+	s.CtxCancelFunc()
+	s.walInst.WaitWrite()
+
+	s.Ctx, s.CtxCancelFunc = context.WithCancel(context.Background())
+	s.walInst = wal.NewWal(s.Ctx, 4096, 10*time.Millisecond, wal.NewSegment(4096, s.BaseDir), zap.NewNop(),
+		wal.WithWalRecoveryTarget(wal.RecoveryTarget{LSN: 2}, false),
+	)
+	db = NewDatabase(inmemory.NewEngine(), compute.NewParser(), zap.NewNop(), s.walInst)
+	s.NoError(db.Init())
+
+	val, err := db.RunQuery("GET key")
+	s.NoError(err)
+	s.Equal("good", val)
+	val, err = db.RunQuery("GET other")
+	s.NoError(err)
+	s.Equal("1", val)
+
+	// новые записи продолжают нумерацию после цели восстановления
+	_, err = db.RunQuery("SET key new")
+	s.NoError(err)
+	s.CtxCancelFunc()
+	s.walInst.WaitWrite()
+
+	fileContent := s.segmentRecords("data_1")
+	s.Equal(3, len(fileContent))
+	s.Equal("SET key new", s.recordQuery(fileContent[2], 3))
+}
+
+func (s *DatabaseSuite) TestDatabase_Snapshot() {
+	db := s.createDataBaseForTest(4096, 4096, 10*time.Millisecond)
+	s.NoError(db.Init())
+	for _, q := range []string{"SET key 1", "SET other 2", "DEL other"} {
+		_, err := db.RunQuery(q)
+		s.NoError(err)
+	}
+	s.NoError(db.Snapshot())
+	_, err := db.RunQuery("SET key 2")
+	s.NoError(err)
+	s.CtxCancelFunc()
+	s.walInst.WaitWrite()
+
+	info, err := wal.ReadSnapshot(filesystem.OS{}, s.BaseDir+"snapshot_3", nil, func(key, val string) error { return nil })
+	s.NoError(err)
+	s.Equal(uint64(3), info.LSN)
+	s.Equal(1, info.Keys)
+
+	s.Ctx, s.CtxCancelFunc = context.WithCancel(context.Background())
+	db = s.createDataBaseForTest(4096, 4096, 10*time.Millisecond)
+	s.NoError(db.Init())
+	val, err := db.RunQuery("GET key")
+	s.NoError(err)
+	s.Equal("2", val)
+	_, err = db.RunQuery("GET other")
+	s.Error(err)
+	s.Equal(1, s.walInst.RecoveryReport().AppliedRecords)
+}
+
+func (s *DatabaseSuite) TestDatabase_StreamWal() {
+	db := s.createDataBaseForTest(4096, 4096, 10*time.Millisecond)
+
+	_, _, err := db.ParseWalStream("WALSTREAM x")
+	s.ErrorIs(err, ErrWrongLSN)
+	_, ok, _ := db.ParseWalStream("GET key")
+	s.False(ok)
+	stream, ok, err := db.ParseWalStream("REPLICATE replica-1 7 2")
+	s.NoError(err)
+	s.True(ok)
+	s.Equal(WalStream{FromLSN: 7, ReplicaID: "replica-1", Epoch: 2}, stream)
+	_, _, err = db.ParseWalStream("REPLICATE replica-1 7 x")
+	s.ErrorIs(err, ErrWrongEpoch)
+	stream, ok, err = db.ParseWalStream("walstream 2")
+	s.NoError(err)
+	s.True(ok)
+	fromLSN := stream.FromLSN
+	s.Equal(uint64(2), fromLSN)
+
+	s.ErrorIs(db.StreamWal(s.Ctx, fromLSN, func(r wal.Record) error { return nil }), ErrLoading)
+
+	s.NoError(db.Init())
+	for _, q := range []string{"SET key 1", "SET key 2", "DEL key"} {
+		_, err := db.RunQuery(q)
+		s.NoError(err)
+	}
+
+	// поток ждёт новых записей
+	written := make(chan error, 1)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_, err := db.RunQuery("SET other 3")
+		written <- err
+	}()
+
+	ctx, cancel := context.WithCancel(s.Ctx)
+	defer cancel()
+	var queries []string
+	err = db.StreamWal(ctx, fromLSN, func(r wal.Record) error {
+		queries = append(queries, r.Query)
+		if len(queries) == 3 {
+			cancel()
+		}
+		return nil
+	})
+	s.ErrorIs(err, context.Canceled)
+	s.Equal([]string{"SET key 2", "DEL key", "SET other 3"}, queries)
+	s.NoError(<-written)
+}
+
+func (s *DatabaseSuite) TestDatabase_Backup() {
+	s.createDataBaseForTest(4096, 4096, 10*time.Millisecond)
+	backupDir := s.BaseDir + "backup/"
+	db := NewDatabase(inmemory.NewEngine(), compute.NewParser(), zap.NewNop(), s.walInst, WithDatabaseBackupDirectory(backupDir))
+	s.NoError(db.Init())
+	for _, q := range []string{"SET key 1", "SET other 2"} {
+		_, err := db.RunQuery(q)
+		s.NoError(err)
+	}
+
+	_, err := db.RunQuery("BACKUP ..")
+	s.ErrorIs(err, ErrWrongBackupName)
+	r, err := db.RunQuery("BACKUP daily")
+	s.NoError(err)
+	s.Equal("[ok] lsn 2", r)
+	_, err = db.RunQuery("BACKUP daily")
+	s.ErrorIs(err, wal.ErrBackupExists)
+
+	manifest, err := wal.VerifyBackup(filesystem.OS{}, backupDir+"daily")
+	s.NoError(err)
+	s.Equal(uint64(2), manifest.LSN)
+}
+
+func (s *DatabaseSuite) TestDatabase_Info() {
+	db := s.createDataBaseForTest(4096, 4096, 10*time.Millisecond)
+	r, err := db.RunQuery("INFO")
+	s.NoError(err)
+	s.Contains(r, "loading:1\n")
+
+	s.NoError(db.Init())
+	_, err = db.RunQuery("SET key 1")
+	s.NoError(err)
+	r, err = db.RunQuery("INFO")
+	s.NoError(err)
+	s.Equal(`role:primary
+epoch:0
+loading:0
+last_lsn:1
+synced_lsn:1
+queue_depth:0
+queue_capacity:1000
+disk_full:0
+disk_free_bytes:0
+write_quorum:0
+quorum_degraded:0
+connected_replicas:0`, r)
+}
+
+func (s *DatabaseSuite) TestDatabase_RunQuery_MaxStale() {
+	db := s.createDataBaseForTest(4096, 4096, 10*time.Millisecond)
+	s.NoError(db.Init())
+	_, err := db.RunQuery("SET key 1")
+	s.NoError(err)
+
+	// данные primary не устаревают
+	r, err := db.RunQuery("GET key MAXSTALE 0s")
+	s.NoError(err)
+	s.Equal("1", r)
+	_, err = db.RunQuery("GET key MAXSTALE -1s")
+	s.ErrorIs(err, ErrWrongStaleness)
+
+	// реплика, ещё не получившая записи primary, не знает, насколько устарели её данные
+	db = s.createDataBaseForTest(4096, 4096, 10*time.Millisecond)
+	WithDatabaseReplicaOf("127.0.0.1:3223")(db)
+	s.NoError(db.Init())
+	_, err = db.RunQuery("GET key MAXSTALE 1h")
+	s.ErrorIs(err, ErrStale)
+}
+
+func (s *DatabaseSuite) TestDatabase_RunQuery_WaitLSN() {
+	db := s.createDataBaseForTest(4096, 4096, 10*time.Millisecond)
+	WithDatabaseWaitLSNTimeout(20 * time.Millisecond)(db)
+	s.NoError(db.Init())
+	r, err := db.RunQuery("SET key 1")
+	s.NoError(err)
+	s.Equal("[ok] lsn 1", r)
+
+	r, err = db.RunQuery("GET key WAITLSN 1")
+	s.NoError(err)
+	s.Equal("1", r)
+	_, err = db.RunQuery("GET key WAITLSN 2")
+	s.ErrorIs(err, ErrLSNTimeout)
+	_, err = db.RunQuery("GET key WAITLSN x")
+	s.ErrorIs(err, ErrWrongLSN)
+
+	// чтение ждёт записи, которая выполняется параллельно
+	read := make(chan string, 1)
+	go func() {
+		r, _ := db.RunQuery("GET key WAITLSN 2")
+		read <- r
+	}()
+	_, err = db.RunQuery("SET key 2")
+	s.NoError(err)
+	s.Equal("2", <-read)
+}
+
+func (s *DatabaseSuite) TestDatabase_RunQuery_ConcurrentWritesInWalOrder() {
+	db := s.createDataBaseForTest(1<<20, 4096, 5*time.Millisecond)
+	s.NoError(db.Init())
+
+	// записи одного ключа завершаются пакетами, но применяются в порядке WAL,
+	// поэтому хранилище совпадает с повтором WAL
+	var wg sync.WaitGroup
+	for i := range 32 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 20 {
+				val := fmt.Sprintf("%d-%d", i, j)
+				r, err := db.RunQuery("SET key " + val)
+				s.NoError(err)
+				lsn, _ := strings.CutPrefix(r, "[ok] lsn ")
+				_, err = db.RunQuery("GET key WAITLSN " + lsn)
+				s.NoError(err)
+			}
+		}()
+	}
+	wg.Wait()
+	s.Equal(db.LastLSN(), db.Applied())
+	val, err := db.RunQuery("GET key")
+	s.NoError(err)
+
+	s.CtxCancelFunc()
+	s.walInst.WaitWrite()
+	s.Ctx, s.CtxCancelFunc = context.WithCancel(context.Background())
+	replayed := s.createDataBaseForTest(1<<20, 4096, 5*time.Millisecond)
+	s.NoError(replayed.Init())
+	replayedVal, err := replayed.RunQuery("GET key")
+	s.NoError(err)
+	s.Equal(replayedVal, val)
+}
+
+func (s *DatabaseSuite) TestDatabase_Cluster() {
+	// слот bar - 5061, слот foo - 12182
+	c, err := cluster.New("n1", []cluster.Node{
+		{ID: "n1", Address: "127.0.0.1:3223", Slots: []cluster.SlotRange{{From: 0, To: 8191}}},
+		{ID: "n2", Address: "127.0.0.1:3224", Slots: []cluster.SlotRange{{From: 8192, To: 16383}}},
+	})
+	s.Require().NoError(err)
+	db := s.createDataBaseForTest(4096, 4096, 10*time.Millisecond)
+	WithDatabaseCluster(s.Ctx, c, nil)(db)
+	s.NoError(db.Init())
+
+	_, err = db.RunQuery("SET bar 1")
+	s.NoError(err)
+	_, err = db.RunQuery("SET {bar}:2 2")
+	s.NoError(err)
+	r, err := db.RunQuery("MGET bar {bar}:2 {bar}:3")
+	s.NoError(err)
+	s.Equal("1\n2\n(nil)", r)
+
+	_, err = db.RunQuery("SET foo 1")
+	s.EqualError(err, "MOVED 12182 127.0.0.1:3224")
+	_, err = db.RunQuery("GET foo")
+	s.EqualError(err, "MOVED 12182 127.0.0.1:3224")
+	_, err = db.RunQuery("MGET bar foo")
+	s.ErrorIs(err, cluster.ErrCrossSlot)
+
+	r, err = db.RunQuery("CLUSTER SLOTS")
+	s.NoError(err)
+	s.Equal("0-8191 n1 127.0.0.1:3223\n8192-16383 n2 127.0.0.1:3224", r)
+	_, err = db.RunQuery("CLUSTER RESET")
+	s.ErrorIs(err, ErrWrongClusterCommand)
+
+	r, err = db.RunQuery("INFO")
+	s.NoError(err)
+	s.Contains(r, "\ncluster_id:n1\ncluster_known_nodes:2\ncluster_slots_assigned:16384\ncluster_slots_served:8192")
+
+	// без режима кластера сервер обслуживает все ключи
+	db = s.createDataBaseForTest(4096, 4096, 10*time.Millisecond)
+	s.NoError(db.Init())
+	_, err = db.RunQuery("MGET bar foo")
+	s.NoError(err)
+	_, err = db.RunQuery("CLUSTER SLOTS")
+	s.ErrorIs(err, ErrClusterDisabled)
+}
+
+// clusterForwarder выполняет запросы на базах узлов кластера, адрес узла совпадает с его id
+type clusterForwarder map[string]*Database
+
+func (f clusterForwarder) Forward(_ context.Context, address, query string) (string, error) {
+	return f[address].RunQuery(query)
+}
+
+func (s *DatabaseSuite) clusterNode(id string, f clusterForwarder) *Database {
+	c, err := cluster.New(id, []cluster.Node{
+		{ID: "n1", Address: "n1", Slots: []cluster.SlotRange{{From: 0, To: 8191}}},
+		{ID: "n2", Address: "n2", Slots: []cluster.SlotRange{{From: 8192, To: 16383}}},
+	})
+	s.Require().NoError(err)
+	s.Require().NoError(os.MkdirAll(s.BaseDir+id, 0755))
+	walInst := wal.NewWal(s.Ctx, 4096, time.Millisecond, wal.NewSegment(4096, s.BaseDir+id), zap.NewNop())
+	db := NewDatabase(inmemory.NewEngine(), compute.NewParser(), zap.NewNop(), walInst, WithDatabaseCluster(s.Ctx, c, f))
+	s.Require().NoError(db.Init())
+	f[id] = db
+	return db
+}
+
+func (s *DatabaseSuite) TestDatabase_ClusterMigration() {
+	f := clusterForwarder{}
+	source, target := s.clusterNode("n1", f), s.clusterNode("n2", f)
+	// слот {bar} - 5061
+	for i := 1; i <= 3; i++ {
+		_, err := source.RunQuery(fmt.Sprintf("SET {bar}:%d %d", i, i))
+		s.Require().NoError(err)
+	}
+
+	r, err := target.RunQuery("CLUSTER SETSLOT 5061 IMPORTING n1")
+	s.NoError(err)
+	s.Equal("[ok]", r)
+	_, err = source.RunQuery("CLUSTER SETSLOT 5061 migrating n2")
+	s.NoError(err)
+
+	// пока ключи на прежнем владельце, он их обслуживает, новые ключи создаются на новом владельце
+	r, err = source.RunQuery("GET {bar}:1")
+	s.NoError(err)
+	s.Equal("1", r)
+	_, err = source.RunQuery("SET {bar}:new x")
+	s.EqualError(err, "ASK 5061 n2")
+	_, err = target.RunQuery("ASKING SET {bar}:new x")
+	s.NoError(err)
+	_, err = target.RunQuery("GET {bar}:new")
+	s.EqualError(err, "MOVED 5061 n1")
+	_, err = source.RunQuery("CLUSTER SETSLOT 5061 NODE n2")
+	s.ErrorIs(err, ErrSlotNotEmpty)
+
+	r, err = source.RunQuery("CLUSTER COUNTKEYSINSLOT 5061")
+	s.NoError(err)
+	s.Equal("3", r)
+	r, err = source.RunQuery("CLUSTER GETKEYSINSLOT 5061 10")
+	s.NoError(err)
+	keys := strings.Split(r, "\n")
+	s.ElementsMatch([]string{"{bar}:1", "{bar}:2", "{bar}:3"}, keys)
+	_, err = source.RunQuery("MIGRATE foo")
+	s.ErrorIs(err, ErrSlotNotMigrating)
+	r, err = source.RunQuery("MIGRATE " + strings.Join(keys, " "))
+	s.NoError(err)
+	s.Equal("[ok]", r)
+
+	_, err = source.RunQuery("GET {bar}:1")
+	s.EqualError(err, "ASK 5061 n2")
+	r, err = source.RunQuery("CLUSTER GETKEYSINSLOT 5061 10")
+	s.NoError(err)
+	s.Equal("(empty)", r)
+	r, err = target.RunQuery("ASKING GET {bar}:1")
+	s.NoError(err)
+	s.Equal("1", r)
+
+	// после передачи слота его ключи обслуживает только новый владелец
+	_, err = target.RunQuery("CLUSTER SETSLOT 5061 NODE n2")
+	s.NoError(err)
+	_, err = source.RunQuery("CLUSTER SETSLOT 5061 NODE n2")
+	s.NoError(err)
+	_, err = source.RunQuery("GET {bar}:1")
+	s.EqualError(err, "MOVED 5061 n2")
+	r, err = target.RunQuery("MGET {bar}:1 {bar}:2 {bar}:3 {bar}:new")
+	s.NoError(err)
+	s.Equal("1\n2\n3\nx", r)
+
+	r, err = source.RunQuery("CLUSTER NODES")
+	s.NoError(err)
+	s.Equal("n1 n1 0-5060,5062-8191\nn2 n2 5061,8192-16383", r)
+	r, err = source.RunQuery("INFO")
+	s.NoError(err)
+	s.Contains(r, "\ncluster_slots_served:8191\ncluster_slots_migrating:0\n")
+}
+
+// gatedForwarder ждёт release перед каждым запросом и сообщает о запросе в started
+type gatedForwarder struct {
+	clusterForwarder
+	started chan string
+	release chan struct{}
+}
+
+func (f gatedForwarder) Forward(ctx context.Context, address, query string) (string, error) {
+	f.started <- query
+	<-f.release
+	return f.clusterForwarder.Forward(ctx, address, query)
+}
+
+func (s *DatabaseSuite) TestDatabase_ClusterMigration_Concurrent() {
+	nodes := clusterForwarder{}
+	f := gatedForwarder{clusterForwarder: nodes, started: make(chan string, 1), release: make(chan struct{})}
+	c, err := cluster.New("n1", []cluster.Node{
+		{ID: "n1", Address: "n1", Slots: []cluster.SlotRange{{From: 0, To: 8191}}},
+		{ID: "n2", Address: "n2", Slots: []cluster.SlotRange{{From: 8192, To: 16383}}},
+	})
+	s.Require().NoError(err)
+	s.Require().NoError(os.MkdirAll(s.BaseDir+"n1", 0755))
+	walInst := wal.NewWal(s.Ctx, 4096, time.Millisecond, wal.NewSegment(4096, s.BaseDir+"n1"), zap.NewNop())
+	source := NewDatabase(inmemory.NewEngine(), compute.NewParser(), zap.NewNop(), walInst, WithDatabaseCluster(s.Ctx, c, f))
+	s.Require().NoError(source.Init())
+	nodes["n1"] = source
+	target := s.clusterNode("n2", nodes)
+
+	for _, key := range []string{"{bar}:1", "{bar}:2", "baz"} {
+		_, err := source.RunQuery("SET " + key + " 1")
+		s.Require().NoError(err)
+	}
+	_, err = target.RunQuery("CLUSTER SETSLOT 5061 IMPORTING n1")
+	s.Require().NoError(err)
+	_, err = source.RunQuery("CLUSTER SETSLOT 5061 MIGRATING n2")
+	s.Require().NoError(err)
+
+	migrated := make(chan error, 1)
+	go func() {
+		_, err := source.RunQuery("MIGRATE {bar}:1")
+		migrated <- err
+	}()
+	s.Equal("ASKING SET {bar}:1 1", <-f.started)
+
+	// пока ключ передаётся, запросы к другим ключам и чтение переносимого ключа выполняются
+	_, err = source.RunQuery("SET baz 2")
+	s.NoError(err)
+	_, err = source.RunQuery("SET {bar}:2 2")
+	s.NoError(err)
+	r, err := source.RunQuery("GET {bar}:1")
+	s.NoError(err)
+	s.Equal("1", r)
+	r, err = source.RunQuery("CLUSTER COUNTKEYSINSLOT 5061")
+	s.NoError(err)
+	s.Equal("2", r)
+
+	// запись в переносимый ключ ждёт конца переноса и уходит на новый владелец
+	written := make(chan error, 1)
+	go func() {
+		_, err := source.RunQuery("SET {bar}:1 2")
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		s.Failf("write to a migrating key is not blocked", "%v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(f.release)
+	s.NoError(<-migrated)
+	s.EqualError(<-written, "ASK 5061 n2")
+
+	r, err = target.RunQuery("ASKING GET {bar}:1")
+	s.NoError(err)
+	s.Equal("1", r)
+	r, err = source.RunQuery("CLUSTER GETKEYSINSLOT 5061 10")
+	s.NoError(err)
+	s.Equal("{bar}:2", r)
+}
+
+func (s *DatabaseSuite) TestDatabase_Replicate() {
+	s.createDataBaseForTest(4096, 4096, 10*time.Millisecond)
+	primary := NewDatabase(inmemory.NewEngine(), compute.NewParser(), zap.NewNop(), s.walInst)
+	s.ErrorIs(primary.Replicate(nil), ErrNotReplica)
+
+	e := inmemory.NewEngine()
+	db := NewDatabase(e, compute.NewParser(), zap.NewNop(), s.walInst, WithDatabaseRole(RoleReplica))
+	s.ErrorIs(db.Replicate(nil), ErrLoading)
+	s.NoError(db.Init())
+
+	_, err := db.RunQuery("SET key 1")
+	s.ErrorIs(err, ErrReadOnly)
+	_, err = db.RunQuery("DEL key")
+	s.ErrorIs(err, ErrReadOnly)
+
+	ts := time.Unix(0, 1700000000000000000)
+	s.NoError(db.Replicate([]wal.Record{wal.NewRecord(1, ts, "SET key 1"), wal.NewRecord(2, ts, "SET other 2")}))
+	// повтор уже полученной записи не применяется второй раз
+	s.NoError(db.Replicate([]wal.Record{wal.NewRecord(2, ts, "SET other 2"), wal.NewRecord(3, ts, "DEL key")}))
+	s.ErrorIs(db.Replicate([]wal.Record{wal.NewRecord(5, ts, "SET key 5")}), wal.ErrLSNOutOfOrder)
+	s.ErrorIs(db.Replicate([]wal.Record{wal.NewRecord(4, ts, "PUT key 5")}), compute.ErrUnknownCommand)
+
+	r, err := db.RunQuery("GET other")
+	s.NoError(err)
+	s.Equal("2", r)
+	_, err = db.RunQuery("GET key")
+	s.ErrorIs(err, storage.ErrNotFound)
+	s.Equal(uint64(3), db.LastLSN())
+
+	r, err = db.RunQuery("INFO")
+	s.NoError(err)
+	s.Contains(r, "role:replica\n")
+}
+
+func (s *DatabaseSuite) TestDatabase_FullResync() {
+	s.createDataBaseForTest(4096, 4096, 5*time.Millisecond)
+	primary := NewDatabase(inmemory.NewEngine(), compute.NewParser(), zap.NewNop(), s.walInst)
+	s.NoError(primary.Init())
+	_, err := primary.RunQuery("SET key 1")
+	s.NoError(err)
+	_, err = primary.RunQuery("SET other 2")
+	s.NoError(err)
+
+	var lines []string
+	lsn, err := primary.FullResync(func(line string) error {
+		lines = append(lines, line)
+		return nil
+	})
+	s.NoError(err)
+	s.Equal(uint64(2), lsn)
+	s.Require().Len(lines, 4)
+	s.Equal("FULLRESYNC 2 2\n", lines[0])
+	s.ElementsMatch([]string{"key 1\n", "other 2\n"}, lines[1:3])
+	s.Regexp(`^FULLRESYNC END [0-9a-f]{8}\n$`, lines[3])
+	s.ErrorIs(primary.Resync(2, nil, nil), ErrNotReplica)
+}
+
+func (s *DatabaseSuite) TestDatabase_Resync() {
+	s.createDataBaseForTest(4096, 4096, 5*time.Millisecond)
+	db := NewDatabase(inmemory.NewEngine(), compute.NewParser(), zap.NewNop(), s.walInst, WithDatabaseRole(RoleReplica))
+	s.NoError(db.Init())
+
+	ts := time.Unix(0, 1700000000000000000)
+	s.NoError(db.Replicate([]wal.Record{wal.NewRecord(1, ts, "SET key 1"), wal.NewRecord(2, ts, "SET old 2")}))
+	s.NoError(db.Resync(10, []string{"key", "new"}, []string{"10", "3"}))
+	s.Equal(uint64(10), db.LastLSN())
+
+	r, err := db.RunQuery("GET key")
+	s.NoError(err)
+	s.Equal("10", r)
+	_, err = db.RunQuery("GET old")
+	s.ErrorIs(err, storage.ErrNotFound)
+
+	// записи до lsn синхронизации пропускаются, следующие продолжают с lsn + 1
+	s.NoError(db.Replicate([]wal.Record{wal.NewRecord(3, ts, "SET key 3")}))
+	s.NoError(db.Replicate([]wal.Record{wal.NewRecord(11, ts, "DEL key")}))
+	_, err = db.RunQuery("GET key")
+	s.ErrorIs(err, storage.ErrNotFound)
+}
+
+func (s *DatabaseSuite) TestDatabase_WriteQuorum() {
+	s.createDataBaseForTest(4096, 4096, 5*time.Millisecond)
+	db := NewDatabase(inmemory.NewEngine(), compute.NewParser(), zap.NewNop(), s.walInst, WithDatabaseWriteQuorum(2, 50*time.Millisecond, false))
+	s.NoError(db.Init())
+	defer db.TrackReplica("r1")()
+	defer db.TrackReplica("r2")()
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := db.RunQuery("SET key 1")
+		written <- err
+	}()
+	s.Eventually(func() bool { return db.LastLSN() == 1 }, time.Second, time.Millisecond)
+	// запись уже в хранилище, и другие клиенты читают её до подтверждения кворумом
+	s.Eventually(func() bool {
+		r, err := db.RunQuery("GET key")
+		return err == nil && r == "1"
+	}, time.Second, time.Millisecond)
+	s.NoError(db.AckReplica("r1", "ACK 1"))
+	select {
+	case <-written:
+		s.Fail("write is acknowledged by one replica of two")
+	case <-time.After(10 * time.Millisecond):
+	}
+	s.NoError(db.AckReplica("r2", "ACK 1"))
+	s.NoError(<-written)
+
+	// запись без кворума остаётся в WAL и хранилище
+	_, err := db.RunQuery("SET key 2")
+	s.ErrorIs(err, ErrNoQuorum)
+	r, err := db.RunQuery("GET key")
+	s.NoError(err)
+	s.Equal("2", r)
+
+	s.ErrorIs(db.AckReplica("r1", "ACK x"), ErrWrongLSN)
+	s.ErrorIs(db.AckReplica("r1", "GET key"), compute.ErrUnknownCommand)
+	r, err = db.RunQuery("INFO")
+	s.NoError(err)
+	// обе реплики подтвердили все записи, кроме последней, lag_ms - время с этого подтверждения
+	s.Regexp(`write_quorum:2\nquorum_degraded:0\nconnected_replicas:2\n`+
+		`replica_r1:connected=1,acked_lsn=1,lag=1,lag_ms=\d+\nreplica_r2:connected=1,acked_lsn=1,lag=1,lag_ms=\d+`, r)
+}
+
+func (s *DatabaseSuite) TestDatabase_WriteQuorum_ExpireReplicas() {
+	s.createDataBaseForTest(4096, 4096, 5*time.Millisecond)
+	db := NewDatabase(inmemory.NewEngine(), compute.NewParser(), zap.NewNop(), s.walInst, WithDatabaseWriteQuorum(1, 30*time.Millisecond, false))
+	s.NoError(db.Init())
+	defer db.TrackReplica("r1")()
+	disconnect := db.TrackReplica("old")
+	s.NoError(db.AckReplica("old", "ACK 0"))
+	disconnect()
+
+	r, err := db.RunQuery("INFO")
+	s.NoError(err)
+	s.Contains(r, "connected_replicas:1\nreplica_old:connected=0,")
+
+	// отключённая реплика без ACK дольше таймаута кворума забывается, подключённая остаётся
+	time.Sleep(40 * time.Millisecond)
+	r, err = db.RunQuery("INFO")
+	s.NoError(err)
+	s.Contains(r, "connected_replicas:1\nreplica_r1:connected=1,")
+	s.NotContains(r, "replica_old")
+}
+
+func (s *DatabaseSuite) TestDatabase_WriteQuorum_DegradeToAsync() {
+	s.createDataBaseForTest(4096, 4096, 5*time.Millisecond)
+	db := NewDatabase(inmemory.NewEngine(), compute.NewParser(), zap.NewNop(), s.walInst, WithDatabaseWriteQuorum(1, 30*time.Millisecond, true))
+	s.NoError(db.Init())
+	defer db.TrackReplica("r1")()
+
+	started := time.Now()
+	_, err := db.RunQuery("SET key 1")
+	s.NoError(err)
+	s.GreaterOrEqual(time.Since(started), 30*time.Millisecond)
+
+	// пока реплика не догонит, кворум не ожидается
+	started = time.Now()
+	_, err = db.RunQuery("SET key 2")
+	s.NoError(err)
+	s.Less(time.Since(started), 30*time.Millisecond)
+	r, err := db.RunQuery("INFO")
+	s.NoError(err)
+	s.Contains(r, "quorum_degraded:1\n")
+
+	s.NoError(db.AckReplica("r1", "ACK 2"))
+	written := make(chan error, 1)
+	go func() {
+		_, err := db.RunQuery("SET key 3")
+		written <- err
+	}()
+	s.Eventually(func() bool { return db.LastLSN() == 3 }, time.Second, time.Millisecond)
+	s.NoError(db.AckReplica("r1", "ACK 3"))
+	s.NoError(<-written)
+	r, err = db.RunQuery("INFO")
+	s.NoError(err)
+	s.Contains(r, "quorum_degraded:0\n")
 }
@@ -0,0 +1,462 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"in-memory-db/internal/storage/wal"
+)
+
+// Смена роли во время работы: REPLICAOF <host> <port> делает сервер репликой, REPLICAOF NO ONE - primary.
+// Каждое назначение primary увеличивает эпоху репликации. Новый primary отправляет прежнему FENCE <эпоха>,
+// пока тот не ответит, а реплика передаёт свою эпоху в REPLICATE. Primary, узнавший о большей эпохе,
+// становится репликой без primary и перестаёт принимать запись, поэтому вернувшийся после переключения
+// primary не расходится с новым. Роль, адрес primary и эпоха хранятся в файле состояния и после
+// перезапуска важнее роли из конфигурации.
+
+var (
+	ErrNotPrimary     = errors.New("NOTPRIMARY server is not a primary")
+	ErrStaleEpoch     = errors.New("STALEEPOCH replication epoch is superseded")
+	ErrWrongEpoch     = errors.New("wrong replication epoch")
+	ErrWrongReplicaOf = errors.New("wrong REPLICAOF arguments")
+)
+
+// EpochHeader - первая строка потока REPLICATE: EPOCH <эпоха> <LSN первой записи эпохи> <последний LSN primary>
+const EpochHeader = "EPOCH"
+
+// Replicator связывает базу с другими серверами, реализация - replication.Replicator
+type Replicator interface {
+	// Follow получает записи от primary, пока не завершится ctx
+	Follow(ctx context.Context, db *Database, primaryAddress string)
+	// Fence отправляет прежнему primary эпоху нового, пока он её не примет или не завершится ctx
+	Fence(ctx context.Context, address string, epoch uint64) error
+	// Forward выполняет запрос на сервере address и возвращает его ответ
+	Forward(ctx context.Context, address, query string) (string, error)
+}
+
+// WithDatabaseReplicator позволяет менять роль во время работы: реплика получает записи через r,
+// пока не завершится ctx
+func WithDatabaseReplicator(ctx context.Context, r Replicator) DatabaseOption {
+	return func(d *Database) {
+		d.replicatorCtx = ctx
+		d.replicator = r
+	}
+}
+
+// WithDatabaseReplicaOf делает сервер репликой primary с адресом primaryAddress
+func WithDatabaseReplicaOf(primaryAddress string) DatabaseOption {
+	return func(d *Database) {
+		d.state.Load().Role = RoleReplica
+		d.state.Load().PrimaryAddress = primaryAddress
+	}
+}
+
+// WithDatabaseReplicationStateFile задаёт файл, в котором хранятся роль и эпоха после смены роли
+func WithDatabaseReplicationStateFile(path string) DatabaseOption {
+	return func(d *Database) {
+		d.stateFile = path
+	}
+}
+
+// replicationState - роль сервера в репликации, не меняется после записи в Database.state
+type replicationState struct {
+	Role           Role   `json:"role"`
+	PrimaryAddress string `json:"primary_address,omitempty"`
+	Epoch          uint64 `json:"epoch"`
+	// EpochStartLSN - LSN первой записи эпохи
+	EpochStartLSN uint64 `json:"epoch_start_lsn"`
+	// FenceAddress - адрес прежнего primary, который ещё не принял эпоху
+	FenceAddress string `json:"fence_address,omitempty"`
+}
+
+// primaryLink - соединение реплики с primary
+type primaryLink struct {
+	connected atomic.Bool
+	// последний известный LSN primary
+	primaryLSN atomic.Uint64
+	// syncedAt - когда реплика последний раз применила все записи primary, unix nano
+	syncedAt atomic.Int64
+}
+
+func (d *Database) role() Role {
+	return d.state.Load().Role
+}
+
+// loadState читает файл состояния, если он есть
+func (d *Database) loadState() error {
+	if d.stateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(d.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var st replicationState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("read %s: %w", d.stateFile, err)
+	}
+	if st.Role != RolePrimary && st.Role != RoleReplica {
+		return fmt.Errorf("read %s: wrong role %q", d.stateFile, st.Role)
+	}
+	d.state.Store(&st)
+	return nil
+}
+
+// updateState сохраняет состояние, которое возвращает f, f возвращает nil, если менять нечего
+func (d *Database) updateState(f func(st replicationState) *replicationState) error {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+
+	st := f(*d.state.Load())
+	if st == nil {
+		return nil
+	}
+	if d.stateFile != "" {
+		data, err := json.Marshal(st)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(d.stateFile, data); err != nil {
+			return err
+		}
+	}
+	d.state.Store(st)
+	return nil
+}
+
+// writeFileAtomic заменяет файл так, что после сбоя остаётся либо прежнее, либо новое содержимое
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// startLinksLocked запускает получение записей от primary или ограждение прежнего primary
+func (d *Database) startLinksLocked() {
+	d.stopLinks = func() {}
+	// во время загрузки роль может смениться командой FENCE, связи запускаются в конце Init
+	if d.replicator == nil || d.loading.Load() {
+		return
+	}
+
+	st := d.state.Load()
+	ctx, cancel := context.WithCancel(d.replicatorCtx)
+	var wg sync.WaitGroup
+	if st.Role == RoleReplica && st.PrimaryAddress != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.replicator.Follow(ctx, d, st.PrimaryAddress)
+		}()
+	}
+	if st.Role == RolePrimary && st.FenceAddress != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.fencePrimary(ctx, st.FenceAddress, st.Epoch)
+		}()
+	}
+
+	d.stopLinks = func() {
+		cancel()
+		wg.Wait()
+		d.link.connected.Store(false)
+	}
+}
+
+func (d *Database) fencePrimary(ctx context.Context, address string, epoch uint64) {
+	if err := d.replicator.Fence(ctx, address, epoch); err != nil {
+		if ctx.Err() == nil {
+			d.logger.Error("fence previous primary", zap.String("address", address), zap.Error(err))
+		}
+		return
+	}
+	d.logger.Info("previous primary is fenced", zap.String("address", address), zap.Uint64("epoch", epoch))
+
+	err := d.updateState(func(st replicationState) *replicationState {
+		if st.FenceAddress != address || st.Epoch != epoch {
+			return nil
+		}
+		st.FenceAddress = ""
+		return &st
+	})
+	if err != nil {
+		d.logger.Error("save replication state", zap.Error(err))
+	}
+}
+
+// changeRole останавливает связи с другими серверами, дожидается записей, которые уже выполняются,
+// и сохраняет состояние, которое возвращает f
+func (d *Database) changeRole(f func(st replicationState) *replicationState) error {
+	d.roleMu.Lock()
+	defer d.roleMu.Unlock()
+
+	d.stopLinks()
+	defer d.startLinksLocked()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.updateState(f)
+}
+
+// replicaOf выполняет REPLICAOF
+func (d *Database) replicaOf(host, port string) (string, error) {
+	if strings.EqualFold(host, "NO") && strings.EqualFold(port, "ONE") {
+		if err := d.promote(); err != nil {
+			return "", err
+		}
+		return "[ok]", nil
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", ErrWrongReplicaOf
+	}
+
+	address := net.JoinHostPort(host, port)
+	err := d.changeRole(func(st replicationState) *replicationState {
+		if st.Role == RoleReplica && st.PrimaryAddress == address {
+			return nil
+		}
+		st.Role, st.PrimaryAddress, st.FenceAddress = RoleReplica, address, ""
+		return &st
+	})
+	if err != nil {
+		return "", err
+	}
+	d.logger.Info("replication role changed", zap.String("role", string(RoleReplica)), zap.String("primary", address))
+	return "[ok]", nil
+}
+
+// promote делает реплику primary следующей эпохи
+func (d *Database) promote() error {
+	var epoch uint64
+	err := d.changeRole(func(st replicationState) *replicationState {
+		if st.Role == RolePrimary {
+			return nil
+		}
+		st.Role = RolePrimary
+		st.Epoch++
+		st.EpochStartLSN = d.wal.LastLSN() + 1
+		st.FenceAddress, st.PrimaryAddress = st.PrimaryAddress, ""
+		epoch = st.Epoch
+		return &st
+	})
+	if err == nil && epoch != 0 {
+		d.logger.Info("replication role changed", zap.String("role", string(RolePrimary)), zap.Uint64("epoch", epoch))
+	}
+	return err
+}
+
+// stepDown делает primary, узнавший о большей эпохе, репликой без primary
+func (d *Database) stepDown(epoch uint64) error {
+	var stepped bool
+	err := d.changeRole(func(st replicationState) *replicationState {
+		if st.Role != RolePrimary || st.Epoch >= epoch {
+			return nil
+		}
+		stepped = true
+		st.Role, st.FenceAddress = RoleReplica, ""
+		return &st
+	})
+	if stepped {
+		d.logger.Warn("primary is fenced by a newer replication epoch, writes are rejected until REPLICAOF",
+			zap.Uint64("epoch", d.state.Load().Epoch), zap.Uint64("newer_epoch", epoch))
+	}
+	return err
+}
+
+// fence выполняет FENCE: primary с меньшей эпохой перестаёт принимать запись
+func (d *Database) fence(arg string) (string, error) {
+	epoch, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		return "", ErrWrongEpoch
+	}
+
+	st := d.state.Load()
+	if st.Role == RolePrimary && st.Epoch >= epoch {
+		return "", ErrStaleEpoch
+	}
+	if err := d.stepDown(epoch); err != nil {
+		return "", err
+	}
+	return "[ok]", nil
+}
+
+// AcceptReplica проверяет эпоху реплики, запросившей REPLICATE. Если эпоха реплики больше, этот primary
+// устарел: он становится репликой без primary и возвращает ErrStaleEpoch. Иначе возвращает строку EPOCH,
+// которую нужно отправить реплике первой, и нужна ли ей полная синхронизация: реплика впереди primary
+// или получала записи прежнего primary после начала его эпохи.
+func (d *Database) AcceptReplica(stream WalStream) (header string, resync bool, err error) {
+	if d.loading.Load() {
+		return "", false, ErrLoading
+	}
+	if d.consensus != nil {
+		return "", false, ErrConsensusMode
+	}
+	st := d.state.Load()
+	if st.Role != RolePrimary {
+		return "", false, ErrNotPrimary
+	}
+	if stream.Epoch > st.Epoch {
+		if err := d.stepDown(stream.Epoch); err != nil {
+			return "", false, err
+		}
+		return "", false, ErrStaleEpoch
+	}
+
+	lastLSN := d.wal.LastLSN()
+	resync = stream.FromLSN > lastLSN+1 ||
+		(stream.Epoch < st.Epoch && (stream.Epoch+1 < st.Epoch || stream.FromLSN > st.EpochStartLSN))
+	return fmt.Sprintf("%s %d %d %d\n", EpochHeader, st.Epoch, st.EpochStartLSN, lastLSN), resync, nil
+}
+
+// PrimaryLink - поток REPLICATE на реплике. Эпоха primary сохраняется после того,
+// как реплика применит первые данные от него: до этого данные реплики могут расходиться с primary.
+type PrimaryLink struct {
+	d             *Database
+	epoch         uint64
+	epochStartLSN uint64
+	adopted       bool
+}
+
+// LinkPrimary разбирает строку EPOCH, с которой начинается поток REPLICATE.
+// Реплика не принимает записи от primary с эпохой меньше своей.
+func (d *Database) LinkPrimary(line string) (*PrimaryLink, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 || fields[0] != EpochHeader {
+		return nil, fmt.Errorf("%w: header %q", ErrWrongEpoch, line)
+	}
+	var values [3]uint64
+	for i := range values {
+		v, err := strconv.ParseUint(fields[i+1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: header %q", ErrWrongEpoch, line)
+		}
+		values[i] = v
+	}
+	if values[0] < d.state.Load().Epoch {
+		return nil, ErrStaleEpoch
+	}
+
+	d.link.connected.Store(true)
+	d.link.primaryLSN.Store(values[2])
+	return &PrimaryLink{d: d, epoch: values[0], epochStartLSN: values[1]}, nil
+}
+
+// Replicate работает как Database.Replicate
+func (l *PrimaryLink) Replicate(records []wal.Record) error {
+	if err := l.d.Replicate(records); err != nil {
+		return err
+	}
+	if len(records) > 0 {
+		l.seen(records[len(records)-1].LSN)
+	}
+	l.d.link.markSynced(l.d.wal.LastLSN())
+	return l.adopt()
+}
+
+// Resync работает как Database.Resync
+func (l *PrimaryLink) Resync(lsn uint64, keys, vals []string) error {
+	if err := l.d.Resync(lsn, keys, vals); err != nil {
+		return err
+	}
+	l.seen(lsn)
+	l.d.link.markSynced(l.d.wal.LastLSN())
+	return l.adopt()
+}
+
+// Heartbeat принимает последний LSN primary из строки HEARTBEAT
+func (l *PrimaryLink) Heartbeat(lsn uint64) {
+	l.seen(lsn)
+	l.d.link.markSynced(l.d.wal.LastLSN())
+}
+
+// Close отмечает, что соединение с primary потеряно
+func (l *PrimaryLink) Close() {
+	l.d.link.connected.Store(false)
+}
+
+func (l *PrimaryLink) seen(lsn uint64) {
+	for {
+		current := l.d.link.primaryLSN.Load()
+		if lsn <= current || l.d.link.primaryLSN.CompareAndSwap(current, lsn) {
+			return
+		}
+	}
+}
+
+func (l *PrimaryLink) adopt() error {
+	if l.adopted {
+		return nil
+	}
+	l.adopted = true
+	return l.d.updateState(func(st replicationState) *replicationState {
+		if st.Role != RoleReplica || st.Epoch >= l.epoch {
+			return nil
+		}
+		st.Epoch, st.EpochStartLSN = l.epoch, l.epochStartLSN
+		return &st
+	})
+}
+
+// roleInfo возвращает поля INFO о роли и эпохе
+func (d *Database) roleInfo(lastLSN uint64) []infoField {
+	st := d.state.Load()
+	fields := []infoField{
+		{"role", st.Role},
+		{"epoch", st.Epoch},
+	}
+	if st.Role == RoleReplica {
+		primaryLSN := d.link.primaryLSN.Load()
+		fields = append(fields,
+			infoField{"primary_address", st.PrimaryAddress},
+			infoField{"primary_link", boolToInt(d.link.connected.Load())},
+			infoField{"primary_last_lsn", primaryLSN},
+			infoField{"replication_lag", primaryLSN - min(primaryLSN, lastLSN)},
+			infoField{"replication_lag_ms", durationMs(d.staleness())},
+		)
+	}
+	return fields
+}
+
+// Epoch возвращает эпоху репликации
+func (d *Database) Epoch() uint64 {
+	return d.state.Load().Epoch
+}
@@ -1,13 +1,25 @@
 package network
 
 import (
+	"bufio"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"strings"
 	"time"
 )
 
-var ErrSmallBufferSize = errors.New("small buffer size")
+var (
+	ErrSmallBufferSize = errors.New("small buffer size")
+	// ErrNotSent - запрос не записан в соединение, поэтому сервер его не выполнял и запрос можно повторить
+	ErrNotSent = errors.New("request is not sent")
+)
+
+const (
+	streamReadSize = 64 << 10
+	maxStreamBatch = 1024
+)
 
 type Client struct {
 	address     string
@@ -29,9 +41,10 @@ func NewClient(address string, idleTimeout time.Duration, bufferSize int) *Clien
 	return &Client{address: address, idleTimeout: idleTimeout, bufferSize: bufferSize}
 }
 
+// Connect открывает соединение, ожидание соединения тоже ограничено idleTimeout
 func (c *Client) Connect() error {
 	var err error
-	c.conn, err = net.Dial("tcp", c.address)
+	c.conn, err = net.DialTimeout("tcp", c.address, c.idleTimeout)
 	if err != nil {
 		return err
 	}
@@ -51,9 +64,16 @@ func (c *Client) Close() {
 	}
 }
 
+// Send отправляет запрос и возвращает ответ, соединение закрывается, если запросов нет дольше idleTimeout.
+// Если запрос не удалось записать в соединение, ошибка оборачивает ErrNotSent.
 func (c *Client) Send(request string) (string, error) {
+	if c.idleTimeout != 0 {
+		if err := c.conn.SetDeadline(time.Now().Add(c.idleTimeout)); err != nil {
+			return "", fmt.Errorf("%w: %w", ErrNotSent, err)
+		}
+	}
 	if _, err := c.conn.Write([]byte(request)); err != nil {
-		return "", err
+		return "", fmt.Errorf("%w: %w", ErrNotSent, err)
 	}
 
 	response := make([]byte, c.bufferSize)
@@ -66,3 +86,58 @@ func (c *Client) Send(request string) (string, error) {
 
 	return string(response[:count]), nil
 }
+
+// WriteLine отправляет строку в соединение, например подтверждение реплики во время StreamBatches
+func (c *Client) WriteLine(line string) error {
+	_, err := c.conn.Write([]byte(line + "\n"))
+	return err
+}
+
+// Stream отправляет запрос WALSTREAM и передаёт в f каждую полученную строку,
+// пока соединение не будет закрыто или f не вернёт ошибку
+func (c *Client) Stream(request string, f func(line string) error) error {
+	return c.StreamBatches(request, func(lines []string) error {
+		for _, line := range lines {
+			if err := f(line); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// StreamBatches работает как Stream, но передаёт в f сразу все строки, которые уже получены,
+// не больше maxStreamBatch за раз
+func (c *Client) StreamBatches(request string, f func(lines []string) error) error {
+	if _, err := c.conn.Write([]byte(request)); err != nil {
+		return err
+	}
+	// записи могут не приходить долго
+	if err := c.conn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReaderSize(c.conn, streamReadSize)
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			lines = append(lines, strings.TrimSuffix(line, "\n"))
+		}
+		if err == nil && reader.Buffered() > 0 && len(lines) < maxStreamBatch {
+			continue
+		}
+		if len(lines) > 0 {
+			if err := f(lines); err != nil {
+				return err
+			}
+			lines = lines[:0]
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -52,3 +52,38 @@ func TestClient(t *testing.T) {
 
 	client.Close()
 }
+
+func TestClient_StreamBatches(t *testing.T) {
+	const addr = "127.0.0.1:3032"
+	l, err := net.Listen("tcp", addr)
+	assert.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buffer := make([]byte, 512)
+		conn.Read(buffer)
+		conn.Write([]byte("line1\nline2\n"))
+		time.Sleep(50 * time.Millisecond)
+		conn.Write([]byte("li"))
+		time.Sleep(50 * time.Millisecond)
+		conn.Write([]byte("ne3\nerror: closed"))
+	}()
+
+	client := NewClient(addr, time.Second, 0)
+	assert.NoError(t, client.Connect())
+	defer client.Close()
+
+	var batches [][]string
+	err = client.StreamBatches("WALSTREAM 1", func(lines []string) error {
+		batches = append(batches, append([]string(nil), lines...))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"line1", "line2"}, {"line3", "error: closed"}}, batches)
+}
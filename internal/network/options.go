@@ -21,3 +21,10 @@ func WithServerMaxConnectionsNumber(count int) ServerOption {
 		server.maxConnections = count
 	}
 }
+
+// WithServerHeartbeatInterval задаёт, как часто primary отправляет реплике HEARTBEAT с последним LSN
+func WithServerHeartbeatInterval(interval time.Duration) ServerOption {
+	return func(server *Server) {
+		server.heartbeatInterval = interval
+	}
+}
@@ -1,6 +1,7 @@
 package network
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
@@ -11,12 +12,20 @@ import (
 
 	"go.uber.org/zap"
 	"in-memory-db/internal"
+	"in-memory-db/internal/storage/wal"
 )
 
 const tooManyConnectionsMsg = "too many connections"
 
+// QueryHandler выполняет запросы клиентов, например запросы к нескольким серверам через прокси
+type QueryHandler interface {
+	RunQuery(query string) (string, error)
+}
+
 type Server struct {
-	ctx    context.Context
+	ctx     context.Context
+	handler QueryHandler
+	// db - база, которая отдаёт поток WAL, nil - сервер не отдаёт поток
 	db     *internal.Database
 	logger *zap.Logger
 
@@ -24,13 +33,22 @@ type Server struct {
 	idleTimeout    time.Duration
 	bufferSize     int
 	maxConnections int
+	// heartbeatInterval - как часто реплике отправляется HEARTBEAT
+	heartbeatInterval time.Duration
 
 	connectionNumber int
 	mu               sync.Mutex
 }
 
 func NewServer(ctx context.Context, address string, db *internal.Database, logger *zap.Logger, options ...ServerOption) *Server {
-	srv := &Server{ctx: ctx, address: address, db: db, logger: logger, connectionNumber: 1}
+	srv := NewHandlerServer(ctx, address, db, logger, options...)
+	srv.db = db
+	return srv
+}
+
+// NewHandlerServer возвращает сервер, который выполняет запросы через handler и не отдаёт поток WAL
+func NewHandlerServer(ctx context.Context, address string, handler QueryHandler, logger *zap.Logger, options ...ServerOption) *Server {
+	srv := &Server{ctx: ctx, address: address, handler: handler, logger: logger, connectionNumber: 1}
 
 	for _, o := range options {
 		o(srv)
@@ -48,6 +66,10 @@ func NewServer(ctx context.Context, address string, db *internal.Database, logge
 		srv.bufferSize = 4096
 	}
 
+	if srv.heartbeatInterval <= 0 {
+		srv.heartbeatInterval = time.Second
+	}
+
 	return srv
 }
 
@@ -114,8 +136,22 @@ func (s *Server) handleUserConnection(conn net.Conn) {
 			break
 		}
 
+		query := string(request[:readBytes])
+		var walStream internal.WalStream
+		var isStream bool
+		if s.db != nil {
+			walStream, isStream, err = s.db.ParseWalStream(query)
+		}
+		if isStream && err == nil {
+			s.streamWal(conn, walStream)
+			break
+		}
+
 		var userResp string
-		dbResp, err := s.db.RunQuery(string(request[:readBytes]))
+		var dbResp string
+		if !isStream {
+			dbResp, err = s.handler.RunQuery(query)
+		}
 		if err != nil {
 			userResp = fmt.Sprintf("error: %s", err.Error())
 			s.logger.Error("db error", zap.Error(err))
@@ -129,3 +165,136 @@ func (s *Server) handleUserConnection(conn net.Conn) {
 		}
 	}
 }
+
+// streamWal отправляет клиенту записи WAL по одной на строку, пока клиент не закроет соединение.
+// Реплике между записями периодически отправляется HEARTBEAT.
+func (s *Server) streamWal(conn net.Conn, stream internal.WalStream) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	if stream.ReplicaID != "" {
+		s.logger.Info("replica connected", zap.String("replica_id", stream.ReplicaID),
+			zap.String("address", conn.RemoteAddr().String()), zap.Uint64("from_lsn", stream.FromLSN))
+		defer s.logger.Info("replica disconnected", zap.String("replica_id", stream.ReplicaID))
+		defer s.db.TrackReplica(stream.ReplicaID)()
+	}
+
+	// новых записей можно ждать сколько угодно, ограничено только время отправки
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		s.logger.Warn("set deadline error", zap.Error(err))
+		return
+	}
+	go func() {
+		defer cancel()
+		// в режиме потока клиент отправляет только подтверждения реплики, чтение завершится при закрытии соединения
+		if stream.ReplicaID == "" {
+			io.Copy(io.Discard, conn)
+			return
+		}
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			if err := s.db.AckReplica(stream.ReplicaID, scanner.Text()); err != nil {
+				s.logger.Warn("replica ack", zap.String("replica_id", stream.ReplicaID), zap.Error(err))
+				return
+			}
+		}
+	}()
+
+	// строки отправляются под sendMu, полная синхронизация отправляется целиком
+	var sendMu sync.Mutex
+	send := func(w io.Writer, line string) error {
+		if s.idleTimeout != 0 {
+			if err := conn.SetWriteDeadline(time.Now().Add(s.idleTimeout)); err != nil {
+				return err
+			}
+		}
+		_, err := io.WriteString(w, line)
+		return err
+	}
+
+	fromLSN := stream.FromLSN
+	resync := false
+	if stream.ReplicaID != "" {
+		header, needResync, err := s.db.AcceptReplica(stream)
+		if err == nil {
+			err = send(conn, header)
+		}
+		if err != nil {
+			s.stopWalStream(ctx, conn, err)
+			return
+		}
+		resync = needResync
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cancel()
+			s.sendHeartbeats(ctx, func(line string) error {
+				sendMu.Lock()
+				defer sendMu.Unlock()
+				return send(conn, line)
+			})
+		}()
+	}
+
+	for {
+		if resync {
+			s.logger.Info("replica full resync", zap.String("replica_id", stream.ReplicaID), zap.Uint64("from_lsn", fromLSN))
+			w := bufio.NewWriterSize(conn, 64<<10)
+			sendMu.Lock()
+			lsn, err := s.db.FullResync(func(line string) error {
+				return send(w, line)
+			})
+			if err == nil {
+				err = w.Flush()
+			}
+			sendMu.Unlock()
+			if err != nil {
+				s.stopWalStream(ctx, conn, err)
+				return
+			}
+			fromLSN = lsn + 1
+		}
+
+		err := s.db.StreamWal(ctx, fromLSN, func(r wal.Record) error {
+			sendMu.Lock()
+			defer sendMu.Unlock()
+			return send(conn, r.Encode())
+		})
+		// реплике, которой не хватает удалённых записей, передаётся всё состояние
+		if stream.ReplicaID == "" || !errors.Is(err, wal.ErrLSNNotAvailable) || ctx.Err() != nil {
+			s.stopWalStream(ctx, conn, err)
+			return
+		}
+		resync = true
+	}
+}
+
+// sendHeartbeats отправляет реплике HEARTBEAT, пока не завершится ctx или не произойдёт ошибка отправки
+func (s *Server) sendHeartbeats(ctx context.Context, send func(line string) error) {
+	ticker := time.NewTicker(s.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := send(s.db.Heartbeat()); err != nil {
+				s.logger.Debug("send heartbeat", zap.Error(err))
+				return
+			}
+		}
+	}
+}
+
+// stopWalStream сообщает клиенту об ошибке, которой завершился поток WAL
+func (s *Server) stopWalStream(ctx context.Context, conn net.Conn, err error) {
+	if err != nil && ctx.Err() == nil {
+		s.logger.Warn("wal stream", zap.Error(err))
+		conn.Write([]byte(fmt.Sprintf("error: %s", err.Error())))
+	}
+}
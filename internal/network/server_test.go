@@ -4,6 +4,7 @@ import (
 	"context"
 	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -13,6 +14,7 @@ import (
 	"in-memory-db/internal"
 	"in-memory-db/internal/compute"
 	inmemory "in-memory-db/internal/storage/in-memory"
+	"in-memory-db/internal/storage/wal"
 )
 
 const (
@@ -22,7 +24,9 @@ const (
 func TestServer_Run(t *testing.T) {
 	cancel, server := createServer(5)
 
+	runDone := make(chan struct{})
 	go func() {
+		defer close(runDone)
 		err := server.Run()
 		assert.NoError(t, err)
 	}()
@@ -42,7 +46,7 @@ func TestServer_Run(t *testing.T) {
 		size, clientErr := conn.Read(buffer)
 		require.NoError(t, clientErr)
 
-		assert.Equal(t, "[ok]", string(buffer[:size]))
+		assert.Regexp(t, `^\[ok\] lsn \d+$`, string(buffer[:size]))
 
 		conn.Write([]byte("GET config"))
 
@@ -64,14 +68,14 @@ func TestServer_Run(t *testing.T) {
 		size, clientErr := conn.Read(buffer)
 		require.NoError(t, clientErr)
 
-		assert.Equal(t, "[ok]", string(buffer[:size]))
+		assert.Regexp(t, `^\[ok\] lsn \d+$`, string(buffer[:size]))
 
 		conn.Write([]byte("DEL key"))
 
 		size, clientErr = conn.Read(buffer)
 		require.NoError(t, clientErr)
 
-		assert.Equal(t, "[ok]", string(buffer[:size]))
+		assert.Regexp(t, `^\[ok\] lsn \d+$`, string(buffer[:size]))
 
 		conn.Write([]byte("GET key"))
 
@@ -84,12 +88,15 @@ func TestServer_Run(t *testing.T) {
 	wg.Wait()
 
 	cancel()
+	<-runDone
 }
 
 func TestServer_RunMaxConn(t *testing.T) {
 	cancel, server := createServer(2)
 
+	runDone := make(chan struct{})
 	go func() {
+		defer close(runDone)
 		err := server.Run()
 		assert.NoError(t, err)
 	}()
@@ -133,6 +140,7 @@ func TestServer_RunMaxConn(t *testing.T) {
 
 	wg.Wait()
 	cancel()
+	<-runDone
 
 	require.Contains(t, responses, "too many connections")
 }
@@ -144,8 +152,9 @@ func createServer(maxConn int) (context.CancelFunc, *Server) {
 	logger := zap.NewNop()
 	e := inmemory.NewEngine()
 	p := compute.NewParser()
-	walInst := wallStub{}
+	walInst := &wallStub{}
 	db := internal.NewDatabase(e, p, logger, walInst)
+	db.Init()
 
 	server := NewServer(ctx, testServerAddr, db, logger,
 		WithServerIdleTimeout(time.Minute),
@@ -155,21 +164,55 @@ func createServer(maxConn int) (context.CancelFunc, *Server) {
 	return cancel, server
 }
 
+// wallStub нумерует записи, но никуда их не пишет
 type wallStub struct {
+	lastLSN atomic.Uint64
 }
 
-func (w wallStub) Init(f func([]byte) error) error {
+func (w *wallStub) Init(replay wal.Replay) error {
 	return nil
 }
 
-func (w wallStub) Run() error {
+func (w *wallStub) Run() error {
 	return nil
 }
 
-func (w wallStub) Write(query string) error {
+func (w *wallStub) WriteLSN(query string) (uint64, error) {
+	return w.lastLSN.Add(1), nil
+}
+
+func (w *wallStub) WriteRecords(records []wal.Record) error {
+	return nil
+}
+
+func (w *wallStub) LastLSN() uint64 {
+	return w.lastLSN.Load()
+}
+
+func (w *wallStub) WriteSnapshot(lsn uint64, rangeFn func(f func(key, val string) bool)) error {
+	return nil
+}
+
+func (w *wallStub) Reset(lsn uint64, rangeFn func(f func(key, val string) bool)) error {
 	return nil
 }
 
-func (w wallStub) Close() error {
+func (w *wallStub) TruncateAfter(lsn uint64) error {
+	return nil
+}
+
+func (w *wallStub) Tail(fromLSN uint64) *wal.Tailer {
+	return nil
+}
+
+func (w *wallStub) Backup(dir string, lsn uint64) (wal.BackupManifest, error) {
+	return wal.BackupManifest{}, nil
+}
+
+func (w *wallStub) Stats() wal.Stats {
+	return wal.Stats{}
+}
+
+func (w *wallStub) Close() error {
 	return nil
 }
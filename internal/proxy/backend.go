@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"in-memory-db/internal/network"
+)
+
+var errConnectionClosed = errors.New("connection closed")
+
+// maxIdleConnections - сколько соединений с сервером остаётся открытыми между запросами
+const maxIdleConnections = 16
+
+// defaultIdleTimeout - время жизни соединения без запросов, если оно не задано, как у сервера
+const defaultIdleTimeout = 5 * time.Minute
+
+// backend - сервер шарда и соединения с ним
+type backend struct {
+	address string
+	// healthy - результат последней проверки, до первой проверки сервер считается доступным
+	healthy atomic.Bool
+	// lastLSN - last_lsn из INFO при последней успешной проверке
+	lastLSN atomic.Uint64
+
+	idle        chan idleClient
+	idleTimeout time.Duration
+	bufferSize  int
+}
+
+// idleClient - соединение в пуле и время, когда оно вернулось в пул
+type idleClient struct {
+	client *network.Client
+	since  time.Time
+}
+
+func newBackend(address string, idleTimeout time.Duration, bufferSize int) *backend {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+	b := &backend{
+		address:     address,
+		idle:        make(chan idleClient, maxIdleConnections),
+		idleTimeout: idleTimeout,
+		bufferSize:  bufferSize,
+	}
+	b.healthy.Store(true)
+	return b
+}
+
+// send выполняет запрос на сервере и возвращает ответ как есть. По новому соединению запрос повторяется,
+// только если его не удалось записать в соединение из пула: записанный запрос сервер мог выполнить,
+// и повтор выполнил бы SET или DEL дважды.
+func (b *backend) send(query string) (string, error) {
+	if client := b.takeIdle(); client != nil {
+		resp, err := b.sendOn(client, query)
+		if !errors.Is(err, network.ErrNotSent) {
+			return resp, err
+		}
+	}
+
+	client := network.NewClient(b.address, b.idleTimeout, b.bufferSize)
+	if err := client.Connect(); err != nil {
+		return "", err
+	}
+	return b.sendOn(client, query)
+}
+
+// takeIdle возвращает соединение из пула или nil, если пул пуст. Соединения, которые пробыли в пуле
+// дольше половины idleTimeout, закрываются: сервер мог закрыть их сам, и запрос пропал бы после записи.
+func (b *backend) takeIdle() *network.Client {
+	for {
+		select {
+		case idle := <-b.idle:
+			if time.Since(idle.since) > b.idleTimeout/2 {
+				idle.client.Close()
+				continue
+			}
+			return idle.client
+		default:
+			return nil
+		}
+	}
+}
+
+// sendOn выполняет запрос по соединению client и возвращает соединение в пул или закрывает его
+func (b *backend) sendOn(client *network.Client, query string) (string, error) {
+	resp, err := client.Send(query)
+	if err == nil && resp == "" {
+		err = errConnectionClosed
+	}
+	if err != nil {
+		client.Close()
+		return "", err
+	}
+
+	select {
+	case b.idle <- idleClient{client: client, since: time.Now()}:
+	default:
+		client.Close()
+	}
+	return resp, nil
+}
+
+// forward выполняет запрос на сервере, ответ error: ... возвращается как ошибка
+func (b *backend) forward(query string) (string, error) {
+	resp, err := b.send(query)
+	if err != nil {
+		return "", err
+	}
+	if msg, ok := strings.CutPrefix(resp, "error: "); ok {
+		return "", errors.New(msg)
+	}
+	return resp, nil
+}
+
+// runChecks раз в interval проверяет, что сервер принимает соединения и загрузил данные, пока не завершится ctx
+func (b *backend) runChecks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		healthy := b.check(interval)
+		b.healthy.Store(healthy)
+		// соединения с сервером, который не прошёл проверку, могли зависнуть
+		if !healthy {
+			b.close()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check выполняет INFO по новому соединению: соединения из пула могут оставаться открытыми у остановленного сервера.
+// Из ответа запоминается last_lsn, по нему promote выбирает реплику.
+func (b *backend) check(timeout time.Duration) bool {
+	client := network.NewClient(b.address, timeout, b.bufferSize)
+	if err := client.Connect(); err != nil {
+		return false
+	}
+	defer client.Close()
+	resp, err := client.Send("INFO")
+	if err != nil || !strings.Contains(resp, "loading:0") {
+		return false
+	}
+	for _, line := range strings.Split(resp, "\n") {
+		if value, ok := strings.CutPrefix(line, "last_lsn:"); ok {
+			if lsn, err := strconv.ParseUint(value, 10, 64); err == nil {
+				b.lastLSN.Store(lsn)
+			}
+		}
+	}
+	return true
+}
+
+// close закрывает соединения из пула
+func (b *backend) close() {
+	for {
+		select {
+		case idle := <-b.idle:
+			idle.client.Close()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"in-memory-db/internal/network"
+)
+
+// closingServer отвечает на GET, а прочитав другой запрос, закрывает соединение без ответа.
+// received - число таких запросов.
+func closingServer(t *testing.T, received *atomic.Int32) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 512)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					if !strings.HasPrefix(string(buf[:n]), "GET ") {
+						received.Add(1)
+						return
+					}
+					if _, err := conn.Write([]byte("val")); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestBackend_SendDoesNotRetryWrittenQuery(t *testing.T) {
+	var received atomic.Int32
+	b := newBackend(closingServer(t, &received), time.Second, 4096)
+	resp, err := b.send("GET key")
+	require.NoError(t, err)
+	require.Equal(t, "val", resp)
+
+	// запрос записан в соединение из пула, и сервер мог его выполнить, поэтому он не повторяется
+	_, err = b.send("SET key 1")
+	assert.ErrorIs(t, err, errConnectionClosed)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int32(1), received.Load())
+}
+
+func TestBackend_SendRetriesUnsentQuery(t *testing.T) {
+	var received atomic.Int32
+	b := newBackend(closingServer(t, &received), time.Second, 4096)
+
+	// в закрытое соединение из пула запрос не записан, поэтому он повторяется по новому соединению
+	client := network.NewClient(b.address, time.Second, 4096)
+	require.NoError(t, client.Connect())
+	client.Close()
+	b.idle <- idleClient{client: client, since: time.Now()}
+	_, err := b.send("SET key 1")
+	assert.ErrorIs(t, err, errConnectionClosed)
+	assert.Eventually(t, func() bool { return received.Load() == 1 }, time.Second, time.Millisecond)
+
+	// соединение, которое пробыло в пуле дольше половины idleTimeout, закрывается
+	client = network.NewClient(b.address, time.Second, 4096)
+	require.NoError(t, client.Connect())
+	b.idle <- idleClient{client: client, since: time.Now().Add(-time.Second)}
+	assert.Nil(t, b.takeIdle())
+}
@@ -0,0 +1,433 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"in-memory-db/internal/compute"
+)
+
+// Прокси принимает запросы клиентов по тому же протоколу, что и сервер, и выполняет их на серверах шардов.
+// Шард ключа выбирается консистентным хешированием (см. Ring), MGET разбивается по шардам и собирается
+// в исходном порядке ключей. Прокси проверяет серверы запросом INFO и, если primary шарда недоступен,
+// читает с реплик или назначает реплику primary, в зависимости от FailoverPolicy.
+
+var (
+	ErrUnsupportedCommand = errors.New("command is not supported by proxy")
+	ErrShardUnavailable   = errors.New("shard is unavailable")
+	ErrWrongShards        = errors.New("wrong proxy shards")
+	ErrWrongFailover      = errors.New("wrong failover policy")
+)
+
+// FailoverPolicy задаёт, что делает прокси, когда primary шарда не проходит проверку
+type FailoverPolicy string
+
+const (
+	// FailoverOff - запросы всегда выполняются на primary
+	FailoverOff FailoverPolicy = "off"
+	// FailoverReads - чтение выполняется на доступной реплике, запись возвращает ErrShardUnavailable
+	FailoverReads FailoverPolicy = "reads"
+	// FailoverPromote - как FailoverReads, а если primary недоступен дольше failoverTimeout,
+	// доступная реплика получает REPLICAOF NO ONE, остальные реплики шарда - REPLICAOF на неё
+	FailoverPromote FailoverPolicy = "promote"
+)
+
+// ParseFailoverPolicy возвращает политику по значению из конфига, пустое значение - FailoverOff
+func ParseFailoverPolicy(s string) (FailoverPolicy, error) {
+	switch p := FailoverPolicy(s); p {
+	case "":
+		return FailoverOff, nil
+	case FailoverOff, FailoverReads, FailoverPromote:
+		return p, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrWrongFailover, s)
+}
+
+const (
+	defaultHealthCheckInterval = time.Second
+	defaultFailoverTimeout     = 5 * time.Second
+)
+
+// Shard - адреса серверов шарда
+type Shard struct {
+	Name     string
+	Primary  string
+	Replicas []string
+}
+
+// shard - серверы шарда и их роли, которые меняются при назначении реплики primary
+type shard struct {
+	name string
+
+	mu       sync.RWMutex
+	primary  *backend
+	replicas []*backend
+	// downSince - время первой неудачной проверки primary
+	downSince time.Time
+	// repoint - реплики, которым не удалось отправить REPLICAOF на новый primary
+	repoint   map[*backend]bool
+	failovers int
+}
+
+type Proxy struct {
+	parser *compute.Parser
+	logger *zap.Logger
+
+	ring   *Ring
+	shards map[string]*shard
+	// names - шарды в порядке конфига, для INFO
+	names []string
+
+	vnodes              int
+	healthCheckInterval time.Duration
+	failover            FailoverPolicy
+	failoverTimeout     time.Duration
+	idleTimeout         time.Duration
+	bufferSize          int
+}
+
+type ProxyOption func(*Proxy)
+
+// WithProxyVirtualNodes задаёт число точек каждого шарда на кольце
+func WithProxyVirtualNodes(vnodes int) ProxyOption {
+	return func(p *Proxy) {
+		p.vnodes = vnodes
+	}
+}
+
+// WithProxyHealthCheckInterval задаёт интервал проверки серверов
+func WithProxyHealthCheckInterval(interval time.Duration) ProxyOption {
+	return func(p *Proxy) {
+		if interval > 0 {
+			p.healthCheckInterval = interval
+		}
+	}
+}
+
+// WithProxyFailover задаёт политику для недоступного primary, timeout используется с FailoverPromote
+func WithProxyFailover(policy FailoverPolicy, timeout time.Duration) ProxyOption {
+	return func(p *Proxy) {
+		p.failover = policy
+		if timeout > 0 {
+			p.failoverTimeout = timeout
+		}
+	}
+}
+
+// WithProxyBackendConnection задаёт таймаут неактивного соединения с сервером и размер буфера ответа,
+// он должен быть не меньше max_message_size серверов
+func WithProxyBackendConnection(idleTimeout time.Duration, bufferSize int) ProxyOption {
+	return func(p *Proxy) {
+		p.idleTimeout = idleTimeout
+		p.bufferSize = bufferSize
+	}
+}
+
+func NewProxy(shards []Shard, logger *zap.Logger, options ...ProxyOption) (*Proxy, error) {
+	p := &Proxy{
+		parser:              compute.NewParser(),
+		logger:              logger,
+		shards:              make(map[string]*shard, len(shards)),
+		healthCheckInterval: defaultHealthCheckInterval,
+		failover:            FailoverOff,
+		failoverTimeout:     defaultFailoverTimeout,
+	}
+	for _, o := range options {
+		o(p)
+	}
+
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("%w: no shards", ErrWrongShards)
+	}
+	for _, s := range shards {
+		if s.Name == "" || s.Primary == "" {
+			return nil, fmt.Errorf("%w: shard needs name and primary", ErrWrongShards)
+		}
+		if _, ok := p.shards[s.Name]; ok {
+			return nil, fmt.Errorf("%w: duplicate shard %s", ErrWrongShards, s.Name)
+		}
+		sh := &shard{
+			name:    s.Name,
+			primary: newBackend(s.Primary, p.idleTimeout, p.bufferSize),
+			repoint: make(map[*backend]bool),
+		}
+		for _, r := range s.Replicas {
+			sh.replicas = append(sh.replicas, newBackend(r, p.idleTimeout, p.bufferSize))
+		}
+		p.shards[s.Name] = sh
+		p.names = append(p.names, s.Name)
+	}
+	p.ring = NewRing(p.names, p.vnodes)
+
+	return p, nil
+}
+
+// Run проверяет серверы шардов и выполняет failover, пока не завершится ctx
+func (p *Proxy) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, sh := range p.shards {
+		for _, b := range append([]*backend{sh.primary}, sh.replicas...) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				b.runChecks(ctx, p.healthCheckInterval)
+			}()
+		}
+	}
+
+	if p.failover == FailoverPromote {
+		ticker := time.NewTicker(p.healthCheckInterval)
+	loop:
+		for {
+			select {
+			case <-ctx.Done():
+				ticker.Stop()
+				break loop
+			case now := <-ticker.C:
+				for _, name := range p.names {
+					p.promote(p.shards[name], now)
+				}
+			}
+		}
+	}
+
+	wg.Wait()
+	for _, sh := range p.shards {
+		sh.primary.close()
+		for _, r := range sh.replicas {
+			r.close()
+		}
+	}
+}
+
+func (p *Proxy) RunQuery(queryStr string) (string, error) {
+	query, err := p.parser.Parse(queryStr)
+	if err != nil {
+		return "", err
+	}
+	if query.Asking() {
+		return "", ErrUnsupportedCommand
+	}
+
+	switch query.Command() {
+	case compute.GetCommand:
+		return p.read(p.shardOf(query.Args()[0]), query.ToSting())
+	case compute.SetCommand, compute.DelCommand:
+		return p.write(p.shardOf(query.Args()[0]), query.ToSting())
+	case compute.MGetCommand:
+		return p.mget(query.Args())
+	case compute.InfoCommand:
+		return p.info(), nil
+	}
+	return "", ErrUnsupportedCommand
+}
+
+func (p *Proxy) shardOf(key string) *shard {
+	return p.shards[p.ring.Get(key)]
+}
+
+// write выполняет запрос на primary шарда
+func (p *Proxy) write(sh *shard, query string) (string, error) {
+	sh.mu.RLock()
+	primary := sh.primary
+	sh.mu.RUnlock()
+	if p.failover != FailoverOff && !primary.healthy.Load() {
+		return "", fmt.Errorf("%w: %s", ErrShardUnavailable, sh.name)
+	}
+	return primary.forward(query)
+}
+
+// read выполняет запрос на primary шарда, а если primary не прошёл проверку, - на первой доступной реплике
+func (p *Proxy) read(sh *shard, query string) (string, error) {
+	sh.mu.RLock()
+	target := sh.primary
+	if p.failover != FailoverOff && !target.healthy.Load() {
+		target = nil
+		for _, r := range sh.replicas {
+			if r.healthy.Load() {
+				target = r
+				break
+			}
+		}
+	}
+	sh.mu.RUnlock()
+	if target == nil {
+		return "", fmt.Errorf("%w: %s", ErrShardUnavailable, sh.name)
+	}
+	return target.forward(query)
+}
+
+// mget выполняет MGET на каждом шарде с его ключами и возвращает значения в порядке keys
+func (p *Proxy) mget(keys []string) (string, error) {
+	type shardKeys struct {
+		keys []string
+		// pos - индексы ключей в keys
+		pos []int
+	}
+	groups := make(map[*shard]*shardKeys)
+	for i, key := range keys {
+		sh := p.shardOf(key)
+		g, ok := groups[sh]
+		if !ok {
+			g = &shardKeys{}
+			groups[sh] = g
+		}
+		g.keys = append(g.keys, key)
+		g.pos = append(g.pos, i)
+	}
+
+	vals := make([]string, len(keys))
+	errs := make([]error, 0, len(groups))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for sh, g := range groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := p.read(sh, string(compute.MGetCommand)+" "+strings.Join(g.keys, " "))
+			if err == nil {
+				lines := strings.Split(resp, "\n")
+				if len(lines) != len(g.keys) {
+					err = fmt.Errorf("shard %s returned %d values for %d keys", sh.name, len(lines), len(g.keys))
+				} else {
+					for i, pos := range g.pos {
+						vals[pos] = lines[i]
+					}
+				}
+			}
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return "", errs[0]
+	}
+	return strings.Join(vals, "\n"), nil
+}
+
+// promote назначает primary доступную реплику шарда с наибольшим last_lsn, если primary не проходит проверки
+// дольше failoverTimeout. При равном last_lsn выбирается реплика, которая раньше в конфигурации.
+func (p *Proxy) promote(sh *shard, now time.Time) {
+	sh.mu.Lock()
+	if sh.primary.healthy.Load() {
+		sh.downSince = time.Time{}
+		primary := sh.primary
+		var repoint []*backend
+		for r := range sh.repoint {
+			if r.healthy.Load() {
+				repoint = append(repoint, r)
+			}
+		}
+		sh.mu.Unlock()
+		// прежний primary и реплики, которые были недоступны при failover, получают REPLICAOF, когда вернутся
+		for _, r := range repoint {
+			if p.replicaOf(sh, r, primary) {
+				sh.mu.Lock()
+				delete(sh.repoint, r)
+				sh.mu.Unlock()
+			}
+		}
+		return
+	}
+	if sh.downSince.IsZero() {
+		sh.downSince = now
+	}
+	if now.Sub(sh.downSince) < p.failoverTimeout {
+		sh.mu.Unlock()
+		return
+	}
+	candidates := slices.DeleteFunc(slices.Clone(sh.replicas), func(r *backend) bool { return !r.healthy.Load() })
+	sh.mu.Unlock()
+
+	// реплика с меньшим last_lsn после promote потеряла бы записи, которые уже есть на других репликах
+	// last_lsn меняется проверками, поэтому сравниваются значения, прочитанные один раз
+	lsns := make(map[*backend]uint64, len(candidates))
+	for _, c := range candidates {
+		lsns[c] = c.lastLSN.Load()
+	}
+	slices.SortStableFunc(candidates, func(a, b *backend) int { return cmp.Compare(lsns[b], lsns[a]) })
+	for _, c := range candidates {
+		if _, err := c.forward(string(compute.ReplicaOfCommand) + " NO ONE"); err != nil {
+			p.logger.Warn("promote replica", zap.String("shard", sh.name), zap.String("address", c.address), zap.Error(err))
+			continue
+		}
+
+		sh.mu.Lock()
+		old := sh.primary
+		sh.primary = c
+		sh.replicas = slices.DeleteFunc(sh.replicas, func(r *backend) bool { return r == c })
+		sh.replicas = append(sh.replicas, old)
+		sh.downSince = time.Time{}
+		sh.failovers++
+		delete(sh.repoint, c)
+		for _, r := range sh.replicas {
+			sh.repoint[r] = true
+		}
+		sh.mu.Unlock()
+
+		p.logger.Info("replica promoted",
+			zap.String("shard", sh.name),
+			zap.String("primary", c.address),
+			zap.String("old_primary", old.address),
+		)
+		return
+	}
+}
+
+// replicaOf отправляет реплике r REPLICAOF на primary и сообщает, удалось ли это
+func (p *Proxy) replicaOf(sh *shard, r, primary *backend) bool {
+	host, port, err := net.SplitHostPort(primary.address)
+	if err != nil {
+		p.logger.Error("wrong primary address", zap.String("shard", sh.name), zap.Error(err))
+		return false
+	}
+	if _, err := r.forward(fmt.Sprintf("%s %s %s", compute.ReplicaOfCommand, host, port)); err != nil {
+		p.logger.Warn("repoint replica", zap.String("shard", sh.name), zap.String("address", r.address), zap.Error(err))
+		return false
+	}
+	return true
+}
+
+// info возвращает состояние прокси строками вида field:value, по строке на шард
+func (p *Proxy) info() string {
+	lines := []string{
+		fmt.Sprintf("proxy_shards:%d", len(p.names)),
+		fmt.Sprintf("proxy_failover:%s", p.failover),
+	}
+	for _, name := range p.names {
+		sh := p.shards[name]
+		sh.mu.RLock()
+		replicas := make([]string, len(sh.replicas))
+		healthy := 0
+		for i, r := range sh.replicas {
+			replicas[i] = r.address
+			if r.healthy.Load() {
+				healthy++
+			}
+		}
+		lines = append(lines, fmt.Sprintf("shard_%s:primary=%s,primary_healthy=%d,replicas=%s,replicas_healthy=%d,failovers=%d",
+			name, sh.primary.address, boolToInt(sh.primary.healthy.Load()), strings.Join(replicas, ";"), healthy, sh.failovers))
+		sh.mu.RUnlock()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
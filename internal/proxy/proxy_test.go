@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+
+	"in-memory-db/internal"
+	"in-memory-db/internal/compute"
+	"in-memory-db/internal/network"
+	"in-memory-db/internal/replication"
+	inmemory "in-memory-db/internal/storage/in-memory"
+	"in-memory-db/internal/storage/wal"
+	"in-memory-db/internal/testingh"
+)
+
+const (
+	testShard1Addr   = "127.0.0.1:3060"
+	testShard2Addr   = "127.0.0.1:3061"
+	testReplicaAddr  = "127.0.0.1:3062"
+	testProxyAddr    = "127.0.0.1:3063"
+	testReplica2Addr = "127.0.0.1:3064"
+	// testNoServerAddr - адрес, на котором нет сервера
+	testNoServerAddr = "127.0.0.1:3065"
+)
+
+type ProxySuite struct {
+	testingh.BaseDirSuite
+	// stops останавливают серверы теста
+	stops []context.CancelFunc
+}
+
+func TestProxySuite(t *testing.T) {
+	suite.Run(t, new(ProxySuite))
+}
+
+func (s *ProxySuite) SetupTest() {
+	s.BaseDir = testingh.GetBaseDir(runtime.Caller(0))
+	s.BaseDirSuite.SetupTest()
+	s.stops = nil
+}
+
+func (s *ProxySuite) TearDownTest() {
+	for _, stop := range s.stops {
+		stop()
+	}
+	s.BaseDirSuite.TearDownTest()
+}
+
+// startServer запускает сервер с базой в поддиректории dir, сервер останавливается после теста или вызовом stop
+func (s *ProxySuite) startServer(dir, address string, options ...internal.DatabaseOption) (*internal.Database, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(s.Ctx)
+	s.Require().NoError(os.MkdirAll(s.BaseDir+dir, 0755))
+	walInst := wal.NewWal(ctx, 4096, 5*time.Millisecond, wal.NewSegment(4096, s.BaseDir+dir), zap.NewNop())
+	options = append(options,
+		internal.WithDatabaseReplicationStateFile(s.BaseDir+dir+"/replication_state.json"),
+		internal.WithDatabaseReplicator(ctx, replication.NewReplicator(dir, zap.NewNop(),
+			replication.WithReplicatorReconnectDelay(10*time.Millisecond))),
+	)
+	db := internal.NewDatabase(inmemory.NewEngine(), compute.NewParser(), zap.NewNop(), walInst, options...)
+	s.Require().NoError(db.Init())
+
+	server := network.NewServer(ctx, address, db, zap.NewNop(), network.WithServerMaxConnectionsNumber(50))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.NoError(server.Run())
+	}()
+	stop := func() {
+		cancel()
+		<-done
+		walInst.WaitWrite()
+	}
+	s.stops = append(s.stops, stop)
+	return db, stop
+}
+
+// startProxy запускает проверки серверов прокси, пока не завершится тест
+func (s *ProxySuite) startProxy(shards []Shard, options ...ProxyOption) *Proxy {
+	p, err := NewProxy(shards, zap.NewNop(), append(options, WithProxyHealthCheckInterval(10*time.Millisecond))...)
+	s.Require().NoError(err)
+	go p.Run(s.Ctx)
+	return p
+}
+
+func (s *ProxySuite) twoShards() (*Proxy, map[string]*internal.Database) {
+	db1, _ := s.startServer("s1", testShard1Addr)
+	db2, _ := s.startServer("s2", testShard2Addr)
+	p := s.startProxy([]Shard{{Name: "s1", Primary: testShard1Addr}, {Name: "s2", Primary: testShard2Addr}})
+	return p, map[string]*internal.Database{"s1": db1, "s2": db2}
+}
+
+func (s *ProxySuite) TestProxy_Routing() {
+	p, dbs := s.twoShards()
+
+	perShard := make(map[string]int)
+	for i := range 20 {
+		key := fmt.Sprintf("key%d", i)
+		r, err := p.RunQuery(fmt.Sprintf("SET %s %d", key, i))
+		s.Require().NoError(err)
+		s.True(strings.HasPrefix(r, "[ok]"), r)
+
+		// ключ записан только на сервер своего шарда
+		shard := p.ring.Get(key)
+		perShard[shard]++
+		for name, db := range dbs {
+			_, err := db.RunQuery("GET " + key)
+			s.Equal(name == shard, err == nil, key)
+		}
+
+		r, err = p.RunQuery("GET " + key)
+		s.NoError(err)
+		s.Equal(fmt.Sprint(i), r)
+	}
+	s.Len(perShard, 2)
+
+	_, err := p.RunQuery("DEL key1")
+	s.NoError(err)
+	_, err = p.RunQuery("GET key1")
+	s.EqualError(err, "not found")
+
+	_, err = p.RunQuery("REPLICAOF NO ONE")
+	s.ErrorIs(err, ErrUnsupportedCommand)
+	_, err = p.RunQuery("GET")
+	s.ErrorIs(err, compute.ErrWrongArgumentNumber)
+}
+
+func (s *ProxySuite) TestProxy_MGet() {
+	p, _ := s.twoShards()
+	for i := range 10 {
+		_, err := p.RunQuery(fmt.Sprintf("SET key%d %d", i, i))
+		s.Require().NoError(err)
+	}
+
+	r, err := p.RunQuery("MGET key9 key0 missing key5 key1 key8")
+	s.NoError(err)
+	s.Equal("9\n0\n(nil)\n5\n1\n8", r)
+}
+
+func (s *ProxySuite) TestProxy_Server() {
+	p, _ := s.twoShards()
+	ctx, cancel := context.WithCancel(s.Ctx)
+	server := network.NewHandlerServer(ctx, testProxyAddr, p, zap.NewNop(), network.WithServerMaxConnectionsNumber(10))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.NoError(server.Run())
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	var client *network.Client
+	s.Require().Eventually(func() bool {
+		client = network.NewClient(testProxyAddr, time.Second, 4096)
+		return client.Connect() == nil
+	}, time.Second, 5*time.Millisecond)
+	defer client.Close()
+
+	r, err := client.Send("SET a 1")
+	s.NoError(err)
+	s.True(strings.HasPrefix(r, "[ok]"), r)
+	r, err = client.Send("MGET a b")
+	s.NoError(err)
+	s.Equal("1\n(nil)", r)
+	r, err = client.Send("REPLICAOF NO ONE")
+	s.NoError(err)
+	s.Equal("error: command is not supported by proxy", r)
+	r, err = client.Send("INFO")
+	s.NoError(err)
+	s.Contains(r, "proxy_shards:2\nproxy_failover:off\nshard_s1:primary=127.0.0.1:3060,primary_healthy=1,")
+}
+
+// shardWithReplica запускает шард из primary и реплики, в которой уже есть ключ key
+func (s *ProxySuite) shardWithReplica(options ...ProxyOption) (p *Proxy, stopPrimary context.CancelFunc, replica *internal.Database) {
+	_, stopPrimary = s.startServer("primary", testShard1Addr)
+	replica, _ = s.startServer("replica", testReplicaAddr, internal.WithDatabaseReplicaOf(testShard1Addr))
+
+	p = s.startProxy([]Shard{{Name: "s1", Primary: testShard1Addr, Replicas: []string{testReplicaAddr}}}, options...)
+	_, err := p.RunQuery("SET key 1")
+	s.Require().NoError(err)
+	s.Require().Eventually(func() bool {
+		r, err := replica.RunQuery("GET key")
+		return err == nil && r == "1"
+	}, 5*time.Second, 5*time.Millisecond)
+	return p, stopPrimary, replica
+}
+
+// waitInfo ждёт, пока INFO прокси не будет содержать substr
+func (s *ProxySuite) waitInfo(p *Proxy, substr string) {
+	s.Require().Eventually(func() bool {
+		r, err := p.RunQuery("INFO")
+		return err == nil && strings.Contains(r, substr)
+	}, 5*time.Second, 5*time.Millisecond)
+}
+
+func (s *ProxySuite) TestProxy_FailoverReads() {
+	p, stopPrimary, _ := s.shardWithReplica(WithProxyFailover(FailoverReads, 0))
+	stopPrimary()
+
+	s.waitInfo(p, "shard_s1:primary=127.0.0.1:3060,primary_healthy=0,replicas=127.0.0.1:3062,replicas_healthy=1,failovers=0")
+	r, err := p.RunQuery("GET key")
+	s.NoError(err)
+	s.Equal("1", r)
+	_, err = p.RunQuery("SET key 2")
+	s.ErrorIs(err, ErrShardUnavailable)
+}
+
+func (s *ProxySuite) TestProxy_FailoverOff() {
+	p, stopPrimary, _ := s.shardWithReplica()
+	stopPrimary()
+
+	// без failover запросы не переходят на реплику
+	s.waitInfo(p, "primary_healthy=0")
+	_, err := p.RunQuery("GET key")
+	s.Error(err)
+	s.NotErrorIs(err, ErrShardUnavailable)
+}
+
+func (s *ProxySuite) TestProxy_FailoverPromote() {
+	p, stopPrimary, replica := s.shardWithReplica(WithProxyFailover(FailoverPromote, 50*time.Millisecond))
+	stopPrimary()
+
+	s.waitInfo(p, "failovers=1")
+	_, err := p.RunQuery("SET key 2")
+	s.Require().NoError(err)
+	r, err := replica.RunQuery("GET key")
+	s.NoError(err)
+	s.Equal("2", r)
+	r, err = replica.RunQuery("INFO")
+	s.NoError(err)
+	s.Contains(r, "role:primary\nepoch:1\n")
+	r, err = p.RunQuery("INFO")
+	s.NoError(err)
+	s.Contains(r, "shard_s1:primary=127.0.0.1:3062,primary_healthy=1,replicas=127.0.0.1:3060,replicas_healthy=0,failovers=1")
+
+	// вернувшийся primary становится репликой нового
+	oldPrimary, _ := s.startServer("primary", testShard1Addr)
+	s.Require().Eventually(func() bool {
+		r, err := oldPrimary.RunQuery("INFO")
+		return err == nil && strings.Contains(r, "primary_address:127.0.0.1:3062\nprimary_link:1\n")
+	}, 5*time.Second, 5*time.Millisecond)
+	s.Require().Eventually(func() bool {
+		r, err := oldPrimary.RunQuery("GET key")
+		return err == nil && r == "2"
+	}, 5*time.Second, 5*time.Millisecond)
+}
+
+func (s *ProxySuite) TestProxy_FailoverPromoteLatest() {
+	_, stopPrimary := s.startServer("primary", testShard1Addr)
+	_, stopLagging := s.startServer("replica", testReplicaAddr, internal.WithDatabaseReplicaOf(testShard1Addr))
+	latest, _ := s.startServer("replica2", testReplica2Addr, internal.WithDatabaseReplicaOf(testShard1Addr))
+
+	// отстающая реплика первая в конфигурации
+	p := s.startProxy([]Shard{{Name: "s1", Primary: testShard1Addr, Replicas: []string{testReplicaAddr, testReplica2Addr}}},
+		WithProxyFailover(FailoverPromote, 50*time.Millisecond))
+	_, err := p.RunQuery("SET key 1")
+	s.Require().NoError(err)
+	s.waitKey(latest, "key", "1")
+
+	// реплика пропускает запись и возвращается без связи с primary
+	stopLagging()
+	_, err = p.RunQuery("SET key 2")
+	s.Require().NoError(err)
+	s.waitKey(latest, "key", "2")
+	lagging, _ := s.startServer("replica", testReplicaAddr, internal.WithDatabaseReplicaOf(testNoServerAddr))
+	s.waitKey(lagging, "key", "1")
+
+	replicas := p.shards["s1"].replicas
+	s.Require().Eventually(func() bool {
+		return replicas[0].healthy.Load() && replicas[1].lastLSN.Load() > replicas[0].lastLSN.Load()
+	}, 5*time.Second, 5*time.Millisecond)
+	stopPrimary()
+
+	s.waitInfo(p, "shard_s1:primary=127.0.0.1:3064,primary_healthy=1,replicas=127.0.0.1:3062;127.0.0.1:3060,replicas_healthy=1,failovers=1")
+	r, err := latest.RunQuery("INFO")
+	s.NoError(err)
+	s.Contains(r, "role:primary\nepoch:1\n")
+	r, err = p.RunQuery("GET key")
+	s.NoError(err)
+	s.Equal("2", r)
+}
+
+// waitKey ждёт, пока в базе db ключ key не получит значение value
+func (s *ProxySuite) waitKey(db *internal.Database, key, value string) {
+	s.Require().Eventually(func() bool {
+		r, err := db.RunQuery("GET " + key)
+		return err == nil && r == value
+	}, 5*time.Second, 5*time.Millisecond)
+}
+
+func (s *ProxySuite) TestNewProxy_Errors() {
+	for _, shards := range [][]Shard{
+		nil,
+		{{Name: "s1"}},
+		{{Primary: testShard1Addr}},
+		{{Name: "s1", Primary: testShard1Addr}, {Name: "s1", Primary: testShard2Addr}},
+	} {
+		_, err := NewProxy(shards, zap.NewNop())
+		s.ErrorIs(err, ErrWrongShards)
+	}
+
+	_, err := ParseFailoverPolicy("always")
+	s.ErrorIs(err, ErrWrongFailover)
+	policy, err := ParseFailoverPolicy("")
+	s.NoError(err)
+	s.Equal(FailoverOff, policy)
+}
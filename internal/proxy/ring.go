@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"cmp"
+	"hash/fnv"
+	"slices"
+	"strconv"
+)
+
+// DefaultVirtualNodes - число точек шарда на кольце по умолчанию
+const DefaultVirtualNodes = 160
+
+// Ring - кольцо консистентного хеширования. Каждый шард занимает на кольце несколько точек, ключ
+// принадлежит шарду первой точки после хеша ключа. При добавлении шарда на него переходит только
+// часть ключей остальных шардов, при удалении его ключи распределяются между оставшимися.
+type Ring struct {
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash  uint64
+	shard string
+}
+
+// NewRing возвращает кольцо шардов shards, vnodes - число точек каждого шарда
+func NewRing(shards []string, vnodes int) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	r := &Ring{points: make([]ringPoint, 0, len(shards)*vnodes)}
+	for _, shard := range shards {
+		for i := range vnodes {
+			r.points = append(r.points, ringPoint{hash: hashKey(shard + "#" + strconv.Itoa(i)), shard: shard})
+		}
+	}
+	slices.SortFunc(r.points, func(a, b ringPoint) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+	return r
+}
+
+// Get возвращает шард ключа, пустую строку, если шардов нет
+func (r *Ring) Get(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i, _ := slices.BinarySearchFunc(r.points, h, func(p ringPoint, h uint64) int {
+		return cmp.Compare(p.hash, h)
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].shard
+}
+
+// hashKey возвращает FNV-1a ключа после перемешивания битов: без него у похожих коротких строк,
+// например точек одного шарда, хеши близки и шарды получают неравные части кольца
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
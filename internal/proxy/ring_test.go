@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRing_Get(t *testing.T) {
+	assert.Equal(t, "", NewRing(nil, 0).Get("key"))
+	assert.Equal(t, "s1", NewRing([]string{"s1"}, 0).Get("key"))
+
+	r := NewRing([]string{"s1", "s2", "s3"}, 0)
+	counts := make(map[string]int)
+	for i := range 30000 {
+		key := "key" + strconv.Itoa(i)
+		shard := r.Get(key)
+		assert.Equal(t, shard, r.Get(key))
+		counts[shard]++
+	}
+	// с виртуальными узлами ключи распределяются почти поровну
+	for _, shard := range []string{"s1", "s2", "s3"} {
+		assert.InDelta(t, 10000, counts[shard], 1500, shard)
+	}
+}
+
+func TestRing_AddShard(t *testing.T) {
+	before := NewRing([]string{"s1", "s2", "s3"}, 0)
+	after := NewRing([]string{"s1", "s2", "s3", "s4"}, 0)
+
+	moved := 0
+	for i := range 30000 {
+		key := "key" + strconv.Itoa(i)
+		if shard := after.Get(key); shard != before.Get(key) {
+			// ключи переходят только на новый шард
+			assert.Equal(t, "s4", shard, key)
+			moved++
+		}
+	}
+	assert.InDelta(t, 7500, moved, 1500)
+}
@@ -0,0 +1,254 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"in-memory-db/internal/compute"
+)
+
+// Полусинхронная репликация: после fsync записи в локальный WAL primary ждёт, пока её подтвердят
+// не меньше writeQuorum реплик. Реплика подтверждает записи командой ACK <lsn> в соединении REPLICATE
+// после fsync в своём WAL. Запись применяется к хранилищу до ожидания кворума, поэтому другие клиенты
+// читают её, пока она не подтверждена. Если подтверждений нет дольше quorumTimeout, запись остаётся
+// в локальном WAL и в хранилище, а клиент получает ErrNoQuorum. С degradeToAsync клиент вместо ошибки получает ответ
+// об успехе, и primary перестаёт ждать реплики, пока кворум не подтвердит запись, на которой ожидание прервалось.
+
+var ErrNoQuorum = errors.New("NOQUORUM write is saved locally but not acknowledged by enough replicas")
+
+const defaultQuorumTimeout = time.Second
+
+// WithDatabaseWriteQuorum включает полусинхронную репликацию: запись подтверждается клиенту после того,
+// как её сохранят n реплик. n = 0 - асинхронная репликация.
+func WithDatabaseWriteQuorum(n int, timeout time.Duration, degradeToAsync bool) DatabaseOption {
+	return func(d *Database) {
+		d.replicas.quorum = n
+		d.replicas.timeout = timeout
+		d.replicas.degradeToAsync = degradeToAsync
+	}
+}
+
+// replicaState - состояние реплики на primary
+type replicaState struct {
+	// connections - количество открытых соединений REPLICATE с этим id, их может быть больше одного,
+	// пока primary не заметил обрыв старого соединения
+	connections int
+	ackedLSN    uint64
+	// syncedAt - когда реплика последний раз подтвердила все записи primary
+	syncedAt time.Time
+	// seenAt - когда реплика последний раз подключалась, отключалась или присылала ACK
+	seenAt time.Time
+}
+
+// replicaTracker хранит подтверждённые репликами LSN и ждёт кворума для записей
+type replicaTracker struct {
+	quorum         int
+	timeout        time.Duration
+	degradeToAsync bool
+
+	mu       sync.Mutex
+	replicas map[string]*replicaState
+	// канал закрывается и заменяется при каждом подтверждении
+	acked chan struct{}
+	// LSN записи, на которой ожидание кворума прервалось, 0 - кворум ожидается
+	degradedLSN uint64
+}
+
+func newReplicaTracker() *replicaTracker {
+	return &replicaTracker{
+		replicas: make(map[string]*replicaState),
+		acked:    make(chan struct{}),
+	}
+}
+
+func (t *replicaTracker) connect(id string) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expireLocked()
+	state, ok := t.replicas[id]
+	if !ok {
+		state = &replicaState{}
+		t.replicas[id] = state
+	}
+	state.connections++
+	state.seenAt = time.Now()
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		state.connections--
+		state.seenAt = time.Now()
+	}
+}
+
+// expireLocked забывает реплики без соединений, которые не подключались и не присылали ACK дольше timeout,
+// например выведенные из работы. Подключённая реплика отвечает ACK на каждый HEARTBEAT.
+func (t *replicaTracker) expireLocked() {
+	for id, state := range t.replicas {
+		if state.connections == 0 && time.Since(state.seenAt) > t.timeout {
+			delete(t.replicas, id)
+		}
+	}
+}
+
+// ack запоминает подтверждённый репликой LSN, lastLSN - последний LSN primary
+func (t *replicaTracker) ack(id string, lsn, lastLSN uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.replicas[id]
+	if !ok {
+		return
+	}
+	state.seenAt = time.Now()
+	if lsn >= lastLSN {
+		state.syncedAt = time.Now()
+	}
+	if lsn <= state.ackedLSN {
+		return
+	}
+	state.ackedLSN = lsn
+	close(t.acked)
+	t.acked = make(chan struct{})
+}
+
+// quorumLSNLocked возвращает наибольший LSN, подтверждённый не меньше чем quorum репликами
+func (t *replicaTracker) quorumLSNLocked() uint64 {
+	t.expireLocked()
+	if len(t.replicas) < t.quorum {
+		return 0
+	}
+	lsns := make([]uint64, 0, len(t.replicas))
+	for _, state := range t.replicas {
+		lsns = append(lsns, state.ackedLSN)
+	}
+	slices.Sort(lsns)
+	return lsns[len(lsns)-t.quorum]
+}
+
+// wait ждёт, пока кворум реплик подтвердит запись lsn. Возвращает ErrNoQuorum, если подтверждений
+// нет дольше timeout, и nil, если в режиме degradeToAsync ожидание кворума отключено.
+func (t *replicaTracker) wait(lsn uint64, logger *zap.Logger) error {
+	if t.quorum <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	for {
+		t.mu.Lock()
+		quorumLSN := t.quorumLSNLocked()
+		if t.degradedLSN != 0 {
+			if quorumLSN < t.degradedLSN {
+				t.mu.Unlock()
+				return nil
+			}
+			t.degradedLSN = 0
+			logger.Info("write quorum restored", zap.Uint64("lsn", quorumLSN))
+		}
+		if quorumLSN >= lsn {
+			t.mu.Unlock()
+			return nil
+		}
+		acked := t.acked
+		t.mu.Unlock()
+
+		select {
+		case <-acked:
+		case <-timer.C:
+			if !t.degradeToAsync {
+				return ErrNoQuorum
+			}
+			t.mu.Lock()
+			if t.degradedLSN == 0 {
+				t.degradedLSN = lsn
+				logger.Warn("write quorum is not reached, replication is asynchronous until replicas catch up",
+					zap.Uint64("lsn", lsn), zap.Int("quorum", t.quorum))
+			}
+			t.mu.Unlock()
+			return nil
+		}
+	}
+}
+
+// lags возвращает отставание реплик от lastLSN
+func (t *replicaTracker) lags(lastLSN uint64) map[string]replicaLag {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expireLocked()
+	lags := make(map[string]replicaLag, len(t.replicas))
+	for id, state := range t.replicas {
+		lag := replicaLag{
+			Connected: state.connections > 0,
+			AckedLSN:  state.ackedLSN,
+			Lag:       lastLSN - min(lastLSN, state.ackedLSN),
+		}
+		lag.LagMs = durationMs(time.Since(state.syncedAt), !state.syncedAt.IsZero())
+		if lag.Lag == 0 {
+			lag.LagMs = 0
+		}
+		lags[id] = lag
+	}
+	return lags
+}
+
+// info возвращает поля INFO о репликах, по реплике на строку в порядке id
+func (t *replicaTracker) info(lastLSN uint64) []infoField {
+	lags := t.lags(lastLSN)
+	ids := make([]string, 0, len(lags))
+	connected := 0
+	for id, lag := range lags {
+		ids = append(ids, id)
+		if lag.Connected {
+			connected++
+		}
+	}
+	slices.Sort(ids)
+
+	t.mu.Lock()
+	fields := []infoField{
+		{"write_quorum", t.quorum},
+		{"quorum_degraded", boolToInt(t.degradedLSN != 0)},
+		{"connected_replicas", connected},
+	}
+	t.mu.Unlock()
+	for _, id := range ids {
+		lag := lags[id]
+		fields = append(fields, infoField{
+			"replica_" + id,
+			fmt.Sprintf("connected=%d,acked_lsn=%d,lag=%d,lag_ms=%d", boolToInt(lag.Connected), lag.AckedLSN, lag.Lag, lag.LagMs),
+		})
+	}
+	return fields
+}
+
+// TrackReplica отмечает реплику подключённой, возвращённая функция отмечает её отключение
+func (d *Database) TrackReplica(replicaID string) func() {
+	return d.replicas.connect(replicaID)
+}
+
+// AckReplica разбирает подтверждение ACK <lsn>, полученное от реплики в потоке REPLICATE
+func (d *Database) AckReplica(replicaID, q string) error {
+	query, err := d.parser.Parse(q)
+	if err != nil {
+		return err
+	}
+	if query.Command() != compute.AckCommand {
+		return fmt.Errorf("%w: expected %s", compute.ErrUnknownCommand, compute.AckCommand)
+	}
+	lsn, err := strconv.ParseUint(query.Args()[0], 10, 64)
+	if err != nil {
+		return ErrWrongLSN
+	}
+
+	d.replicas.ack(replicaID, lsn, d.wal.LastLSN())
+	return nil
+}
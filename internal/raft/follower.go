@@ -0,0 +1,217 @@
+package raft
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+
+	"in-memory-db/internal/storage/wal"
+)
+
+// RequestVote отвечает кандидату. Голос отдаётся один раз за терм и только кандидату,
+// лог которого не отстаёт от лога узла.
+func (n *Node) RequestVote(_ context.Context, req VoteRequest) (VoteResponse, error) {
+	if !n.started() {
+		return VoteResponse{}, ErrNotReady
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// пока лидер на связи, выборы не нужны: так узел, удалённый из кластера, не сменит лидера
+	if req.Term > n.st.Term && (n.state == StateLeader || time.Since(n.lastContact) < n.electionTimeout) {
+		return VoteResponse{Term: n.st.Term}, nil
+	}
+	if req.Term > n.st.Term {
+		n.becomeFollowerLocked(req.Term)
+	}
+	resp := VoteResponse{Term: n.st.Term}
+	if req.Term < n.st.Term {
+		return resp, nil
+	}
+
+	lastTerm := n.termAtLocked(n.lastIndex)
+	upToDate := req.LastLogTerm > lastTerm || (req.LastLogTerm == lastTerm && req.LastLogIndex >= n.lastIndex)
+	if !upToDate || (n.st.VotedFor != "" && n.st.VotedFor != req.CandidateID) {
+		return resp, nil
+	}
+
+	n.st.VotedFor = req.CandidateID
+	if err := n.saveLocked(); err != nil {
+		n.st.VotedFor = ""
+		return resp, err
+	}
+	n.resetDeadlineLocked()
+	resp.Granted = true
+	return resp, nil
+}
+
+// followLocked принимает лидера терма term
+func (n *Node) followLocked(term uint64, leaderID string) {
+	n.becomeFollowerLocked(term)
+	if n.leaderID != leaderID {
+		n.logger.Info("raft leader changed", zap.String("leader", leaderID), zap.Uint64("term", term))
+	}
+	n.leaderID = leaderID
+	n.lastContact = time.Now()
+	n.resetDeadlineLocked()
+}
+
+// AppendEntries добавляет в лог записи лидера. Если лог расходится с логом лидера,
+// удаляются записи начиная с первой расходящейся, совпадающие с лидером записи остаются.
+func (n *Node) AppendEntries(_ context.Context, req AppendRequest) (AppendResponse, error) {
+	if !n.started() {
+		return AppendResponse{}, ErrNotReady
+	}
+
+	n.logMu.Lock()
+	defer n.logMu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	resp := AppendResponse{Term: n.st.Term}
+	if req.Term < n.st.Term {
+		return resp, nil
+	}
+	n.followLocked(req.Term, req.LeaderID)
+	resp.Term = n.st.Term
+
+	// закоммиченные записи совпадают с записями лидера
+	commit := n.commit.Load()
+	if req.PrevLogIndex > n.lastIndex {
+		resp.ConflictIndex = n.lastIndex + 1
+		return resp, nil
+	}
+	if req.PrevLogIndex > commit && n.termAtLocked(req.PrevLogIndex) != req.PrevLogTerm {
+		// лидер пропускает весь терм, в котором разошлись логи
+		resp.ConflictIndex = max(n.termStartLocked(req.PrevLogIndex), commit+1)
+		return resp, nil
+	}
+
+	entries := req.Entries
+	for len(entries) > 0 && entries[0].Record.LSN <= n.lastIndex {
+		index := entries[0].Record.LSN
+		if index <= commit || n.termAtLocked(index) == entries[0].Term {
+			entries = entries[1:]
+			continue
+		}
+
+		// записи до index совпадают с лидером: узел мог уже подтвердить их, и лидер учитывает их при коммите
+		if err := n.truncateLocked(index); err != nil {
+			return resp, err
+		}
+	}
+	if len(entries) > 0 {
+		if err := n.appendEntriesLocked(entries); err != nil {
+			return resp, err
+		}
+	}
+
+	last := req.PrevLogIndex + uint64(len(req.Entries))
+	if index := min(req.LeaderCommit, last); index > commit {
+		n.setCommit(index)
+	}
+	if req.LeaderCommit <= last {
+		n.syncedAt, n.syncedIndex = time.Now(), req.LeaderCommit
+	}
+	resp.Success = true
+	resp.MatchIndex = last
+	return resp, nil
+}
+
+// truncateLocked удаляет из лога незакоммиченные записи начиная с index. Термы и составы сохраняются
+// после удаления записей из WAL: при старте лишние термы отбрасываются по последнему LSN.
+func (n *Node) truncateLocked(index uint64) error {
+	n.gen.Add(1)
+	if err := n.db.TruncateLog(index - 1); err != nil {
+		return err
+	}
+	n.logger.Warn("uncommitted raft entries are removed", zap.Uint64("from_index", index), zap.Uint64("to_index", n.lastIndex))
+	n.lastIndex = index - 1
+	n.dropAfterLocked(index - 1)
+	return n.saveLocked()
+}
+
+// appendEntriesLocked добавляет записи в конец лога, термы и составы сохраняются до записи в WAL
+func (n *Node) appendEntriesLocked(entries []Entry) error {
+	n.dropAfterLocked(n.lastIndex)
+	records := make([]wal.Record, len(entries))
+	lastTerm := n.termAtLocked(n.lastIndex)
+	changed := false
+	for i, e := range entries {
+		records[i] = e.Record
+		if e.Term != lastTerm {
+			n.st.Terms = append(n.st.Terms, termStart{Term: e.Term, Index: e.Record.LSN})
+			lastTerm = e.Term
+			changed = true
+		}
+		if kind, arg := parseEntry(e.Record.Query); kind == entryConfig {
+			members, err := ParseMembers(arg)
+			if err != nil {
+				return err
+			}
+			n.st.Configs = append(n.st.Configs, memberConfig{Index: e.Record.LSN, Members: members})
+			changed = true
+		}
+	}
+	if changed {
+		if err := n.saveLocked(); err != nil {
+			return err
+		}
+	}
+
+	if err := n.db.AppendLog(records); err != nil {
+		return err
+	}
+	n.lastIndex = records[len(records)-1].LSN
+	return nil
+}
+
+// InstallSnapshot заменяет данные и лог узла состоянием лидера
+func (n *Node) InstallSnapshot(ctx context.Context, req SnapshotRequest) (AppendResponse, error) {
+	if !n.started() {
+		return AppendResponse{}, ErrNotReady
+	}
+
+	n.logMu.Lock()
+	defer n.logMu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	resp := AppendResponse{Term: n.st.Term}
+	if req.Term < n.st.Term {
+		return resp, nil
+	}
+	n.followLocked(req.Term, req.LeaderID)
+	resp.Term = n.st.Term
+
+	commit := n.commit.Load()
+	if req.LastIndex <= commit {
+		resp.Success = true
+		resp.MatchIndex = req.LastIndex
+		return resp, nil
+	}
+	if err := n.db.WaitApplied(ctx, commit); err != nil {
+		return resp, err
+	}
+
+	n.gen.Add(1)
+	if err := n.db.InstallState(req.LastIndex, req.Keys, req.Vals); err != nil {
+		return resp, err
+	}
+	n.lastIndex = req.LastIndex
+	n.st.Terms = []termStart{{Term: req.LastTerm, Index: req.LastIndex}}
+	n.st.Configs = []memberConfig{{Index: req.LastIndex, Members: slices.Clone(req.Members)}}
+	if err := n.saveLocked(); err != nil {
+		return resp, err
+	}
+	n.setCommit(req.LastIndex)
+	n.syncedAt, n.syncedIndex = time.Now(), req.LastIndex
+	n.logger.Info("raft snapshot installed", zap.Uint64("index", req.LastIndex), zap.Int("keys", len(req.Keys)))
+
+	resp.Success = true
+	resp.MatchIndex = req.LastIndex
+	return resp, nil
+}
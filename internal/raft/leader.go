@@ -0,0 +1,528 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"in-memory-db/internal/compute"
+	"in-memory-db/internal/storage/wal"
+)
+
+// proposal - запрос, ожидающий добавления в лог лидера
+type proposal struct {
+	query string
+	// index и term назначаются при добавлении в лог
+	index uint64
+	term  uint64
+	done  chan error
+}
+
+// peer - узел, которому лидер передаёт записи
+type peer struct {
+	id      string
+	address string
+	// next - следующая запись для узла, match - последняя запись, совпадающая с логом лидера
+	next   uint64
+	match  uint64
+	wake   chan struct{}
+	cancel context.CancelFunc
+}
+
+// Submit добавляет запрос в лог через лидера и ждёт, пока запись будет применена на этом узле.
+// Узел, который не является лидером, передаёт запрос лидеру.
+func (n *Node) Submit(ctx context.Context, query string) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, n.submitTimeout)
+	defer cancel()
+
+	index, err := n.submit(ctx, query)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return 0, ErrTimeout
+	}
+	return index, err
+}
+
+func (n *Node) submit(ctx context.Context, query string) (uint64, error) {
+	select {
+	case <-n.ready:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	n.mu.Lock()
+	leader := n.state == StateLeader
+	address := n.memberAddressLocked(n.leaderID)
+	n.mu.Unlock()
+	if leader {
+		return n.submitLocal(ctx, query)
+	}
+	if address == "" {
+		return 0, ErrNoLeader
+	}
+
+	resp, err := n.transport.Forward(ctx, address, ForwardRequest{Query: query})
+	if err != nil {
+		return 0, fmt.Errorf("forward to raft leader: %w", err)
+	}
+	if resp.Error != "" {
+		return 0, errors.New(resp.Error)
+	}
+	// ответ возвращается, когда запись применена и на этом узле, поэтому клиент видит свою запись
+	return resp.Index, n.db.WaitApplied(ctx, resp.Index)
+}
+
+// Forward выполняет запрос, который другой узел передал лидеру
+func (n *Node) Forward(ctx context.Context, req ForwardRequest) (ForwardResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, n.submitTimeout)
+	defer cancel()
+
+	index, err := n.submitLocal(ctx, req.Query)
+	if err != nil {
+		return ForwardResponse{Error: err.Error()}, nil
+	}
+	return ForwardResponse{Index: index}, nil
+}
+
+// submitLocal добавляет запрос в лог лидера и ждёт, пока запись будет закоммичена и применена
+func (n *Node) submitLocal(ctx context.Context, query string) (uint64, error) {
+	if !n.started() {
+		return 0, ErrNotReady
+	}
+
+	n.mu.Lock()
+	if n.state != StateLeader {
+		n.mu.Unlock()
+		return 0, ErrNotLeader
+	}
+	query, config, err := n.prepareLocked(query)
+	if err != nil {
+		n.mu.Unlock()
+		return 0, err
+	}
+	p := &proposal{query: query}
+	n.proposeLocked(p)
+	n.configPending = n.configPending || config
+	n.mu.Unlock()
+
+	select {
+	case err := <-p.done:
+		if err != nil {
+			return 0, err
+		}
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	if err := n.db.WaitApplied(ctx, p.index); err != nil {
+		return 0, err
+	}
+	if n.termAt(p.index) != p.term {
+		return 0, ErrLeadershipLost
+	}
+	return p.index, nil
+}
+
+// prepareLocked заменяет RAFT ADD и RAFT REMOVE записью с новым составом кластера
+func (n *Node) prepareLocked(query string) (string, bool, error) {
+	fields := strings.Fields(query)
+	if len(fields) == 0 || !strings.EqualFold(fields[0], string(compute.RaftCommand)) {
+		return query, false, nil
+	}
+
+	// новый состав принимается, когда предыдущий закоммичен, а лидер закоммитил запись своего терма
+	commit := n.commit.Load()
+	latest := n.configAtLocked(n.lastIndex)
+	if n.configPending || latest.Index > commit || n.termStartIndex == 0 || n.termStartIndex > commit {
+		return "", false, ErrMembershipChange
+	}
+
+	members := slices.Clone(latest.Members)
+	switch {
+	case len(fields) == 4 && strings.EqualFold(fields[1], addMember):
+		m := Member{ID: fields[2], Address: fields[3]}
+		if !validMember(m) || slices.ContainsFunc(members, func(o Member) bool { return o.ID == m.ID }) {
+			return "", false, fmt.Errorf("%w: %s", ErrWrongMember, m.ID)
+		}
+		members = append(members, m)
+	case len(fields) == 3 && strings.EqualFold(fields[1], removeMember):
+		i := slices.IndexFunc(members, func(o Member) bool { return o.ID == fields[2] })
+		if i < 0 {
+			return "", false, fmt.Errorf("%w: %s", ErrUnknownMember, fields[2])
+		}
+		members = slices.Delete(members, i, i+1)
+		if len(members) == 0 {
+			return "", false, fmt.Errorf("%w: cluster cannot be empty", ErrWrongMember)
+		}
+	default:
+		return "", false, ErrWrongRaftCommand
+	}
+
+	return fmt.Sprintf("%s %s %s", compute.RaftCommand, entryConfig, formatMembers(members)), true, nil
+}
+
+func (n *Node) proposeLocked(p *proposal) {
+	p.done = make(chan error, 1)
+	n.pending = append(n.pending, p)
+	select {
+	case n.appendSignal <- struct{}{}:
+	default:
+	}
+}
+
+// runAppender добавляет в лог запросы, накопленные лидером, одной записью в WAL
+func (n *Node) runAppender(ctx context.Context, term uint64, signal <-chan struct{}) {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signal:
+			n.appendPending(term)
+		}
+	}
+}
+
+func (n *Node) appendPending(term uint64) {
+	n.logMu.Lock()
+	defer n.logMu.Unlock()
+
+	n.mu.Lock()
+	if n.state != StateLeader || n.st.Term != term || len(n.pending) == 0 {
+		n.mu.Unlock()
+		return
+	}
+	batch := n.pending
+	n.pending = nil
+
+	now := time.Now()
+	records := make([]wal.Record, len(batch))
+	saved := n.st
+	changed, configChanged := false, false
+	for i, p := range batch {
+		p.index, p.term = n.lastIndex+uint64(i)+1, term
+		records[i] = wal.NewRecord(p.index, now, p.query)
+
+		if n.termAtLocked(p.index) != term {
+			n.st.Terms = append(slices.Clone(n.st.Terms), termStart{Term: term, Index: p.index})
+			n.termStartIndex = p.index
+			changed = true
+		}
+		if kind, arg := parseEntry(p.query); kind == entryConfig {
+			members, err := ParseMembers(arg)
+			if err != nil {
+				n.logger.Error("wrong raft config entry", zap.String("query", p.query), zap.Error(err))
+				continue
+			}
+			n.st.Configs = append(slices.Clone(n.st.Configs), memberConfig{Index: p.index, Members: members})
+			n.configPending = false
+			changed, configChanged = true, true
+		}
+	}
+	if changed {
+		if err := n.saveLocked(); err != nil {
+			n.st = saved
+			n.mu.Unlock()
+			n.logger.Error("save raft state", zap.Error(err))
+			for _, p := range batch {
+				p.done <- err
+			}
+			return
+		}
+	}
+	if configChanged {
+		n.syncPeersLocked()
+	}
+	n.mu.Unlock()
+
+	err := n.db.AppendLog(records)
+
+	n.mu.Lock()
+	if err == nil {
+		n.lastIndex = records[len(records)-1].LSN
+		if n.state == StateLeader && n.st.Term == term {
+			n.advanceCommitLocked()
+		}
+	} else {
+		n.logger.Error("append raft entries", zap.Error(err))
+		n.becomeFollowerLocked(n.st.Term)
+	}
+	n.mu.Unlock()
+
+	for _, p := range batch {
+		p.done <- err
+	}
+}
+
+// syncPeersLocked запускает передачу записей узлам действующего состава и останавливает для удалённых
+func (n *Node) syncPeersLocked() {
+	members := n.membersLocked()
+	for id, p := range n.peers {
+		if !slices.ContainsFunc(members, func(m Member) bool { return m.ID == id }) {
+			p.cancel()
+			delete(n.peers, id)
+		}
+	}
+	for _, m := range members {
+		if m.ID == n.id {
+			continue
+		}
+		if p, ok := n.peers[m.ID]; ok && p.address == m.Address {
+			continue
+		} else if ok {
+			p.cancel()
+		}
+
+		ctx, cancel := context.WithCancel(n.leaderCtx)
+		p := &peer{
+			id:      m.ID,
+			address: m.Address,
+			next:    n.lastIndex + 1,
+			wake:    make(chan struct{}, 1),
+			cancel:  cancel,
+		}
+		n.peers[m.ID] = p
+		n.wg.Add(1)
+		go n.replicate(ctx, n.st.Term, p)
+	}
+}
+
+// advanceCommitLocked коммитит записи, сохранённые большинством узлов. Записи прежних термов
+// коммитятся только вместе с записью текущего терма.
+func (n *Node) advanceCommitLocked() {
+	members := n.membersLocked()
+	if len(members) == 0 {
+		return
+	}
+	matches := make([]uint64, 0, len(members))
+	for _, m := range members {
+		if m.ID == n.id {
+			matches = append(matches, n.lastIndex)
+		} else if p, ok := n.peers[m.ID]; ok {
+			matches = append(matches, p.match)
+		} else {
+			matches = append(matches, 0)
+		}
+	}
+	slices.Sort(matches)
+	index := matches[len(matches)-quorum(members)]
+	if index <= n.commit.Load() || n.termAtLocked(index) != n.st.Term {
+		return
+	}
+
+	n.setCommit(index)
+	for _, p := range n.peers {
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	// лидер, удалённый из кластера, уходит, когда новый состав закоммичен
+	if !n.isMemberLocked() && n.configAtLocked(n.lastIndex).Index <= index {
+		n.logger.Info("raft leader is removed from the cluster")
+		n.becomeFollowerLocked(n.st.Term)
+		n.leaderID = ""
+	}
+}
+
+// replicate передаёт записи лога узлу p, пока узел остаётся лидером терма term
+func (n *Node) replicate(ctx context.Context, term uint64, p *peer) {
+	defer n.wg.Done()
+
+	var tailer *wal.Tailer
+	var tailNext uint64
+	closeTailer := func() {
+		if tailer != nil {
+			tailer.Close()
+			tailer = nil
+		}
+	}
+	defer closeTailer()
+
+	for ctx.Err() == nil {
+		n.mu.Lock()
+		next := p.next
+		n.mu.Unlock()
+		if tailer == nil || tailNext != next {
+			closeTailer()
+			tailer, tailNext = n.db.TailLog(next), next
+		}
+
+		records, err := n.readRecords(ctx, tailer, p.wake)
+		if errors.Is(err, wal.ErrLSNNotAvailable) {
+			// записей, нужных узлу, уже нет в WAL
+			closeTailer()
+			if err := n.sendSnapshot(ctx, term, p); err != nil {
+				n.logger.Debug("send raft snapshot", zap.String("member", p.id), zap.Error(err))
+				if !n.pause(ctx) {
+					return
+				}
+			}
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			n.logger.Error("read raft entries", zap.String("member", p.id), zap.Error(err))
+			closeTailer()
+			if !n.pause(ctx) {
+				return
+			}
+			continue
+		}
+
+		req, ok := n.appendRequest(term, next, records)
+		if !ok {
+			return
+		}
+		rpcCtx, cancel := context.WithTimeout(ctx, n.electionTimeout)
+		resp, err := n.transport.AppendEntries(rpcCtx, p.address, req)
+		cancel()
+		if err != nil {
+			n.logger.Debug("append raft entries", zap.String("member", p.id), zap.Error(err))
+			// записи будут отправлены заново
+			closeTailer()
+			if !n.pause(ctx) {
+				return
+			}
+			continue
+		}
+		tailNext = next + uint64(len(records))
+		if !n.handleAppendResponse(term, p, resp) {
+			return
+		}
+	}
+}
+
+// readRecords ждёт новых записей не дольше интервала heartbeat или до коммита новых записей
+// и возвращает все уже доступные, но не больше maxEntries
+func (n *Node) readRecords(ctx context.Context, tailer *wal.Tailer, wake <-chan struct{}) ([]wal.Record, error) {
+	waitCtx, cancel := context.WithTimeout(ctx, n.heartbeatInterval)
+	defer cancel()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-wake:
+			cancel()
+		case <-stop:
+		}
+	}()
+
+	r, err := tailer.Next(waitCtx)
+	if err != nil {
+		if waitCtx.Err() != nil && ctx.Err() == nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	records := []wal.Record{r}
+	available, stopAvailable := context.WithCancel(ctx)
+	stopAvailable()
+	for len(records) < n.maxEntries {
+		r, err := tailer.Next(available)
+		if err != nil {
+			break
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+func (n *Node) appendRequest(term, next uint64, records []wal.Record) (AppendRequest, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state != StateLeader || n.st.Term != term {
+		return AppendRequest{}, false
+	}
+
+	entries := make([]Entry, len(records))
+	for i, r := range records {
+		entries[i] = Entry{Term: n.termAtLocked(r.LSN), Record: r}
+	}
+	return AppendRequest{
+		Term:         term,
+		LeaderID:     n.id,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  n.termAtLocked(next - 1),
+		Entries:      entries,
+		LeaderCommit: n.commit.Load(),
+	}, true
+}
+
+// handleAppendResponse учитывает ответ узла, возвращает false, если узел больше не лидер терма term
+func (n *Node) handleAppendResponse(term uint64, p *peer, resp AppendResponse) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if resp.Term > n.st.Term {
+		n.becomeFollowerLocked(resp.Term)
+		return false
+	}
+	if n.state != StateLeader || n.st.Term != term {
+		return false
+	}
+
+	if resp.Success {
+		p.next = resp.MatchIndex + 1
+		if resp.MatchIndex > p.match {
+			p.match = resp.MatchIndex
+			n.advanceCommitLocked()
+		}
+		return true
+	}
+
+	next := resp.ConflictIndex
+	if next == 0 || next >= p.next {
+		next = p.next - 1
+	}
+	p.next = max(next, 1)
+	return true
+}
+
+// sendSnapshot передаёт узлу применённое состояние лидера
+func (n *Node) sendSnapshot(ctx context.Context, term uint64, p *peer) error {
+	lsn, keys, vals := n.db.State()
+
+	n.mu.Lock()
+	if n.state != StateLeader || n.st.Term != term {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	req := SnapshotRequest{
+		Term:      term,
+		LeaderID:  n.id,
+		LastIndex: lsn,
+		LastTerm:  n.termAtLocked(lsn),
+		Members:   n.configAtLocked(lsn).Members,
+		Keys:      keys,
+		Vals:      vals,
+	}
+	n.mu.Unlock()
+
+	n.logger.Info("send raft snapshot", zap.String("member", p.id), zap.Uint64("index", lsn))
+	rpcCtx, cancel := context.WithTimeout(ctx, 10*n.electionTimeout)
+	defer cancel()
+	resp, err := n.transport.InstallSnapshot(rpcCtx, p.address, req)
+	if err != nil {
+		return err
+	}
+	n.handleAppendResponse(term, p, resp)
+	return nil
+}
+
+// parseEntry возвращает вид служебной записи RAFT и её аргумент
+func parseEntry(query string) (string, string) {
+	fields := strings.Fields(query)
+	if len(fields) != 3 || fields[0] != string(compute.RaftCommand) {
+		return "", ""
+	}
+	return fields[1], fields[2]
+}
@@ -0,0 +1,648 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"in-memory-db/internal"
+	"in-memory-db/internal/compute"
+	"in-memory-db/internal/storage/wal"
+)
+
+// Raft поверх WAL базы: индекс записи в логе Raft - её LSN. Терм записи в WAL не хранится: терм меняется
+// только при выборах, поэтому в файле состояния узла хранится, с какой записи начинается каждый терм,
+// вместе с текущим термом, голосом и составом кластера. Кроме запросов клиентов в лог пишутся служебные записи:
+//   RAFT TERM <терм>                - первая запись лидера в его терме, после её коммита закоммичены
+//                                     и записи прежних термов
+//   RAFT CONFIG <id>=<адрес>,...    - новый состав кластера, действует с момента добавления в лог
+// Состав меняется по одному узлу: следующее изменение принимается после коммита предыдущего.
+
+var (
+	ErrNoLeader         = errors.New("NOLEADER raft cluster has no leader")
+	ErrNotLeader        = errors.New("NOTLEADER node is not the raft leader")
+	ErrLeadershipLost   = errors.New("LEADERSHIPLOST entry was replaced by a new raft leader")
+	ErrTimeout          = errors.New("TIMEOUT raft entry was not applied in time")
+	ErrNotReady         = errors.New("raft node is not started")
+	ErrMembershipChange = errors.New("raft membership change is in progress")
+	ErrWrongMember      = errors.New("wrong raft member")
+	ErrUnknownMember    = errors.New("unknown raft member")
+	ErrWrongRaftCommand = errors.New("wrong RAFT command")
+)
+
+// State - состояние узла Raft
+type State string
+
+const (
+	StateFollower  State = "follower"
+	StateCandidate State = "candidate"
+	StateLeader    State = "leader"
+)
+
+const (
+	entryTerm    = "TERM"
+	entryConfig  = "CONFIG"
+	addMember    = "ADD"
+	removeMember = "REMOVE"
+
+	defaultElectionTimeout   = time.Second
+	defaultHeartbeatInterval = 100 * time.Millisecond
+	defaultSubmitTimeout     = 5 * time.Second
+	defaultMaxEntries        = 512
+)
+
+// Member - узел кластера, Address - адрес транспорта Raft
+type Member struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+}
+
+// termStart - терм записей лога, начиная с Index
+type termStart struct {
+	Term  uint64 `json:"term"`
+	Index uint64 `json:"index"`
+}
+
+// memberConfig - состав кластера, добавленный в лог записью Index
+type memberConfig struct {
+	Index   uint64   `json:"index"`
+	Members []Member `json:"members"`
+}
+
+// persistentState - состояние, которое узел сохраняет до ответа на запросы
+type persistentState struct {
+	Term     uint64         `json:"term"`
+	VotedFor string         `json:"voted_for,omitempty"`
+	Terms    []termStart    `json:"terms"`
+	Configs  []memberConfig `json:"configs"`
+}
+
+type Node struct {
+	id        string
+	statePath string
+	transport Transport
+	logger    *zap.Logger
+	bootstrap []Member
+
+	electionTimeout   time.Duration
+	heartbeatInterval time.Duration
+	submitTimeout     time.Duration
+	maxEntries        int
+
+	db    *internal.Database
+	ready chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+
+	// logMu упорядочивает запись в лог, mu защищает остальное состояние узла
+	logMu       sync.Mutex
+	mu          sync.Mutex
+	st          persistentState
+	state       State
+	leaderID    string
+	lastIndex   uint64
+	lastContact time.Time
+	deadline    time.Time
+	// syncedAt - когда лидер последний раз сообщил коммит syncedIndex, все записи до которого есть у узла
+	syncedAt    time.Time
+	syncedIndex uint64
+
+	commit   atomic.Uint64
+	commitMu sync.Mutex
+	commitCh chan struct{}
+	// gen меняется, когда из лога удаляются записи
+	gen atomic.Uint64
+
+	// состояние лидера
+	leaderCancel   context.CancelFunc
+	leaderCtx      context.Context
+	peers          map[string]*peer
+	pending        []*proposal
+	appendSignal   chan struct{}
+	termStartIndex uint64
+	configPending  bool
+}
+
+type NodeOption func(*Node)
+
+// WithNodeBootstrap задаёт начальный состав кластера, если узел запускается впервые.
+// Узел без состава не начинает выборы и ждёт, пока лидер добавит его командой RAFT ADD.
+func WithNodeBootstrap(members []Member) NodeOption {
+	return func(n *Node) {
+		n.bootstrap = members
+	}
+}
+
+// WithNodeElectionTimeout задаёт, сколько узел ждёт лидера до начала выборов: от timeout до 2*timeout
+func WithNodeElectionTimeout(timeout time.Duration) NodeOption {
+	return func(n *Node) {
+		n.electionTimeout = timeout
+	}
+}
+
+// WithNodeHeartbeatInterval задаёт, как часто лидер отправляет AppendEntries без записей
+func WithNodeHeartbeatInterval(interval time.Duration) NodeOption {
+	return func(n *Node) {
+		n.heartbeatInterval = interval
+	}
+}
+
+// WithNodeSubmitTimeout задаёт, сколько запрос на запись ждёт применения
+func WithNodeSubmitTimeout(timeout time.Duration) NodeOption {
+	return func(n *Node) {
+		n.submitTimeout = timeout
+	}
+}
+
+// NewNode возвращает узел с идентификатором id, состояние узла хранится в файле statePath
+func NewNode(id, statePath string, transport Transport, logger *zap.Logger, options ...NodeOption) *Node {
+	n := &Node{
+		id:        id,
+		statePath: statePath,
+		transport: transport,
+		logger:    logger.With(zap.String("raft_id", id)),
+		ready:     make(chan struct{}),
+		done:      make(chan struct{}),
+		state:     StateFollower,
+		commitCh:  make(chan struct{}),
+	}
+
+	for _, o := range options {
+		o(n)
+	}
+
+	if n.electionTimeout <= 0 {
+		n.electionTimeout = defaultElectionTimeout
+	}
+	if n.heartbeatInterval <= 0 {
+		n.heartbeatInterval = defaultHeartbeatInterval
+	}
+	if n.submitTimeout <= 0 {
+		n.submitTimeout = defaultSubmitTimeout
+	}
+	if n.maxEntries <= 0 {
+		n.maxEntries = defaultMaxEntries
+	}
+
+	return n
+}
+
+// Run ведёт лог базы, пока не завершится ctx
+func (n *Node) Run(ctx context.Context, db *internal.Database) {
+	defer close(n.done)
+
+	if err := n.start(db); err != nil {
+		n.logger.Error("start raft node", zap.Error(err))
+		return
+	}
+
+	n.wg.Add(1)
+	go n.runApplier(ctx)
+
+	ticker := time.NewTicker(max(n.electionTimeout/10, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			n.mu.Lock()
+			n.stopLeadingLocked()
+			n.mu.Unlock()
+			n.wg.Wait()
+			return
+		case <-ticker.C:
+			n.tick(ctx)
+		}
+	}
+}
+
+// Wait ждёт, пока Run завершится
+func (n *Node) Wait() {
+	<-n.done
+}
+
+func (n *Node) start(db *internal.Database) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.db = db
+	data, err := os.ReadFile(n.statePath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if len(n.bootstrap) > 0 {
+			n.st.Configs = []memberConfig{{Members: n.bootstrap}}
+		}
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(data, &n.st); err != nil {
+			return fmt.Errorf("read %s: %w", n.statePath, err)
+		}
+	}
+
+	// термы и состав могли быть сохранены для записей, которые не успели попасть в WAL
+	n.lastIndex = db.LastLSN()
+	n.dropAfterLocked(n.lastIndex)
+	n.commit.Store(db.Applied())
+	n.resetDeadlineLocked()
+	close(n.ready)
+
+	n.logger.Info("raft node started",
+		zap.Uint64("term", n.st.Term),
+		zap.Uint64("last_index", n.lastIndex),
+		zap.Uint64("applied_index", db.Applied()),
+	)
+	return nil
+}
+
+func (n *Node) started() bool {
+	select {
+	case <-n.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// tick начинает выборы, если узел слишком долго не получал записей от лидера
+func (n *Node) tick(ctx context.Context) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.state == StateLeader || !n.isMemberLocked() || time.Now().Before(n.deadline) {
+		return
+	}
+	n.startElectionLocked(ctx)
+}
+
+func (n *Node) resetDeadlineLocked() {
+	n.deadline = time.Now().Add(n.electionTimeout + rand.N(n.electionTimeout))
+}
+
+func (n *Node) startElectionLocked(ctx context.Context) {
+	n.st.Term++
+	n.st.VotedFor = n.id
+	if err := n.saveLocked(); err != nil {
+		n.logger.Error("save raft state", zap.Error(err))
+		return
+	}
+	n.state = StateCandidate
+	n.leaderID = ""
+	n.resetDeadlineLocked()
+
+	term := n.st.Term
+	members := n.membersLocked()
+	req := VoteRequest{
+		Term:         term,
+		CandidateID:  n.id,
+		LastLogIndex: n.lastIndex,
+		LastLogTerm:  n.termAtLocked(n.lastIndex),
+	}
+	n.logger.Info("raft election started", zap.Uint64("term", term))
+
+	votes := 1
+	if votes >= quorum(members) {
+		n.becomeLeaderLocked(ctx)
+		return
+	}
+	for _, m := range members {
+		if m.ID == n.id {
+			continue
+		}
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			rpcCtx, cancel := context.WithTimeout(ctx, n.electionTimeout)
+			defer cancel()
+			resp, err := n.transport.RequestVote(rpcCtx, m.Address, req)
+			if err != nil {
+				n.logger.Debug("request vote", zap.String("member", m.ID), zap.Error(err))
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.st.Term {
+				n.becomeFollowerLocked(resp.Term)
+				return
+			}
+			if !resp.Granted || n.state != StateCandidate || n.st.Term != term {
+				return
+			}
+			votes++
+			if votes >= quorum(members) {
+				n.becomeLeaderLocked(ctx)
+			}
+		}()
+	}
+}
+
+// becomeFollowerLocked переводит узел в терм term, если он больше текущего, и делает его последователем
+func (n *Node) becomeFollowerLocked(term uint64) {
+	if term > n.st.Term {
+		n.st.Term = term
+		n.st.VotedFor = ""
+		if err := n.saveLocked(); err != nil {
+			n.logger.Error("save raft state", zap.Error(err))
+		}
+		n.leaderID = ""
+	}
+	if n.state == StateLeader {
+		n.logger.Info("raft leadership lost", zap.Uint64("term", n.st.Term))
+		n.stopLeadingLocked()
+	}
+	n.state = StateFollower
+}
+
+func (n *Node) becomeLeaderLocked(ctx context.Context) {
+	if ctx.Err() != nil {
+		return
+	}
+	n.state = StateLeader
+	n.leaderID = n.id
+	n.leaderCtx, n.leaderCancel = context.WithCancel(ctx)
+	n.peers = make(map[string]*peer)
+	n.appendSignal = make(chan struct{}, 1)
+	n.termStartIndex = 0
+	n.configPending = false
+	n.syncPeersLocked()
+
+	n.wg.Add(1)
+	go n.runAppender(n.leaderCtx, n.st.Term, n.appendSignal)
+	// записи прежних термов коммитятся вместе с первой записью нового
+	n.proposeLocked(&proposal{query: fmt.Sprintf("%s %s %d", compute.RaftCommand, entryTerm, n.st.Term)})
+
+	n.logger.Info("raft leader elected", zap.Uint64("term", n.st.Term), zap.Uint64("last_index", n.lastIndex))
+}
+
+func (n *Node) stopLeadingLocked() {
+	if n.leaderCancel != nil {
+		n.leaderCancel()
+		n.leaderCancel = nil
+	}
+	n.peers = nil
+	for _, p := range n.pending {
+		p.done <- ErrNotLeader
+	}
+	n.pending = nil
+	n.configPending = false
+}
+
+// termAtLocked возвращает терм записи index, 0 - если терм неизвестен
+func (n *Node) termAtLocked(index uint64) uint64 {
+	for i := len(n.st.Terms) - 1; i >= 0; i-- {
+		if n.st.Terms[i].Index <= index {
+			return n.st.Terms[i].Term
+		}
+	}
+	return 0
+}
+
+// termStartLocked возвращает первую запись терма, в который входит запись index
+func (n *Node) termStartLocked(index uint64) uint64 {
+	for i := len(n.st.Terms) - 1; i >= 0; i-- {
+		if n.st.Terms[i].Index <= index {
+			return n.st.Terms[i].Index
+		}
+	}
+	return 0
+}
+
+// termAt работает как termAtLocked
+func (n *Node) termAt(index uint64) uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.termAtLocked(index)
+}
+
+// configAtLocked возвращает состав кластера на момент записи index
+func (n *Node) configAtLocked(index uint64) memberConfig {
+	for i := len(n.st.Configs) - 1; i >= 0; i-- {
+		if n.st.Configs[i].Index <= index {
+			return n.st.Configs[i]
+		}
+	}
+	return memberConfig{}
+}
+
+// membersLocked возвращает действующий состав: последний добавленный в лог
+func (n *Node) membersLocked() []Member {
+	if len(n.st.Configs) == 0 {
+		return nil
+	}
+	return n.st.Configs[len(n.st.Configs)-1].Members
+}
+
+func (n *Node) isMemberLocked() bool {
+	return slices.ContainsFunc(n.membersLocked(), func(m Member) bool { return m.ID == n.id })
+}
+
+func (n *Node) memberAddressLocked(id string) string {
+	for _, m := range n.membersLocked() {
+		if m.ID == id {
+			return m.Address
+		}
+	}
+	return ""
+}
+
+// dropAfterLocked забывает термы и составы записей после index
+func (n *Node) dropAfterLocked(index uint64) {
+	n.st.Terms = slices.DeleteFunc(n.st.Terms, func(t termStart) bool { return t.Index > index })
+	n.st.Configs = slices.DeleteFunc(n.st.Configs, func(c memberConfig) bool { return c.Index > index })
+}
+
+func quorum(members []Member) int {
+	return len(members)/2 + 1
+}
+
+func (n *Node) commitState() (uint64, <-chan struct{}) {
+	n.commitMu.Lock()
+	defer n.commitMu.Unlock()
+	return n.commit.Load(), n.commitCh
+}
+
+func (n *Node) setCommit(index uint64) {
+	n.commitMu.Lock()
+	defer n.commitMu.Unlock()
+	n.commit.Store(index)
+	close(n.commitCh)
+	n.commitCh = make(chan struct{})
+}
+
+// saveLocked сохраняет состояние так, что после сбоя остаётся либо прежнее, либо новое содержимое
+func (n *Node) saveLocked() error {
+	data, err := json.Marshal(n.st)
+	if err != nil {
+		return err
+	}
+
+	tmp := n.statePath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, n.statePath); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(n.statePath))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// runApplier применяет закоммиченные записи по порядку
+func (n *Node) runApplier(ctx context.Context) {
+	defer n.wg.Done()
+
+	var tailer *wal.Tailer
+	var gen uint64
+	defer func() {
+		if tailer != nil {
+			tailer.Close()
+		}
+	}()
+
+	for {
+		commit, committed := n.commitState()
+		applied := n.db.Applied()
+		if applied >= commit {
+			select {
+			case <-ctx.Done():
+				return
+			case <-committed:
+			}
+			continue
+		}
+
+		// после удаления записей из лога Tailer мог прочитать записи, которых уже нет
+		if tailer == nil || gen != n.gen.Load() {
+			if tailer != nil {
+				tailer.Close()
+			}
+			gen = n.gen.Load()
+			tailer = n.db.TailLog(applied + 1)
+		}
+		r, err := tailer.Next(ctx)
+		if err == nil && gen != n.gen.Load() {
+			continue
+		}
+		if err == nil {
+			err = n.db.ApplyLog(r)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			n.logger.Error("apply raft entry", zap.Uint64("index", applied+1), zap.Error(err))
+			tailer.Close()
+			tailer = nil
+			if !n.pause(ctx) {
+				return
+			}
+		}
+	}
+}
+
+// pause ждёт интервал heartbeat, возвращает false, если ctx завершился
+func (n *Node) pause(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(n.heartbeatInterval):
+		return true
+	}
+}
+
+// Staleness возвращает, насколько данные узла могут отставать от лидера: лидер считает свои данные
+// актуальными, последователь - устаревшими с момента, когда лидер последний раз сообщил ему коммит,
+// если все записи до этого коммита уже применены
+func (n *Node) Staleness() (time.Duration, bool) {
+	if !n.started() {
+		return 0, false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state == StateLeader {
+		return 0, true
+	}
+	if n.syncedAt.IsZero() || n.db.Applied() < n.syncedIndex {
+		return 0, false
+	}
+	return time.Since(n.syncedAt), true
+}
+
+// Info возвращает состояние узла строками вида field:value
+func (n *Node) Info() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var applied uint64
+	if n.db != nil {
+		applied = n.db.Applied()
+	}
+	return []string{
+		"raft_state:" + string(n.state),
+		"raft_id:" + n.id,
+		fmt.Sprintf("raft_term:%d", n.st.Term),
+		"raft_leader:" + n.leaderID,
+		fmt.Sprintf("raft_last_index:%d", n.lastIndex),
+		fmt.Sprintf("raft_commit_index:%d", n.commit.Load()),
+		fmt.Sprintf("raft_applied_index:%d", applied),
+		"raft_members:" + formatMembers(n.membersLocked()),
+	}
+}
+
+func formatMembers(members []Member) string {
+	parts := make([]string, len(members))
+	for i, m := range members {
+		parts[i] = m.ID + "=" + m.Address
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseMembers разбирает состав кластера вида id=адрес,id=адрес
+func ParseMembers(s string) ([]Member, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var members []Member
+	for _, part := range strings.Split(s, ",") {
+		id, address, ok := strings.Cut(part, "=")
+		m := Member{ID: id, Address: address}
+		if !ok || !validMember(m) || slices.ContainsFunc(members, func(o Member) bool { return o.ID == id }) {
+			return nil, fmt.Errorf("%w: %q", ErrWrongMember, part)
+		}
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+func validMember(m Member) bool {
+	return m.ID != "" && m.Address != "" && !strings.ContainsAny(m.ID+m.Address, "=, \t\n")
+}
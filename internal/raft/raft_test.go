@@ -0,0 +1,391 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+
+	"in-memory-db/internal"
+	"in-memory-db/internal/compute"
+	inmemory "in-memory-db/internal/storage/in-memory"
+	"in-memory-db/internal/storage/wal"
+	"in-memory-db/internal/testingh"
+)
+
+type testNode struct {
+	db      *internal.Database
+	node    *Node
+	segment *wal.Segment
+	stop    context.CancelFunc
+}
+
+type RaftSuite struct {
+	testingh.BaseDirSuite
+	network *MemoryNetwork
+	nodes   map[string]*testNode
+	// tcp - адреса узлов, которые соединяются по TCP, а не через network
+	tcp map[string]string
+}
+
+func TestRaftSuite(t *testing.T) {
+	suite.Run(t, new(RaftSuite))
+}
+
+func (s *RaftSuite) SetupTest() {
+	s.BaseDir = testingh.GetBaseDir(runtime.Caller(0))
+	s.BaseDirSuite.SetupTest()
+	s.network = NewMemoryNetwork()
+	s.nodes = make(map[string]*testNode)
+	s.tcp = nil
+}
+
+func (s *RaftSuite) TearDownTest() {
+	for id := range s.nodes {
+		s.stopNode(id)
+	}
+	s.BaseDirSuite.TearDownTest()
+}
+
+func members(ids ...string) []Member {
+	res := make([]Member, len(ids))
+	for i, id := range ids {
+		res[i] = Member{ID: id, Address: id}
+	}
+	return res
+}
+
+func (s *RaftSuite) tcpMembers(ids ...string) []Member {
+	res := make([]Member, len(ids))
+	for i, id := range ids {
+		res[i] = Member{ID: id, Address: s.tcp[id]}
+	}
+	return res
+}
+
+// startNode запускает узел id с базой в поддиректории id, адрес узла в сети совпадает с id
+func (s *RaftSuite) startNode(id string, bootstrap []Member) *testNode {
+	ctx, cancel := context.WithCancel(s.Ctx)
+	s.Require().NoError(os.MkdirAll(s.BaseDir+id, 0755))
+	segment := wal.NewSegment(4096, s.BaseDir+id)
+	walInst := wal.NewWal(ctx, 4096, time.Millisecond, segment, zap.NewNop())
+	transport := s.network.Transport(id)
+	if s.tcp != nil {
+		transport = NewTCPTransport(time.Second)
+	}
+	node := NewNode(id, s.BaseDir+id+"/raft_state.json", transport, zap.NewNop(),
+		WithNodeBootstrap(bootstrap),
+		WithNodeElectionTimeout(150*time.Millisecond),
+		WithNodeHeartbeatInterval(20*time.Millisecond),
+		WithNodeSubmitTimeout(time.Second),
+	)
+	served := make(chan struct{})
+	if s.tcp != nil {
+		go func() {
+			defer close(served)
+			s.NoError(ServeTCP(ctx, s.tcp[id], node, zap.NewNop()))
+		}()
+	} else {
+		s.network.Register(id, node)
+		close(served)
+	}
+	db := internal.NewDatabase(inmemory.NewEngine(), compute.NewParser(), zap.NewNop(), walInst,
+		internal.WithDatabaseConsensus(ctx, node))
+	s.Require().NoError(db.Init())
+
+	n := &testNode{db: db, node: node, segment: segment, stop: func() {
+		cancel()
+		node.Wait()
+		<-served
+		walInst.WaitWrite()
+	}}
+	s.nodes[id] = n
+	return n
+}
+
+func (s *RaftSuite) stopNode(id string) {
+	s.nodes[id].stop()
+	delete(s.nodes, id)
+}
+
+// leader ждёт, пока среди узлов ids будет лидер, которого признают остальные
+func (s *RaftSuite) leader(ids ...string) string {
+	var leader string
+	s.Require().Eventually(func() bool {
+		leader = ""
+		for _, id := range ids {
+			n := s.nodes[id].node
+			n.mu.Lock()
+			state, leaderID := n.state, n.leaderID
+			n.mu.Unlock()
+			if state == StateLeader {
+				leader = id
+			}
+			if leaderID == "" || (leader != "" && leaderID != leader) {
+				return false
+			}
+		}
+		return leader != ""
+	}, 5*time.Second, 5*time.Millisecond)
+	return leader
+}
+
+func (s *RaftSuite) follower(leader string, ids ...string) string {
+	for _, id := range ids {
+		if id != leader {
+			return id
+		}
+	}
+	s.FailNow("no follower")
+	return ""
+}
+
+// waitValue ждёт, пока на узлах ids ключ key будет иметь значение val
+func (s *RaftSuite) waitValue(key, val string, ids ...string) {
+	for _, id := range ids {
+		s.Require().Eventually(func() bool {
+			r, err := s.nodes[id].db.RunQuery("GET " + key)
+			return err == nil && r == val
+		}, 5*time.Second, 5*time.Millisecond, "node %s", id)
+	}
+}
+
+func (s *RaftSuite) runQueries(db *internal.Database, from, to int) {
+	for i := from; i <= to; i++ {
+		_, err := db.RunQuery(fmt.Sprintf("SET key%d %d", i, i))
+		s.Require().NoError(err)
+	}
+}
+
+func (s *RaftSuite) TestRaft_WritesGoThroughLeader() {
+	ids := []string{"n1", "n2", "n3"}
+	for _, id := range ids {
+		s.startNode(id, members(ids...))
+	}
+	leader := s.leader(ids...)
+	follower := s.follower(leader, ids...)
+
+	// запись на последователе передаётся лидеру и видна на нём сразу после ответа
+	s.runQueries(s.nodes[follower].db, 1, 10)
+	r, err := s.nodes[follower].db.RunQuery("GET key10")
+	s.NoError(err)
+	s.Equal("10", r)
+	_, err = s.nodes[leader].db.RunQuery("DEL key1")
+	s.Require().NoError(err)
+	s.waitValue("key10", "10", ids...)
+	for _, id := range ids {
+		s.Require().Eventually(func() bool {
+			_, err := s.nodes[id].db.RunQuery("GET key1")
+			return err != nil
+		}, 5*time.Second, 5*time.Millisecond)
+	}
+
+	// запись на лидере видна на последователе, который дождался её LSN
+	r, err = s.nodes[leader].db.RunQuery("SET ryw 1")
+	s.Require().NoError(err)
+	lsn, ok := strings.CutPrefix(r, "[ok] lsn ")
+	s.Require().True(ok, r)
+	r, err = s.nodes[follower].db.RunQuery("GET ryw WAITLSN " + lsn)
+	s.NoError(err)
+	s.Equal("1", r)
+
+	// последователь отвечает на чтение с границей устаревания, пока получает коммит от лидера
+	r, err = s.nodes[leader].db.RunQuery("GET key10 MAXSTALE 0s")
+	s.NoError(err)
+	s.Equal("10", r)
+	s.Require().Eventually(func() bool {
+		r, err := s.nodes[follower].db.RunQuery("GET key10 MAXSTALE 1s")
+		return err == nil && r == "10"
+	}, 5*time.Second, 5*time.Millisecond)
+	_, err = s.nodes[follower].db.RunQuery("GET key10 MAXSTALE 0s")
+	s.ErrorIs(err, internal.ErrStale)
+
+	r, err = s.nodes[leader].db.RunQuery("INFO")
+	s.NoError(err)
+	s.Contains(r, "raft_state:leader\nraft_id:"+leader+"\n")
+	s.Contains(r, "raft_members:n1=n1,n2=n2,n3=n3\n")
+	s.NotContains(r, "role:")
+	_, err = s.nodes[leader].db.RunQuery("REPLICAOF NO ONE")
+	s.ErrorIs(err, internal.ErrConsensusMode)
+}
+
+func (s *RaftSuite) TestRaft_LeaderFailover() {
+	ids := []string{"n1", "n2", "n3"}
+	for _, id := range ids {
+		s.startNode(id, members(ids...))
+	}
+	oldLeader := s.leader(ids...)
+	s.runQueries(s.nodes[oldLeader].db, 1, 5)
+
+	// отрезанный лидер не может закоммитить запись
+	s.network.Disconnect(oldLeader)
+	_, err := s.nodes[oldLeader].db.RunQuery("SET lost 1")
+	s.ErrorIs(err, ErrTimeout)
+
+	var rest []string
+	for _, id := range ids {
+		if id != oldLeader {
+			rest = append(rest, id)
+		}
+	}
+	leader := s.leader(rest...)
+	s.runQueries(s.nodes[s.follower(leader, rest...)].db, 6, 10)
+
+	// вернувшийся лидер становится последователем, его незакоммиченная запись удаляется
+	s.network.Connect(oldLeader)
+	s.waitValue("key10", "10", ids...)
+	s.Equal(leader, s.leader(ids...))
+	for _, id := range ids {
+		_, err := s.nodes[id].db.RunQuery("GET lost")
+		s.Error(err)
+	}
+	r, err := s.nodes[oldLeader].db.RunQuery("GET key3")
+	s.NoError(err)
+	s.Equal("3", r)
+
+	// после перезапуска узел восстанавливает состояние из снимка и записей, закоммиченных лидером
+	s.stopNode(oldLeader)
+	s.runQueries(s.nodes[leader].db, 11, 15)
+	s.startNode(oldLeader, members(ids...))
+	s.waitValue("key15", "15", ids...)
+	_, err = s.nodes[oldLeader].db.RunQuery("GET lost")
+	s.Error(err)
+}
+
+func (s *RaftSuite) TestRaft_ConflictKeepsMatchingEntries() {
+	ids := []string{"n1", "n2", "n3"}
+	for _, id := range ids {
+		s.startNode(id, members(ids...))
+	}
+	oldLeader := s.leader(ids...)
+	s.runQueries(s.nodes[oldLeader].db, 1, 4)
+	s.waitValue("key4", "4", ids...)
+
+	// последователь отключается от сети, и запросы лидеров ему передаёт тест
+	follower := s.follower(oldLeader, ids...)
+	newLeader := s.follower(oldLeader, slices.DeleteFunc(slices.Clone(ids), func(id string) bool { return id == follower })...)
+	s.network.Disconnect(follower)
+	node := s.nodes[follower].node
+	node.mu.Lock()
+	term, last := node.st.Term+1, node.lastIndex
+	node.mu.Unlock()
+	commit := node.commit.Load()
+	entry := func(term, index uint64, query string) Entry {
+		return Entry{Term: term, Record: wal.NewRecord(index, time.Now(), query)}
+	}
+
+	// прежний лидер передал две записи и ещё одну, которую не успел закоммитить; коммит последователь не узнал
+	resp, err := node.AppendEntries(s.Ctx, AppendRequest{
+		Term: term, LeaderID: oldLeader, PrevLogIndex: last, PrevLogTerm: node.termAt(last), LeaderCommit: commit,
+		Entries: []Entry{entry(term, last+1, "SET match1 1"), entry(term, last+2, "SET match2 2"), entry(term, last+3, "SET stale 1")},
+	})
+	s.Require().NoError(err)
+	s.Require().True(resp.Success)
+
+	// у нового лидера первые две записи совпадают, третья - из его терма: удаляется только она
+	resp, err = node.AppendEntries(s.Ctx, AppendRequest{
+		Term: term + 1, LeaderID: newLeader, PrevLogIndex: last + 2, PrevLogTerm: term, LeaderCommit: last + 3,
+		Entries: []Entry{entry(term+1, last+3, "SET fresh 1")},
+	})
+	s.Require().NoError(err)
+	s.True(resp.Success)
+	s.Equal(last+3, resp.MatchIndex)
+
+	s.waitValue("fresh", "1", follower)
+	s.waitValue("match2", "2", follower)
+	s.waitValue("match1", "1", follower)
+	_, err = s.nodes[follower].db.RunQuery("GET stale")
+	s.Error(err)
+
+	// после перезапуска лог и термы записей сохраняются
+	s.stopNode(follower)
+	node = s.startNode(follower, members(ids...)).node
+	s.Require().Eventually(node.started, 5*time.Second, 5*time.Millisecond)
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	s.Equal(last+3, node.lastIndex)
+	s.Equal(term, node.termAtLocked(last+2))
+	s.Equal(term+1, node.termAtLocked(last+3))
+}
+
+func (s *RaftSuite) TestRaft_SnapshotForLaggingNode() {
+	ids := []string{"n1", "n2", "n3"}
+	for _, id := range ids {
+		s.startNode(id, members(ids...))
+	}
+	leader := s.leader(ids...)
+	lagging := s.follower(leader, ids...)
+	s.stopNode(lagging)
+
+	// пока узел остановлен, лидер удаляет записи, которые ему нужны
+	s.runQueries(s.nodes[leader].db, 1, 200)
+	s.Require().NoError(s.nodes[leader].db.Snapshot())
+	cleaner, err := wal.NewCleaner(s.nodes[leader].segment, wal.RetentionPolicy{MaxSegments: 1}, wal.ArchivePolicy{}, zap.NewNop())
+	s.Require().NoError(err)
+	s.Require().NoError(cleaner.Clean(s.Ctx))
+
+	s.startNode(lagging, members(ids...))
+	s.waitValue("key200", "200", lagging)
+	s.runQueries(s.nodes[leader].db, 201, 205)
+	s.waitValue("key205", "205", ids...)
+	r, err := s.nodes[lagging].db.RunQuery("GET key1")
+	s.NoError(err)
+	s.Equal("1", r)
+}
+
+func (s *RaftSuite) TestRaft_MembershipChange() {
+	ids := []string{"n1", "n2", "n3"}
+	for _, id := range ids {
+		s.startNode(id, members(ids...))
+	}
+	leader := s.leader(ids...)
+	s.runQueries(s.nodes[leader].db, 1, 5)
+
+	// новый узел запускается без состава и получает лог от лидера
+	s.startNode("n4", nil)
+	r, err := s.nodes[s.follower(leader, ids...)].db.RunQuery("RAFT ADD n4 n4")
+	s.Require().NoError(err)
+	s.Equal("[ok]", r)
+	s.waitValue("key5", "5", "n4")
+	_, err = s.nodes[leader].db.RunQuery("RAFT ADD n4 n4")
+	s.ErrorIs(err, ErrWrongMember)
+
+	// лидер удаляет себя, оставшиеся узлы выбирают нового
+	_, err = s.nodes[leader].db.RunQuery("RAFT REMOVE " + leader)
+	s.Require().NoError(err)
+	var rest []string
+	for _, id := range append(ids, "n4") {
+		if id != leader {
+			rest = append(rest, id)
+		}
+	}
+	newLeader := s.leader(rest...)
+	s.NotEqual(leader, newLeader)
+	s.runQueries(s.nodes[newLeader].db, 6, 10)
+	s.waitValue("key10", "10", rest...)
+
+	r, err = s.nodes[newLeader].db.RunQuery("INFO")
+	s.NoError(err)
+	s.Contains(r, "raft_members:"+formatMembers(members(rest...))+"\n")
+	_, err = s.nodes[leader].db.RunQuery("SET key11 11")
+	s.Error(err)
+}
+
+func (s *RaftSuite) TestRaft_TCPTransport() {
+	s.tcp = map[string]string{"n1": "127.0.0.1:3050", "n2": "127.0.0.1:3051", "n3": "127.0.0.1:3052"}
+	ids := []string{"n1", "n2", "n3"}
+	for _, id := range ids {
+		s.startNode(id, s.tcpMembers(ids...))
+	}
+	leader := s.leader(ids...)
+
+	s.runQueries(s.nodes[s.follower(leader, ids...)].db, 1, 20)
+	s.waitValue("key20", "20", ids...)
+}
@@ -0,0 +1,245 @@
+package raft
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Запросы между узлами передаются по TCP строками JSON: в соединении по очереди запрос и ответ.
+// Соединения с узлами переиспользуются.
+
+const (
+	rpcVote     = "vote"
+	rpcAppend   = "append"
+	rpcSnapshot = "snapshot"
+	rpcForward  = "forward"
+
+	defaultDialTimeout = time.Second
+	maxIdleConnections = 4
+)
+
+type rpcRequest struct {
+	Type string          `json:"type"`
+	Body json.RawMessage `json:"body"`
+}
+
+type rpcResponse struct {
+	Body  json.RawMessage `json:"body,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+type rpcConn struct {
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+func newRPCConn(conn net.Conn) *rpcConn {
+	return &rpcConn{conn: conn, enc: json.NewEncoder(conn), dec: json.NewDecoder(bufio.NewReader(conn))}
+}
+
+// TCPTransport передаёт запросы узлам по TCP
+type TCPTransport struct {
+	dialTimeout time.Duration
+
+	mu   sync.Mutex
+	idle map[string][]*rpcConn
+}
+
+func NewTCPTransport(dialTimeout time.Duration) *TCPTransport {
+	if dialTimeout <= 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	return &TCPTransport{dialTimeout: dialTimeout, idle: make(map[string][]*rpcConn)}
+}
+
+func (t *TCPTransport) RequestVote(ctx context.Context, address string, req VoteRequest) (VoteResponse, error) {
+	var resp VoteResponse
+	return resp, t.call(ctx, address, rpcVote, req, &resp)
+}
+
+func (t *TCPTransport) AppendEntries(ctx context.Context, address string, req AppendRequest) (AppendResponse, error) {
+	var resp AppendResponse
+	return resp, t.call(ctx, address, rpcAppend, req, &resp)
+}
+
+func (t *TCPTransport) InstallSnapshot(ctx context.Context, address string, req SnapshotRequest) (AppendResponse, error) {
+	var resp AppendResponse
+	return resp, t.call(ctx, address, rpcSnapshot, req, &resp)
+}
+
+func (t *TCPTransport) Forward(ctx context.Context, address string, req ForwardRequest) (ForwardResponse, error) {
+	var resp ForwardResponse
+	return resp, t.call(ctx, address, rpcForward, req, &resp)
+}
+
+// Close закрывает неиспользуемые соединения
+func (t *TCPTransport) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for address, conns := range t.idle {
+		for _, c := range conns {
+			c.conn.Close()
+		}
+		delete(t.idle, address)
+	}
+}
+
+func (t *TCPTransport) call(ctx context.Context, address, typ string, req, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	c, err := t.get(ctx, address)
+	if err != nil {
+		return err
+	}
+
+	stop := context.AfterFunc(ctx, func() { c.conn.SetDeadline(time.Now()) })
+	var r rpcResponse
+	err = c.enc.Encode(rpcRequest{Type: typ, Body: body})
+	if err == nil {
+		err = c.dec.Decode(&r)
+	}
+	// после срабатывания AfterFunc у соединения истёк срок, его нельзя переиспользовать
+	if stopped := stop(); err != nil || !stopped {
+		c.conn.Close()
+		if err != nil && !stopped {
+			err = ctx.Err()
+		}
+	} else {
+		t.put(address, c)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUnreachable, err)
+	}
+
+	if r.Error != "" {
+		return errors.New(r.Error)
+	}
+	return json.Unmarshal(r.Body, resp)
+}
+
+func (t *TCPTransport) get(ctx context.Context, address string) (*rpcConn, error) {
+	t.mu.Lock()
+	if conns := t.idle[address]; len(conns) > 0 {
+		c := conns[len(conns)-1]
+		t.idle[address] = conns[:len(conns)-1]
+		t.mu.Unlock()
+		return c, nil
+	}
+	t.mu.Unlock()
+
+	dialer := net.Dialer{Timeout: t.dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnreachable, err)
+	}
+	return newRPCConn(conn), nil
+}
+
+func (t *TCPTransport) put(address string, c *rpcConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.idle[address]) >= maxIdleConnections {
+		c.conn.Close()
+		return
+	}
+	t.idle[address] = append(t.idle[address], c)
+}
+
+// ServeTCP принимает запросы других узлов на address и передаёт их h, пока не завершится ctx
+func ServeTCP(ctx context.Context, address string, h Handler, logger *zap.Logger) error {
+	var lc net.ListenConfig
+	listener, err := lc.Listen(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveRPCConn(ctx, newRPCConn(conn), h, logger)
+		}()
+	}
+}
+
+func serveRPCConn(ctx context.Context, c *rpcConn, h Handler, logger *zap.Logger) {
+	defer c.conn.Close()
+	stop := context.AfterFunc(ctx, func() { c.conn.Close() })
+	defer stop()
+
+	for {
+		var req rpcRequest
+		if err := c.dec.Decode(&req); err != nil {
+			return
+		}
+		body, err := handleRPC(ctx, h, req)
+		resp := rpcResponse{Body: body}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		if err := c.enc.Encode(resp); err != nil {
+			logger.Debug("send raft response", zap.Error(err))
+			return
+		}
+	}
+}
+
+func handleRPC(ctx context.Context, h Handler, req rpcRequest) (json.RawMessage, error) {
+	var resp any
+	var err error
+	switch req.Type {
+	case rpcVote:
+		var r VoteRequest
+		if err := json.Unmarshal(req.Body, &r); err != nil {
+			return nil, err
+		}
+		resp, err = h.RequestVote(ctx, r)
+	case rpcAppend:
+		var r AppendRequest
+		if err := json.Unmarshal(req.Body, &r); err != nil {
+			return nil, err
+		}
+		resp, err = h.AppendEntries(ctx, r)
+	case rpcSnapshot:
+		var r SnapshotRequest
+		if err := json.Unmarshal(req.Body, &r); err != nil {
+			return nil, err
+		}
+		resp, err = h.InstallSnapshot(ctx, r)
+	case rpcForward:
+		var r ForwardRequest
+		if err := json.Unmarshal(req.Body, &r); err != nil {
+			return nil, err
+		}
+		resp, err = h.Forward(ctx, r)
+	default:
+		return nil, fmt.Errorf("unknown raft request %q", req.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(resp)
+}
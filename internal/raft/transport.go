@@ -0,0 +1,174 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"in-memory-db/internal/storage/wal"
+)
+
+var ErrUnreachable = errors.New("raft node is unreachable")
+
+// VoteRequest - RequestVote: кандидат просит голос в терме Term
+type VoteRequest struct {
+	Term         uint64 `json:"term"`
+	CandidateID  string `json:"candidate_id"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// Entry - запись лога с термом, в котором её добавил лидер
+type Entry struct {
+	Term   uint64     `json:"term"`
+	Record wal.Record `json:"record"`
+}
+
+// AppendRequest - AppendEntries: записи после PrevLogIndex, без записей - heartbeat
+type AppendRequest struct {
+	Term         uint64  `json:"term"`
+	LeaderID     string  `json:"leader_id"`
+	PrevLogIndex uint64  `json:"prev_log_index"`
+	PrevLogTerm  uint64  `json:"prev_log_term"`
+	Entries      []Entry `json:"entries"`
+	LeaderCommit uint64  `json:"leader_commit"`
+}
+
+// AppendResponse - ответ на AppendEntries и InstallSnapshot. MatchIndex - последняя запись,
+// совпадающая с логом лидера, ConflictIndex - с какой записи лидеру продолжить, если записи не приняты.
+type AppendResponse struct {
+	Term          uint64 `json:"term"`
+	Success       bool   `json:"success"`
+	MatchIndex    uint64 `json:"match_index"`
+	ConflictIndex uint64 `json:"conflict_index"`
+}
+
+// SnapshotRequest - InstallSnapshot: состояние на момент LastIndex и состав кластера на этот момент.
+// Лидер отправляет его, если записей, нужных узлу, уже нет в WAL лидера.
+type SnapshotRequest struct {
+	Term      uint64   `json:"term"`
+	LeaderID  string   `json:"leader_id"`
+	LastIndex uint64   `json:"last_index"`
+	LastTerm  uint64   `json:"last_term"`
+	Members   []Member `json:"members"`
+	Keys      []string `json:"keys"`
+	Vals      []string `json:"vals"`
+}
+
+// ForwardRequest - запрос клиента, который узел передал лидеру
+type ForwardRequest struct {
+	Query string `json:"query"`
+}
+
+type ForwardResponse struct {
+	Index uint64 `json:"index"`
+	Error string `json:"error,omitempty"`
+}
+
+// Handler обрабатывает запросы других узлов, реализация - Node
+type Handler interface {
+	RequestVote(ctx context.Context, req VoteRequest) (VoteResponse, error)
+	AppendEntries(ctx context.Context, req AppendRequest) (AppendResponse, error)
+	InstallSnapshot(ctx context.Context, req SnapshotRequest) (AppendResponse, error)
+	Forward(ctx context.Context, req ForwardRequest) (ForwardResponse, error)
+}
+
+// Transport передаёт запросы узлу с адресом address
+type Transport interface {
+	RequestVote(ctx context.Context, address string, req VoteRequest) (VoteResponse, error)
+	AppendEntries(ctx context.Context, address string, req AppendRequest) (AppendResponse, error)
+	InstallSnapshot(ctx context.Context, address string, req SnapshotRequest) (AppendResponse, error)
+	Forward(ctx context.Context, address string, req ForwardRequest) (ForwardResponse, error)
+}
+
+// MemoryNetwork связывает узлы в одном процессе, узлы можно отключать от сети
+type MemoryNetwork struct {
+	mu           sync.RWMutex
+	handlers     map[string]Handler
+	disconnected map[string]bool
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		handlers:     make(map[string]Handler),
+		disconnected: make(map[string]bool),
+	}
+}
+
+// Register подключает к сети узел с адресом address
+func (m *MemoryNetwork) Register(address string, h Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[address] = h
+}
+
+// Transport возвращает транспорт, через который узел с адресом address отправляет запросы
+func (m *MemoryNetwork) Transport(address string) Transport {
+	return &memoryTransport{network: m, from: address}
+}
+
+// Disconnect отключает узел: он не получает запросы и не может их отправить
+func (m *MemoryNetwork) Disconnect(address string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.disconnected[address] = true
+}
+
+// Connect возвращает отключённый узел в сеть
+func (m *MemoryNetwork) Connect(address string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.disconnected, address)
+}
+
+func (m *MemoryNetwork) handler(from, to string) (Handler, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	h, ok := m.handlers[to]
+	if !ok || m.disconnected[from] || m.disconnected[to] {
+		return nil, ErrUnreachable
+	}
+	return h, nil
+}
+
+type memoryTransport struct {
+	network *MemoryNetwork
+	from    string
+}
+
+func (t *memoryTransport) RequestVote(ctx context.Context, address string, req VoteRequest) (VoteResponse, error) {
+	h, err := t.network.handler(t.from, address)
+	if err != nil {
+		return VoteResponse{}, err
+	}
+	return h.RequestVote(ctx, req)
+}
+
+func (t *memoryTransport) AppendEntries(ctx context.Context, address string, req AppendRequest) (AppendResponse, error) {
+	h, err := t.network.handler(t.from, address)
+	if err != nil {
+		return AppendResponse{}, err
+	}
+	return h.AppendEntries(ctx, req)
+}
+
+func (t *memoryTransport) InstallSnapshot(ctx context.Context, address string, req SnapshotRequest) (AppendResponse, error) {
+	h, err := t.network.handler(t.from, address)
+	if err != nil {
+		return AppendResponse{}, err
+	}
+	return h.InstallSnapshot(ctx, req)
+}
+
+func (t *memoryTransport) Forward(ctx context.Context, address string, req ForwardRequest) (ForwardResponse, error) {
+	h, err := t.network.handler(t.from, address)
+	if err != nil {
+		return ForwardResponse{}, err
+	}
+	return h.Forward(ctx, req)
+}
@@ -0,0 +1,207 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"in-memory-db/internal"
+	"in-memory-db/internal/compute"
+	"in-memory-db/internal/network"
+	"in-memory-db/internal/storage/wal"
+)
+
+// Реплика подключается к primary командой REPLICATE и получает записи WAL, начиная со следующей после
+// последней записи в своём WAL. Первой строкой primary отправляет свою эпоху (см. internal.AcceptReplica).
+// Записи, пришедшие вместе, записываются в сегменты реплики одним fsync
+// и применяются к хранилищу, после чего реплика отправляет primary подтверждение ACK <lsn>.
+// Primary ждёт подтверждений, только если задан кворум записи. На строку HEARTBEAT с последним LSN primary
+// реплика тоже отвечает ACK, так обе стороны знают, насколько реплика отстаёт. Если нужных записей у primary уже нет,
+// он передаёт всё состояние (см. internal.FullResync), и реплика заменяет им свои данные.
+// После разрыва соединения реплика подключается заново и продолжает с того же места.
+
+const defaultReconnectDelay = time.Second
+
+var ErrConnectionClosed = errors.New("connection closed by primary")
+
+type Replica struct {
+	primaryAddress string
+	id             string
+	db             *internal.Database
+	logger         *zap.Logger
+
+	reconnectDelay time.Duration
+}
+
+type ReplicaOption func(*Replica)
+
+// WithReplicaReconnectDelay задаёт паузу перед повторным подключением к primary
+func WithReplicaReconnectDelay(delay time.Duration) ReplicaOption {
+	return func(r *Replica) {
+		r.reconnectDelay = delay
+	}
+}
+
+func NewReplica(primaryAddress, id string, db *internal.Database, logger *zap.Logger, options ...ReplicaOption) *Replica {
+	r := &Replica{primaryAddress: primaryAddress, id: id, db: db, logger: logger}
+
+	for _, o := range options {
+		o(r)
+	}
+
+	if r.reconnectDelay <= 0 {
+		r.reconnectDelay = defaultReconnectDelay
+	}
+
+	return r
+}
+
+// Run получает записи от primary, пока не завершится ctx. Вызывается после Database.Init.
+func (r *Replica) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := r.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		r.logger.Warn("replication stream", zap.String("primary", r.primaryAddress), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.reconnectDelay):
+		}
+	}
+}
+
+// follow получает записи по одному соединению, пока оно не оборвётся
+func (r *Replica) follow(ctx context.Context) error {
+	client := network.NewClient(r.primaryAddress, 0, 0)
+	if err := client.Connect(); err != nil {
+		return err
+	}
+	defer client.Close()
+
+	stop := context.AfterFunc(ctx, client.Close)
+	defer stop()
+
+	fromLSN := r.db.LastLSN() + 1
+	r.logger.Info("replication started", zap.String("primary", r.primaryAddress), zap.Uint64("from_lsn", fromLSN))
+
+	// ACK отправляется, когда полученные записи уже на диске реплики: primary может ответить клиентам,
+	// которые ждут кворума
+	ack := func() error {
+		return client.WriteLine(fmt.Sprintf("%s %d", compute.AckCommand, r.db.LastLSN()))
+	}
+
+	var link *internal.PrimaryLink
+	defer func() {
+		if link != nil {
+			link.Close()
+		}
+	}()
+	var resync *resyncReceiver
+	request := fmt.Sprintf("%s %s %d %d", compute.ReplicateCommand, r.id, fromLSN, r.db.Epoch())
+	err := client.StreamBatches(request, func(lines []string) error {
+		records := make([]wal.Record, 0, len(lines))
+		heartbeat := false
+		var streamErr error
+		for _, line := range lines {
+			if resync != nil {
+				done, err := resync.add(line)
+				if err != nil {
+					streamErr = err
+					break
+				}
+				if !done {
+					continue
+				}
+				if err := link.Resync(resync.lsn, resync.keys, resync.vals); err != nil {
+					return err
+				}
+				r.logger.Info("full resync finished", zap.String("primary", r.primaryAddress),
+					zap.Uint64("lsn", resync.lsn), zap.Int("keys", resync.count))
+				resync = nil
+				if err := ack(); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if msg, ok := strings.CutPrefix(line, "error: "); ok {
+				streamErr = errors.New(msg)
+				break
+			}
+			if link == nil {
+				var err error
+				if link, err = r.db.LinkPrimary(line); err != nil {
+					streamErr = err
+					break
+				}
+				continue
+			}
+			if lsn, ok, err := parseHeartbeat(line); ok {
+				if err != nil {
+					streamErr = err
+					break
+				}
+				link.Heartbeat(lsn)
+				heartbeat = true
+				continue
+			}
+			receiver, ok, err := newResyncReceiver(line)
+			if err != nil {
+				streamErr = err
+				break
+			}
+			if ok {
+				r.logger.Info("full resync started", zap.String("primary", r.primaryAddress), zap.Uint64("lsn", receiver.lsn))
+				// записи до синхронизации заменяются её состоянием
+				resync, records = receiver, records[:0]
+				continue
+			}
+			record, err := wal.DecodeRecord(line)
+			if err != nil {
+				streamErr = err
+				break
+			}
+			records = append(records, record)
+		}
+
+		// записи до ошибки применяются, чтобы не получать их заново
+		if len(records) > 0 {
+			if err := link.Replicate(records); err != nil {
+				return err
+			}
+			if err := ack(); err != nil {
+				return err
+			}
+		} else if heartbeat {
+			if err := ack(); err != nil {
+				return err
+			}
+		}
+		return streamErr
+	})
+	if err == nil {
+		err = ErrConnectionClosed
+	}
+	return err
+}
+
+// parseHeartbeat разбирает строку HEARTBEAT <lsn>, ok = false, если строка ей не является
+func parseHeartbeat(line string) (uint64, bool, error) {
+	arg, ok := strings.CutPrefix(line, internal.HeartbeatHeader+" ")
+	if !ok {
+		return 0, false, nil
+	}
+	lsn, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		return 0, true, fmt.Errorf("%w: heartbeat %q", internal.ErrWrongLSN, line)
+	}
+	return lsn, true, nil
+}
@@ -0,0 +1,345 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+
+	"in-memory-db/internal"
+	"in-memory-db/internal/compute"
+	"in-memory-db/internal/network"
+	"in-memory-db/internal/storage/filesystem"
+	inmemory "in-memory-db/internal/storage/in-memory"
+	"in-memory-db/internal/storage/wal"
+	"in-memory-db/internal/testingh"
+)
+
+const (
+	testPrimaryAddr = "127.0.0.1:3040"
+	testReplicaAddr = "127.0.0.1:3041"
+)
+
+type ReplicaSuite struct {
+	testingh.BaseDirSuite
+	primarySegment *wal.Segment
+}
+
+func TestReplicaSuite(t *testing.T) {
+	suite.Run(t, new(ReplicaSuite))
+}
+
+func (s *ReplicaSuite) SetupTest() {
+	s.BaseDir = testingh.GetBaseDir(runtime.Caller(0))
+	s.BaseDirSuite.SetupTest()
+}
+
+// startDatabase запускает базу с WAL в поддиректории dir, WAL останавливается при завершении ctx
+func (s *ReplicaSuite) startDatabase(ctx context.Context, dir string, options ...internal.DatabaseOption) (*internal.Database, *wal.Wal, *wal.Segment) {
+	s.Require().NoError(os.MkdirAll(s.BaseDir+dir, 0755))
+	segment := wal.NewSegment(4096, s.BaseDir+dir)
+	walInst := wal.NewWal(ctx, 4096, 5*time.Millisecond, segment, zap.NewNop())
+	db := internal.NewDatabase(inmemory.NewEngine(), compute.NewParser(), zap.NewNop(), walInst, options...)
+	s.Require().NoError(db.Init())
+	return db, walInst, segment
+}
+
+// startServer запускает базу в поддиректории dir, а если задан address - и сервер.
+// Роль сервера сохраняется в директории, REPLICAOF выполняется через Replicator с id dir.
+func (s *ReplicaSuite) startServer(dir, address string, options ...internal.DatabaseOption) (*internal.Database, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(s.Ctx)
+	options = append(options,
+		internal.WithDatabaseReplicationStateFile(s.BaseDir+dir+"/replication_state.json"),
+		internal.WithDatabaseReplicator(ctx, NewReplicator(dir, zap.NewNop(), WithReplicatorReconnectDelay(10*time.Millisecond))),
+	)
+	db, walInst, segment := s.startDatabase(ctx, dir, options...)
+	if dir == "primary" {
+		s.primarySegment = segment
+	}
+
+	done := make(chan struct{})
+	if address == "" {
+		close(done)
+	} else {
+		server := network.NewServer(ctx, address, db, zap.NewNop(),
+			network.WithServerMaxConnectionsNumber(10),
+			network.WithServerHeartbeatInterval(20*time.Millisecond),
+		)
+		go func() {
+			defer close(done)
+			s.NoError(server.Run())
+		}()
+	}
+	return db, func() {
+		cancel()
+		<-done
+		walInst.WaitWrite()
+	}
+}
+
+func (s *ReplicaSuite) startPrimary(options ...internal.DatabaseOption) (*internal.Database, context.CancelFunc) {
+	return s.startServer("primary", testPrimaryAddr, options...)
+}
+
+func (s *ReplicaSuite) startReplica(options ...internal.DatabaseOption) (*internal.Database, context.CancelFunc) {
+	return s.startServer("replica", "", append(options, internal.WithDatabaseReplicaOf(testPrimaryAddr))...)
+}
+
+func (s *ReplicaSuite) runQueries(db *internal.Database, from, to int) {
+	for i := from; i <= to; i++ {
+		_, err := db.RunQuery(fmt.Sprintf("SET key%d %d", i, i))
+		s.Require().NoError(err)
+	}
+}
+
+// waitLSN ждёт, пока запись lsn будет сохранена в WAL и применена
+func (s *ReplicaSuite) waitLSN(db *internal.Database, lsn uint64) {
+	s.Require().Eventually(func() bool {
+		return db.LastLSN() == lsn && db.Applied() == lsn
+	}, 5*time.Second, 5*time.Millisecond)
+}
+
+func (s *ReplicaSuite) TestReplica_FollowsPrimary() {
+	primary, stopPrimary := s.startPrimary()
+	defer stopPrimary()
+	s.runQueries(primary, 1, 5)
+
+	replica, stop := s.startReplica()
+	s.waitLSN(replica, 5)
+	s.runQueries(primary, 6, 20)
+	_, err := primary.RunQuery("DEL key3")
+	s.Require().NoError(err)
+	s.waitLSN(replica, 21)
+
+	r, err := replica.RunQuery("GET key20")
+	s.NoError(err)
+	s.Equal("20", r)
+	_, err = replica.RunQuery("GET key3")
+	s.Error(err)
+	_, err = replica.RunQuery("SET key3 3")
+	s.ErrorIs(err, internal.ErrReadOnly)
+	stop()
+
+	// после перезапуска реплика продолжает со следующей записи своего WAL
+	s.runQueries(primary, 21, 25)
+	replica, stop = s.startReplica()
+	defer stop()
+	s.waitLSN(replica, 26)
+	r, err = replica.RunQuery("GET key25")
+	s.NoError(err)
+	s.Equal("25", r)
+	r, err = replica.RunQuery("GET key1")
+	s.NoError(err)
+	s.Equal("1", r)
+}
+
+func (s *ReplicaSuite) TestReplica_WriteQuorum() {
+	primary, stopPrimary := s.startPrimary(internal.WithDatabaseWriteQuorum(1, 200*time.Millisecond, false))
+	defer stopPrimary()
+
+	replica, stop := s.startReplica()
+	// ответ приходит после того, как запись сохранена на реплике
+	s.runQueries(primary, 1, 10)
+	s.Equal(uint64(10), replica.LastLSN())
+	stop()
+	s.Eventually(func() bool {
+		r, err := primary.RunQuery("INFO")
+		return err == nil && strings.Contains(r, "connected_replicas:0\nreplica_replica:connected=0,acked_lsn=10,lag=0")
+	}, time.Second, 5*time.Millisecond)
+
+	_, err := primary.RunQuery("SET key11 11")
+	s.ErrorIs(err, internal.ErrNoQuorum)
+
+	// реплика, отключённая дольше таймаута кворума, забывается
+	r, err := primary.RunQuery("INFO")
+	s.NoError(err)
+	s.Contains(r, "connected_replicas:0")
+	s.NotContains(r, "replica_replica")
+}
+
+func (s *ReplicaSuite) TestReplica_FullResync() {
+	primary, stopPrimary := s.startPrimary()
+	defer stopPrimary()
+
+	replica, stop := s.startReplica()
+	s.runQueries(primary, 1, 5)
+	s.waitLSN(replica, 5)
+	stop()
+
+	// пока реплика отключена, primary удаляет сегменты, которые ей нужны
+	s.runQueries(primary, 6, 200)
+	_, err := primary.RunQuery("DEL key1")
+	s.Require().NoError(err)
+	s.Require().NoError(primary.Snapshot())
+	cleaner, err := wal.NewCleaner(s.primarySegment, wal.RetentionPolicy{MaxSegments: 1}, wal.ArchivePolicy{}, zap.NewNop())
+	s.Require().NoError(err)
+	s.Require().NoError(cleaner.Clean(s.Ctx))
+
+	replica, stop = s.startReplica()
+	s.waitLSN(replica, 201)
+	// после синхронизации записи передаются по одной
+	s.runQueries(primary, 201, 205)
+	s.waitLSN(replica, 206)
+
+	_, err = replica.RunQuery("GET key1")
+	s.Error(err)
+	r, err := replica.RunQuery("GET key205")
+	s.NoError(err)
+	s.Equal("205", r)
+	stop()
+
+	// данные реплики заменены снимком полученного состояния
+	snapshots, err := wal.ListSnapshotFiles(filesystem.OS{}, s.BaseDir+"replica")
+	s.Require().NoError(err)
+	s.Require().Len(snapshots, 1)
+	s.Equal(uint64(201), snapshots[0].LSN)
+	replica, stop = s.startReplica()
+	defer stop()
+	s.Equal(uint64(206), replica.LastLSN())
+	r, err = replica.RunQuery("GET key100")
+	s.NoError(err)
+	s.Equal("100", r)
+	_, err = replica.RunQuery("GET key1")
+	s.Error(err)
+}
+
+func (s *ReplicaSuite) TestReplica_Failover() {
+	primary, stopPrimary := s.startPrimary()
+	replica, stopReplica := s.startServer("replica", testReplicaAddr, internal.WithDatabaseReplicaOf(testPrimaryAddr))
+	s.runQueries(primary, 1, 5)
+	s.waitLSN(replica, 5)
+	r, err := replica.RunQuery("INFO")
+	s.NoError(err)
+	s.Contains(r, "role:replica\nepoch:0\nprimary_address:127.0.0.1:3040\nprimary_link:1\nprimary_last_lsn:5\nreplication_lag:0\n")
+
+	// запись, которую реплика не получила до отказа primary
+	stopReplica()
+	_, err = primary.RunQuery("SET lost 1")
+	s.Require().NoError(err)
+	stopPrimary()
+
+	replica, stopReplica = s.startServer("replica", testReplicaAddr, internal.WithDatabaseReplicaOf(testPrimaryAddr))
+	defer stopReplica()
+	r, err = replica.RunQuery("REPLICAOF NO ONE")
+	s.Require().NoError(err)
+	s.Equal("[ok]", r)
+	_, err = replica.RunQuery("SET key6 6")
+	s.Require().NoError(err)
+	r, err = replica.RunQuery("INFO")
+	s.NoError(err)
+	s.Contains(r, "role:primary\nepoch:1\n")
+
+	// вернувшийся primary получает FENCE и перестаёт принимать запись
+	oldPrimary, stopOldPrimary := s.startPrimary()
+	defer stopOldPrimary()
+	s.Require().Eventually(func() bool {
+		r, err := oldPrimary.RunQuery("INFO")
+		return err == nil && strings.HasPrefix(r, "role:replica\nepoch:0\n")
+	}, 5*time.Second, 5*time.Millisecond)
+	_, err = oldPrimary.RunQuery("SET key7 7")
+	s.ErrorIs(err, internal.ErrReadOnly)
+
+	// у прежнего primary есть запись, которой нет у нового, поэтому он синхронизируется полностью
+	r, err = oldPrimary.RunQuery("REPLICAOF 127.0.0.1 3041")
+	s.Require().NoError(err)
+	s.Equal("[ok]", r)
+	// LSN lost совпадает с LSN key6, поэтому синхронизация видна только по данным
+	s.Require().Eventually(func() bool {
+		r, err := oldPrimary.RunQuery("GET key6")
+		return err == nil && r == "6"
+	}, 5*time.Second, 5*time.Millisecond)
+	_, err = oldPrimary.RunQuery("GET lost")
+	s.Error(err)
+	s.Require().Eventually(func() bool {
+		r, err := oldPrimary.RunQuery("INFO")
+		return err == nil && strings.HasPrefix(r, "role:replica\nepoch:1\nprimary_address:127.0.0.1:3041\nprimary_link:1\n")
+	}, 5*time.Second, 5*time.Millisecond)
+	s.Require().Eventually(func() bool {
+		r, err := replica.RunQuery("INFO")
+		return err == nil && strings.Contains(r, "replica_primary:connected=1,acked_lsn=6,lag=0")
+	}, 5*time.Second, 5*time.Millisecond)
+}
+
+func (s *ReplicaSuite) TestReplica_BoundedStaleness() {
+	primary, stopPrimary := s.startPrimary()
+	replica, stop := s.startReplica()
+	s.runQueries(primary, 1, 5)
+	s.waitLSN(replica, 5)
+
+	// после HEARTBEAT реплика знает, что получила все записи primary
+	s.Require().Eventually(func() bool {
+		r, err := replica.RunQuery("GET key5 MAXSTALE 1s")
+		return err == nil && r == "5"
+	}, 5*time.Second, 5*time.Millisecond)
+	_, err := replica.RunQuery("GET key5 MAXSTALE 0s")
+	s.ErrorIs(err, internal.ErrStale)
+	_, err = replica.RunQuery("GET key5 MAXSTALE 1")
+	s.ErrorIs(err, internal.ErrWrongStaleness)
+	r, err := replica.RunQuery("INFO")
+	s.NoError(err)
+	s.Contains(r, "replication_lag:0\nreplication_lag_ms:")
+	s.NotContains(r, "replication_lag_ms:-1")
+	s.Require().Eventually(func() bool {
+		r, err := primary.RunQuery("INFO")
+		return err == nil && strings.Contains(r, "replica_replica:connected=1,acked_lsn=5,lag=0,lag_ms=0")
+	}, 5*time.Second, 5*time.Millisecond)
+
+	// без primary данные реплики устаревают
+	stopPrimary()
+	s.Require().Eventually(func() bool {
+		_, err := replica.RunQuery("GET key5 MAXSTALE 100ms")
+		return errors.Is(err, internal.ErrStale)
+	}, 5*time.Second, 5*time.Millisecond)
+	r, err = replica.RunQuery("GET key5")
+	s.NoError(err)
+	s.Equal("5", r)
+	stop()
+
+	// с политикой forward устаревшее чтение выполняется на primary
+	primary, stopPrimary = s.startPrimary()
+	defer stopPrimary()
+	replica, stop = s.startReplica(internal.WithDatabaseStaleReads(internal.StaleReadsForward))
+	defer stop()
+	s.runQueries(primary, 6, 6)
+	r, err = replica.RunQuery("GET key6 MAXSTALE 0s")
+	s.NoError(err)
+	s.Equal("6", r)
+	_, err = replica.RunQuery("GET missing MAXSTALE 0s")
+	s.Error(err)
+}
+
+func (s *ReplicaSuite) TestReplica_ReadYourWrites() {
+	primary, stopPrimary := s.startPrimary()
+	defer stopPrimary()
+	replica, stop := s.startReplica(internal.WithDatabaseWaitLSNTimeout(100 * time.Millisecond))
+	s.runQueries(primary, 1, 5)
+
+	// реплика отвечает после того, как применит запись, LSN которой получил клиент
+	r, err := primary.RunQuery("SET key 1")
+	s.Require().NoError(err)
+	lsn, ok := strings.CutPrefix(r, "[ok] lsn ")
+	s.Require().True(ok, r)
+	r, err = replica.RunQuery("GET key WAITLSN " + lsn)
+	s.NoError(err)
+	s.Equal("1", r)
+	_, err = replica.RunQuery("GET key WAITLSN 100")
+	s.ErrorIs(err, internal.ErrLSNTimeout)
+	stop()
+
+	// с политикой forward чтение, не дождавшееся записи, выполняется на primary
+	replica, stop = s.startReplica(
+		internal.WithDatabaseWaitLSNTimeout(10*time.Millisecond),
+		internal.WithDatabaseStaleReads(internal.StaleReadsForward),
+	)
+	defer stop()
+	r, err = replica.RunQuery("GET key5 WAITLSN 100")
+	s.NoError(err)
+	s.Equal("5", r)
+}
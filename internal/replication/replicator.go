@@ -0,0 +1,110 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"in-memory-db/internal"
+	"in-memory-db/internal/compute"
+	"in-memory-db/internal/network"
+)
+
+// Replicator выполняет связи с другими серверами, которые нужны базе после смены роли:
+// получает записи от primary и ограждает прежнего primary после REPLICAOF NO ONE
+type Replicator struct {
+	id     string
+	logger *zap.Logger
+
+	reconnectDelay time.Duration
+}
+
+type ReplicatorOption func(*Replicator)
+
+// WithReplicatorReconnectDelay задаёт паузу перед повторным подключением к другому серверу
+func WithReplicatorReconnectDelay(delay time.Duration) ReplicatorOption {
+	return func(r *Replicator) {
+		r.reconnectDelay = delay
+	}
+}
+
+// NewReplicator возвращает Replicator, id отличает сервер среди реплик primary
+func NewReplicator(id string, logger *zap.Logger, options ...ReplicatorOption) *Replicator {
+	r := &Replicator{id: id, logger: logger}
+
+	for _, o := range options {
+		o(r)
+	}
+
+	if r.reconnectDelay <= 0 {
+		r.reconnectDelay = defaultReconnectDelay
+	}
+
+	return r
+}
+
+// Follow получает записи от primary, пока не завершится ctx
+func (r *Replicator) Follow(ctx context.Context, db *internal.Database, primaryAddress string) {
+	NewReplica(primaryAddress, r.id, db, r.logger, WithReplicaReconnectDelay(r.reconnectDelay)).Run(ctx)
+}
+
+// Fence отправляет прежнему primary FENCE <epoch>, пока он не ответит. Пока прежний primary недоступен,
+// подключение повторяется. Если он ответил ошибкой, например у него эпоха не меньше, возвращает её.
+func (r *Replicator) Fence(ctx context.Context, address string, epoch uint64) error {
+	for {
+		resp, err := r.send(ctx, address, fmt.Sprintf("%s %d", compute.FenceCommand, epoch))
+		if err == nil {
+			if msg, ok := strings.CutPrefix(resp, "error: "); ok {
+				return errors.New(msg)
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		r.logger.Debug("fence previous primary", zap.String("address", address), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.reconnectDelay):
+		}
+	}
+}
+
+// Forward выполняет запрос на сервере address, например чтение на primary, когда данные реплики устарели
+func (r *Replicator) Forward(ctx context.Context, address, query string) (string, error) {
+	resp, err := r.send(ctx, address, query)
+	if err != nil {
+		return "", err
+	}
+	if msg, ok := strings.CutPrefix(resp, "error: "); ok {
+		return "", errors.New(msg)
+	}
+	return resp, nil
+}
+
+// send отправляет запрос по новому соединению и возвращает ответ
+func (r *Replicator) send(ctx context.Context, address, query string) (string, error) {
+	client := network.NewClient(address, r.reconnectDelay+time.Second, 0)
+	if err := client.Connect(); err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	stop := context.AfterFunc(ctx, client.Close)
+	defer stop()
+
+	resp, err := client.Send(query)
+	if err != nil {
+		return "", err
+	}
+	if resp == "" {
+		return "", ErrConnectionClosed
+	}
+	return resp, nil
+}
@@ -0,0 +1,73 @@
+package replication
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strconv"
+	"strings"
+
+	"in-memory-db/internal"
+)
+
+var ErrCorruptedResync = errors.New("corrupted full resync")
+
+// resyncReceiver собирает состояние, которое primary передаёт при полной синхронизации
+type resyncReceiver struct {
+	lsn        uint64
+	count      int
+	keys, vals []string
+	crc        hash.Hash32
+}
+
+// newResyncReceiver разбирает заголовок полной синхронизации, ok = false, если строка им не является
+func newResyncReceiver(line string) (*resyncReceiver, bool, error) {
+	header, ok := strings.CutPrefix(line, internal.FullResyncHeader+" ")
+	if !ok || strings.HasPrefix(line, internal.FullResyncTrailer) {
+		return nil, false, nil
+	}
+
+	fields := strings.Fields(header)
+	if len(fields) != 2 {
+		return nil, true, fmt.Errorf("%w: header %q", ErrCorruptedResync, line)
+	}
+	lsn, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return nil, true, fmt.Errorf("%w: header %q", ErrCorruptedResync, line)
+	}
+	count, err := strconv.Atoi(fields[1])
+	if err != nil || count < 0 {
+		return nil, true, fmt.Errorf("%w: header %q", ErrCorruptedResync, line)
+	}
+
+	return &resyncReceiver{
+		lsn:   lsn,
+		count: count,
+		keys:  make([]string, 0, count),
+		vals:  make([]string, 0, count),
+		crc:   crc32.NewIEEE(),
+	}, true, nil
+}
+
+// add принимает строку с ключом или завершающую строку, возвращает true, когда получено всё состояние
+func (r *resyncReceiver) add(line string) (bool, error) {
+	if trailer, ok := strings.CutPrefix(line, internal.FullResyncTrailer+" "); ok {
+		if len(r.keys) != r.count {
+			return false, fmt.Errorf("%w: got %d keys, expected %d", ErrCorruptedResync, len(r.keys), r.count)
+		}
+		if trailer != fmt.Sprintf("%08x", r.crc.Sum32()) {
+			return false, fmt.Errorf("%w: checksum mismatch", ErrCorruptedResync)
+		}
+		return true, nil
+	}
+
+	key, val, ok := strings.Cut(line, " ")
+	if !ok || len(r.keys) == r.count {
+		return false, fmt.Errorf("%w: unexpected line %q", ErrCorruptedResync, line)
+	}
+	r.crc.Write([]byte(line))
+	r.keys = append(r.keys, key)
+	r.vals = append(r.vals, val)
+	return false, nil
+}
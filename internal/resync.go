@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"fmt"
+	"hash/crc32"
+)
+
+// Полная синхронизация: если записей, с которых реплика просит продолжить, уже нет в WAL primary,
+// primary отправляет в соединении REPLICATE состояние на момент LSN:
+//   FULLRESYNC <lsn> <количество ключей>
+//   <ключ> <значение>
+//   ...
+//   FULLRESYNC END <crc32 строк с ключами в hex>
+// и продолжает передавать записи WAL с lsn+1. Реплика заменяет свои данные полученным состоянием.
+
+const (
+	FullResyncHeader  = "FULLRESYNC"
+	FullResyncTrailer = "FULLRESYNC END"
+)
+
+// FullResync передаёт в send строки полной синхронизации и возвращает LSN переданного состояния.
+// Запись блокируется только на время копирования состояния в память.
+func (d *Database) FullResync(send func(line string) error) (uint64, error) {
+	if d.loading.Load() {
+		return 0, ErrLoading
+	}
+
+	lsn, pairs := d.copyState()
+	if err := send(fmt.Sprintf("%s %d %d\n", FullResyncHeader, lsn, len(pairs.keys))); err != nil {
+		return 0, err
+	}
+
+	crc := crc32.NewIEEE()
+	for i, key := range pairs.keys {
+		line := key + " " + pairs.vals[i]
+		crc.Write([]byte(line))
+		if err := send(line + "\n"); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := send(fmt.Sprintf("%s %08x\n", FullResyncTrailer, crc.Sum32())); err != nil {
+		return 0, err
+	}
+	return lsn, nil
+}
+
+// Resync заменяет данные реплики состоянием primary на момент lsn, полученным при полной синхронизации.
+// WAL реплики заменяется снимком этого состояния. Пока данные заменяются, запросы получают ErrLoading.
+func (d *Database) Resync(lsn uint64, keys, vals []string) error {
+	if d.role() != RoleReplica {
+		return ErrNotReplica
+	}
+	return d.replaceState(lsn, keys, vals)
+}
+
+// replaceState заменяет данные и WAL состоянием на момент lsn
+func (d *Database) replaceState(lsn uint64, keys, vals []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.loading.Store(true)
+	defer d.loading.Store(false)
+
+	pairs := statePairs{keys: keys, vals: vals}
+	d.logResets.Add(1)
+	if err := d.wal.Reset(lsn, pairs.rangeFn); err != nil {
+		return err
+	}
+	defer d.setApplied(lsn)
+
+	if engine, ok := d.storage.(clearEngine); ok {
+		engine.Clear()
+	} else {
+		var old []string
+		d.storage.Range(func(key, val string) bool {
+			old = append(old, key)
+			return true
+		})
+		for _, key := range old {
+			if err := d.storage.Del(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	if engine, ok := d.storage.(batchEngine); ok {
+		return engine.SetBatch(keys, vals)
+	}
+	for i, key := range keys {
+		if err := d.storage.Set(key, vals[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
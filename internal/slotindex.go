@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"sync"
+
+	"in-memory-db/internal/cluster"
+	"in-memory-db/internal/storage"
+)
+
+// slotIndex - хранилище режима кластера, которое помнит ключи каждого слота,
+// чтобы GETKEYSINSLOT и COUNTKEYSINSLOT не обходили все ключи
+type slotIndex struct {
+	storage.Engine
+
+	// mu упорядочивает изменения хранилища и индекса, поэтому индекс совпадает с ключами хранилища
+	mu    sync.RWMutex
+	slots [cluster.SlotCount]map[string]struct{}
+}
+
+func newSlotIndex(engine storage.Engine) *slotIndex {
+	return &slotIndex{Engine: engine}
+}
+
+func (s *slotIndex) Set(key, val string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.Engine.Set(key, val); err != nil {
+		return err
+	}
+	s.add(key)
+	return nil
+}
+
+func (s *slotIndex) Del(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.Engine.Del(key); err != nil {
+		return err
+	}
+	delete(s.slots[cluster.Slot(key)], key)
+	return nil
+}
+
+// SetBatch записывает пары пачкой, если это умеет хранилище, иначе по одной
+func (s *slotIndex) SetBatch(keys, vals []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if engine, ok := s.Engine.(batchEngine); ok {
+		if err := engine.SetBatch(keys, vals); err != nil {
+			return err
+		}
+	} else {
+		for i, key := range keys {
+			if err := s.Engine.Set(key, vals[i]); err != nil {
+				return err
+			}
+		}
+	}
+	for _, key := range keys {
+		s.add(key)
+	}
+	return nil
+}
+
+// Clear удаляет все ключи сразу, если это умеет хранилище, иначе по одному
+func (s *slotIndex) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if engine, ok := s.Engine.(clearEngine); ok {
+		engine.Clear()
+	} else {
+		for _, keys := range s.slots {
+			for key := range keys {
+				_ = s.Engine.Del(key)
+			}
+		}
+	}
+	s.slots = [cluster.SlotCount]map[string]struct{}{}
+}
+
+func (s *slotIndex) add(key string) {
+	slot := cluster.Slot(key)
+	if s.slots[slot] == nil {
+		s.slots[slot] = make(map[string]struct{})
+	}
+	s.slots[slot][key] = struct{}{}
+}
+
+// Keys возвращает не больше count ключей слота, count = 0 - все ключи
+func (s *slotIndex) Keys(slot uint16, count int) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []string
+	for key := range s.slots[slot] {
+		if count > 0 && len(keys) == count {
+			break
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Count возвращает число ключей слота
+func (s *slotIndex) Count(slot uint16) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.slots[slot])
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"in-memory-db/internal/compute"
+)
+
+// Устаревание данных реплики. В соединении REPLICATE primary периодически отправляет HEARTBEAT <последний LSN>,
+// реплика отвечает на него ACK. Реплика запоминает момент, когда она применила все записи, о которых знает
+// от primary, устаревание - время с этого момента. Primary так же запоминает для каждой реплики момент,
+// когда она подтвердила все его записи. Чтение GET <ключ> MAXSTALE <длительность> реплика выполняет, только
+// если её данные устарели не больше чем на длительность, иначе возвращает ErrStale или, с политикой
+// StaleReadsForward, выполняет чтение на primary.
+
+var (
+	ErrStale          = errors.New("STALE replica data is older than the requested bound")
+	ErrWrongStaleness = errors.New("wrong staleness bound")
+)
+
+// HeartbeatHeader - строка потока REPLICATE: HEARTBEAT <последний LSN primary>
+const HeartbeatHeader = "HEARTBEAT"
+
+// StaleReadPolicy - что делает реплика с чтением, для которого её данные устарели
+type StaleReadPolicy string
+
+const (
+	// StaleReadsError возвращает ErrStale
+	StaleReadsError StaleReadPolicy = "error"
+	// StaleReadsForward выполняет чтение на primary
+	StaleReadsForward StaleReadPolicy = "forward"
+)
+
+// WithDatabaseStaleReads задаёт политику чтения устаревших данных, по умолчанию StaleReadsError
+func WithDatabaseStaleReads(policy StaleReadPolicy) DatabaseOption {
+	return func(d *Database) {
+		d.staleReads = policy
+	}
+}
+
+// Heartbeat возвращает строку, которую primary периодически отправляет в соединение REPLICATE
+func (d *Database) Heartbeat() string {
+	return fmt.Sprintf("%s %d\n", HeartbeatHeader, d.wal.LastLSN())
+}
+
+// staleness возвращает, насколько устарели данные сервера, ok = false, если это неизвестно
+func (d *Database) staleness() (time.Duration, bool) {
+	if d.consensus != nil {
+		return d.consensus.Staleness()
+	}
+	if d.role() == RolePrimary {
+		return 0, true
+	}
+	syncedAt := d.link.syncedAt.Load()
+	if syncedAt == 0 {
+		return 0, false
+	}
+	return time.Since(time.Unix(0, syncedAt)), true
+}
+
+// markSynced запоминает момент, когда реплика применила все записи, о которых знает от primary
+func (l *primaryLink) markSynced(lastLSN uint64) {
+	if lastLSN >= l.primaryLSN.Load() {
+		l.syncedAt.Store(time.Now().UnixNano())
+	}
+}
+
+// readPrimary выполняет на primary чтение, которое реплика не может выполнить сама, или возвращает err,
+// если политика StaleReadsForward не задана
+func (d *Database) readPrimary(key string, err error) (string, error) {
+	st := d.state.Load()
+	if d.staleReads != StaleReadsForward || d.consensus != nil || d.replicator == nil || st.PrimaryAddress == "" {
+		return "", err
+	}
+	return d.replicator.Forward(d.replicatorCtx, st.PrimaryAddress, fmt.Sprintf("%s %s", compute.GetCommand, key))
+}
+
+// replicaLag - отставание реплики на primary
+type replicaLag struct {
+	Connected bool   `json:"connected"`
+	AckedLSN  uint64 `json:"acked_lsn"`
+	// Lag - на сколько записей подтверждённый LSN отстаёт от последнего LSN primary
+	Lag uint64 `json:"lag"`
+	// LagMs - сколько миллисекунд назад реплика подтвердила все записи primary, -1 - ещё не подтверждала
+	LagMs int64 `json:"lag_ms"`
+}
+
+// ReplicationMetrics возвращает отставание реплик или этого сервера для публикации через expvar
+func (d *Database) ReplicationMetrics() any {
+	lastLSN := d.wal.LastLSN()
+	metrics := map[string]any{
+		"last_lsn":     lastLSN,
+		"staleness_ms": durationMs(d.staleness()),
+	}
+	if d.consensus != nil {
+		return metrics
+	}
+
+	metrics["role"] = d.role()
+	if d.role() == RoleReplica {
+		primaryLSN := d.link.primaryLSN.Load()
+		metrics["primary_last_lsn"] = primaryLSN
+		metrics["replication_lag"] = primaryLSN - min(primaryLSN, lastLSN)
+	} else {
+		metrics["replicas"] = d.replicas.lags(lastLSN)
+	}
+	return metrics
+}
+
+// durationMs возвращает d в миллисекундах или -1, если d неизвестна
+func durationMs(d time.Duration, ok bool) int64 {
+	if !ok {
+		return -1
+	}
+	return d.Milliseconds()
+}
@@ -0,0 +1,141 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// KeySize - размер ключа AES-256 в байтах
+const KeySize = 32
+
+var (
+	ErrNoKeys          = errors.New("no encryption keys")
+	ErrKeyNotFound     = errors.New("encryption key not found")
+	ErrWrongKey        = errors.New("wrong encryption key or corrupted data")
+	ErrInvalidKey      = errors.New("invalid encryption key")
+	ErrShortCipherText = errors.New("cipher text too short")
+)
+
+type key struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// Keyring хранит набор ключей AES-256-GCM.
+// Активный ключ используется для шифрования новых данных,
+// остальные нужны для чтения данных, зашифрованных до ротации.
+type Keyring struct {
+	active *key
+	keys   map[string]*key
+}
+
+// ParseKeyring разбирает ключи в формате "id:hex", разделённые переводом строки или запятой.
+// Пустые строки и строки, начинающиеся с #, пропускаются. Последний ключ считается активным.
+func ParseKeyring(raw string) (*Keyring, error) {
+	kr := &Keyring{keys: make(map[string]*key)}
+
+	entries := strings.FieldsFunc(raw, func(r rune) bool {
+		return r == '\n' || r == ','
+	})
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		id, hexKey, ok := strings.Cut(entry, ":")
+		id = strings.TrimSpace(id)
+		if !ok || id == "" {
+			return nil, fmt.Errorf("%w: entry must have form id:hex", ErrInvalidKey)
+		}
+		if len(id) > 255 {
+			return nil, fmt.Errorf("%w: key id %q is too long", ErrInvalidKey, id)
+		}
+
+		secret, err := hex.DecodeString(strings.TrimSpace(hexKey))
+		if err != nil {
+			return nil, fmt.Errorf("%w: key %q is not hex encoded", ErrInvalidKey, id)
+		}
+
+		if err := kr.add(id, secret); err != nil {
+			return nil, err
+		}
+	}
+
+	if kr.active == nil {
+		return nil, ErrNoKeys
+	}
+
+	return kr, nil
+}
+
+func (kr *Keyring) add(id string, secret []byte) error {
+	if len(secret) != KeySize {
+		return fmt.Errorf("%w: key %q must be %d bytes, got %d", ErrInvalidKey, id, KeySize, len(secret))
+	}
+	if _, ok := kr.keys[id]; ok {
+		return fmt.Errorf("%w: duplicate key id %q", ErrInvalidKey, id)
+	}
+
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	k := &key{id: id, aead: aead}
+	kr.keys[id] = k
+	kr.active = k
+	return nil
+}
+
+// ActiveKeyID возвращает идентификатор ключа, которым шифруются новые данные
+func (kr *Keyring) ActiveKeyID() string {
+	return kr.active.id
+}
+
+// HasKey проверяет, есть ли в наборе ключ с указанным идентификатором
+func (kr *Keyring) HasKey(id string) bool {
+	_, ok := kr.keys[id]
+	return ok
+}
+
+// Seal шифрует данные активным ключом. Результат имеет вид nonce || ciphertext || tag.
+// additionalData не шифруется, но участвует в проверке подлинности.
+func (kr *Keyring) Seal(plaintext, additionalData []byte) ([]byte, error) {
+	aead := kr.active.aead
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// Open расшифровывает данные, зашифрованные ключом keyID
+func (kr *Keyring) Open(keyID string, sealed, additionalData []byte) ([]byte, error) {
+	k, ok := kr.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrKeyNotFound, keyID)
+	}
+
+	nonceSize := k.aead.NonceSize()
+	if len(sealed) < nonceSize+k.aead.Overhead() {
+		return nil, ErrShortCipherText
+	}
+
+	plaintext, err := k.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %q", ErrWrongKey, keyID)
+	}
+
+	return plaintext, nil
+}
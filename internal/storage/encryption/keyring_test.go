@@ -0,0 +1,118 @@
+package encryption
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testKey1 = "k1:000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testKey2 = "k2:1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+)
+
+func TestParseKeyring(t *testing.T) {
+	tests := []struct {
+		name          string
+		raw           string
+		expectedKeyID string
+		expectedError error
+	}{
+		{
+			name:          "one key",
+			raw:           testKey1,
+			expectedKeyID: "k1",
+		},
+		{
+			name:          "keys separated by new line, last is active",
+			raw:           "# old key\n" + testKey1 + "\n\n" + testKey2 + "\n",
+			expectedKeyID: "k2",
+		},
+		{
+			name:          "keys separated by comma",
+			raw:           testKey2 + "," + testKey1,
+			expectedKeyID: "k1",
+		},
+		{
+			name:          "empty",
+			raw:           " \n",
+			expectedError: ErrNoKeys,
+		},
+		{
+			name:          "no id",
+			raw:           strings.TrimPrefix(testKey1, "k1:"),
+			expectedError: ErrInvalidKey,
+		},
+		{
+			name:          "short key",
+			raw:           "k1:0001",
+			expectedError: ErrInvalidKey,
+		},
+		{
+			name:          "not hex",
+			raw:           "k1:zz",
+			expectedError: ErrInvalidKey,
+		},
+		{
+			name:          "duplicate id",
+			raw:           testKey1 + "," + testKey1,
+			expectedError: ErrInvalidKey,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kr, err := ParseKeyring(test.raw)
+			if test.expectedError != nil {
+				assert.ErrorIs(t, err, test.expectedError)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, test.expectedKeyID, kr.ActiveKeyID())
+			}
+		})
+	}
+}
+
+func TestKeyring_SealOpen(t *testing.T) {
+	kr, err := ParseKeyring(testKey1)
+	require.NoError(t, err)
+
+	sealed, err := kr.Seal([]byte("SET key val\n"), []byte("header"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(sealed), "SET key val")
+
+	plaintext, err := kr.Open("k1", sealed, []byte("header"))
+	require.NoError(t, err)
+	assert.Equal(t, "SET key val\n", string(plaintext))
+
+	_, err = kr.Open("k1", sealed, []byte("other header"))
+	assert.ErrorIs(t, err, ErrWrongKey)
+
+	_, err = kr.Open("k2", sealed, []byte("header"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	_, err = kr.Open("k1", sealed[:5], []byte("header"))
+	assert.ErrorIs(t, err, ErrShortCipherText)
+}
+
+func TestKeyring_OpenAfterRotation(t *testing.T) {
+	oldKr, err := ParseKeyring(testKey1)
+	require.NoError(t, err)
+	sealed, err := oldKr.Seal([]byte("data"), nil)
+	require.NoError(t, err)
+
+	kr, err := ParseKeyring(testKey1 + "\n" + testKey2)
+	require.NoError(t, err)
+	assert.Equal(t, "k2", kr.ActiveKeyID())
+
+	plaintext, err := kr.Open("k1", sealed, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(plaintext))
+
+	wrongKr, err := ParseKeyring("k1:" + strings.TrimPrefix(testKey2, "k2:"))
+	require.NoError(t, err)
+	_, err = wrongKr.Open("k1", sealed, nil)
+	assert.ErrorIs(t, err, ErrWrongKey)
+}
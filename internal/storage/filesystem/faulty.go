@@ -0,0 +1,172 @@
+package filesystem
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+var ErrInjected = errors.New("injected fault")
+
+// Op - операция, в которую можно внедрить сбой
+type Op string
+
+const (
+	OpOpen     Op = "open"
+	OpRead     Op = "read"
+	OpWrite    Op = "write"
+	OpTruncate Op = "truncate"
+	OpSync     Op = "sync"
+	OpRename   Op = "rename"
+	OpRemove   Op = "remove"
+	OpSyncDir  Op = "syncdir"
+)
+
+// Fault описывает сбой операции Op с файлом, путь которого содержит Path.
+// Первые Skip подходящих операций выполняются успешно, после этого сбой повторяется,
+// пока не вызван Clear, как у диска, который перестал отвечать.
+type Fault struct {
+	Op   Op
+	Path string
+	Skip int
+	// Err возвращается операцией, по умолчанию ErrInjected
+	Err error
+	// ShortWrite - перед ошибкой записать половину данных
+	ShortWrite bool
+}
+
+// Faulty передаёт операции в FS и возвращает ошибки в соответствии с внедрёнными сбоями
+type Faulty struct {
+	FS
+
+	mu     sync.Mutex
+	faults []*faultState
+}
+
+type faultState struct {
+	Fault
+	calls int
+}
+
+func NewFaulty(fs FS) *Faulty {
+	return &Faulty{FS: fs}
+}
+
+func (f *Faulty) Inject(fault Fault) {
+	if fault.Err == nil {
+		fault.Err = ErrInjected
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, &faultState{Fault: fault})
+}
+
+// Clear убирает все сбои
+func (f *Faulty) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = nil
+}
+
+func (f *Faulty) fault(op Op, path string) *Fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, state := range f.faults {
+		if state.Op != op || !strings.Contains(path, state.Path) {
+			continue
+		}
+		state.calls++
+		if state.calls > state.Skip {
+			fault := state.Fault
+			return &fault
+		}
+	}
+	return nil
+}
+
+func (f *Faulty) Open(name string) (io.ReadCloser, error) {
+	if fault := f.fault(OpRead, name); fault != nil {
+		return nil, pathError(string(OpRead), name, fault.Err)
+	}
+	return f.FS.Open(name)
+}
+
+func (f *Faulty) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if fault := f.fault(OpOpen, name); fault != nil {
+		return nil, pathError(string(OpOpen), name, fault.Err)
+	}
+
+	file, err := f.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{File: file, fs: f, name: name}, nil
+}
+
+func (f *Faulty) ReadFile(name string) ([]byte, error) {
+	if fault := f.fault(OpRead, name); fault != nil {
+		return nil, pathError(string(OpRead), name, fault.Err)
+	}
+	return f.FS.ReadFile(name)
+}
+
+func (f *Faulty) Rename(oldPath, newPath string) error {
+	if fault := f.fault(OpRename, oldPath+" "+newPath); fault != nil {
+		return &os.LinkError{Op: string(OpRename), Old: oldPath, New: newPath, Err: fault.Err}
+	}
+	return f.FS.Rename(oldPath, newPath)
+}
+
+func (f *Faulty) Remove(name string) error {
+	if fault := f.fault(OpRemove, name); fault != nil {
+		return pathError(string(OpRemove), name, fault.Err)
+	}
+	return f.FS.Remove(name)
+}
+
+func (f *Faulty) SyncDir(path string) error {
+	if fault := f.fault(OpSyncDir, path); fault != nil {
+		return pathError(string(OpSyncDir), path, fault.Err)
+	}
+	return f.FS.SyncDir(path)
+}
+
+type faultyFile struct {
+	File
+	fs   *Faulty
+	name string
+}
+
+func (f *faultyFile) Write(p []byte) (int, error) {
+	fault := f.fs.fault(OpWrite, f.name)
+	if fault == nil {
+		return f.File.Write(p)
+	}
+
+	n := 0
+	if fault.ShortWrite {
+		var err error
+		if n, err = f.File.Write(p[:len(p)/2]); err != nil {
+			return n, err
+		}
+	}
+	return n, pathError(string(OpWrite), f.name, fault.Err)
+}
+
+func (f *faultyFile) Truncate(size int64) error {
+	if fault := f.fs.fault(OpTruncate, f.name); fault != nil {
+		return pathError(string(OpTruncate), f.name, fault.Err)
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *faultyFile) Sync() error {
+	if fault := f.fs.fault(OpSync, f.name); fault != nil {
+		return pathError(string(OpSync), f.name, fault.Err)
+	}
+	return f.File.Sync()
+}
@@ -0,0 +1,56 @@
+package filesystem
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaulty_Skip(t *testing.T) {
+	f := NewFaulty(NewMemory())
+	f.Inject(Fault{Op: OpSync, Path: "data_", Skip: 1, Err: syscall.EIO})
+
+	file := writeFile(t, f, "/data_1", "a", true)
+	assert.ErrorIs(t, file.Sync(), syscall.EIO)
+	// сбой повторяется
+	assert.ErrorIs(t, file.Sync(), syscall.EIO)
+
+	// другие файлы не затронуты
+	other := writeFile(t, f, "/other", "a", false)
+	assert.NoError(t, other.Sync())
+
+	f.Clear()
+	assert.NoError(t, file.Sync())
+}
+
+func TestFaulty_ShortWrite(t *testing.T) {
+	f := NewFaulty(NewMemory())
+	f.Inject(Fault{Op: OpWrite, Err: syscall.ENOSPC, ShortWrite: true})
+
+	file, err := f.OpenFile("/data_1", os.O_CREATE|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	n, err := file.Write([]byte("abcd"))
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, "ab", readFile(t, f, "/data_1"))
+}
+
+func TestFaulty_Operations(t *testing.T) {
+	f := NewFaulty(NewMemory())
+	writeFile(t, f, "/data_1", "a", true)
+
+	for _, op := range []Op{OpOpen, OpRead, OpRename, OpRemove, OpSyncDir} {
+		f.Inject(Fault{Op: op})
+	}
+
+	_, err := f.OpenFile("/data_1", os.O_WRONLY, 0644)
+	assert.ErrorIs(t, err, ErrInjected)
+	_, err = f.ReadFile("/data_1")
+	assert.ErrorIs(t, err, ErrInjected)
+	assert.ErrorIs(t, f.Rename("/data_1", "/data_2"), ErrInjected)
+	assert.ErrorIs(t, f.Remove("/data_1"), ErrInjected)
+	assert.ErrorIs(t, f.SyncDir("/"), ErrInjected)
+}
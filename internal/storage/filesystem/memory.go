@@ -0,0 +1,368 @@
+package filesystem
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Memory хранит файлы в памяти и отслеживает, что из записанного уже сохранено на диск.
+// Содержимое файла сохраняется вызовом Sync, а создание, переименование и удаление файла - вызовом SyncDir
+// для его директории. Crash отбрасывает всё несохранённое, как при отключении питания.
+// Директории считаются сохранёнными сразу после создания.
+type Memory struct {
+	mu sync.Mutex
+	// файлы, видимые сейчас
+	files map[string]*memNode
+	// файлы, которые останутся после сбоя
+	durable map[string]*memNode
+	dirs    map[string]bool
+	// увеличивается при сбое, открытые до сбоя файлы становятся недействительными
+	generation int
+}
+
+type memNode struct {
+	data    []byte
+	synced  []byte
+	modTime time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		files:   make(map[string]*memNode),
+		durable: make(map[string]*memNode),
+		dirs:    map[string]bool{"/": true, ".": true},
+	}
+}
+
+// Crash имитирует отключение питания: остаются только файлы, сохранённые в директории через SyncDir,
+// с содержимым на момент последнего Sync
+func (m *Memory) Crash() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.files = make(map[string]*memNode, len(m.durable))
+	for name, node := range m.durable {
+		node.data = slices.Clone(node.synced)
+		m.files[name] = node
+	}
+	m.generation++
+}
+
+func (m *Memory) Open(name string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	node, ok := m.files[name]
+	if !ok {
+		return nil, pathError("open", name, fs.ErrNotExist)
+	}
+	return &memFile{fs: m, node: node, name: name, flag: os.O_RDONLY, generation: m.generation}, nil
+}
+
+func (m *Memory) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	node, ok := m.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, pathError("open", name, fs.ErrExist)
+	case !ok && m.dirs[name]:
+		return nil, pathError("open", name, syscall.EISDIR)
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, pathError("open", name, fs.ErrNotExist)
+	case !ok:
+		if !m.dirs[filepath.Dir(name)] {
+			return nil, pathError("open", name, fs.ErrNotExist)
+		}
+		node = &memNode{modTime: time.Now()}
+		m.files[name] = node
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		node.data = nil
+	}
+
+	return &memFile{fs: m, node: node, name: name, flag: flag, generation: m.generation}, nil
+}
+
+func (m *Memory) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	node, ok := m.files[name]
+	if !ok {
+		return nil, pathError("open", name, fs.ErrNotExist)
+	}
+	return slices.Clone(node.data), nil
+}
+
+func (m *Memory) ReadDir(name string) ([]os.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if !m.dirs[name] {
+		return nil, pathError("open", name, fs.ErrNotExist)
+	}
+
+	var entries []os.DirEntry
+	for path, node := range m.files {
+		if filepath.Dir(path) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(node.info(path)))
+		}
+	}
+	for path := range m.dirs {
+		if path != name && filepath.Dir(path) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(dirInfo(path)))
+		}
+	}
+
+	slices.SortFunc(entries, func(a, b os.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+func (m *Memory) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if node, ok := m.files[name]; ok {
+		return node.info(name), nil
+	}
+	if m.dirs[name] {
+		return dirInfo(name), nil
+	}
+	return nil, pathError("stat", name, fs.ErrNotExist)
+}
+
+func (m *Memory) Rename(oldPath, newPath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	node, ok := m.files[oldPath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: fs.ErrNotExist}
+	}
+	if !m.dirs[filepath.Dir(newPath)] || m.dirs[newPath] {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: fs.ErrInvalid}
+	}
+
+	delete(m.files, oldPath)
+	m.files[newPath] = node
+	return nil
+}
+
+func (m *Memory) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if !m.dirs[name] {
+		return pathError("remove", name, fs.ErrNotExist)
+	}
+	for path := range m.files {
+		if filepath.Dir(path) == name {
+			return pathError("remove", name, syscall.ENOTEMPTY)
+		}
+	}
+	for path := range m.dirs {
+		if path != name && filepath.Dir(path) == name {
+			return pathError("remove", name, syscall.ENOTEMPTY)
+		}
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *Memory) MkdirAll(path string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for path = filepath.Clean(path); !m.dirs[path]; path = filepath.Dir(path) {
+		if _, ok := m.files[path]; ok {
+			return pathError("mkdir", path, syscall.ENOTDIR)
+		}
+		m.dirs[path] = true
+	}
+	return nil
+}
+
+func (m *Memory) SyncDir(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path = filepath.Clean(path)
+	if !m.dirs[path] {
+		return pathError("sync", path, fs.ErrNotExist)
+	}
+
+	for name := range m.durable {
+		if filepath.Dir(name) == path {
+			delete(m.durable, name)
+		}
+	}
+	for name, node := range m.files {
+		if filepath.Dir(name) == path {
+			m.durable[name] = node
+		}
+	}
+	return nil
+}
+
+type memFile struct {
+	fs         *Memory
+	node       *memNode
+	name       string
+	flag       int
+	offset     int64
+	generation int
+	closed     bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("read"); err != nil {
+		return 0, err
+	}
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("write"); err != nil {
+		return 0, err
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, pathError("write", f.name, fs.ErrPermission)
+	}
+
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.node.data))
+	}
+	if end := f.offset + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[f.offset:], p)
+	f.offset += int64(len(p))
+	f.node.modTime = time.Now()
+
+	return len(p), nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("stat"); err != nil {
+		return nil, err
+	}
+	return f.node.info(f.name), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("truncate"); err != nil {
+		return err
+	}
+	if size < 0 {
+		return pathError("truncate", f.name, fs.ErrInvalid)
+	}
+
+	if size <= int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("sync"); err != nil {
+		return err
+	}
+	f.node.synced = slices.Clone(f.node.data)
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("close"); err != nil {
+		return err
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) check(op string) error {
+	if f.closed || f.generation != f.fs.generation {
+		return pathError(op, f.name, fs.ErrClosed)
+	}
+	return nil
+}
+
+func (n *memNode) info(path string) os.FileInfo {
+	return fileInfo{name: filepath.Base(path), size: int64(len(n.data)), modTime: n.modTime}
+}
+
+func dirInfo(path string) os.FileInfo {
+	return fileInfo{name: filepath.Base(path), dir: true}
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i fileInfo) Name() string       { return i.name }
+func (i fileInfo) Size() int64        { return i.size }
+func (i fileInfo) ModTime() time.Time { return i.modTime }
+func (i fileInfo) IsDir() bool        { return i.dir }
+func (i fileInfo) Sys() any           { return nil }
+
+func (i fileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func pathError(op, path string, err error) error {
+	return &os.PathError{Op: op, Path: path, Err: err}
+}
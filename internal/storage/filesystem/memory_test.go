@@ -0,0 +1,137 @@
+package filesystem
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, m FS, name, content string, sync bool) File {
+	f, err := m.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte(content))
+	require.NoError(t, err)
+	if sync {
+		require.NoError(t, f.Sync())
+	}
+	return f
+}
+
+func readFile(t *testing.T, m FS, name string) string {
+	data, err := m.ReadFile(name)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestMemory_ReadWrite(t *testing.T) {
+	m := NewMemory()
+	require.NoError(t, m.MkdirAll("/data/wal", 0755))
+
+	f := writeFile(t, m, "/data/wal/data_1", "abc", false)
+	_, err := f.Write([]byte("def"))
+	assert.NoError(t, err)
+	assert.Equal(t, "abcdef", readFile(t, m, "/data/wal/data_1"))
+
+	assert.NoError(t, f.Truncate(2))
+	info, err := f.Stat()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), info.Size())
+	assert.NoError(t, f.Close())
+	_, err = f.Write([]byte("x"))
+	assert.ErrorIs(t, err, fs.ErrClosed)
+
+	writeFile(t, m, "/data/wal/data_2", "", false)
+	entries, err := m.ReadDir("/data/wal/")
+	assert.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "data_1", entries[0].Name())
+	assert.Equal(t, "data_2", entries[1].Name())
+
+	_, err = m.OpenFile("/data/wal/data_1", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	assert.ErrorIs(t, err, fs.ErrExist)
+	_, err = m.OpenFile("/other/data_1", os.O_CREATE|os.O_WRONLY, 0644)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	assert.NoError(t, m.Rename("/data/wal/data_2", "/data/data_2"))
+	_, err = m.Stat("/data/data_2")
+	assert.NoError(t, err)
+	assert.NoError(t, m.Remove("/data/data_2"))
+	_, err = m.ReadFile("/data/data_2")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestMemory_OpenFollowsAppends(t *testing.T) {
+	m := NewMemory()
+	f := writeFile(t, m, "data_1", "abc", false)
+
+	r, err := m.Open("data_1")
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", string(data))
+
+	_, err = f.Write([]byte("def"))
+	require.NoError(t, err)
+	data, err = io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "def", string(data))
+	assert.NoError(t, r.Close())
+
+	_, err = m.Open("data_2")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestMemory_Crash(t *testing.T) {
+	m := NewMemory()
+	require.NoError(t, m.MkdirAll("/data", 0755))
+
+	// файл и его содержимое сохранены
+	f := writeFile(t, m, "/data/synced", "durable", true)
+	require.NoError(t, m.SyncDir("/data"))
+	_, err := f.Write([]byte(" lost"))
+	require.NoError(t, err)
+
+	// удаление не сохранено
+	writeFile(t, m, "/data/removed", "kept", true)
+	require.NoError(t, m.SyncDir("/data"))
+	require.NoError(t, m.Remove("/data/removed"))
+
+	// содержимое сохранено, а запись в директории - нет
+	writeFile(t, m, "/data/not_in_dir", "data", true)
+
+	m.Crash()
+
+	assert.Equal(t, "durable", readFile(t, m, "/data/synced"))
+	assert.Equal(t, "kept", readFile(t, m, "/data/removed"))
+	_, err = m.Stat("/data/not_in_dir")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// файлы, открытые до сбоя, недействительны
+	_, err = f.Write([]byte("x"))
+	assert.ErrorIs(t, err, fs.ErrClosed)
+}
+
+func TestMemory_CrashAfterRename(t *testing.T) {
+	m := NewMemory()
+	require.NoError(t, m.MkdirAll("/data", 0755))
+
+	writeFile(t, m, "/data/file", "old", true)
+	require.NoError(t, m.SyncDir("/data"))
+
+	writeFile(t, m, "/data/file.tmp", "new", true)
+	require.NoError(t, m.Rename("/data/file.tmp", "/data/file"))
+	m.Crash()
+	assert.Equal(t, "old", readFile(t, m, "/data/file"))
+
+	writeFile(t, m, "/data/file.tmp", "new", true)
+	require.NoError(t, m.Rename("/data/file.tmp", "/data/file"))
+	require.NoError(t, m.SyncDir("/data"))
+	m.Crash()
+	assert.Equal(t, "new", readFile(t, m, "/data/file"))
+	_, err := m.Stat("/data/file.tmp")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
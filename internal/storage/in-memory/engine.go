@@ -24,6 +24,23 @@ func (e *Engine) Set(key string, val string) error {
 	return nil
 }
 
+// SetBatch записывает пары keys[i], vals[i] под одной блокировкой, используется при загрузке снимка
+func (e *Engine) SetBatch(keys, vals []string) error {
+	defer e.mu.Unlock()
+	e.mu.Lock()
+	for i, key := range keys {
+		e.data[key] = vals[i]
+	}
+	return nil
+}
+
+// Clear удаляет все ключи
+func (e *Engine) Clear() {
+	defer e.mu.Unlock()
+	e.mu.Lock()
+	e.data = make(map[string]string)
+}
+
 func (e *Engine) Get(key string) (string, error) {
 	defer e.mu.RUnlock()
 	e.mu.RLock()
@@ -40,3 +57,15 @@ func (e *Engine) Del(key string) error {
 	delete(e.data, key)
 	return nil
 }
+
+// Range вызывает f для каждой пары ключ-значение, пока f возвращает true.
+// Порядок обхода не определён.
+func (e *Engine) Range(f func(key, val string) bool) {
+	defer e.mu.RUnlock()
+	e.mu.RLock()
+	for k, v := range e.data {
+		if !f(k, v) {
+			return
+		}
+	}
+}
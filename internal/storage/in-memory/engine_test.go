@@ -69,3 +69,52 @@ func TestEngine_Parallel_NoRace(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "val", val)
 }
+
+func TestEngine_Range(t *testing.T) {
+	e := NewEngine()
+	assert.NoError(t, e.Set("a", "1"))
+	assert.NoError(t, e.Set("b", "2"))
+	assert.NoError(t, e.Set("c", "3"))
+
+	res := make(map[string]string)
+	e.Range(func(key, val string) bool {
+		res[key] = val
+		return true
+	})
+	assert.Equal(t, map[string]string{"a": "1", "b": "2", "c": "3"}, res)
+
+	count := 0
+	e.Range(func(key, val string) bool {
+		count++
+		return false
+	})
+	assert.Equal(t, 1, count)
+}
+
+func TestEngine_SetBatch(t *testing.T) {
+	e := NewEngine()
+	assert.NoError(t, e.Set("a", "0"))
+	assert.NoError(t, e.SetBatch([]string{"a", "b"}, []string{"1", "2"}))
+
+	val, err := e.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", val)
+	val, err = e.Get("b")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", val)
+}
+
+func TestEngine_Clear(t *testing.T) {
+	e := NewEngine()
+	assert.NoError(t, e.SetBatch([]string{"a", "b"}, []string{"1", "2"}))
+	e.Clear()
+
+	_, err := e.Get("a")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	count := 0
+	e.Range(func(key, val string) bool {
+		count++
+		return true
+	})
+	assert.Equal(t, 0, count)
+}
@@ -10,4 +10,5 @@ type Engine interface {
 	Set(string, string) error
 	Get(string) (string, error)
 	Del(string) error
+	Range(func(key, val string) bool)
 }
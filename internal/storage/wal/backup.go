@@ -0,0 +1,232 @@
+package wal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+
+	"in-memory-db/internal/storage/filesystem"
+)
+
+// Резервная копия - директория с последним снимком, сегментами WAL до LSN копии и манифестом.
+// Манифест записывается последним, поэтому директория без манифеста - незавершённая копия.
+
+const (
+	BackupManifestName = "backup_manifest.json"
+	backupVersion      = 1
+)
+
+var (
+	ErrBackupExists       = errors.New("backup directory is not empty")
+	ErrBackupCorrupted    = errors.New("backup is corrupted")
+	ErrDataDirectoryInUse = errors.New("data directory already contains wal")
+)
+
+type BackupManifest struct {
+	Version     int          `json:"version"`
+	CreatedAt   time.Time    `json:"created_at"`
+	LSN         uint64       `json:"lsn"`
+	SnapshotLSN uint64       `json:"snapshot_lsn"`
+	Encrypted   bool         `json:"encrypted"`
+	Files       []BackupFile `json:"files"`
+}
+
+type BackupFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+var errBackupCut = errors.New("record after backup lsn")
+
+// Backup копирует в dir последний снимок и сегменты с записями до lsn включительно.
+// Запись в WAL при этом продолжается. Вызывающий должен гарантировать, что все записи до lsn
+// уже сохранены на диск. Если сегмент удалён политикой хранения во время копирования, копию нужно повторить.
+func (w *Wal) Backup(dir string, lsn uint64) (BackupManifest, error) {
+	fs := w.segment.fs
+	if err := checkEmptyDir(fs, dir); err != nil {
+		return BackupManifest{}, err
+	}
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return BackupManifest{}, err
+	}
+
+	manifest := BackupManifest{Version: backupVersion, CreatedAt: time.Now().UTC(), LSN: lsn, Encrypted: w.segment.keyring != nil}
+
+	snapshots, err := ListSnapshotFiles(fs, w.segment.DataDirectory)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if snapshots[i].LSN > lsn {
+			continue
+		}
+		if err := copyFile(fs, snapshots[i].Path, filepath.Join(dir, snapshots[i].Name)); err != nil {
+			return BackupManifest{}, err
+		}
+		manifest.SnapshotLSN = snapshots[i].LSN
+		manifest.Files = append(manifest.Files, BackupFile{Name: snapshots[i].Name})
+		break
+	}
+
+	segments, err := ListSegmentFiles(fs, w.segment.DataDirectory)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	decoder := Decoder{}
+	for i, segment := range segments {
+		path := filepath.Join(dir, segment.Name)
+		if err := copyFile(fs, segment.Path, path); err != nil {
+			return BackupManifest{}, err
+		}
+
+		cut := -1
+		err := ReadSegmentFile(fs, path, w.segment.keyring, &decoder, func(index int, r Record) error {
+			if r.LSN > lsn {
+				cut = index
+				return errBackupCut
+			}
+			return nil
+		})
+		var recordErr *RecordError
+		switch {
+		case errors.Is(err, errBackupCut):
+		case errors.As(err, &recordErr) && i == len(segments)-1:
+			// в последний сегмент в это время может дописываться пачка после lsn
+			cut = recordErr.Index
+		case err != nil:
+			return BackupManifest{}, fmt.Errorf("segment %s: %w", segment.Name, err)
+		}
+
+		if cut == 0 {
+			if err := fs.Remove(path); err != nil {
+				return BackupManifest{}, err
+			}
+			break
+		}
+		if cut > 0 {
+			if err := TruncateSegmentFile(fs, path, w.segment.keyring, cut); err != nil {
+				return BackupManifest{}, err
+			}
+		}
+		manifest.Files = append(manifest.Files, BackupFile{Name: segment.Name})
+		if cut > 0 {
+			break
+		}
+	}
+	if decoder.LastLSN < lsn && manifest.SnapshotLSN < lsn {
+		return BackupManifest{}, fmt.Errorf("%w: wal ends at %d, backup lsn %d", ErrLSNNotAvailable, decoder.LastLSN, lsn)
+	}
+
+	for i := range manifest.Files {
+		if manifest.Files[i].Size, manifest.Files[i].SHA256, err = fileChecksum(fs, filepath.Join(dir, manifest.Files[i].Name)); err != nil {
+			return BackupManifest{}, err
+		}
+	}
+	if err := fs.SyncDir(dir); err != nil {
+		return BackupManifest{}, err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	if err := replaceFile(fs, filepath.Join(dir, BackupManifestName), data); err != nil {
+		return BackupManifest{}, err
+	}
+	w.logger.Info("backup written", zap.String("directory", dir), zap.Uint64("lsn", lsn), zap.Int("files", len(manifest.Files)))
+
+	return manifest, nil
+}
+
+// VerifyBackup читает манифест и проверяет размеры и контрольные суммы файлов копии
+func VerifyBackup(fs filesystem.FS, dir string) (BackupManifest, error) {
+	data, err := fs.ReadFile(filepath.Join(dir, BackupManifestName))
+	if err != nil {
+		return BackupManifest{}, fmt.Errorf("%w: %w", ErrBackupCorrupted, err)
+	}
+
+	var manifest BackupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return BackupManifest{}, fmt.Errorf("%w: manifest: %w", ErrBackupCorrupted, err)
+	}
+	if manifest.Version != backupVersion {
+		return BackupManifest{}, fmt.Errorf("%w: unsupported version %d", ErrBackupCorrupted, manifest.Version)
+	}
+
+	for _, file := range manifest.Files {
+		if file.Name != filepath.Base(file.Name) {
+			return BackupManifest{}, fmt.Errorf("%w: bad file name %q", ErrBackupCorrupted, file.Name)
+		}
+		size, checksum, err := fileChecksum(fs, filepath.Join(dir, file.Name))
+		if err != nil {
+			return BackupManifest{}, fmt.Errorf("%w: %w", ErrBackupCorrupted, err)
+		}
+		if size != file.Size || checksum != file.SHA256 {
+			return BackupManifest{}, fmt.Errorf("%w: %s checksum mismatch", ErrBackupCorrupted, file.Name)
+		}
+	}
+
+	return manifest, nil
+}
+
+// RestoreBackup проверяет копию и копирует её файлы в dataDirectory, в которой ещё нет WAL и снимков
+func RestoreBackup(fs filesystem.FS, backupDir, dataDirectory string) (BackupManifest, error) {
+	manifest, err := VerifyBackup(fs, backupDir)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+
+	if err := fs.MkdirAll(dataDirectory, 0755); err != nil {
+		return BackupManifest{}, err
+	}
+	segments, err := ListSegmentFiles(fs, dataDirectory)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	snapshots, err := ListSnapshotFiles(fs, dataDirectory)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	if len(segments) > 0 || len(snapshots) > 0 {
+		return BackupManifest{}, ErrDataDirectoryInUse
+	}
+
+	for _, file := range manifest.Files {
+		if err := copyFile(fs, filepath.Join(backupDir, file.Name), filepath.Join(dataDirectory, file.Name)); err != nil {
+			return BackupManifest{}, err
+		}
+	}
+
+	return manifest, fs.SyncDir(dataDirectory)
+}
+
+func fileChecksum(fs filesystem.FS, path string) (int64, string, error) {
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		return 0, "", err
+	}
+	sum := sha256.Sum256(data)
+	return int64(len(data)), hex.EncodeToString(sum[:]), nil
+}
+
+func checkEmptyDir(fsys filesystem.FS, dir string) error {
+	entries, err := fsys.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%w: %s", ErrBackupExists, dir)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package wal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"in-memory-db/internal/storage/filesystem"
+)
+
+const backupTestDirectory = "/backup/daily"
+
+func writeTestSnapshot(t *testing.T, w *Wal, lsn uint64) {
+	require.NoError(t, w.WriteSnapshot(lsn, func(f func(key, val string) bool) {
+		for i := uint64(1); i <= lsn; i++ {
+			if !f(fmt.Sprintf("key%d", i), "val") {
+				return
+			}
+		}
+	}))
+}
+
+func TestWal_BackupWhileWriting(t *testing.T) {
+	fs := filesystem.NewMemory()
+	w := startTailTestWal(t, fs)
+	writeQueries(t, w, 1, 10)
+	writeTestSnapshot(t, w, 10)
+	writeQueries(t, w, 11, 20)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		writeQueries(t, w, 21, 60)
+	}()
+	manifest, err := w.Backup(backupTestDirectory, 20)
+	<-done
+	require.NoError(t, err)
+	assert.Equal(t, uint64(20), manifest.LSN)
+	assert.Equal(t, uint64(10), manifest.SnapshotLSN)
+
+	_, err = VerifyBackup(fs, backupTestDirectory)
+	require.NoError(t, err)
+
+	_, err = RestoreBackup(fs, backupTestDirectory, "/restored")
+	require.NoError(t, err)
+
+	// восстановленная директория содержит снимок и записи ровно до LSN копии
+	var restored []string
+	var lsns []uint64
+	restoredWal := NewWal(context.Background(), 1, time.Hour, NewSegment(256, "/restored", WithSegmentFileSystem(fs)), zap.NewNop())
+	require.NoError(t, restoredWal.Init(replayFunc(
+		func(key, val string) error {
+			restored = append(restored, key)
+			return nil
+		},
+		func(r Record) error {
+			lsns = append(lsns, r.LSN)
+			return nil
+		},
+	)))
+	assert.Len(t, restored, 10)
+	require.NotEmpty(t, lsns)
+	assert.Equal(t, uint64(11), lsns[0])
+	assert.Equal(t, uint64(20), lsns[len(lsns)-1])
+	assert.Equal(t, uint64(20), restoredWal.LastLSN())
+}
+
+func TestWal_BackupErrors(t *testing.T) {
+	fs := filesystem.NewMemory()
+	w := startTailTestWal(t, fs)
+	writeQueries(t, w, 1, 5)
+
+	_, err := w.Backup(backupTestDirectory, 6)
+	assert.ErrorIs(t, err, ErrLSNNotAvailable)
+
+	require.NoError(t, fs.MkdirAll("/backup/other", 0755))
+	f, err := fs.OpenFile("/backup/other/file", os.O_CREATE|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	_, err = w.Backup("/backup/other", 5)
+	assert.ErrorIs(t, err, ErrBackupExists)
+
+	_, err = RestoreBackup(fs, backupTestDirectory, "/restored")
+	assert.ErrorIs(t, err, ErrBackupCorrupted, "backup without manifest")
+
+	manifest, err := w.Backup("/backup/next", 5)
+	require.NoError(t, err)
+	_, err = RestoreBackup(fs, "/backup/next", crashTestDirectory)
+	assert.ErrorIs(t, err, ErrDataDirectoryInUse)
+
+	// изменённый сегмент не проходит проверку контрольной суммы
+	path := filepath.Join("/backup/next", manifest.Files[0].Name)
+	f, err = fs.OpenFile(path, os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("9"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	_, err = VerifyBackup(fs, "/backup/next")
+	assert.ErrorIs(t, err, ErrBackupCorrupted)
+}
@@ -0,0 +1,128 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DiskGuard следит за свободным местом в директории данных. Когда места меньше MinFree,
+// запись в WAL отклоняется с ErrDiskFull, пока места снова не станет не меньше ResumeFree.
+// Чтение при этом продолжает работать.
+
+var ErrDiskFull = errors.New("DISK_FULL not enough free space for wal, writes are rejected")
+
+// DiskGuardPolicy задаёт пороги свободного места в байтах. Если ResumeFree меньше MinFree, используется MinFree.
+type DiskGuardPolicy struct {
+	MinFree    int64
+	ResumeFree int64
+}
+
+// Метрики свободного места публикуются через expvar в wal вместе с метриками записи
+var diskMetrics = struct {
+	freeBytes expvar.Int
+	full      expvar.Int
+	rejected  expvar.Int
+}{}
+
+type DiskGuard struct {
+	dataDirectory string
+	policy        DiskGuardPolicy
+	logger        *zap.Logger
+
+	full      atomic.Bool
+	freeBytes atomic.Int64
+	// возвращает свободное для непривилегированного процесса место
+	freeSpace func(path string) (int64, error)
+}
+
+func NewDiskGuard(dataDirectory string, policy DiskGuardPolicy, logger *zap.Logger) *DiskGuard {
+	policy.ResumeFree = max(policy.ResumeFree, policy.MinFree)
+	return &DiskGuard{
+		dataDirectory: dataDirectory,
+		policy:        policy,
+		logger:        logger,
+		freeSpace:     statfsFreeSpace,
+	}
+}
+
+// Run проверяет свободное место с интервалом interval, пока не завершится ctx
+func (g *DiskGuard) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := g.Check(); err != nil {
+				g.logger.Error("check free disk space", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Check обновляет свободное место и переключает запрет записи
+func (g *DiskGuard) Check() error {
+	free, err := g.freeSpace(g.dataDirectory)
+	if err != nil {
+		return err
+	}
+	g.freeBytes.Store(free)
+	diskMetrics.freeBytes.Set(free)
+
+	switch {
+	case !g.full.Load() && free < g.policy.MinFree:
+		g.setFull(true)
+		g.logger.Error("not enough free disk space, wal writes are rejected",
+			zap.Int64("free_bytes", free),
+			zap.Int64("min_free_bytes", g.policy.MinFree),
+		)
+	case g.full.Load() && free >= g.policy.ResumeFree:
+		g.setFull(false)
+		g.logger.Info("free disk space is available, wal writes are resumed", zap.Int64("free_bytes", free))
+	}
+
+	return nil
+}
+
+// Full сообщает, что запись в WAL запрещена
+func (g *DiskGuard) Full() bool {
+	return g.full.Load()
+}
+
+// FreeBytes возвращает свободное место на момент последней проверки
+func (g *DiskGuard) FreeBytes() int64 {
+	return g.freeBytes.Load()
+}
+
+// writeFailed запрещает запись после ошибки ENOSPC, не дожидаясь следующей проверки
+func (g *DiskGuard) writeFailed(err error) {
+	if errors.Is(err, syscall.ENOSPC) && !g.full.Load() {
+		g.setFull(true)
+		g.logger.Error("disk is full, wal writes are rejected", zap.Error(err))
+	}
+}
+
+func (g *DiskGuard) setFull(full bool) {
+	g.full.Store(full)
+	if full {
+		diskMetrics.full.Set(1)
+	} else {
+		diskMetrics.full.Set(0)
+	}
+}
+
+func statfsFreeSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
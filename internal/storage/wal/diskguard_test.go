@@ -0,0 +1,58 @@
+package wal
+
+import (
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"in-memory-db/internal/storage/filesystem"
+)
+
+func TestDiskGuard(t *testing.T) {
+	var free atomic.Int64
+	free.Store(100)
+	guard := NewDiskGuard(crashTestDirectory, DiskGuardPolicy{MinFree: 50, ResumeFree: 80}, zap.NewNop())
+	guard.freeSpace = func(path string) (int64, error) {
+		return free.Load(), nil
+	}
+	w, _ := startTestWal(t, filesystem.NewMemory(), WithWalDiskGuard(guard))
+
+	require.NoError(t, guard.Check())
+	require.NoError(t, w.Write("SET key1 val"))
+
+	free.Store(40)
+	require.NoError(t, guard.Check())
+	assert.True(t, guard.Full())
+	assert.ErrorIs(t, w.Write("SET key2 val"), ErrDiskFull)
+	assert.Equal(t, Stats{LastLSN: 1, SyncedLSN: 1, QueueCapacity: defaultQueueSize, DiskFull: true, DiskFreeBytes: 40}, w.Stats())
+
+	// запись возобновляется только после освобождения места выше второго порога
+	free.Store(60)
+	require.NoError(t, guard.Check())
+	assert.ErrorIs(t, w.Write("SET key2 val"), ErrDiskFull)
+	free.Store(80)
+	require.NoError(t, guard.Check())
+	assert.False(t, guard.Full())
+	assert.NoError(t, w.Write("SET key2 val"))
+}
+
+func TestDiskGuard_WriteFailed(t *testing.T) {
+	fs := filesystem.NewFaulty(filesystem.NewMemory())
+	guard := NewDiskGuard(crashTestDirectory, DiskGuardPolicy{}, zap.NewNop())
+	guard.freeSpace = func(path string) (int64, error) {
+		return 1000, nil
+	}
+	w, _ := startTestWal(t, fs, WithWalDiskGuard(guard))
+
+	fs.Inject(filesystem.Fault{Op: filesystem.OpWrite, Path: "data_", Err: syscall.ENOSPC})
+	assert.ErrorIs(t, w.Write("SET key1 val"), syscall.ENOSPC)
+	assert.True(t, guard.Full())
+	assert.ErrorIs(t, w.Write("SET key2 val"), ErrDiskFull)
+
+	fs.Clear()
+	require.NoError(t, guard.Check())
+	assert.NoError(t, w.Write("SET key2 val"))
+}
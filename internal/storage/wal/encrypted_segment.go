@@ -0,0 +1,101 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"in-memory-db/internal/storage/encryption"
+)
+
+// Зашифрованный сегмент имеет вид:
+//   magic (8 байт) | длина id ключа (1 байт) | id ключа | фрейм | фрейм | ...
+// каждый фрейм - это одна пачка запросов, записанная через Segment.Write:
+//   длина (4 байта, big endian) | nonce || ciphertext || tag
+// заголовок используется как additional data, поэтому подменить id ключа незаметно нельзя.
+
+var encryptedSegmentMagic = []byte("IMDBWALE")
+
+const frameLengthSize = 4
+
+var (
+	ErrEncryptionNotConfigured = errors.New("segment is encrypted, but encryption is not configured")
+	ErrCorruptedSegment        = errors.New("corrupted segment")
+)
+
+func isEncryptedSegment(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedSegmentMagic)
+}
+
+func encodeEncryptedHeader(keyID string) []byte {
+	header := make([]byte, 0, len(encryptedSegmentMagic)+1+len(keyID))
+	header = append(header, encryptedSegmentMagic...)
+	header = append(header, byte(len(keyID)))
+	header = append(header, keyID...)
+	return header
+}
+
+// decodeEncryptedHeader возвращает id ключа, сам заголовок и данные после него
+func decodeEncryptedHeader(data []byte) (string, []byte, []byte, error) {
+	if !isEncryptedSegment(data) || len(data) < len(encryptedSegmentMagic)+1 {
+		return "", nil, nil, fmt.Errorf("%w: bad header", ErrCorruptedSegment)
+	}
+
+	keyIDLen := int(data[len(encryptedSegmentMagic)])
+	headerLen := len(encryptedSegmentMagic) + 1 + keyIDLen
+	if len(data) < headerLen {
+		return "", nil, nil, fmt.Errorf("%w: bad header", ErrCorruptedSegment)
+	}
+
+	return string(data[len(encryptedSegmentMagic)+1 : headerLen]), data[:headerLen], data[headerLen:], nil
+}
+
+func encodeEncryptedFrame(keyring *encryption.Keyring, header, data []byte) ([]byte, error) {
+	sealed, err := keyring.Seal(data, header)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, frameLengthSize, frameLengthSize+len(sealed))
+	binary.BigEndian.PutUint32(frame, uint32(len(sealed)))
+	return append(frame, sealed...), nil
+}
+
+// readEncryptedSegment расшифровывает все фреймы сегмента и передаёт их в handler
+func readEncryptedSegment(keyring *encryption.Keyring, data []byte, handler func([]byte) error) error {
+	keyID, header, body, err := decodeEncryptedHeader(data)
+	if err != nil {
+		return err
+	}
+
+	if keyring == nil {
+		return fmt.Errorf("%w: key %q", ErrEncryptionNotConfigured, keyID)
+	}
+	if !keyring.HasKey(keyID) {
+		return fmt.Errorf("%w: %q", encryption.ErrKeyNotFound, keyID)
+	}
+
+	for len(body) > 0 {
+		if len(body) < frameLengthSize {
+			return fmt.Errorf("%w: truncated frame length", ErrCorruptedSegment)
+		}
+		frameLen := int(binary.BigEndian.Uint32(body))
+		body = body[frameLengthSize:]
+		if len(body) < frameLen {
+			return fmt.Errorf("%w: truncated frame", ErrCorruptedSegment)
+		}
+
+		plaintext, err := keyring.Open(keyID, body[:frameLen], header)
+		if err != nil {
+			return err
+		}
+		if err := handler(plaintext); err != nil {
+			return err
+		}
+
+		body = body[frameLen:]
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Версия формата хранится в начале каждого сегмента строкой "IMDBWAL <версия>\n",
+// после неё идут записи или заголовок зашифрованного сегмента. Сегменты без этой строки
+// записаны до появления версий и имеют версию 1. Версия снимка хранится в его заголовке.
+// Файлы более новых версий не читаются, старые читаются и переводятся в текущий формат командой walctl migrate.
+
+const (
+	// SegmentFormatVersion - версия формата, в которой записываются новые сегменты
+	SegmentFormatVersion = 2
+	// SnapshotFormatVersion - версия формата, в которой записываются новые снимки
+	SnapshotFormatVersion = 3
+	// lastTextSnapshotVersion - последняя версия текстового формата снимков
+	lastTextSnapshotVersion = 2
+	// legacyFormatVersion - версия файлов, записанных без номера версии
+	legacyFormatVersion = 1
+
+	segmentVersionPrefix = "IMDBWAL "
+)
+
+var ErrUnsupportedFormatVersion = errors.New("unsupported data format version")
+
+func encodeSegmentVersion() []byte {
+	return []byte(fmt.Sprintf("%s%d\n", segmentVersionPrefix, SegmentFormatVersion))
+}
+
+// splitSegmentVersion возвращает версию формата сегмента и данные после строки версии
+func splitSegmentVersion(data []byte) (int, []byte, error) {
+	if !bytes.HasPrefix(data, []byte(segmentVersionPrefix)) {
+		return legacyFormatVersion, data, nil
+	}
+
+	line, rest, ok := bytes.Cut(data, []byte("\n"))
+	if !ok {
+		return 0, nil, fmt.Errorf("%w: bad version header", ErrCorruptedSegment)
+	}
+	version, err := strconv.Atoi(string(line[len(segmentVersionPrefix):]))
+	if err != nil || version <= legacyFormatVersion {
+		return 0, nil, fmt.Errorf("%w: bad version header", ErrCorruptedSegment)
+	}
+	if err := checkFormatVersion("segment", version, SegmentFormatVersion); err != nil {
+		return 0, nil, err
+	}
+
+	return version, rest, nil
+}
+
+// segmentVersionIncomplete сообщает, что данных пока не хватает, чтобы прочитать строку версии
+func segmentVersionIncomplete(data []byte) bool {
+	if len(data) < len(segmentVersionPrefix) {
+		return bytes.HasPrefix([]byte(segmentVersionPrefix), data)
+	}
+	return bytes.HasPrefix(data, []byte(segmentVersionPrefix)) && bytes.IndexByte(data, '\n') < 0
+}
+
+func checkFormatVersion(kind string, version, supported int) error {
+	if version > supported {
+		return fmt.Errorf("%w: %s format version %d is newer than supported %d, upgrade the server", ErrUnsupportedFormatVersion, kind, version, supported)
+	}
+	return nil
+}
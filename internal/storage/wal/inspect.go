@@ -0,0 +1,235 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"in-memory-db/internal/storage/encryption"
+	"in-memory-db/internal/storage/filesystem"
+)
+
+var (
+	ErrRecordIndexOutOfRange = errors.New("record index out of range")
+
+	errStopReading = errors.New("stop reading")
+)
+
+// SegmentFile описывает файл сегмента в директории данных
+type SegmentFile struct {
+	Number  int
+	Name    string
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// ListSegmentFiles возвращает файлы сегментов, отсортированные по номеру
+func ListSegmentFiles(fs filesystem.FS, dataDirectory string) ([]SegmentFile, error) {
+	entries, err := fs.ReadDir(dataDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]SegmentFile, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		fn := segmentFileNumber(entry.Name())
+		if fn == 0 {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, SegmentFile{
+			Number:  fn,
+			Name:    entry.Name(),
+			Path:    filepath.Join(dataDirectory, entry.Name()),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+	// т.к. у нас нет гарантии порядка файлов, то на надо отсортировать
+	slices.SortFunc(files, func(a, b SegmentFile) int {
+		return a.Number - b.Number
+	})
+
+	return files, nil
+}
+
+func segmentFileNumber(fileName string) int {
+	res := strings.Split(fileName, "_")
+	if len(res) != 2 || res[0] != "data" {
+		return 0
+	}
+
+	number, _ := strconv.Atoi(res[1])
+	return number
+}
+
+// RecordError указывает на запись сегмента, которую не удалось прочитать
+type RecordError struct {
+	Index int
+	Err   error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("record %d: %s", e.Index, e.Err)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// ReadSegmentFile читает записи одного сегмента. index - порядковый номер записи внутри сегмента.
+// decoder хранит LSN между вызовами, что позволяет читать сегменты по очереди.
+func ReadSegmentFile(fs filesystem.FS, path string, keyring *encryption.Keyring, decoder *Decoder, f func(index int, r Record) error) error {
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	index := 0
+	err = readSegmentData(keyring, data, func(batch []byte) error {
+		for _, line := range splitBatch(batch) {
+			r, err := decoder.Decode(line)
+			if err != nil {
+				return &RecordError{Index: index, Err: err}
+			}
+			if err := f(index, r); err != nil {
+				return err
+			}
+			index++
+		}
+		return nil
+	})
+	var recordErr *RecordError
+	if err != nil && !errors.As(err, &recordErr) {
+		return &RecordError{Index: index, Err: err}
+	}
+
+	return err
+}
+
+// TruncateSegmentFile оставляет в сегменте только записи с номером меньше recordIndex.
+// Зашифрованный сегмент перешифровывается активным ключом.
+// Файл заменяется атомарно, поэтому при сбое остаётся либо старая, либо новая версия.
+// Описание сегмента в манифесте обновляется после замены файла.
+func TruncateSegmentFile(fs filesystem.FS, path string, keyring *encryption.Keyring, recordIndex int) error {
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var kept [][]byte
+	index := 0
+	err = readSegmentData(keyring, data, func(batch []byte) error {
+		var keptBatch []byte
+		for _, line := range splitBatch(batch) {
+			if index >= recordIndex {
+				break
+			}
+			if _, err := DecodeRecord(line); err != nil {
+				return &RecordError{Index: index, Err: err}
+			}
+			keptBatch = append(keptBatch, line+"\n"...)
+			index++
+		}
+		if len(keptBatch) > 0 {
+			kept = append(kept, keptBatch)
+		}
+		if index >= recordIndex {
+			return errStopReading
+		}
+		return nil
+	})
+	if err == nil {
+		return fmt.Errorf("%w: segment has %d records", ErrRecordIndexOutOfRange, index)
+	}
+	if !errors.Is(err, errStopReading) {
+		return fmt.Errorf("can not keep records before %d: %w", recordIndex, err)
+	}
+
+	// строка версии сохраняется как есть, перевод в текущий формат делает только миграция
+	_, body, err := splitSegmentVersion(data)
+	if err != nil {
+		return err
+	}
+	content := slices.Clone(data[:len(data)-len(body)])
+	if isEncryptedSegment(body) {
+		header := encodeEncryptedHeader(keyring.ActiveKeyID())
+		content = append(content, header...)
+		for _, batch := range kept {
+			frame, err := encodeEncryptedFrame(keyring, header, batch)
+			if err != nil {
+				return err
+			}
+			content = append(content, frame...)
+		}
+	} else {
+		for _, batch := range kept {
+			content = append(content, batch...)
+		}
+	}
+
+	if err := replaceFile(fs, path, content); err != nil {
+		return err
+	}
+
+	name := filepath.Base(path)
+	info := describeSegment(keyring, name, content)
+	return updateSegmentManifest(fs, filepath.Dir(path), func(m *SegmentManifest) {
+		for i := range m.Segments {
+			if m.Segments[i].Name == name {
+				info.Active = m.Segments[i].Active
+				m.Segments[i] = info
+			}
+		}
+	})
+}
+
+func readSegmentData(keyring *encryption.Keyring, data []byte, handler func([]byte) error) error {
+	_, data, err := splitSegmentVersion(data)
+	if err != nil {
+		return err
+	}
+	if isEncryptedSegment(data) {
+		return readEncryptedSegment(keyring, data, handler)
+	}
+	return handler(data)
+}
+
+func replaceFile(fs filesystem.FS, path string, content []byte) error {
+	tmpPath := path + ".tmp"
+	f, err := fs.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := fs.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	return fs.SyncDir(filepath.Dir(path))
+}
@@ -0,0 +1,120 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"in-memory-db/internal/storage/encryption"
+	"in-memory-db/internal/storage/filesystem"
+	"in-memory-db/internal/testingh"
+)
+
+type InspectSuite struct {
+	testingh.BaseDirSuite
+}
+
+func TestInspectSuite(t *testing.T) {
+	suite.Run(t, new(InspectSuite))
+}
+
+func (s *InspectSuite) SetupTest() {
+	s.BaseDir = testingh.GetBaseDir(runtime.Caller(0))
+	s.BaseDirSuite.SetupTest()
+}
+
+func (s *InspectSuite) writeRecords(segment *Segment, from, to int) {
+	for i := from; i <= to; i++ {
+		s.NoError(segment.Write([]byte(NewRecord(uint64(i), time.Now(), fmt.Sprintf("SET key%d val", i)).Encode())))
+	}
+}
+
+func (s *InspectSuite) readRecords(path string, keyring *encryption.Keyring) []Record {
+	var records []Record
+	err := ReadSegmentFile(filesystem.OS{}, path, keyring, &Decoder{}, func(index int, r Record) error {
+		s.Equal(len(records), index)
+		records = append(records, r)
+		return nil
+	})
+	s.NoError(err)
+	return records
+}
+
+func (s *InspectSuite) TestListSegmentFiles() {
+	for _, name := range []string{"data_10", "data_2", "data_1", "data_x", "other", "data_3.tmp"} {
+		s.NoError(os.WriteFile(s.BaseDir+name, []byte("SET a b\n"), 0644))
+	}
+	s.NoError(os.Mkdir(s.BaseDir+"data_4", 0755))
+
+	files, err := ListSegmentFiles(filesystem.OS{}, s.BaseDir)
+	s.NoError(err)
+	s.Len(files, 3)
+	s.Equal([]int{1, 2, 10}, []int{files[0].Number, files[1].Number, files[2].Number})
+	s.Equal("data_10", files[2].Name)
+	s.Equal(s.BaseDir+"data_10", files[2].Path)
+	s.Equal(int64(8), files[2].Size)
+}
+
+func (s *InspectSuite) TestReadSegmentFile_Corrupted() {
+	content := NewRecord(1, time.Now(), "SET a 1").Encode() + "2 1 00000000 SET b 2\n"
+	s.NoError(os.WriteFile(s.BaseDir+"data_1", []byte(content), 0644))
+
+	var read int
+	err := ReadSegmentFile(filesystem.OS{}, s.BaseDir+"data_1", nil, &Decoder{}, func(index int, r Record) error {
+		read++
+		return nil
+	})
+	s.Equal(1, read)
+	var recordErr *RecordError
+	s.ErrorAs(err, &recordErr)
+	s.Equal(1, recordErr.Index)
+	s.ErrorIs(err, ErrChecksumMismatch)
+}
+
+func (s *InspectSuite) TestTruncateSegmentFile_Plain() {
+	segment := NewSegment(4096, s.BaseDir)
+	s.NoError(segment.Init(func(data []byte) error { return nil }))
+	s.writeRecords(segment, 1, 3)
+	s.writeRecords(segment, 4, 5)
+	s.NoError(segment.Close())
+
+	s.NoError(TruncateSegmentFile(filesystem.OS{}, s.BaseDir+"data_1", nil, 4))
+	records := s.readRecords(s.BaseDir+"data_1", nil)
+	s.Len(records, 4)
+	s.Equal("SET key4 val", records[3].Query)
+
+	s.NoError(TruncateSegmentFile(filesystem.OS{}, s.BaseDir+"data_1", nil, 0))
+	s.Empty(s.readRecords(s.BaseDir+"data_1", nil))
+
+	s.ErrorIs(TruncateSegmentFile(filesystem.OS{}, s.BaseDir+"data_1", nil, 1), ErrRecordIndexOutOfRange)
+	s.ElementsMatch([]string{"data_1", SegmentManifestName}, s.FileNamesInBaseDir())
+}
+
+func (s *InspectSuite) TestTruncateSegmentFile_CorruptedTail() {
+	content := NewRecord(1, time.Now(), "SET a 1").Encode() + NewRecord(2, time.Now(), "SET b 2").Encode() + "3 1 000"
+	s.NoError(os.WriteFile(s.BaseDir+"data_1", []byte(content), 0644))
+
+	s.Error(TruncateSegmentFile(filesystem.OS{}, s.BaseDir+"data_1", nil, 3))
+	s.NoError(TruncateSegmentFile(filesystem.OS{}, s.BaseDir+"data_1", nil, 2))
+	s.Len(s.readRecords(s.BaseDir+"data_1", nil), 2)
+}
+
+func (s *InspectSuite) TestTruncateSegmentFile_Encrypted() {
+	keyring, err := encryption.ParseKeyring(testKey1)
+	s.Require().NoError(err)
+
+	segment := NewSegment(4096, s.BaseDir, WithSegmentKeyring(keyring))
+	s.NoError(segment.Init(func(data []byte) error { return nil }))
+	s.writeRecords(segment, 1, 5)
+	s.NoError(segment.Close())
+
+	s.NoError(TruncateSegmentFile(filesystem.OS{}, s.BaseDir+"data_1", keyring, 2))
+	s.NotContains(string(s.ReadFile(s.BaseDir+"data_1")), "SET")
+
+	records := s.readRecords(s.BaseDir+"data_1", keyring)
+	s.Len(records, 2)
+	s.Equal(uint64(2), records[1].LSN)
+}
@@ -0,0 +1,65 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Директория данных блокируется через flock на файл lock, чтобы два процесса не писали в одни сегменты.
+// Блокировка снимается ядром при завершении процесса, поэтому файл, оставшийся после сбоя, не мешает запуску.
+
+const LockFileName = "lock"
+
+var ErrDataDirectoryLocked = errors.New("data directory is locked by another process")
+
+type DataDirectoryLock struct {
+	file *os.File
+}
+
+// LockDataDirectory захватывает блокировку директории данных и записывает в файл PID и время запуска владельца.
+// Если блокировка занята, сразу возвращает ErrDataDirectoryLocked с данными владельца.
+func LockDataDirectory(dataDirectory string) (*DataDirectoryLock, error) {
+	path := filepath.Join(dataDirectory, LockFileName)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		owner, _ := os.ReadFile(path)
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s, %s", ErrDataDirectoryLocked, dataDirectory, strings.Join(strings.Fields(string(owner)), " "))
+		}
+		return nil, err
+	}
+
+	owner := fmt.Sprintf("pid %d\nstarted %s\n", os.Getpid(), time.Now().UTC().Format(time.RFC3339))
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteAt([]byte(owner), 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &DataDirectoryLock{file: f}, nil
+}
+
+// Unlock очищает данные владельца и снимает блокировку. Файл не удаляется: другой процесс
+// мог уже открыть его, чтобы захватить блокировку.
+func (l *DataDirectoryLock) Unlock() error {
+	truncateErr := l.file.Truncate(0)
+	unlockErr := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	return errors.Join(truncateErr, unlockErr, l.file.Close())
+}
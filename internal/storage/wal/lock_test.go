@@ -0,0 +1,33 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockDataDirectory(t *testing.T) {
+	dir := t.TempDir()
+
+	lock, err := LockDataDirectory(dir)
+	require.NoError(t, err)
+	owner, err := os.ReadFile(filepath.Join(dir, LockFileName))
+	require.NoError(t, err)
+	assert.Contains(t, string(owner), fmt.Sprintf("pid %d\n", os.Getpid()))
+
+	_, err = LockDataDirectory(dir)
+	assert.ErrorIs(t, err, ErrDataDirectoryLocked)
+	assert.ErrorContains(t, err, fmt.Sprintf("pid %d", os.Getpid()))
+
+	require.NoError(t, lock.Unlock())
+	lock, err = LockDataDirectory(dir)
+	require.NoError(t, err)
+	require.NoError(t, lock.Unlock())
+
+	_, err = LockDataDirectory(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,178 @@
+package wal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"path/filepath"
+
+	"in-memory-db/internal/storage/encryption"
+	"in-memory-db/internal/storage/filesystem"
+)
+
+// Манифест перечисляет сегменты WAL по порядку с диапазонами LSN, для закрытых сегментов - с размером и crc32.
+// Он заменяется атомарно (временный файл, fsync, rename, fsync директории) при смене сегмента
+// и до удаления старых сегментов. При старте сегменты читаются по манифесту, без него - по именам файлов.
+
+const (
+	SegmentManifestName    = "segments_manifest.json"
+	segmentManifestVersion = 1
+)
+
+var (
+	ErrSegmentManifest = errors.New("segment manifest is corrupted")
+	ErrSegmentMissing  = errors.New("segment listed in manifest is missing")
+	ErrSegmentChecksum = errors.New("segment does not match manifest checksum")
+)
+
+type SegmentManifest struct {
+	Version  int           `json:"version"`
+	Segments []SegmentInfo `json:"segments"`
+}
+
+// SegmentInfo описывает сегмент в манифесте. Size и CRC32 проверяются только для закрытых сегментов,
+// в активный сегмент продолжается запись, и его описание в файле манифеста обновляется только при смене сегмента.
+// Для сегментов из записей старого формата LSN равны 0.
+type SegmentInfo struct {
+	Name     string `json:"name"`
+	FirstLSN uint64 `json:"first_lsn"`
+	LastLSN  uint64 `json:"last_lsn"`
+	Size     int64  `json:"size"`
+	CRC32    uint32 `json:"crc32"`
+	Active   bool   `json:"active"`
+}
+
+// ReadSegmentManifest читает манифест из директории данных, если манифеста нет, возвращает fs.ErrNotExist
+func ReadSegmentManifest(fsys filesystem.FS, dataDirectory string) (SegmentManifest, error) {
+	data, err := fsys.ReadFile(filepath.Join(dataDirectory, SegmentManifestName))
+	if err != nil {
+		return SegmentManifest{}, err
+	}
+
+	var manifest SegmentManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return SegmentManifest{}, fmt.Errorf("%w: %w", ErrSegmentManifest, err)
+	}
+	if err := checkFormatVersion("segment manifest", manifest.Version, segmentManifestVersion); err != nil {
+		return SegmentManifest{}, err
+	}
+	for _, segment := range manifest.Segments {
+		if segmentFileNumber(segment.Name) == 0 {
+			return SegmentManifest{}, fmt.Errorf("%w: bad segment name %q", ErrSegmentManifest, segment.Name)
+		}
+	}
+
+	return manifest, nil
+}
+
+func writeSegmentManifest(fs filesystem.FS, dataDirectory string, manifest SegmentManifest) error {
+	manifest.Version = segmentManifestVersion
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return replaceFile(fs, filepath.Join(dataDirectory, SegmentManifestName), data)
+}
+
+// updateSegmentManifest изменяет манифест в директории данных, если он есть.
+// Используется, когда сервер остановлен, например walctl и восстановлением на момент времени.
+func updateSegmentManifest(fsys filesystem.FS, dataDirectory string, f func(m *SegmentManifest)) error {
+	manifest, err := ReadSegmentManifest(fsys, dataDirectory)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	f(&manifest)
+	return writeSegmentManifest(fsys, dataDirectory, manifest)
+}
+
+// listManifestSegments возвращает сегменты, которые нужно прочитать при старте, и их описания из манифеста.
+// Сегменты из манифеста должны существовать. Файлы с номерами больше последнего сегмента манифеста
+// могли остаться от смены сегмента, прерванной сбоем, и добавляются в конец без описания.
+// Файлы, которых нет в манифесте, с меньшими номерами уже исключены из WAL и пропускаются.
+// Если манифеста нет, возвращаются все сегменты директории.
+func listManifestSegments(fsys filesystem.FS, dataDirectory string) ([]SegmentFile, []SegmentInfo, error) {
+	files, err := ListSegmentFiles(fsys, dataDirectory)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifest, err := ReadSegmentManifest(fsys, dataDirectory)
+	if errors.Is(err, fs.ErrNotExist) {
+		return files, make([]SegmentInfo, len(files)), nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byName := make(map[string]SegmentFile, len(files))
+	for _, file := range files {
+		byName[file.Name] = file
+	}
+
+	var res []SegmentFile
+	var infos []SegmentInfo
+	lastNumber := 0
+	for _, info := range manifest.Segments {
+		file, ok := byName[info.Name]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: %s", ErrSegmentMissing, info.Name)
+		}
+		if !info.Active && file.Size != info.Size {
+			return nil, nil, fmt.Errorf("%w: %s has size %d, manifest %d", ErrSegmentChecksum, info.Name, file.Size, info.Size)
+		}
+		res = append(res, file)
+		infos = append(infos, info)
+		lastNumber = max(lastNumber, file.Number)
+	}
+	for _, file := range files {
+		if file.Number > lastNumber {
+			res = append(res, file)
+			infos = append(infos, SegmentInfo{})
+		}
+	}
+
+	return res, infos, nil
+}
+
+// verifySegment сверяет содержимое закрытого сегмента с манифестом
+func verifySegment(info SegmentInfo, data []byte) error {
+	if info.Name == "" || info.Active {
+		return nil
+	}
+	if int64(len(data)) != info.Size || crc32.ChecksumIEEE(data) != info.CRC32 {
+		return fmt.Errorf("%w: %s", ErrSegmentChecksum, info.Name)
+	}
+	return nil
+}
+
+// describeSegment строит описание сегмента по его содержимому
+func describeSegment(keyring *encryption.Keyring, name string, data []byte) SegmentInfo {
+	info := SegmentInfo{Name: name, Size: int64(len(data)), CRC32: crc32.ChecksumIEEE(data)}
+	_ = readSegmentData(keyring, data, func(batch []byte) error {
+		info.addBatch(batch)
+		return nil
+	})
+	return info
+}
+
+// addBatch расширяет диапазон LSN сегмента записями пачки. LSN в пачке возрастают,
+// поэтому достаточно первой и последней записи.
+func (info *SegmentInfo) addBatch(batch []byte) {
+	lines := splitBatch(batch)
+	if len(lines) == 0 {
+		return
+	}
+	if first, err := DecodeRecord(lines[0]); err == nil && first.LSN != 0 && info.FirstLSN == 0 {
+		info.FirstLSN = first.LSN
+	}
+	if last, err := DecodeRecord(lines[len(lines)-1]); err == nil && last.LSN != 0 {
+		info.LastLSN = last.LSN
+	}
+}
@@ -0,0 +1,84 @@
+package wal
+
+import (
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"in-memory-db/internal/storage/filesystem"
+)
+
+func TestSegmentManifest_Rotation(t *testing.T) {
+	fs := filesystem.NewMemory()
+	w := newCrashTestWriter(t, fs)
+	for _, err := range w.write(10) {
+		require.NoError(t, err)
+	}
+
+	// на диске манифест обновляется при смене сегмента, поэтому диапазон LSN активного сегмента есть только в памяти
+	manifest := w.segment.Manifest()
+	require.Greater(t, len(manifest.Segments), 2)
+	saved, err := ReadSegmentManifest(fs, crashTestDirectory)
+	require.NoError(t, err)
+	closed := len(manifest.Segments) - 1
+	assert.Equal(t, manifest.Segments[:closed], saved.Segments[:closed])
+	assert.Equal(t, manifest.Segments[closed].Name, saved.Segments[closed].Name)
+
+	var prevLSN uint64
+	for i, info := range manifest.Segments {
+		assert.Equal(t, prevLSN+1, info.FirstLSN, info.Name)
+		assert.Less(t, info.FirstLSN, info.LastLSN, info.Name)
+		prevLSN = info.LastLSN
+
+		if i == len(manifest.Segments)-1 {
+			assert.True(t, info.Active)
+			continue
+		}
+		assert.False(t, info.Active)
+		data, err := fs.ReadFile(filepath.Join(crashTestDirectory, info.Name))
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(data)), info.Size)
+		assert.Equal(t, crc32.ChecksumIEEE(data), info.CRC32)
+	}
+	assert.Equal(t, w.lsn, prevLSN)
+}
+
+func TestSegmentManifest_Init(t *testing.T) {
+	fs := filesystem.NewMemory()
+	w := newCrashTestWriter(t, fs)
+	for _, err := range w.write(10) {
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.segment.Close())
+	manifest := w.segment.Manifest()
+
+	// без манифеста сегменты ищутся в директории, и манифест создаётся заново
+	require.NoError(t, fs.Remove(filepath.Join(crashTestDirectory, SegmentManifestName)))
+	assert.Equal(t, w.acked, recoverQueries(t, fs))
+	restored, err := ReadSegmentManifest(fs, crashTestDirectory)
+	require.NoError(t, err)
+	closed := len(manifest.Segments) - 1
+	assert.Equal(t, manifest.Segments[:closed], restored.Segments[:closed])
+	assert.True(t, restored.Segments[closed].Active)
+
+	// файл с меньшим номером, которого нет в манифесте, уже исключён из WAL
+	first := filepath.Join(crashTestDirectory, manifest.Segments[0].Name)
+	require.NoError(t, w.segment.removeFromManifest([]string{manifest.Segments[0].Name}))
+	assert.Equal(t, w.acked[manifest.Segments[0].LastLSN:], recoverQueries(t, fs))
+
+	// сегмент из манифеста изменён или удалён
+	require.NoError(t, writeSegmentManifest(fs, crashTestDirectory, manifest))
+	f, err := fs.OpenFile(first, os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("9"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	segment := NewSegment(256, crashTestDirectory, WithSegmentFileSystem(fs))
+	assert.ErrorIs(t, segment.Init(func(data []byte) error { return nil }), ErrSegmentChecksum)
+
+	require.NoError(t, fs.Remove(first))
+	assert.ErrorIs(t, segment.Init(func(data []byte) error { return nil }), ErrSegmentMissing)
+}
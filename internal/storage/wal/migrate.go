@@ -0,0 +1,246 @@
+package wal
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"in-memory-db/internal/storage/encryption"
+	"in-memory-db/internal/storage/filesystem"
+)
+
+// Миграция переводит директорию данных остановленного сервера в текущую версию формата на месте.
+// До изменений все файлы директории копируются в резервную копию, которую можно вернуть через walctl restore.
+// Сегменты записываются заново со строкой версии, записи старого формата получают LSN, которые сервер
+// назначает им при чтении, время таких записей остаётся неизвестным. Зашифрованные сегменты и снимки
+// перешифровываются активным ключом, незашифрованные остаются незашифрованными.
+//
+// На время миграции все сегменты в манифесте помечаются активными, и размеры с контрольными суммами
+// не проверяются. Поэтому после сбоя директория остаётся читаемой, а миграцию можно повторить.
+
+type MigrationResult struct {
+	Backup    BackupManifest
+	Segments  []string
+	Snapshots []string
+	LastLSN   uint64
+}
+
+// MigrateDataDirectory копирует директорию данных в backupDir и переводит сегменты и снимки старых версий в текущую
+func MigrateDataDirectory(fs filesystem.FS, dataDirectory, backupDir string, keyring *encryption.Keyring) (MigrationResult, error) {
+	files, _, err := listManifestSegments(fs, dataDirectory)
+	if err != nil {
+		return MigrationResult{}, err
+	}
+	snapshots, err := ListSnapshotFiles(fs, dataDirectory)
+	if err != nil {
+		return MigrationResult{}, err
+	}
+
+	// сначала читаем всё, чтобы не начинать миграцию директории, которую нельзя прочитать
+	var segments []migratedSegment
+	decoder := Decoder{}
+	for _, file := range files {
+		segment, err := migrateSegment(fs, file, keyring, &decoder)
+		if err != nil {
+			return MigrationResult{}, fmt.Errorf("segment %s: %w", file.Name, err)
+		}
+		segments = append(segments, segment)
+	}
+
+	res := MigrationResult{LastLSN: decoder.LastLSN}
+	res.Backup, err = copyDataDirectory(fs, dataDirectory, backupDir, decoder.LastLSN, snapshots, keyring != nil)
+	if err != nil {
+		return MigrationResult{}, err
+	}
+
+	if err := updateSegmentManifest(fs, dataDirectory, func(m *SegmentManifest) {
+		for i := range m.Segments {
+			m.Segments[i].Active = true
+		}
+	}); err != nil {
+		return MigrationResult{}, err
+	}
+
+	manifest := SegmentManifest{}
+	for _, segment := range segments {
+		if segment.content != nil {
+			if err := replaceFile(fs, segment.file.Path, segment.content); err != nil {
+				return MigrationResult{}, err
+			}
+			res.Segments = append(res.Segments, segment.file.Name)
+		}
+		manifest.Segments = append(manifest.Segments, segment.info)
+	}
+	if len(manifest.Segments) > 0 {
+		manifest.Segments[len(manifest.Segments)-1].Active = true
+		if err := writeSegmentManifest(fs, dataDirectory, manifest); err != nil {
+			return MigrationResult{}, err
+		}
+	}
+
+	for _, file := range snapshots {
+		migrated, err := migrateSnapshot(fs, dataDirectory, file, keyring)
+		if err != nil {
+			return MigrationResult{}, fmt.Errorf("snapshot %s: %w", file.Name, err)
+		}
+		if migrated {
+			res.Snapshots = append(res.Snapshots, file.Name)
+		}
+	}
+
+	return res, nil
+}
+
+type migratedSegment struct {
+	file SegmentFile
+	info SegmentInfo
+	// новое содержимое, nil - если сегмент уже в текущем формате
+	content []byte
+}
+
+// migrateSegment читает сегмент и, если он записан в старом формате, кодирует его записи заново
+func migrateSegment(fs filesystem.FS, file SegmentFile, keyring *encryption.Keyring, decoder *Decoder) (migratedSegment, error) {
+	data, err := fs.ReadFile(file.Path)
+	if err != nil {
+		return migratedSegment{}, err
+	}
+	version, body, err := splitSegmentVersion(data)
+	if err != nil {
+		return migratedSegment{}, err
+	}
+
+	legacy := version < SegmentFormatVersion
+	var batches [][]byte
+	err = readSegmentData(keyring, data, func(batch []byte) error {
+		var encoded []byte
+		for _, line := range splitBatch(batch) {
+			raw, err := DecodeRecord(line)
+			if err != nil {
+				return err
+			}
+			r, err := decoder.next(raw)
+			if err != nil {
+				return err
+			}
+			legacy = legacy || raw.LSN == 0
+			encoded = append(encoded, r.Encode()...)
+		}
+		if len(encoded) > 0 {
+			batches = append(batches, encoded)
+		}
+		return nil
+	})
+	if err != nil {
+		return migratedSegment{}, err
+	}
+
+	if !legacy {
+		return migratedSegment{file: file, info: describeSegment(keyring, file.Name, data)}, nil
+	}
+
+	content := encodeSegmentVersion()
+	if isEncryptedSegment(body) {
+		header := encodeEncryptedHeader(keyring.ActiveKeyID())
+		content = append(content, header...)
+		for _, batch := range batches {
+			frame, err := encodeEncryptedFrame(keyring, header, batch)
+			if err != nil {
+				return migratedSegment{}, err
+			}
+			content = append(content, frame...)
+		}
+	} else {
+		for _, batch := range batches {
+			content = append(content, batch...)
+		}
+	}
+
+	return migratedSegment{file: file, info: describeSegment(keyring, file.Name, content), content: content}, nil
+}
+
+// migrateSnapshot записывает снимок старой версии заново, возвращает false, если снимок уже в текущем формате
+func migrateSnapshot(fs filesystem.FS, dataDirectory string, file SnapshotFile, keyring *encryption.Keyring) (bool, error) {
+	data, err := fs.ReadFile(file.Path)
+	if err != nil {
+		return false, err
+	}
+	header, err := readSnapshotHeader(fs, file.Path, keyring)
+	if err != nil {
+		return false, err
+	}
+	if header.Version >= SnapshotFormatVersion {
+		return false, nil
+	}
+
+	var pairs [][2]string
+	info, err := ReadSnapshot(fs, file.Path, keyring, func(key, val string) error {
+		pairs = append(pairs, [2]string{key, val})
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	var snapshotKeyring *encryption.Keyring
+	if isEncryptedSegment(data) {
+		snapshotKeyring = keyring
+	}
+	_, err = WriteSnapshot(fs, dataDirectory, snapshotKeyring, SnapshotInfo{LSN: info.LSN, Timestamp: info.Timestamp}, func(f func(key, val string) bool) {
+		for _, pair := range pairs {
+			if !f(pair[0], pair[1]) {
+				return
+			}
+		}
+	})
+	return err == nil, err
+}
+
+// copyDataDirectory копирует файлы директории данных в пустую директорию backupDir и записывает манифест копии,
+// чтобы её можно было проверить и вернуть как обычную резервную копию
+func copyDataDirectory(fs filesystem.FS, dataDirectory, backupDir string, lsn uint64, snapshots []SnapshotFile, encrypted bool) (BackupManifest, error) {
+	if err := checkEmptyDir(fs, backupDir); err != nil {
+		return BackupManifest{}, err
+	}
+	if err := fs.MkdirAll(backupDir, 0755); err != nil {
+		return BackupManifest{}, err
+	}
+
+	entries, err := fs.ReadDir(dataDirectory)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+
+	manifest := BackupManifest{Version: backupVersion, CreatedAt: time.Now().UTC(), LSN: lsn, Encrypted: encrypted}
+	if len(snapshots) > 0 {
+		manifest.SnapshotLSN = snapshots[len(snapshots)-1].LSN
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || name == LockFileName || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		if err := copyFile(fs, filepath.Join(dataDirectory, name), filepath.Join(backupDir, name)); err != nil {
+			return BackupManifest{}, err
+		}
+		file := BackupFile{Name: name}
+		if file.Size, file.SHA256, err = fileChecksum(fs, filepath.Join(backupDir, name)); err != nil {
+			return BackupManifest{}, err
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+	if err := fs.SyncDir(backupDir); err != nil {
+		return BackupManifest{}, err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	if err := replaceFile(fs, filepath.Join(backupDir, BackupManifestName), data); err != nil {
+		return BackupManifest{}, err
+	}
+
+	return manifest, nil
+}
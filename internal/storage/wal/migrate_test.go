@@ -0,0 +1,124 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"in-memory-db/internal/storage/filesystem"
+)
+
+// writeLegacyDataDirectory записывает директорию данных версии 1: снимок на LSN 2 без версии
+// и сегменты без строки версии, в первом записи без LSN
+func writeLegacyDataDirectory(t *testing.T, fs filesystem.FS) {
+	require.NoError(t, fs.MkdirAll(crashTestDirectory, 0755))
+	require.NoError(t, replaceFile(fs, filepath.Join(crashTestDirectory, "data_1"), []byte("SET a 1\nSET b 2\n")))
+	require.NoError(t, replaceFile(fs, filepath.Join(crashTestDirectory, "data_2"), []byte(NewRecord(3, time.Now(), "DEL a").Encode())))
+
+	snapshot := fmt.Sprintf("SNAPSHOT 2 %d\na 1\nb 2\nEND 2 %08x\n", time.Now().UnixNano(), crc32.ChecksumIEEE([]byte("a 1b 2")))
+	require.NoError(t, replaceFile(fs, filepath.Join(crashTestDirectory, "snapshot_2"), []byte(snapshot)))
+}
+
+func TestMigrateDataDirectory(t *testing.T) {
+	fs := filesystem.NewMemory()
+	writeLegacyDataDirectory(t, fs)
+	legacy, err := fs.ReadFile(filepath.Join(crashTestDirectory, "data_1"))
+	require.NoError(t, err)
+
+	res, err := MigrateDataDirectory(fs, crashTestDirectory, backupTestDirectory, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"data_1", "data_2"}, res.Segments)
+	assert.Equal(t, []string{"snapshot_2"}, res.Snapshots)
+	assert.Equal(t, uint64(3), res.LastLSN)
+
+	// копия хранит файлы до миграции
+	_, err = VerifyBackup(fs, backupTestDirectory)
+	require.NoError(t, err)
+	backup, err := fs.ReadFile(filepath.Join(backupTestDirectory, "data_1"))
+	require.NoError(t, err)
+	assert.Equal(t, legacy, backup)
+
+	var records []Record
+	require.NoError(t, ReadSegmentFile(fs, filepath.Join(crashTestDirectory, "data_1"), nil, &Decoder{}, func(index int, r Record) error {
+		records = append(records, r)
+		return nil
+	}))
+	require.Len(t, records, 2)
+	assert.Equal(t, NewRecord(2, time.Time{}, "SET b 2"), records[1])
+	migrated, err := fs.ReadFile(filepath.Join(crashTestDirectory, "data_1"))
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(migrated, encodeSegmentVersion()))
+	assert.Contains(t, string(migrated), "\n1 0 ")
+
+	info, err := readSnapshotHeader(fs, filepath.Join(crashTestDirectory, "snapshot_2"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, SnapshotFormatVersion, info.Version)
+
+	// сервер дописывает в последний сегмент, потому что он уже в текущем формате
+	var keys []string
+	var lsns []uint64
+	w := NewWal(context.Background(), 1, time.Hour, NewSegment(4096, crashTestDirectory, WithSegmentFileSystem(fs)), zap.NewNop())
+	require.NoError(t, w.Init(replayFunc(
+		func(key, val string) error {
+			keys = append(keys, key)
+			return nil
+		},
+		func(r Record) error {
+			lsns = append(lsns, r.LSN)
+			return nil
+		},
+	)))
+	assert.ElementsMatch(t, []string{"a", "b"}, keys)
+	assert.Equal(t, []uint64{3}, lsns)
+	assert.Equal(t, 2, w.segment.ActiveFileNumber())
+	require.NoError(t, w.segment.Close())
+
+	// повторная миграция ничего не меняет
+	res, err = MigrateDataDirectory(fs, crashTestDirectory, "/backup/second", nil)
+	require.NoError(t, err)
+	assert.Empty(t, res.Segments)
+	assert.Empty(t, res.Snapshots)
+
+	_, err = MigrateDataDirectory(fs, crashTestDirectory, backupTestDirectory, nil)
+	assert.ErrorIs(t, err, ErrBackupExists)
+}
+
+func TestFormatVersion_Newer(t *testing.T) {
+	fs := filesystem.NewMemory()
+	require.NoError(t, fs.MkdirAll(crashTestDirectory, 0755))
+	initWal := func() error {
+		w := NewWal(context.Background(), 1, time.Hour, NewSegment(4096, crashTestDirectory, WithSegmentFileSystem(fs)), zap.NewNop())
+		return w.Init(replayFunc(func(key, val string) error { return nil }, func(r Record) error { return nil }))
+	}
+
+	segmentPath := filepath.Join(crashTestDirectory, "data_1")
+	require.NoError(t, replaceFile(fs, segmentPath, []byte("IMDBWAL 3\n"+NewRecord(1, time.Now(), "SET a 1").Encode())))
+	assert.ErrorIs(t, initWal(), ErrUnsupportedFormatVersion)
+	_, err := MigrateDataDirectory(fs, crashTestDirectory, backupTestDirectory, nil)
+	assert.ErrorIs(t, err, ErrUnsupportedFormatVersion)
+	require.NoError(t, fs.Remove(segmentPath))
+
+	snapshotPath := filepath.Join(crashTestDirectory, "snapshot_1")
+	require.NoError(t, replaceFile(fs, snapshotPath, []byte("SNAPSHOT 1 0 4\nEND 0 00000000\n")))
+	assert.ErrorIs(t, initWal(), ErrUnsupportedFormatVersion)
+	// версия двоичного снимка проверяется до контрольной суммы заголовка
+	file, err := WriteSnapshot(fs, crashTestDirectory, nil, SnapshotInfo{LSN: 1}, rangeMap(nil))
+	require.NoError(t, err)
+	data, err := fs.ReadFile(file.Path)
+	require.NoError(t, err)
+	binary.BigEndian.PutUint16(data[len(binarySnapshotMagic):], SnapshotFormatVersion+1)
+	require.NoError(t, replaceFile(fs, snapshotPath, data))
+	assert.ErrorIs(t, initWal(), ErrUnsupportedFormatVersion)
+	require.NoError(t, fs.Remove(snapshotPath))
+
+	require.NoError(t, replaceFile(fs, filepath.Join(crashTestDirectory, SegmentManifestName), []byte(`{"version": 2, "segments": []}`)))
+	assert.ErrorIs(t, initWal(), ErrUnsupportedFormatVersion)
+}
@@ -0,0 +1,145 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Запись WAL хранится одной строкой:
+//   <lsn> <timestamp в наносекундах> <crc32 в hex> <запрос>
+// crc32 считается по строке "<lsn> <timestamp> <запрос>".
+// Строки старого формата содержат только запрос, LSN для них назначается по порядку чтения,
+// а время записи неизвестно.
+
+var (
+	ErrBadRecord        = errors.New("bad record")
+	ErrChecksumMismatch = errors.New("record checksum mismatch")
+	ErrLSNOrder         = errors.New("record lsn is out of order")
+)
+
+const recordFieldsNumber = 4
+
+type Record struct {
+	LSN       uint64
+	Timestamp time.Time
+	Query     string
+}
+
+func NewRecord(lsn uint64, timestamp time.Time, query string) Record {
+	return Record{LSN: lsn, Timestamp: timestamp, Query: query}
+}
+
+// Legacy сообщает, что запись прочитана из строки старого формата без LSN и времени
+func (r Record) Legacy() bool {
+	return r.Timestamp.IsZero()
+}
+
+// Encode кодирует запись в строку. Для записи старого формата время записывается как 0.
+func (r Record) Encode() string {
+	var ts int64
+	if !r.Legacy() {
+		ts = r.Timestamp.UnixNano()
+	}
+	return fmt.Sprintf("%d %d %08x %s\n", r.LSN, ts, recordChecksum(r.LSN, ts, r.Query), r.Query)
+}
+
+func recordChecksum(lsn uint64, ts int64, query string) uint32 {
+	return crc32.ChecksumIEEE([]byte(fmt.Sprintf("%d %d %s", lsn, ts, query)))
+}
+
+// DecodeRecord разбирает строку записи без завершающего перевода строки.
+// Для строки старого формата возвращается запись с нулевым LSN.
+func DecodeRecord(line string) (Record, error) {
+	if strings.TrimSpace(line) == "" {
+		return Record{}, fmt.Errorf("%w: empty line", ErrBadRecord)
+	}
+
+	first, _, _ := strings.Cut(line, " ")
+	if _, err := strconv.ParseUint(first, 10, 64); err != nil {
+		return Record{Query: line}, nil
+	}
+
+	parts := strings.SplitN(line, " ", recordFieldsNumber)
+	if len(parts) != recordFieldsNumber {
+		return Record{}, fmt.Errorf("%w: %q", ErrBadRecord, line)
+	}
+
+	lsn, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil || lsn == 0 {
+		return Record{}, fmt.Errorf("%w: bad lsn %q", ErrBadRecord, parts[0])
+	}
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return Record{}, fmt.Errorf("%w: bad timestamp %q", ErrBadRecord, parts[1])
+	}
+	checksum, err := strconv.ParseUint(parts[2], 16, 32)
+	if err != nil {
+		return Record{}, fmt.Errorf("%w: bad checksum %q", ErrBadRecord, parts[2])
+	}
+
+	if recordChecksum(lsn, ts, parts[3]) != uint32(checksum) {
+		return Record{}, fmt.Errorf("%w: lsn %d", ErrChecksumMismatch, lsn)
+	}
+
+	var timestamp time.Time
+	if ts != 0 {
+		timestamp = time.Unix(0, ts)
+	}
+	return NewRecord(lsn, timestamp, parts[3]), nil
+}
+
+// Decoder разбирает пачки записей и следит за порядком LSN.
+// Записи старого формата получают следующий по порядку LSN.
+type Decoder struct {
+	LastLSN uint64
+}
+
+// Decode разбирает одну строку записи
+func (d *Decoder) Decode(line string) (Record, error) {
+	r, err := DecodeRecord(line)
+	if err != nil {
+		return Record{}, err
+	}
+
+	return d.next(r)
+}
+
+// next проверяет порядок LSN записи, разобранной DecodeRecord
+func (d *Decoder) next(r Record) (Record, error) {
+	if r.LSN == 0 {
+		r.LSN = d.LastLSN + 1
+	} else if r.LSN <= d.LastLSN {
+		return Record{}, fmt.Errorf("%w: %d after %d", ErrLSNOrder, r.LSN, d.LastLSN)
+	}
+
+	d.LastLSN = r.LSN
+	return r, nil
+}
+
+// DecodeBatch разбирает пачку записей, разделённых переводом строки
+func (d *Decoder) DecodeBatch(batch []byte, f func(Record) error) error {
+	for _, line := range splitBatch(batch) {
+		r, err := d.Decode(line)
+		if err != nil {
+			return err
+		}
+		if err := f(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func splitBatch(batch []byte) []string {
+	lines := strings.Split(string(bytes.TrimRight(batch, "\n")), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return nil
+	}
+	return lines
+}
@@ -0,0 +1,121 @@
+package wal
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecord_EncodeDecode(t *testing.T) {
+	ts := time.Unix(0, 1734567890123456789)
+	r := NewRecord(42, ts, "SET key val")
+
+	line := r.Encode()
+	assert.True(t, strings.HasPrefix(line, "42 1734567890123456789 "))
+	assert.True(t, strings.HasSuffix(line, " SET key val\n"))
+
+	decoded, err := DecodeRecord(strings.TrimSuffix(line, "\n"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(42), decoded.LSN)
+	assert.True(t, ts.Equal(decoded.Timestamp))
+	assert.Equal(t, "SET key val", decoded.Query)
+	assert.False(t, decoded.Legacy())
+
+	// запись старого формата после назначения LSN кодируется без времени
+	line = NewRecord(3, time.Time{}, "DEL key").Encode()
+	assert.True(t, strings.HasPrefix(line, "3 0 "))
+	decoded, err = DecodeRecord(strings.TrimSuffix(line, "\n"))
+	require.NoError(t, err)
+	assert.True(t, decoded.Legacy())
+}
+
+func TestDecodeRecord(t *testing.T) {
+	valid := strings.TrimSuffix(NewRecord(7, time.Unix(0, 100), "DEL key").Encode(), "\n")
+
+	tests := []struct {
+		name          string
+		line          string
+		expectedQuery string
+		expectedLSN   uint64
+		expectedError error
+	}{
+		{
+			name:          "valid record",
+			line:          valid,
+			expectedQuery: "DEL key",
+			expectedLSN:   7,
+		},
+		{
+			name:          "legacy record",
+			line:          "SET key val",
+			expectedQuery: "SET key val",
+		},
+		{
+			name:          "changed query",
+			line:          strings.Replace(valid, "DEL key", "DEL kez", 1),
+			expectedError: ErrChecksumMismatch,
+		},
+		{
+			name:          "changed lsn",
+			line:          "8" + valid[1:],
+			expectedError: ErrChecksumMismatch,
+		},
+		{
+			name:          "missing fields",
+			line:          "7 100",
+			expectedError: ErrBadRecord,
+		},
+		{
+			name:          "bad checksum",
+			line:          "7 100 zz DEL key",
+			expectedError: ErrBadRecord,
+		},
+		{
+			name:          "zero lsn",
+			line:          "0 100 00000000 DEL key",
+			expectedError: ErrBadRecord,
+		},
+		{
+			name:          "empty",
+			line:          "",
+			expectedError: ErrBadRecord,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := DecodeRecord(test.line)
+			if test.expectedError != nil {
+				assert.ErrorIs(t, err, test.expectedError)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, test.expectedQuery, r.Query)
+				assert.Equal(t, test.expectedLSN, r.LSN)
+			}
+		})
+	}
+}
+
+func TestDecoder_DecodeBatch(t *testing.T) {
+	batch := "SET a 1\nSET b 2\n" + NewRecord(3, time.Now(), "DEL a").Encode() + NewRecord(10, time.Now(), "DEL b").Encode()
+
+	d := Decoder{}
+	var records []Record
+	err := d.DecodeBatch([]byte(batch), func(r Record) error {
+		records = append(records, r)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	assert.Equal(t, []uint64{1, 2, 3, 10}, []uint64{records[0].LSN, records[1].LSN, records[2].LSN, records[3].LSN})
+	assert.True(t, records[0].Legacy())
+	assert.Equal(t, uint64(10), d.LastLSN)
+
+	err = d.DecodeBatch([]byte(NewRecord(9, time.Now(), "DEL a").Encode()), func(r Record) error {
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrLSNOrder)
+}
@@ -0,0 +1,257 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+
+	"in-memory-db/internal/storage/filesystem"
+)
+
+const recoveryDirectoryTemplate = "recovery_%d"
+
+var (
+	ErrDryRun = errors.New("wal is opened in dry run mode")
+	ErrWalGap = errors.New("wal has a gap, records are missing")
+)
+
+// RecoveryTarget ограничивает восстановление состояния из WAL.
+// Восстанавливаются записи с LSN не больше LSN и временем не позже Time.
+// Нулевые значения полей не ограничивают восстановление.
+type RecoveryTarget struct {
+	LSN  uint64
+	Time time.Time
+}
+
+func (t RecoveryTarget) IsSet() bool {
+	return t.LSN != 0 || !t.Time.IsZero()
+}
+
+// Includes сообщает, входит ли запись в восстанавливаемое состояние.
+// Записи старого формата не имеют времени и считаются более ранними, чем любая запись с временем.
+func (t RecoveryTarget) Includes(r Record) bool {
+	if t.LSN != 0 && r.LSN > t.LSN {
+		return false
+	}
+	if !t.Time.IsZero() && !r.Legacy() && r.Timestamp.After(t.Time) {
+		return false
+	}
+	return true
+}
+
+func (t RecoveryTarget) String() string {
+	if !t.IsSet() {
+		return "latest"
+	}
+
+	res := ""
+	if t.LSN != 0 {
+		res += fmt.Sprintf("lsn <= %d", t.LSN)
+	}
+	if !t.Time.IsZero() {
+		if res != "" {
+			res += ", "
+		}
+		res += "time <= " + t.Time.Format(time.RFC3339Nano)
+	}
+	return res
+}
+
+// RecoveryReport описывает результат чтения WAL при старте
+type RecoveryReport struct {
+	Target           RecoveryTarget
+	DryRun           bool
+	SnapshotLSN      uint64
+	AppliedRecords   int
+	DiscardedRecords int
+	LastLSN          uint64
+	LastTimestamp    time.Time
+	// ArchiveDirectory - куда перенесены отброшенные записи, если восстановление было не пробным
+	ArchiveDirectory string
+}
+
+// apply учитывает запись, применяемую после снимка.
+// Первая такая запись должна идти сразу за снимком, иначе часть истории потеряна.
+func (r *RecoveryReport) apply(rec Record) error {
+	if r.AppliedRecords == 0 && !rec.Legacy() && rec.LSN > r.SnapshotLSN+1 {
+		return fmt.Errorf("%w: state is known up to lsn %d, next record has lsn %d", ErrWalGap, r.SnapshotLSN, rec.LSN)
+	}
+
+	r.AppliedRecords++
+	r.LastLSN = rec.LSN
+	if !rec.Legacy() {
+		r.LastTimestamp = rec.Timestamp
+	}
+	return nil
+}
+
+// loadSnapshot загружает последний снимок, подходящий под цель восстановления, и возвращает его LSN
+func (w *Wal) loadSnapshot(replay Replay) (uint64, error) {
+	files, err := ListSnapshotFiles(w.segment.fs, w.segment.DataDirectory)
+	if err != nil {
+		return 0, err
+	}
+
+	target := w.report.Target
+	for i := len(files) - 1; i >= 0; i-- {
+		file := files[i]
+		if target.LSN != 0 && file.LSN > target.LSN {
+			continue
+		}
+		if !target.Time.IsZero() {
+			info, err := readSnapshotHeader(w.segment.fs, file.Path, w.segment.keyring)
+			if err != nil {
+				return 0, fmt.Errorf("read snapshot %s: %w", file.Name, err)
+			}
+			if info.Timestamp.After(target.Time) {
+				continue
+			}
+		}
+
+		restore := replay.RestoreBatch
+		if restore == nil {
+			restore = func(keys, vals []string) error {
+				for i := range keys {
+					if err := replay.Restore(keys[i], vals[i]); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+		}
+		info, err := readSnapshotBatches(w.segment.fs, file.Path, w.segment.keyring, restore)
+		if err != nil {
+			return 0, fmt.Errorf("read snapshot %s: %w", file.Name, err)
+		}
+
+		w.report.SnapshotLSN = info.LSN
+		w.report.LastLSN = info.LSN
+		w.logger.Info("snapshot loaded", zap.String("file", file.Name), zap.Int("keys", info.Keys))
+		return info.LSN, nil
+	}
+
+	return 0, nil
+}
+
+// cutAtRecoveryTarget отрезает записи WAL после цели восстановления.
+// Сегмент, в котором находится первая отброшенная запись, копируется в директорию recovery_<время>
+// и обрезается, все последующие сегменты и снимки после цели переносятся туда же.
+func (w *Wal) cutAtRecoveryTarget(snapshotLSN uint64) error {
+	files, _, err := listManifestSegments(w.segment.fs, w.segment.DataDirectory)
+	if err != nil {
+		return err
+	}
+
+	decoder := Decoder{}
+	checked := false
+	for i, file := range files {
+		cutIndex := -1
+		var cutLSN uint64
+		err := ReadSegmentFile(w.segment.fs, file.Path, w.segment.keyring, &decoder, func(index int, r Record) error {
+			if r.LSN <= snapshotLSN {
+				return nil
+			}
+			// прежде чем что-то переносить, убеждаемся, что состояние на цель вообще можно восстановить
+			if !checked && !r.Legacy() && r.LSN > snapshotLSN+1 {
+				return fmt.Errorf("%w: state is known up to lsn %d, next record has lsn %d", ErrWalGap, snapshotLSN, r.LSN)
+			}
+			checked = true
+			if !w.report.Target.Includes(r) {
+				cutIndex, cutLSN = index, r.LSN
+				return errStopReading
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStopReading) {
+			return fmt.Errorf("read segment %s: %w", file.Name, err)
+		}
+		if cutIndex < 0 {
+			continue
+		}
+
+		archiveDir := filepath.Join(w.segment.DataDirectory, fmt.Sprintf(recoveryDirectoryTemplate, time.Now().UnixNano()))
+		if err := w.segment.fs.MkdirAll(archiveDir, 0755); err != nil {
+			return err
+		}
+		if err := copyFile(w.segment.fs, file.Path, filepath.Join(archiveDir, file.Name)); err != nil {
+			return err
+		}
+		if err := TruncateSegmentFile(w.segment.fs, file.Path, w.segment.keyring, cutIndex); err != nil {
+			return err
+		}
+		moved := make([]string, 0, len(files)-i-1)
+		for _, next := range files[i+1:] {
+			moved = append(moved, next.Name)
+		}
+		if err := updateSegmentManifest(w.segment.fs, w.segment.DataDirectory, func(m *SegmentManifest) {
+			m.Segments = slices.DeleteFunc(m.Segments, func(info SegmentInfo) bool {
+				return slices.Contains(moved, info.Name)
+			})
+		}); err != nil {
+			return err
+		}
+		for _, next := range files[i+1:] {
+			if err := w.segment.fs.Rename(next.Path, filepath.Join(archiveDir, next.Name)); err != nil {
+				return err
+			}
+		}
+
+		snapshots, err := ListSnapshotFiles(w.segment.fs, w.segment.DataDirectory)
+		if err != nil {
+			return err
+		}
+		for _, snapshot := range snapshots {
+			if snapshot.LSN < cutLSN {
+				continue
+			}
+			if err := w.segment.fs.Rename(snapshot.Path, filepath.Join(archiveDir, snapshot.Name)); err != nil {
+				return err
+			}
+		}
+
+		if err := w.segment.fs.SyncDir(archiveDir); err != nil {
+			return err
+		}
+		if err := w.segment.fs.SyncDir(w.segment.DataDirectory); err != nil {
+			return err
+		}
+
+		w.report.ArchiveDirectory = archiveDir
+		w.logger.Info("wal cut at recovery target",
+			zap.Stringer("target", w.report.Target),
+			zap.String("segment", file.Name),
+			zap.Int("record", cutIndex),
+			zap.String("archive", archiveDir),
+		)
+		return nil
+	}
+
+	return nil
+}
+
+func copyFile(fs filesystem.FS, src, dst string) error {
+	data, err := fs.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	out, err := fs.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(data); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,241 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+	"in-memory-db/internal/storage/filesystem"
+	"in-memory-db/internal/testingh"
+)
+
+func TestRecoveryTarget_Includes(t *testing.T) {
+	base := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		target   RecoveryTarget
+		record   Record
+		expected bool
+	}{
+		{
+			name:     "no target",
+			record:   NewRecord(100, base, "SET a 1"),
+			expected: true,
+		},
+		{
+			name:     "lsn before target",
+			target:   RecoveryTarget{LSN: 10},
+			record:   NewRecord(10, base, "SET a 1"),
+			expected: true,
+		},
+		{
+			name:     "lsn after target",
+			target:   RecoveryTarget{LSN: 10},
+			record:   NewRecord(11, base, "SET a 1"),
+			expected: false,
+		},
+		{
+			name:     "time before target",
+			target:   RecoveryTarget{Time: base},
+			record:   NewRecord(11, base, "SET a 1"),
+			expected: true,
+		},
+		{
+			name:     "time after target",
+			target:   RecoveryTarget{Time: base},
+			record:   NewRecord(11, base.Add(time.Nanosecond), "SET a 1"),
+			expected: false,
+		},
+		{
+			name:     "legacy record with time target",
+			target:   RecoveryTarget{Time: base},
+			record:   Record{LSN: 11, Query: "SET a 1"},
+			expected: true,
+		},
+		{
+			name:     "lsn and time, time after target",
+			target:   RecoveryTarget{LSN: 20, Time: base},
+			record:   NewRecord(11, base.Add(time.Second), "SET a 1"),
+			expected: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.target.Includes(test.record))
+		})
+	}
+}
+
+type RecoverySuite struct {
+	testingh.BaseDirSuite
+	base time.Time
+}
+
+func TestRecoverySuite(t *testing.T) {
+	suite.Run(t, new(RecoverySuite))
+}
+
+func (s *RecoverySuite) SetupTest() {
+	s.BaseDir = testingh.GetBaseDir(runtime.Caller(0))
+	s.BaseDirSuite.SetupTest()
+
+	// 9 записей в трёх сегментах, запись i сделана в base + i минут
+	s.base = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	for fn := 1; fn <= 3; fn++ {
+		content := string(encodeSegmentVersion())
+		for i := fn*3 - 2; i <= fn*3; i++ {
+			content += NewRecord(uint64(i), s.base.Add(time.Duration(i)*time.Minute), fmt.Sprintf("SET key%d val", i)).Encode()
+		}
+		s.NoError(os.WriteFile(s.BaseDir+fmt.Sprintf(fileNameTemplate, fn), []byte(content), 0644))
+	}
+}
+
+func (s *RecoverySuite) initWal(target RecoveryTarget, dryRun bool) (*Wal, []uint64) {
+	w := NewWal(s.Ctx, 100, time.Second, NewSegment(4096, s.BaseDir), zap.NewNop(), WithWalRecoveryTarget(target, dryRun))
+
+	var lsns []uint64
+	s.NoError(w.Init(replayFunc(func(key, val string) error { return nil }, func(r Record) error {
+		lsns = append(lsns, r.LSN)
+		return nil
+	})))
+	return w, lsns
+}
+
+func (s *RecoverySuite) recoveryDirs() []string {
+	var dirs []string
+	for _, name := range s.FileNamesInBaseDir() {
+		if strings.HasPrefix(name, "recovery_") {
+			dirs = append(dirs, name)
+		}
+	}
+	return dirs
+}
+
+func (s *RecoverySuite) TestDryRun() {
+	before := s.FileNamesInBaseDir()
+
+	w, lsns := s.initWal(RecoveryTarget{LSN: 4}, true)
+	s.Equal([]uint64{1, 2, 3, 4}, lsns)
+
+	report := w.RecoveryReport()
+	s.Equal(4, report.AppliedRecords)
+	s.Equal(5, report.DiscardedRecords)
+	s.Equal(uint64(4), report.LastLSN)
+	s.True(s.base.Add(4 * time.Minute).Equal(report.LastTimestamp))
+	s.Empty(report.ArchiveDirectory)
+
+	s.ErrorIs(w.Write("SET a b"), ErrDryRun)
+	s.ElementsMatch(before, s.FileNamesInBaseDir())
+	s.NoError(w.Close())
+}
+
+func (s *RecoverySuite) TestRecoveryToLSN() {
+	w, lsns := s.initWal(RecoveryTarget{LSN: 4}, false)
+	s.Equal([]uint64{1, 2, 3, 4}, lsns)
+	s.Equal(uint64(4), w.LastLSN())
+	s.NoError(w.Close())
+
+	dirs := s.recoveryDirs()
+	s.Len(dirs, 1)
+	s.Equal(s.BaseDir+dirs[0], w.RecoveryReport().ArchiveDirectory)
+	s.ElementsMatch([]string{"data_1", "data_2", SegmentManifestName, dirs[0]}, s.FileNamesInBaseDir())
+
+	archived, err := os.ReadDir(s.BaseDir + dirs[0])
+	s.NoError(err)
+	s.Len(archived, 2)
+	// строка версии и записи
+	s.Len(s.ReadFileToSlice(s.BaseDir+dirs[0]+"/data_2"), 4)
+	s.Len(s.ReadFileToSlice(s.BaseDir+"data_2"), 2)
+
+	// после восстановления без цели читаются только оставшиеся записи
+	_, lsns = s.initWal(RecoveryTarget{}, false)
+	s.Equal([]uint64{1, 2, 3, 4}, lsns)
+}
+
+func (s *RecoverySuite) TestRecoveryToTime() {
+	w, lsns := s.initWal(RecoveryTarget{Time: s.base.Add(6*time.Minute + time.Second)}, false)
+	s.Equal([]uint64{1, 2, 3, 4, 5, 6}, lsns)
+	s.NoError(w.Close())
+	// первая отброшенная запись - первая в data_3, поэтому сегмент остаётся пустым
+	s.ElementsMatch([]string{"data_1", "data_2", "data_3", SegmentManifestName, s.recoveryDirs()[0]}, s.FileNamesInBaseDir())
+	s.Len(s.ReadFileToSlice(s.BaseDir+"data_2"), 4)
+	s.Equal([]string{fmt.Sprintf("IMDBWAL %d", SegmentFormatVersion)}, s.ReadFileToSlice(s.BaseDir+"data_3"))
+}
+
+func (s *RecoverySuite) TestRecoveryTargetAfterEnd() {
+	w, lsns := s.initWal(RecoveryTarget{LSN: 100}, false)
+	s.Len(lsns, 9)
+	s.Empty(w.RecoveryReport().ArchiveDirectory)
+	s.Empty(s.recoveryDirs())
+	s.NoError(w.Close())
+}
+
+func (s *RecoverySuite) writeSnapshot(lsn uint64) {
+	_, err := WriteSnapshot(filesystem.OS{}, s.BaseDir, nil, SnapshotInfo{LSN: lsn, Timestamp: s.base.Add(time.Duration(lsn) * time.Minute)},
+		rangeMap(map[string]string{"snapshot": fmt.Sprint(lsn)}))
+	s.NoError(err)
+}
+
+func (s *RecoverySuite) TestInitFromSnapshot() {
+	s.writeSnapshot(4)
+
+	w := NewWal(s.Ctx, 100, time.Second, NewSegment(4096, s.BaseDir), zap.NewNop())
+	restored := make(map[string]string)
+	var lsns []uint64
+	s.NoError(w.Init(replayFunc(func(key, val string) error {
+		restored[key] = val
+		return nil
+	}, func(r Record) error {
+		lsns = append(lsns, r.LSN)
+		return nil
+	})))
+
+	s.Equal(map[string]string{"snapshot": "4"}, restored)
+	s.Equal([]uint64{5, 6, 7, 8, 9}, lsns)
+	s.Equal(uint64(4), w.RecoveryReport().SnapshotLSN)
+	s.Equal(uint64(9), w.LastLSN())
+	s.NoError(w.Close())
+}
+
+func (s *RecoverySuite) TestInitFromSnapshot_RecoveryTargetBeforeSnapshot() {
+	s.writeSnapshot(2)
+	s.writeSnapshot(7)
+
+	w, lsns := s.initWal(RecoveryTarget{LSN: 5}, false)
+	s.Equal([]uint64{3, 4, 5}, lsns)
+	s.Equal(uint64(2), w.RecoveryReport().SnapshotLSN)
+	s.NoError(w.Close())
+
+	// снимок после цели перенесён вместе с отброшенными записями
+	dirs := s.recoveryDirs()
+	s.Len(dirs, 1)
+	s.FileExists(s.BaseDir + dirs[0] + "/snapshot_7")
+	s.NoFileExists(s.BaseDir + "snapshot_7")
+}
+
+func (s *RecoverySuite) TestInitFromSnapshot_Gap() {
+	s.writeSnapshot(1)
+	s.NoError(os.Remove(s.BaseDir + "data_1"))
+
+	w := NewWal(s.Ctx, 100, time.Second, NewSegment(4096, s.BaseDir), zap.NewNop())
+	err := w.Init(replayFunc(func(key, val string) error { return nil }, func(r Record) error { return nil }))
+	s.ErrorIs(err, ErrWalGap)
+}
+
+// replayFunc передаёт снимок в restore, а записи в apply
+func replayFunc(restore func(key, val string) error, apply func(Record) error) Replay {
+	return Replay{
+		Restore: restore,
+		Apply: func(r Record, _ any) error {
+			return apply(r)
+		},
+	}
+}
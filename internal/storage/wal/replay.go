@@ -0,0 +1,279 @@
+package wal
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Записи восстанавливаются конвейером: одна горутина читает и расшифровывает сегменты,
+// несколько горутин разбирают записи и вызывают Replay.Prepare, а Init применяет их строго по порядку.
+
+const (
+	// размер части сегмента, которую разбирает одна горутина
+	replayChunkSize = 1 << 20
+	// сколько частей может ждать применения
+	replayQueueSize = 16
+
+	replayProgressInterval = 5 * time.Second
+)
+
+// Replay задаёт применение снимка и записей WAL при старте
+type Replay struct {
+	// Restore получает пары ключ-значение из снимка
+	Restore func(key, val string) error
+	// RestoreBatch, если задана, используется вместо Restore и получает пары снимка пачками,
+	// пачки передаются по очереди
+	RestoreBatch func(keys, vals []string) error
+	// Prepare разбирает запись до применения. Вызывается параллельно для разных записей,
+	// поэтому не должна менять состояние. LSN записей старого формата в этот момент ещё не назначен.
+	Prepare func(Record) (any, error)
+	// Apply применяет записи по порядку LSN, prepared - результат Prepare
+	Apply func(r Record, prepared any) error
+}
+
+// Метрики восстановления публикуются через expvar в wal_replay
+var replayMetrics = struct {
+	loading        expvar.Int
+	segmentsTotal  expvar.Int
+	segmentsRead   expvar.Int
+	bytesTotal     expvar.Int
+	bytesRead      expvar.Int
+	recordsApplied expvar.Int
+	durationMs     expvar.Int
+}{}
+
+func init() {
+	m := expvar.NewMap("wal_replay")
+	m.Set("loading", &replayMetrics.loading)
+	m.Set("segments_total", &replayMetrics.segmentsTotal)
+	m.Set("segments_read", &replayMetrics.segmentsRead)
+	m.Set("bytes_total", &replayMetrics.bytesTotal)
+	m.Set("bytes_read", &replayMetrics.bytesRead)
+	m.Set("records_applied", &replayMetrics.recordsApplied)
+	m.Set("duration_ms", &replayMetrics.durationMs)
+}
+
+type replayChunk struct {
+	segment SegmentFile
+	// последняя часть сегмента, size - размер файла сегмента
+	last     bool
+	size     int
+	data     []byte
+	records  []Record
+	prepared []any
+	err      error
+	done     chan struct{}
+}
+
+// replay применяет записи сегментов после snapshotLSN и возвращает LSN последней записи.
+// infos - описания сегментов из манифеста, закрытые сегменты сверяются с ними перед чтением.
+func (w *Wal) replay(files []SegmentFile, infos []SegmentInfo, snapshotLSN uint64, replay Replay) (uint64, error) {
+	started := time.Now()
+	var bytesTotal int64
+	for _, file := range files {
+		bytesTotal += file.Size
+	}
+	replayMetrics.loading.Set(1)
+	replayMetrics.segmentsTotal.Set(int64(len(files)))
+	replayMetrics.segmentsRead.Set(0)
+	replayMetrics.bytesTotal.Set(bytesTotal)
+	replayMetrics.bytesRead.Set(0)
+	replayMetrics.recordsApplied.Set(0)
+	defer func() {
+		replayMetrics.loading.Set(0)
+		replayMetrics.durationMs.Set(time.Since(started).Milliseconds())
+	}()
+
+	stop := make(chan struct{})
+	ordered := make(chan *replayChunk, replayQueueSize)
+	work := make(chan *replayChunk, replayQueueSize)
+	wg := sync.WaitGroup{}
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(ordered)
+		defer close(work)
+		w.readChunks(files, infos, ordered, work, stop)
+	}()
+
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range work {
+				c.decode(replay.Prepare)
+			}
+		}()
+	}
+
+	decoder := Decoder{}
+	var bytesRead int64
+	var records int
+	progressAt := time.Now().Add(replayProgressInterval)
+	for c := range ordered {
+		<-c.done
+		for i, r := range c.records {
+			r, err := decoder.next(r)
+			if err != nil {
+				return 0, fmt.Errorf("read segment %s: %w", c.segment.Name, err)
+			}
+			if r.LSN <= snapshotLSN {
+				continue
+			}
+			if w.report.DiscardedRecords > 0 || !w.report.Target.Includes(r) {
+				w.report.DiscardedRecords++
+				continue
+			}
+			if err := w.report.apply(r); err != nil {
+				return 0, fmt.Errorf("read segment %s: %w", c.segment.Name, err)
+			}
+			if err := replay.Apply(r, c.prepared[i]); err != nil {
+				return 0, err
+			}
+			records++
+		}
+		if c.err != nil {
+			return 0, fmt.Errorf("read segment %s: %w", c.segment.Name, c.err)
+		}
+
+		bytesRead += int64(c.size)
+		replayMetrics.bytesRead.Set(bytesRead)
+		replayMetrics.recordsApplied.Set(int64(records))
+		if c.last {
+			replayMetrics.segmentsRead.Add(1)
+		}
+
+		if time.Now().After(progressAt) {
+			progressAt = time.Now().Add(replayProgressInterval)
+			w.logger.Info("replaying wal",
+				zap.String("segment", c.segment.Name),
+				zap.Int64("bytes_read", bytesRead),
+				zap.Int64("bytes_total", bytesTotal),
+				zap.Int("records", records),
+				zap.Float64("records_per_second", float64(records)/time.Since(started).Seconds()),
+			)
+		}
+	}
+
+	elapsed := time.Since(started)
+	w.logger.Info("wal replayed",
+		zap.Int("segments", len(files)),
+		zap.Int64("bytes", bytesRead),
+		zap.Int("records", records),
+		zap.Duration("duration", elapsed),
+		zap.Float64("records_per_second", float64(records)/max(elapsed.Seconds(), 1e-9)),
+	)
+
+	return decoder.LastLSN, nil
+}
+
+// readChunks читает сегменты и делит их на части по целым строкам.
+// Части отправляются в ordered в порядке чтения и в work для разбора.
+func (w *Wal) readChunks(files []SegmentFile, infos []SegmentInfo, ordered, work chan<- *replayChunk, stop <-chan struct{}) {
+	send := func(c *replayChunk) bool {
+		select {
+		case ordered <- c:
+		case <-stop:
+			return false
+		}
+		select {
+		case work <- c:
+		case <-stop:
+			return false
+		}
+		return true
+	}
+	fail := func(file SegmentFile, err error) {
+		c := &replayChunk{segment: file, err: err, done: make(chan struct{})}
+		close(c.done)
+		select {
+		case ordered <- c:
+		case <-stop:
+		}
+	}
+
+	for i, file := range files {
+		data, err := w.segment.fs.ReadFile(file.Path)
+		if err != nil {
+			fail(file, err)
+			return
+		}
+		if err := verifySegment(infos[i], data); err != nil {
+			fail(file, err)
+			return
+		}
+
+		var plain []byte
+		err = readSegmentData(w.segment.keyring, data, func(batch []byte) error {
+			plain = append(plain, batch...)
+			return nil
+		})
+		if err != nil {
+			fail(file, err)
+			return
+		}
+
+		var chunks []*replayChunk
+		for len(plain) > 0 {
+			size := len(plain)
+			if size > replayChunkSize {
+				size = replayChunkSize
+				if i := bytes.IndexByte(plain[size:], '\n'); i >= 0 {
+					size += i + 1
+				} else {
+					size = len(plain)
+				}
+			}
+			chunks = append(chunks, &replayChunk{segment: file, data: plain[:size], done: make(chan struct{})})
+			plain = plain[size:]
+		}
+		if len(chunks) == 0 {
+			chunks = append(chunks, &replayChunk{segment: file, done: make(chan struct{})})
+		}
+		last := chunks[len(chunks)-1]
+		last.last, last.size = true, int(file.Size)
+		for _, c := range chunks {
+			if !send(c) {
+				return
+			}
+		}
+	}
+}
+
+// decode разбирает записи части сегмента, порядок LSN проверяется при применении.
+// При ошибке records содержит записи до ошибочной.
+func (c *replayChunk) decode(prepare func(Record) (any, error)) {
+	defer close(c.done)
+
+	lines := splitBatch(c.data)
+	c.records = make([]Record, 0, len(lines))
+	c.prepared = make([]any, 0, len(lines))
+	for _, line := range lines {
+		r, err := DecodeRecord(line)
+		if err != nil {
+			c.err = err
+			return
+		}
+
+		var prepared any
+		if prepare != nil {
+			if prepared, err = prepare(r); err != nil {
+				c.err = err
+				return
+			}
+		}
+		c.records = append(c.records, r)
+		c.prepared = append(c.prepared, prepared)
+	}
+}
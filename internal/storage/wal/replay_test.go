@@ -0,0 +1,147 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+	"in-memory-db/internal/testingh"
+)
+
+type ReplaySuite struct {
+	testingh.BaseDirSuite
+}
+
+func TestReplaySuite(t *testing.T) {
+	suite.Run(t, new(ReplaySuite))
+}
+
+func (s *ReplaySuite) SetupTest() {
+	s.BaseDir = testingh.GetBaseDir(runtime.Caller(0))
+	s.BaseDirSuite.SetupTest()
+}
+
+// writeSegments записывает segments сегментов по perSegment записей и возвращает запросы по порядку
+func (s *ReplaySuite) writeSegments(segments, perSegment int) []string {
+	var queries []string
+	lsn := uint64(0)
+	for fn := 1; fn <= segments; fn++ {
+		var content strings.Builder
+		for i := 0; i < perSegment; i++ {
+			lsn++
+			query := fmt.Sprintf("SET key%d %s", lsn, strings.Repeat("v", 50))
+			content.WriteString(NewRecord(lsn, time.Now(), query).Encode())
+			queries = append(queries, query)
+		}
+		s.NoError(os.WriteFile(s.BaseDir+fmt.Sprintf(fileNameTemplate, fn), []byte(content.String()), 0644))
+	}
+	return queries
+}
+
+func (s *ReplaySuite) TestReplay_Order() {
+	// каждый сегмент больше replayChunkSize, поэтому делится на несколько частей
+	queries := s.writeSegments(3, 20000)
+
+	w := NewWal(s.Ctx, 100, time.Second, NewSegment(1<<30, s.BaseDir), zap.NewNop())
+	var applied []string
+	var lsn uint64
+	s.NoError(w.Init(Replay{
+		Prepare: func(r Record) (any, error) {
+			return strings.ToUpper(r.Query), nil
+		},
+		Apply: func(r Record, prepared any) error {
+			s.Require().Equal(lsn+1, r.LSN)
+			s.Require().Equal(strings.ToUpper(r.Query), prepared)
+			lsn = r.LSN
+			applied = append(applied, r.Query)
+			return nil
+		},
+	}))
+	s.NoError(w.Close())
+
+	s.Equal(queries, applied)
+	s.Equal(uint64(len(queries)), w.LastLSN())
+	s.Equal(int64(0), replayMetrics.loading.Value())
+	s.Equal(int64(3), replayMetrics.segmentsRead.Value())
+	s.Equal(int64(len(queries)), replayMetrics.recordsApplied.Value())
+	s.Equal(replayMetrics.bytesTotal.Value(), replayMetrics.bytesRead.Value())
+}
+
+func (s *ReplaySuite) TestReplay_Legacy() {
+	s.NoError(os.WriteFile(s.BaseDir+"data_1", []byte("SET a 1\nSET b 2\n"), 0644))
+	s.NoError(os.WriteFile(s.BaseDir+"data_2", []byte(NewRecord(3, time.Now(), "SET c 3").Encode()+"DEL a\n"), 0644))
+
+	w := NewWal(s.Ctx, 100, time.Second, NewSegment(4096, s.BaseDir), zap.NewNop())
+	var lsns []uint64
+	s.NoError(w.Init(replayFunc(nil, func(r Record) error {
+		lsns = append(lsns, r.LSN)
+		return nil
+	})))
+	s.NoError(w.Close())
+
+	s.Equal([]uint64{1, 2, 3, 4}, lsns)
+	s.Equal(uint64(4), w.LastLSN())
+}
+
+func (s *ReplaySuite) TestReplay_Errors() {
+	prepareErr := errors.New("prepare failed")
+
+	tests := map[string]struct {
+		second   string
+		prepare  func(Record) (any, error)
+		expected error
+		applied  int
+	}{
+		"bad checksum": {
+			second:   strings.Replace(NewRecord(4, time.Now(), "SET d 4").Encode(), "SET d 4", "SET d 5", 1),
+			expected: ErrChecksumMismatch,
+			applied:  3,
+		},
+		"lsn out of order": {
+			second:   NewRecord(2, time.Now(), "SET d 4").Encode(),
+			expected: ErrLSNOrder,
+			applied:  3,
+		},
+		"prepare failed": {
+			second: NewRecord(4, time.Now(), "SET d 4").Encode(),
+			prepare: func(r Record) (any, error) {
+				if r.LSN == 4 {
+					return nil, prepareErr
+				}
+				return nil, nil
+			},
+			expected: prepareErr,
+			applied:  3,
+		},
+	}
+
+	for name, test := range tests {
+		s.Run(name, func() {
+			var first string
+			for i := 1; i <= 3; i++ {
+				first += NewRecord(uint64(i), time.Now(), "SET a 1").Encode()
+			}
+			s.NoError(os.WriteFile(s.BaseDir+"data_1", []byte(first), 0644))
+			s.NoError(os.WriteFile(s.BaseDir+"data_2", []byte(test.second+NewRecord(5, time.Now(), "SET e 5").Encode()), 0644))
+
+			w := NewWal(s.Ctx, 100, time.Second, NewSegment(4096, s.BaseDir), zap.NewNop())
+			applied := 0
+			err := w.Init(Replay{
+				Prepare: test.prepare,
+				Apply: func(r Record, prepared any) error {
+					applied++
+					return nil
+				},
+			})
+			s.ErrorIs(err, test.expected)
+			s.ErrorContains(err, "data_2")
+			s.Equal(test.applied, applied)
+		})
+	}
+}
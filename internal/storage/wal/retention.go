@@ -0,0 +1,422 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"in-memory-db/internal/storage/filesystem"
+)
+
+// Удалять можно только закрытые сегменты, все записи которых вошли в последний снимок.
+// Удаляется всегда самая старая часть WAL, чтобы оставшиеся сегменты шли без пропусков.
+
+const (
+	archiveStatusDirectory = "archive_status"
+	archiveReadySuffix     = ".ready"
+	archiveDoneSuffix      = ".done"
+)
+
+var ErrWrongArchivePolicy = errors.New("wrong archive policy")
+
+// RetentionPolicy задаёт, какие сегменты можно удалить из директории данных.
+// Нулевые значения не ограничивают хранение.
+type RetentionPolicy struct {
+	MaxSegments  int
+	MaxAge       time.Duration
+	MaxTotalSize int64
+}
+
+func (p RetentionPolicy) IsSet() bool {
+	return p.MaxSegments > 0 || p.MaxAge > 0 || p.MaxTotalSize > 0
+}
+
+type ArchiveMode string
+
+const (
+	// ArchiveOff - сегменты, вышедшие за политику хранения, удаляются
+	ArchiveOff ArchiveMode = ""
+	// ArchiveCopy - каждый закрытый сегмент копируется в архив, удаляются только заархивированные сегменты
+	ArchiveCopy ArchiveMode = "copy"
+	// ArchiveMove - сегменты, вышедшие за политику хранения, переносятся в архив вместо удаления
+	ArchiveMove ArchiveMode = "move"
+)
+
+// ArchivePolicy задаёт архивирование сегментов.
+// Command выполняется через sh -c для каждого заархивированного сегмента,
+// %p заменяется на путь к файлу в архиве, %f - на имя файла.
+// Пока команда не завершится успешно, она будет повторяться при следующих проверках.
+type ArchivePolicy struct {
+	Mode      ArchiveMode
+	Directory string
+	Command   string
+}
+
+type segmentRange struct {
+	firstLSN    uint64
+	lastLSN     uint64
+	firstLegacy bool
+	empty       bool
+}
+
+// Cleaner применяет политики хранения и архивирования к сегментам
+type Cleaner struct {
+	segment   *Segment
+	retention RetentionPolicy
+	archive   ArchivePolicy
+	logger    *zap.Logger
+
+	// закрытые сегменты не изменяются, поэтому их диапазоны LSN можно запомнить,
+	// пока из конца WAL не удалены записи, см. Segment.truncations
+	ranges      map[int]segmentRange
+	truncations uint64
+	now         func() time.Time
+}
+
+func NewCleaner(segment *Segment, retention RetentionPolicy, archive ArchivePolicy, logger *zap.Logger) (*Cleaner, error) {
+	switch archive.Mode {
+	case ArchiveOff:
+	case ArchiveCopy, ArchiveMove:
+		if archive.Directory == "" {
+			return nil, fmt.Errorf("%w: archive directory is required for mode %q", ErrWrongArchivePolicy, archive.Mode)
+		}
+		if err := segment.fs.MkdirAll(archive.Directory, 0755); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown mode %q", ErrWrongArchivePolicy, archive.Mode)
+	}
+
+	return &Cleaner{
+		segment:   segment,
+		retention: retention,
+		archive:   archive,
+		logger:    logger,
+		ranges:    make(map[int]segmentRange),
+		now:       time.Now,
+	}, nil
+}
+
+// Run запускает проверку сегментов с интервалом interval, пока не завершится ctx
+func (c *Cleaner) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Clean(ctx); err != nil {
+				c.logger.Error("clean wal segments", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Clean архивирует закрытые сегменты и удаляет сегменты, вышедшие за политику хранения
+func (c *Cleaner) Clean(ctx context.Context) error {
+	active := c.segment.ActiveFileNumber()
+	if active == 0 {
+		return nil
+	}
+	if truncations := c.segment.truncations.Load(); truncations != c.truncations {
+		c.ranges = make(map[int]segmentRange)
+		c.truncations = truncations
+	}
+
+	files, err := ListSegmentFiles(c.segment.fs, c.segment.DataDirectory)
+	if err != nil {
+		return err
+	}
+
+	closed := 0
+	for closed < len(files) && files[closed].Number < active {
+		closed++
+	}
+
+	if c.archive.Mode == ArchiveCopy {
+		for _, file := range files[:closed] {
+			if err := c.copyToArchive(file); err != nil {
+				return err
+			}
+		}
+	}
+	if err := c.runArchiveCommands(ctx); err != nil {
+		return err
+	}
+
+	removable, err := c.removableSegments(files, closed)
+	if err != nil {
+		return err
+	}
+
+	if removable > 0 {
+		names := make([]string, 0, removable)
+		for _, file := range files[:removable] {
+			names = append(names, file.Name)
+		}
+		if err := c.segment.removeFromManifest(names); err != nil {
+			return err
+		}
+	}
+	for _, file := range files[:removable] {
+		if err := c.remove(file); err != nil {
+			return err
+		}
+		delete(c.ranges, file.Number)
+	}
+
+	if removable > 0 {
+		if err := c.segment.fs.SyncDir(c.segment.DataDirectory); err != nil {
+			return err
+		}
+		if c.archive.Mode == ArchiveMove {
+			return c.runArchiveCommands(ctx)
+		}
+	}
+
+	return nil
+}
+
+// removableSegments возвращает, сколько самых старых сегментов нужно удалить
+func (c *Cleaner) removableSegments(files []SegmentFile, closed int) (int, error) {
+	if !c.retention.IsSet() || closed == 0 {
+		return 0, nil
+	}
+
+	snapshots, err := ListSnapshotFiles(c.segment.fs, c.segment.DataDirectory)
+	if err != nil {
+		return 0, err
+	}
+	if len(snapshots) == 0 {
+		return 0, nil
+	}
+	snapshotLSN := snapshots[len(snapshots)-1].LSN
+
+	// сегменты, которые не нужны для восстановления
+	candidates := 0
+	var prevLSN uint64
+	for _, file := range files[:closed] {
+		r, err := c.segmentRange(file, prevLSN)
+		if err != nil {
+			return 0, err
+		}
+		if !r.empty {
+			prevLSN = r.lastLSN
+		}
+		if r.lastLSN > snapshotLSN || (c.archive.Mode == ArchiveCopy && !c.archived(file, archiveDoneSuffix)) {
+			break
+		}
+		candidates++
+	}
+
+	removable := 0
+	if c.retention.MaxSegments > 0 {
+		removable = max(removable, min(len(files)-c.retention.MaxSegments, candidates))
+	}
+	if c.retention.MaxAge > 0 {
+		deadline := c.now().Add(-c.retention.MaxAge)
+		old := 0
+		for old < candidates && files[old].ModTime.Before(deadline) {
+			old++
+		}
+		removable = max(removable, old)
+	}
+	if c.retention.MaxTotalSize > 0 {
+		var total int64
+		for _, file := range files {
+			total += file.Size
+		}
+		over := 0
+		for over < candidates && total > c.retention.MaxTotalSize {
+			total -= files[over].Size
+			over++
+		}
+		removable = max(removable, over)
+	}
+
+	// LSN записей старого формата назначаются по порядку чтения,
+	// поэтому нельзя удалять сегменты перед сегментом, который начинается с такой записи
+	for removable > 0 && removable < len(files) {
+		next := files[removable]
+		if next.Number >= c.segment.ActiveFileNumber() {
+			// в активный сегмент идёт запись, поэтому читаем только первую запись
+			legacy := false
+			err := ReadSegmentFile(c.segment.fs, next.Path, c.segment.keyring, &Decoder{}, func(index int, rec Record) error {
+				legacy = rec.Legacy()
+				return errStopReading
+			})
+			if err != nil && !errors.Is(err, errStopReading) {
+				return 0, err
+			}
+			if !legacy {
+				break
+			}
+		} else if !c.ranges[next.Number].firstLegacy {
+			break
+		}
+		removable--
+	}
+
+	return removable, nil
+}
+
+func (c *Cleaner) segmentRange(file SegmentFile, prevLSN uint64) (segmentRange, error) {
+	if r, ok := c.ranges[file.Number]; ok {
+		return r, nil
+	}
+
+	r, err := readSegmentRange(file, c.segment, prevLSN)
+	if err != nil {
+		return segmentRange{}, err
+	}
+	c.ranges[file.Number] = r
+	return r, nil
+}
+
+func readSegmentRange(file SegmentFile, segment *Segment, prevLSN uint64) (segmentRange, error) {
+	r := segmentRange{empty: true}
+	decoder := Decoder{LastLSN: prevLSN}
+	err := ReadSegmentFile(segment.fs, file.Path, segment.keyring, &decoder, func(index int, rec Record) error {
+		if r.empty {
+			r.firstLSN, r.firstLegacy, r.empty = rec.LSN, rec.Legacy(), false
+		}
+		r.lastLSN = rec.LSN
+		return nil
+	})
+	if err != nil {
+		return segmentRange{}, fmt.Errorf("read segment %s: %w", file.Name, err)
+	}
+
+	return r, nil
+}
+
+func (c *Cleaner) remove(file SegmentFile) error {
+	if c.archive.Mode == ArchiveMove {
+		dst := filepath.Join(c.archive.Directory, file.Name)
+		if err := moveFile(c.segment.fs, file.Path, dst); err != nil {
+			return err
+		}
+		c.logger.Info("wal segment moved to archive", zap.String("segment", file.Name))
+		return c.setArchiveStatus(file.Name, archiveReadySuffix)
+	}
+
+	if err := c.segment.fs.Remove(file.Path); err != nil {
+		return err
+	}
+	c.logger.Info("wal segment removed", zap.String("segment", file.Name))
+
+	if c.archive.Mode == ArchiveCopy {
+		return c.segment.fs.Remove(c.archiveStatusPath(file.Name, archiveDoneSuffix))
+	}
+	return nil
+}
+
+func (c *Cleaner) copyToArchive(file SegmentFile) error {
+	if c.archived(file, archiveReadySuffix) || c.archived(file, archiveDoneSuffix) {
+		return nil
+	}
+
+	dst := filepath.Join(c.archive.Directory, file.Name)
+	tmp := dst + ".tmp"
+	if err := c.segment.fs.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := copyFile(c.segment.fs, file.Path, tmp); err != nil {
+		return err
+	}
+	if err := c.segment.fs.Rename(tmp, dst); err != nil {
+		return err
+	}
+	if err := c.segment.fs.SyncDir(c.archive.Directory); err != nil {
+		return err
+	}
+
+	c.logger.Info("wal segment copied to archive", zap.String("segment", file.Name))
+	return c.setArchiveStatus(file.Name, archiveReadySuffix)
+}
+
+// runArchiveCommands выполняет команду для каждого сегмента, ожидающего отправки
+func (c *Cleaner) runArchiveCommands(ctx context.Context) error {
+	entries, err := c.segment.fs.ReadDir(filepath.Join(c.segment.DataDirectory, archiveStatusDirectory))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), archiveReadySuffix)
+		if !ok {
+			continue
+		}
+
+		if c.archive.Command != "" {
+			path := filepath.Join(c.archive.Directory, name)
+			command := strings.NewReplacer("%p", path, "%f", name).Replace(c.archive.Command)
+			output, err := exec.CommandContext(ctx, "sh", "-c", command).CombinedOutput()
+			if err != nil {
+				// повторим при следующей проверке
+				c.logger.Error("archive command failed",
+					zap.String("segment", name),
+					zap.String("output", string(output)),
+					zap.Error(err),
+				)
+				continue
+			}
+		}
+
+		if c.archive.Mode == ArchiveMove {
+			err = c.segment.fs.Remove(c.archiveStatusPath(name, archiveReadySuffix))
+		} else {
+			err = c.segment.fs.Rename(c.archiveStatusPath(name, archiveReadySuffix), c.archiveStatusPath(name, archiveDoneSuffix))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Cleaner) archived(file SegmentFile, suffix string) bool {
+	_, err := c.segment.fs.Stat(c.archiveStatusPath(file.Name, suffix))
+	return err == nil
+}
+
+func (c *Cleaner) archiveStatusPath(name, suffix string) string {
+	return filepath.Join(c.segment.DataDirectory, archiveStatusDirectory, name+suffix)
+}
+
+func (c *Cleaner) setArchiveStatus(name, suffix string) error {
+	if err := c.segment.fs.MkdirAll(filepath.Join(c.segment.DataDirectory, archiveStatusDirectory), 0755); err != nil {
+		return err
+	}
+
+	f, err := c.segment.fs.OpenFile(c.archiveStatusPath(name, suffix), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func moveFile(fs filesystem.FS, src, dst string) error {
+	if err := fs.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	// архив может находиться на другом устройстве
+	if err := copyFile(fs, src, dst); err != nil {
+		return err
+	}
+	return fs.Remove(src)
+}
@@ -0,0 +1,186 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+	"in-memory-db/internal/storage/filesystem"
+	"in-memory-db/internal/testingh"
+)
+
+type CleanerSuite struct {
+	testingh.BaseDirSuite
+	segment    *Segment
+	archiveDir string
+}
+
+func TestCleanerSuite(t *testing.T) {
+	suite.Run(t, new(CleanerSuite))
+}
+
+func (s *CleanerSuite) SetupTest() {
+	s.BaseDir = testingh.GetBaseDir(runtime.Caller(0))
+	s.BaseDirSuite.SetupTest()
+	s.archiveDir = s.BaseDir + "archive"
+	s.NoError(os.Mkdir(s.archiveDir, 0755))
+
+	// 4 сегмента по 3 записи, data_4 - активный
+	for fn := 1; fn <= 4; fn++ {
+		content := string(encodeSegmentVersion())
+		for i := fn*3 - 2; i <= fn*3; i++ {
+			content += NewRecord(uint64(i), time.Now(), fmt.Sprintf("SET key%d val", i)).Encode()
+		}
+		s.NoError(os.WriteFile(s.BaseDir+fmt.Sprintf(fileNameTemplate, fn), []byte(content), 0644))
+	}
+
+	s.segment = NewSegment(4096, s.BaseDir)
+	s.NoError(s.segment.Init(func(data []byte) error { return nil }))
+}
+
+func (s *CleanerSuite) TearDownTest() {
+	s.NoError(s.segment.Close())
+	s.BaseDirSuite.TearDownTest()
+}
+
+func (s *CleanerSuite) clean(retention RetentionPolicy, archive ArchivePolicy) *Cleaner {
+	cleaner, err := NewCleaner(s.segment, retention, archive, zap.NewNop())
+	s.Require().NoError(err)
+	s.NoError(cleaner.Clean(s.Ctx))
+	return cleaner
+}
+
+func (s *CleanerSuite) writeSnapshot(lsn uint64) {
+	_, err := WriteSnapshot(filesystem.OS{}, s.BaseDir, nil, SnapshotInfo{LSN: lsn}, rangeMap(nil))
+	s.NoError(err)
+}
+
+func (s *CleanerSuite) segments() []string {
+	files, err := ListSegmentFiles(filesystem.OS{}, s.BaseDir)
+	s.NoError(err)
+
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+
+	// удалённые сегменты исключены и из манифеста
+	manifest, err := ReadSegmentManifest(filesystem.OS{}, s.BaseDir)
+	s.NoError(err)
+	listed := make([]string, 0, len(manifest.Segments))
+	for _, info := range manifest.Segments {
+		listed = append(listed, info.Name)
+	}
+	s.Equal(names, listed)
+
+	return names
+}
+
+func (s *CleanerSuite) TestWrongPolicy() {
+	_, err := NewCleaner(s.segment, RetentionPolicy{}, ArchivePolicy{Mode: ArchiveCopy}, zap.NewNop())
+	s.ErrorIs(err, ErrWrongArchivePolicy)
+	_, err = NewCleaner(s.segment, RetentionPolicy{}, ArchivePolicy{Mode: "unknown", Directory: s.archiveDir}, zap.NewNop())
+	s.ErrorIs(err, ErrWrongArchivePolicy)
+}
+
+func (s *CleanerSuite) TestNoSnapshot() {
+	s.clean(RetentionPolicy{MaxSegments: 1}, ArchivePolicy{})
+	s.Equal([]string{"data_1", "data_2", "data_3", "data_4"}, s.segments())
+}
+
+func (s *CleanerSuite) TestMaxSegments() {
+	// data_3 нужен для восстановления после снимка
+	s.writeSnapshot(7)
+	s.clean(RetentionPolicy{MaxSegments: 1}, ArchivePolicy{})
+	s.Equal([]string{"data_3", "data_4"}, s.segments())
+}
+
+func (s *CleanerSuite) TestActiveSegmentIsKept() {
+	s.writeSnapshot(100)
+	s.clean(RetentionPolicy{MaxSegments: 1}, ArchivePolicy{})
+	s.Equal([]string{"data_4"}, s.segments())
+}
+
+func (s *CleanerSuite) TestMaxAge() {
+	s.writeSnapshot(12)
+	old := time.Now().Add(-2 * time.Hour)
+	s.NoError(os.Chtimes(s.BaseDir+"data_1", old, old))
+
+	s.clean(RetentionPolicy{MaxAge: time.Hour}, ArchivePolicy{})
+	s.Equal([]string{"data_2", "data_3", "data_4"}, s.segments())
+}
+
+func (s *CleanerSuite) TestMaxTotalSize() {
+	s.writeSnapshot(12)
+	files, err := ListSegmentFiles(filesystem.OS{}, s.BaseDir)
+	s.NoError(err)
+
+	s.clean(RetentionPolicy{MaxTotalSize: files[2].Size + files[3].Size}, ArchivePolicy{})
+	s.Equal([]string{"data_3", "data_4"}, s.segments())
+}
+
+func (s *CleanerSuite) TestLegacySegmentBoundary() {
+	// LSN записей data_3 зависят от data_2, поэтому data_2 удалять нельзя
+	s.NoError(os.WriteFile(s.BaseDir+"data_3", []byte("SET key7 val\nSET key8 val\n"), 0644))
+	s.writeSnapshot(12)
+
+	s.clean(RetentionPolicy{MaxSegments: 2}, ArchivePolicy{})
+	s.Equal([]string{"data_2", "data_3", "data_4"}, s.segments())
+}
+
+func (s *CleanerSuite) TestArchiveCopy() {
+	command := "echo %f >> " + filepath.Join(s.archiveDir, "sent")
+	cleaner := s.clean(RetentionPolicy{}, ArchivePolicy{Mode: ArchiveCopy, Directory: s.archiveDir, Command: command})
+
+	for _, name := range []string{"data_1", "data_2", "data_3"} {
+		s.Equal(s.ReadFile(s.BaseDir+name), s.ReadFile(filepath.Join(s.archiveDir, name)))
+		s.FileExists(s.BaseDir + "archive_status/" + name + archiveDoneSuffix)
+	}
+	s.NoFileExists(filepath.Join(s.archiveDir, "data_4"))
+	s.Equal([]string{"data_1", "data_2", "data_3"}, s.ReadFileToSlice(filepath.Join(s.archiveDir, "sent")))
+
+	// повторная проверка не копирует сегменты и не вызывает команду снова
+	s.NoError(cleaner.Clean(s.Ctx))
+	s.Len(s.ReadFileToSlice(filepath.Join(s.archiveDir, "sent")), 3)
+
+	// без политики хранения заархивированные сегменты не удаляются
+	s.writeSnapshot(12)
+	s.NoError(cleaner.Clean(s.Ctx))
+	s.Len(s.segments(), 4)
+
+	cleaner.retention = RetentionPolicy{MaxSegments: 1}
+	s.NoError(cleaner.Clean(s.Ctx))
+	s.Equal([]string{"data_4"}, s.segments())
+	s.NoFileExists(s.BaseDir + "archive_status/data_1" + archiveDoneSuffix)
+}
+
+func (s *CleanerSuite) TestArchiveCopy_CommandFailed() {
+	s.writeSnapshot(12)
+	cleaner := s.clean(RetentionPolicy{MaxSegments: 1}, ArchivePolicy{Mode: ArchiveCopy, Directory: s.archiveDir, Command: "exit 1"})
+
+	// пока сегменты не отправлены, удалять их нельзя
+	s.Equal([]string{"data_1", "data_2", "data_3", "data_4"}, s.segments())
+	s.FileExists(s.BaseDir + "archive_status/data_1" + archiveReadySuffix)
+
+	cleaner.archive.Command = "true"
+	s.NoError(cleaner.Clean(s.Ctx))
+	s.Equal([]string{"data_4"}, s.segments())
+}
+
+func (s *CleanerSuite) TestArchiveMove() {
+	s.writeSnapshot(7)
+	content := s.ReadFile(s.BaseDir + "data_1")
+
+	command := "test -f %p"
+	s.clean(RetentionPolicy{MaxSegments: 1}, ArchivePolicy{Mode: ArchiveMove, Directory: s.archiveDir, Command: command})
+
+	s.Equal([]string{"data_3", "data_4"}, s.segments())
+	s.Equal(content, s.ReadFile(filepath.Join(s.archiveDir, "data_1")))
+	s.FileExists(filepath.Join(s.archiveDir, "data_2"))
+	s.NoFileExists(s.BaseDir + "archive_status/data_1" + archiveReadySuffix)
+}
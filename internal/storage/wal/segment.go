@@ -1,82 +1,167 @@
 package wal
 
 import (
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
+	"path/filepath"
 	"slices"
-	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"in-memory-db/internal/storage/encryption"
+	"in-memory-db/internal/storage/filesystem"
 )
 
 // имя файла будет иметь вид data_123 - где 123 будет возрастающей последовательностью
 
 const fileNameTemplate = "data_%d"
 
+var ErrSegmentFailed = errors.New("segment is not writable after failed write")
+
+type SegmentOption func(*Segment)
+
+// WithSegmentKeyring включает шифрование новых сегментов активным ключом из keyring
+func WithSegmentKeyring(keyring *encryption.Keyring) SegmentOption {
+	return func(segment *Segment) {
+		segment.keyring = keyring
+	}
+}
+
+// WithSegmentFileSystem задаёт файловую систему, с которой работают сегменты и снимки
+func WithSegmentFileSystem(fs filesystem.FS) SegmentOption {
+	return func(segment *Segment) {
+		segment.fs = fs
+	}
+}
+
 type Segment struct {
 	MaxSegmentSizeBytes int64
 	DataDirectory       string
 
-	currentFile       *os.File
+	keyring *encryption.Keyring
+	fs      filesystem.FS
+
+	currentFile       filesystem.File
 	currentFileNumber int
+	currentHeader     []byte
+	currentSize       int64
+	// crc32 содержимого текущего файла, записывается в манифест при смене сегмента
+	currentCRC uint32
+	// ошибка, после которой запись в сегмент невозможна
+	err error
+	// номер сегмента, в который идёт запись, доступен из других горутин
+	activeFileNumber atomic.Int64
+
+	// манифест меняется при смене сегмента и при удалении старых сегментов из Cleaner,
+	// последний сегмент манифеста - активный
+	manifestMu sync.Mutex
+	manifest   SegmentManifest
+	// номер активного сегмента и размер его данных, сохранённых на диск, меняются вместе с манифестом
+	durableNumber int
+	durableSize   int64
+	// truncations меняется после удаления записей из конца WAL: сегменты с прежними номерами
+	// могут быть записаны заново с другим содержимым
+	truncations atomic.Uint64
 }
 
-func NewSegment(maxSegmentSizeBytes int, dataDirectory string) *Segment {
-	return &Segment{
+func NewSegment(maxSegmentSizeBytes int, dataDirectory string, options ...SegmentOption) *Segment {
+	segment := &Segment{
 		MaxSegmentSizeBytes: int64(maxSegmentSizeBytes),
 		DataDirectory:       dataDirectory,
+		fs:                  filesystem.OS{},
 	}
+
+	for _, o := range options {
+		o(segment)
+	}
+
+	return segment
 }
 
 func (s *Segment) Init(fileHandler func(data []byte) error) error {
-	files, err := os.ReadDir(s.DataDirectory)
+	files, infos, err := listManifestSegments(s.fs, s.DataDirectory)
 	if err != nil {
 		return err
 	}
 
-	fileNums := make([]int, 0, len(files))
-	for _, file := range files {
-		if file.IsDir() {
-			continue
+	for i, file := range files {
+		data, err := s.fs.ReadFile(file.Path)
+		if err != nil {
+			return err
 		}
-		fn := s.fileNumber(file.Name())
-		if fn == 0 {
-			continue
+		if err := verifySegment(infos[i], data); err != nil {
+			return err
 		}
-		if fn > s.currentFileNumber {
-			s.currentFileNumber = fn
+
+		if err := readSegmentData(s.keyring, data, fileHandler); err != nil {
+			return fmt.Errorf("read segment %s: %w", file.Name, err)
 		}
-		fileNums = append(fileNums, fn)
 	}
-	// т.к. у нас нет гарантии порядка файлов, то на надо отсортировать
-	slices.Sort(fileNums)
 
-	fileFullPathTemplate := s.DataDirectory + fileNameTemplate
-	for idx, fn := range fileNums {
-		data, err := os.ReadFile(fmt.Sprintf(fileFullPathTemplate, fn))
-		if err != nil {
-			return err
-		}
+	return s.Open()
+}
 
-		if err := fileHandler(data); err != nil {
-			return err
-		}
+// Open открывает для записи последний сегмент и записывает манифест.
+// Закрытые сегменты из манифеста не читаются.
+func (s *Segment) Open() error {
+	files, infos, err := listManifestSegments(s.fs, s.DataDirectory)
+	if err != nil {
+		return err
+	}
 
-		if idx == len(fileNums)-1 {
-			s.currentFileNumber = fn
-			if err = s.setAndOpenFile(); err != nil {
+	manifest := SegmentManifest{}
+	for i, file := range files {
+		info := infos[i]
+		// описания активного сегмента и сегментов не из манифеста строятся по содержимому
+		if info.Name == "" || info.Active {
+			data, err := s.fs.ReadFile(file.Path)
+			if err != nil {
 				return err
 			}
+			info = describeSegment(s.keyring, file.Name, data)
 		}
+		info.Active = false
+		manifest.Segments = append(manifest.Segments, info)
 	}
 
-	if len(fileNums) == 0 {
-		s.currentFileNumber = 1
-		if err = s.setAndOpenFile(); err != nil {
+	s.currentFileNumber = 1
+	var active SegmentInfo
+	if len(files) > 0 {
+		last := files[len(files)-1]
+		data, err := s.fs.ReadFile(last.Path)
+		if err != nil {
 			return err
 		}
-		return nil
+
+		s.currentFileNumber = last.Number
+		// дописывать можно только в сегмент того же формата и с тем же ключом,
+		// иначе начинаем новый сегмент
+		if s.canAppend(data) {
+			manifest.Segments = manifest.Segments[:len(manifest.Segments)-1]
+			active = describeSegment(s.keyring, last.Name, data)
+		} else {
+			s.currentFileNumber++
+		}
+	}
+	if err := s.setAndOpenFile(); err != nil {
+		return err
+	}
+
+	active.Name, active.Size, active.CRC32, active.Active = filepath.Base(s.currentFilePath()), s.currentSize, s.currentCRC, true
+	manifest.Segments = append(manifest.Segments, active)
+
+	if err := writeSegmentManifest(s.fs, s.DataDirectory, manifest); err != nil {
+		return err
 	}
+	s.manifestMu.Lock()
+	s.manifest = manifest
+	s.durableNumber, s.durableSize = s.currentFileNumber, s.currentSize
+	s.manifestMu.Unlock()
 
+	s.activeFileNumber.Store(int64(s.currentFileNumber))
 	return nil
 }
 
@@ -84,56 +169,341 @@ func (s *Segment) Write(data []byte) error {
 	if len(data) == 0 {
 		return nil
 	}
+	if s.err != nil {
+		return s.err
+	}
+
+	plain := data
+	if s.keyring != nil {
+		frame, err := encodeEncryptedFrame(s.keyring, s.currentHeader, data)
+		if err != nil {
+			return err
+		}
+		data = frame
+	}
 
-	stat, err := s.currentFile.Stat()
+	headerSize := int64(len(encodeSegmentVersion()) + len(s.currentHeader))
+	if s.currentSize+int64(len(data)) >= s.MaxSegmentSizeBytes && s.currentSize > headerSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.currentFile.Write(data); err != nil {
+		// убираем частично записанные данные, иначе следующие записи окажутся после обрывка
+		if truncateErr := s.currentFile.Truncate(s.currentSize); truncateErr != nil {
+			s.err = fmt.Errorf("%w: %w", ErrSegmentFailed, err)
+		}
+		return err
+	}
+
+	syncStarted := time.Now()
+	err := s.currentFile.Sync()
+	observeFsync(time.Since(syncStarted))
 	if err != nil {
+		// после неудачного fsync неизвестно, что из файла сохранено на диск,
+		// поэтому дописывать в него нельзя
+		s.err = fmt.Errorf("%w: %w", ErrSegmentFailed, err)
+		return s.err
+	}
+	s.currentSize += int64(len(data))
+	s.currentCRC = crc32.Update(s.currentCRC, crc32.IEEETable, data)
+
+	s.manifestMu.Lock()
+	s.manifest.Segments[len(s.manifest.Segments)-1].addBatch(plain)
+	s.durableSize = s.currentSize
+	s.manifestMu.Unlock()
+
+	return nil
+}
+
+// DurableEnd возвращает номер активного сегмента и размер его данных, сохранённых на диск.
+// Данные после этого размера могут быть удалены из файла после неудачной записи.
+func (s *Segment) DurableEnd() (int, int64) {
+	s.manifestMu.Lock()
+	defer s.manifestMu.Unlock()
+	return s.durableNumber, s.durableSize
+}
+
+// ActiveFileNumber возвращает номер сегмента, в который идёт запись, или 0, если сегмент ещё не открыт.
+// Сегменты с меньшими номерами закрыты и больше не изменяются.
+func (s *Segment) ActiveFileNumber() int {
+	return int(s.activeFileNumber.Load())
+}
+
+func (s *Segment) Close() error {
+	if s.currentFile != nil {
+		return s.currentFile.Close()
+	}
+	return nil
+}
+
+// rotate начинает новый сегмент. Новый файл создаётся до записи манифеста, поэтому после сбоя
+// он либо уже есть в манифесте, либо будет найден при старте как следующий за последним.
+// Если сегмент не удалось начать, запись продолжается в текущий.
+func (s *Segment) rotate() error {
+	prevFile, prevHeader, prevSize, prevCRC := s.currentFile, s.currentHeader, s.currentSize, s.currentCRC
+
+	revert := func() {
+		if s.currentFile != prevFile {
+			s.currentFile.Close()
+		}
+		s.currentFileNumber--
+		s.currentFile, s.currentHeader, s.currentSize, s.currentCRC = prevFile, prevHeader, prevSize, prevCRC
+	}
+
+	s.currentFileNumber++
+	if err := s.setAndOpenFile(); err != nil {
+		revert()
+		return err
+	}
+
+	s.manifestMu.Lock()
+	manifest := SegmentManifest{Segments: slices.Clone(s.manifest.Segments)}
+	closed := &manifest.Segments[len(manifest.Segments)-1]
+	closed.Active, closed.Size, closed.CRC32 = false, prevSize, prevCRC
+	manifest.Segments = append(manifest.Segments, SegmentInfo{Name: filepath.Base(s.currentFilePath()), Size: s.currentSize, CRC32: s.currentCRC, Active: true})
+	err := writeSegmentManifest(s.fs, s.DataDirectory, manifest)
+	if err == nil {
+		s.manifest = manifest
+		s.durableNumber, s.durableSize = s.currentFileNumber, s.currentSize
+	}
+	s.manifestMu.Unlock()
+	if err != nil {
+		revert()
 		return err
 	}
 
-	if stat.Size()+int64(len(data)) >= s.MaxSegmentSizeBytes && stat.Size() > 0 {
-		if err = s.currentFile.Close(); err != nil {
+	// номер меняется только после записи манифеста: читатели считают сегменты до активного закрытыми
+	s.activeFileNumber.Store(int64(s.currentFileNumber))
+	return prevFile.Close()
+}
+
+// clear закрывает текущий сегмент и удаляет все сегменты. Манифест записывается пустым до удаления файлов,
+// чтобы после сбоя он не ссылался на удалённые файлы. До restart запись в сегмент невозможна.
+func (s *Segment) clear() error {
+	s.err = fmt.Errorf("%w: segments are removed", ErrSegmentFailed)
+	if s.currentFile != nil {
+		if err := s.currentFile.Close(); err != nil {
 			return err
 		}
-		s.currentFileNumber++
-		if err = s.setAndOpenFile(); err != nil {
+		s.currentFile = nil
+	}
+
+	s.manifestMu.Lock()
+	err := writeSegmentManifest(s.fs, s.DataDirectory, SegmentManifest{})
+	if err == nil {
+		s.manifest = SegmentManifest{}
+	}
+	s.manifestMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	files, err := ListSegmentFiles(s.fs, s.DataDirectory)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := s.fs.Remove(file.Path); err != nil {
 			return err
 		}
 	}
+	return s.fs.SyncDir(s.DataDirectory)
+}
 
-	if _, err := s.currentFile.Write(data); err != nil {
+// restart начинает запись в новый сегмент после clear. Один номер сегмента пропускается,
+// чтобы читатели WAL увидели разрыв и получили ErrLSNNotAvailable.
+func (s *Segment) restart() error {
+	s.currentFileNumber += 2
+	if err := s.setAndOpenFile(); err != nil {
 		return err
 	}
 
-	if err := s.currentFile.Sync(); err != nil {
+	manifest := SegmentManifest{Segments: []SegmentInfo{
+		{Name: filepath.Base(s.currentFilePath()), Size: s.currentSize, CRC32: s.currentCRC, Active: true},
+	}}
+	if err := writeSegmentManifest(s.fs, s.DataDirectory, manifest); err != nil {
 		return err
 	}
+	s.manifestMu.Lock()
+	s.manifest = manifest
+	s.durableNumber, s.durableSize = s.currentFileNumber, s.currentSize
+	s.manifestMu.Unlock()
+
+	s.err = nil
+	s.activeFileNumber.Store(int64(s.currentFileNumber))
 	return nil
 }
 
-func (s *Segment) Close() error {
+// truncateAfter удаляет записи с LSN больше lsn, запись продолжается в сегмент с последней оставшейся записью.
+// Сегменты после него сначала исключаются из манифеста, затем удаляются с конца, а сам сегмент заменяется
+// атомарно, поэтому после сбоя в WAL остаются либо все записи, либо их начало без пропусков.
+// Сегмент с оставшимися записями в манифесте помечен активным, пока его не откроет Open.
+func (s *Segment) truncateAfter(lsn uint64) error {
+	s.manifestMu.Lock()
+	segments := slices.Clone(s.manifest.Segments)
+	s.manifestMu.Unlock()
+	if len(segments) == 0 {
+		return nil
+	}
+
+	// LSN записей возрастают, поэтому записи не новее lsn есть только в сегментах до первого, начинающегося после lsn
+	boundary := len(segments) - 1
+	for boundary > 0 && (segments[boundary].FirstLSN == 0 || segments[boundary].FirstLSN > lsn) {
+		boundary--
+	}
+	name := segments[boundary].Name
+	path := filepath.Join(s.DataDirectory, name)
+	cut := -1
+	err := ReadSegmentFile(s.fs, path, s.keyring, &Decoder{}, func(index int, r Record) error {
+		if r.Legacy() {
+			return fmt.Errorf("%w: segment %s has records without lsn", ErrLSNNotAvailable, name)
+		}
+		if r.LSN > lsn {
+			cut = index
+			return errStopReading
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopReading) {
+		return fmt.Errorf("read segment %s: %w", name, err)
+	}
+
+	s.err = fmt.Errorf("%w: segments are truncated", ErrSegmentFailed)
 	if s.currentFile != nil {
-		return s.currentFile.Close()
+		if err := s.currentFile.Close(); err != nil {
+			return err
+		}
+		s.currentFile = nil
+	}
+	defer s.truncations.Add(1)
+
+	manifest := SegmentManifest{Segments: slices.Clone(segments[:boundary+1])}
+	manifest.Segments[boundary].Active = true
+	s.manifestMu.Lock()
+	err = writeSegmentManifest(s.fs, s.DataDirectory, manifest)
+	if err == nil {
+		s.manifest = manifest
+	}
+	s.manifestMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	files, err := ListSegmentFiles(s.fs, s.DataDirectory)
+	if err != nil {
+		return err
+	}
+	number := segmentFileNumber(name)
+	for i := len(files) - 1; i >= 0 && files[i].Number > number; i-- {
+		if err := s.fs.Remove(files[i].Path); err != nil {
+			return err
+		}
+	}
+	if err := s.fs.SyncDir(s.DataDirectory); err != nil {
+		return err
 	}
+	if cut >= 0 {
+		if err := TruncateSegmentFile(s.fs, path, s.keyring, cut); err != nil {
+			return err
+		}
+	}
+
+	if err := s.Open(); err != nil {
+		return err
+	}
+	s.err = nil
 	return nil
 }
 
+// removeFromManifest исключает сегменты из манифеста до удаления их файлов,
+// чтобы после сбоя манифест не ссылался на удалённые файлы
+func (s *Segment) removeFromManifest(names []string) error {
+	s.manifestMu.Lock()
+	defer s.manifestMu.Unlock()
+
+	manifest := SegmentManifest{}
+	for _, info := range s.manifest.Segments {
+		if !slices.Contains(names, info.Name) {
+			manifest.Segments = append(manifest.Segments, info)
+		}
+	}
+	if err := writeSegmentManifest(s.fs, s.DataDirectory, manifest); err != nil {
+		return err
+	}
+	s.manifest = manifest
+	return nil
+}
+
+// Manifest возвращает копию текущего манифеста сегментов
+func (s *Segment) Manifest() SegmentManifest {
+	s.manifestMu.Lock()
+	defer s.manifestMu.Unlock()
+	return SegmentManifest{Version: segmentManifestVersion, Segments: slices.Clone(s.manifest.Segments)}
+}
+
+func (s *Segment) canAppend(data []byte) bool {
+	// в пустой файл заголовок ещё не записан
+	if len(data) == 0 {
+		return true
+	}
+	version, data, err := splitSegmentVersion(data)
+	if err != nil || version != SegmentFormatVersion {
+		return false
+	}
+	if !isEncryptedSegment(data) {
+		return s.keyring == nil
+	}
+	if s.keyring == nil {
+		return false
+	}
+
+	keyID, _, _, err := decodeEncryptedHeader(data)
+	return err == nil && keyID == s.keyring.ActiveKeyID()
+}
+
+func (s *Segment) currentFilePath() string {
+	return filepath.Join(s.DataDirectory, fmt.Sprintf(fileNameTemplate, s.currentFileNumber))
+}
+
 func (s *Segment) setAndOpenFile() error {
-	fileFullPathTemplate := s.DataDirectory + fileNameTemplate
-	fileName := fmt.Sprintf(fileFullPathTemplate, s.currentFileNumber)
-	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	f, err := s.fs.OpenFile(s.currentFilePath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
 	s.currentFile = f
-	return nil
-}
+	s.currentHeader = nil
+	if s.keyring != nil {
+		s.currentHeader = encodeEncryptedHeader(s.keyring.ActiveKeyID())
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	s.currentSize = stat.Size()
+	s.currentCRC = 0
+	if s.currentSize > 0 {
+		data, err := s.fs.ReadFile(s.currentFilePath())
+		if err != nil {
+			return err
+		}
+		s.currentCRC = crc32.ChecksumIEEE(data)
+	}
 
-func (s *Segment) fileNumber(fileName string) int {
-	res := strings.Split(fileName, "_")
-	if len(res) != 2 {
-		return 0
+	if s.currentSize == 0 {
+		header := append(encodeSegmentVersion(), s.currentHeader...)
+		if _, err := f.Write(header); err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		s.currentSize = int64(len(header))
+		s.currentCRC = crc32.ChecksumIEEE(header)
 	}
 
-	number, _ := strconv.Atoi(res[1])
-	return number
+	// файл должен остаться в директории после сбоя, иначе вместе с ним пропадут подтверждённые записи
+	return s.fs.SyncDir(s.DataDirectory)
 }
@@ -7,9 +7,15 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/suite"
+	"in-memory-db/internal/storage/encryption"
 	"in-memory-db/internal/testingh"
 )
 
+const (
+	testKey1 = "k1:000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testKey2 = "k2:1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+)
+
 type SegmentSuite struct {
 	testingh.BaseDirSuite
 }
@@ -73,16 +79,17 @@ func (s *SegmentSuite) TestInitReadAndWrite_NoFilesExisted() {
 
 	f, err := os.OpenFile(s.BaseDir+fmt.Sprintf(fileNameTemplate, 1), os.O_RDONLY, 0644)
 	s.NoError(err)
-	buffer := make([]byte, len(insertData))
+	expected := append(encodeSegmentVersion(), insertData...)
+	buffer := make([]byte, len(expected))
 	_, err = f.Read(buffer)
 	s.NoError(err)
-	s.Equal(buffer, insertData)
+	s.Equal(expected, buffer)
 	err = f.Close()
 	s.NoError(err)
 }
 
 func (s *SegmentSuite) TestFileRotation() {
-	segment := NewSegment(32, s.BaseDir)
+	segment := NewSegment(42, s.BaseDir)
 	counter := 1
 	err := segment.Init(func(data []byte) error {
 		counter++
@@ -105,7 +112,7 @@ func (s *SegmentSuite) TestFileRotation() {
 
 	fileNames := s.FileNamesInBaseDir()
 
-	s.ElementsMatch(fileNames, []string{fmt.Sprintf(fileNameTemplate, 1), fmt.Sprintf(fileNameTemplate, 2)})
+	s.ElementsMatch(fileNames, []string{fmt.Sprintf(fileNameTemplate, 1), fmt.Sprintf(fileNameTemplate, 2), SegmentManifestName})
 }
 
 func (s *SegmentSuite) TestFileRotation_FirstDataMoreThenMaxSegmentSizeBytes() {
@@ -126,9 +133,141 @@ func (s *SegmentSuite) TestFileRotation_FirstDataMoreThenMaxSegmentSizeBytes() {
 
 	fileNames := s.FileNamesInBaseDir()
 
-	s.ElementsMatch(fileNames, []string{fmt.Sprintf(fileNameTemplate, 1)})
+	s.ElementsMatch(fileNames, []string{fmt.Sprintf(fileNameTemplate, 1), SegmentManifestName})
 
 	fileContent := s.ReadFileToSlice(s.BaseDir + fmt.Sprintf(fileNameTemplate, 1))
-	s.Equal(1, len(fileContent))
-	s.Equal(string([]byte("123456789abcdfg")), fileContent[0])
+	s.Equal(2, len(fileContent))
+	s.Equal(fmt.Sprintf("IMDBWAL %d", SegmentFormatVersion), fileContent[0])
+	s.Equal(string([]byte("123456789abcdfg")), fileContent[1])
+}
+
+func (s *SegmentSuite) TestEncryptedWriteAndInitRead() {
+	keyring, err := encryption.ParseKeyring(testKey1)
+	s.Require().NoError(err)
+
+	segment := NewSegment(4096, s.BaseDir, WithSegmentKeyring(keyring))
+	err = segment.Init(func(data []byte) error {
+		return nil
+	})
+	s.NoError(err)
+
+	s.NoError(segment.Write([]byte("SET key1 secret1\n")))
+	s.NoError(segment.Write([]byte("SET key2 secret2\n")))
+	s.NoError(segment.Close())
+
+	raw, err := os.ReadFile(s.BaseDir + fmt.Sprintf(fileNameTemplate, 1))
+	s.NoError(err)
+	s.NotContains(string(raw), "secret")
+
+	var batches []string
+	segment = NewSegment(4096, s.BaseDir, WithSegmentKeyring(keyring))
+	err = segment.Init(func(data []byte) error {
+		batches = append(batches, string(data))
+		return nil
+	})
+	s.NoError(err)
+	s.Equal([]string{"SET key1 secret1\n", "SET key2 secret2\n"}, batches)
+
+	// сегмент зашифрован активным ключом, поэтому дописываем в него же
+	s.NoError(segment.Write([]byte("DEL key1\n")))
+	s.NoError(segment.Close())
+	s.ElementsMatch([]string{fmt.Sprintf(fileNameTemplate, 1), SegmentManifestName}, s.FileNamesInBaseDir())
+}
+
+func (s *SegmentSuite) TestEncryptedFileRotation() {
+	keyring, err := encryption.ParseKeyring(testKey1)
+	s.Require().NoError(err)
+
+	segment := NewSegment(64, s.BaseDir, WithSegmentKeyring(keyring))
+	s.NoError(segment.Init(func(data []byte) error { return nil }))
+
+	data15bytes := []byte("123456789abcdfg")
+	for i := 0; i < 3; i++ {
+		s.NoError(segment.Write(data15bytes))
+	}
+	s.NoError(segment.Close())
+
+	s.ElementsMatch([]string{fmt.Sprintf(fileNameTemplate, 1), fmt.Sprintf(fileNameTemplate, 2), fmt.Sprintf(fileNameTemplate, 3), SegmentManifestName}, s.FileNamesInBaseDir())
+
+	counter := 0
+	segment = NewSegment(64, s.BaseDir, WithSegmentKeyring(keyring))
+	s.NoError(segment.Init(func(data []byte) error {
+		s.Equal(data15bytes, data)
+		counter++
+		return nil
+	}))
+	s.Equal(3, counter)
+	s.NoError(segment.Close())
+}
+
+func (s *SegmentSuite) TestEncryptedKeyRotation() {
+	oldKeyring, err := encryption.ParseKeyring(testKey1)
+	s.Require().NoError(err)
+	segment := NewSegment(4096, s.BaseDir, WithSegmentKeyring(oldKeyring))
+	s.NoError(segment.Init(func(data []byte) error { return nil }))
+	s.NoError(segment.Write([]byte("SET key1 1\n")))
+	s.NoError(segment.Close())
+
+	keyring, err := encryption.ParseKeyring(testKey1 + "\n" + testKey2)
+	s.Require().NoError(err)
+	var batches []string
+	segment = NewSegment(4096, s.BaseDir, WithSegmentKeyring(keyring))
+	s.NoError(segment.Init(func(data []byte) error {
+		batches = append(batches, string(data))
+		return nil
+	}))
+	s.Equal([]string{"SET key1 1\n"}, batches)
+
+	// новые данные пишутся новым ключом в новый сегмент
+	s.NoError(segment.Write([]byte("SET key2 2\n")))
+	s.NoError(segment.Close())
+	s.ElementsMatch([]string{fmt.Sprintf(fileNameTemplate, 1), fmt.Sprintf(fileNameTemplate, 2), SegmentManifestName}, s.FileNamesInBaseDir())
+
+	batches = nil
+	segment = NewSegment(4096, s.BaseDir, WithSegmentKeyring(keyring))
+	s.NoError(segment.Init(func(data []byte) error {
+		batches = append(batches, string(data))
+		return nil
+	}))
+	s.Equal([]string{"SET key1 1\n", "SET key2 2\n"}, batches)
+	s.NoError(segment.Close())
+}
+
+func (s *SegmentSuite) TestEncryptedInit_PlainSegmentThenEncryption() {
+	s.NoError(os.WriteFile(s.BaseDir+fmt.Sprintf(fileNameTemplate, 1), []byte("SET key1 1\n"), 0644))
+
+	keyring, err := encryption.ParseKeyring(testKey1)
+	s.Require().NoError(err)
+	segment := NewSegment(4096, s.BaseDir, WithSegmentKeyring(keyring))
+	s.NoError(segment.Init(func(data []byte) error { return nil }))
+	s.NoError(segment.Write([]byte("SET key2 2\n")))
+	s.NoError(segment.Close())
+
+	s.ElementsMatch([]string{fmt.Sprintf(fileNameTemplate, 1), fmt.Sprintf(fileNameTemplate, 2), SegmentManifestName}, s.FileNamesInBaseDir())
+	s.Equal([]string{"SET key1 1"}, s.ReadFileToSlice(s.BaseDir+fmt.Sprintf(fileNameTemplate, 1)))
+}
+
+func (s *SegmentSuite) TestEncryptedInit_KeyErrors() {
+	keyring, err := encryption.ParseKeyring(testKey1)
+	s.Require().NoError(err)
+	segment := NewSegment(4096, s.BaseDir, WithSegmentKeyring(keyring))
+	s.NoError(segment.Init(func(data []byte) error { return nil }))
+	s.NoError(segment.Write([]byte("SET key1 1\n")))
+	s.NoError(segment.Close())
+
+	segment = NewSegment(4096, s.BaseDir)
+	err = segment.Init(func(data []byte) error { return nil })
+	s.ErrorIs(err, ErrEncryptionNotConfigured)
+
+	otherKeyring, err := encryption.ParseKeyring(testKey2)
+	s.Require().NoError(err)
+	segment = NewSegment(4096, s.BaseDir, WithSegmentKeyring(otherKeyring))
+	err = segment.Init(func(data []byte) error { return nil })
+	s.ErrorIs(err, encryption.ErrKeyNotFound)
+
+	wrongKeyring, err := encryption.ParseKeyring("k1:" + testKey2[len("k2:"):])
+	s.Require().NoError(err)
+	segment = NewSegment(4096, s.BaseDir, WithSegmentKeyring(wrongKeyring))
+	err = segment.Init(func(data []byte) error { return nil })
+	s.ErrorIs(err, encryption.ErrWrongKey)
 }
@@ -0,0 +1,261 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"in-memory-db/internal/storage/encryption"
+	"in-memory-db/internal/storage/filesystem"
+)
+
+// Снимок хранит состояние хранилища на момент записи WAL с номером LSN. Новые снимки записываются
+// в двоичном формате (snapshot_binary.go), снимки версий 1 и 2 - текстовые и только читаются:
+//   SNAPSHOT <lsn> <timestamp в наносекундах> <версия формата>
+//   <ключ> <значение>
+//   ...
+//   END <количество ключей> <crc32 строк с ключами в hex>
+// Зашифрованный текстовый снимок устроен так же, как зашифрованный сегмент, каждый фрейм содержит целые строки.
+// В заголовке снимков версии 1 нет версии формата.
+
+const (
+	snapshotFilePrefix  = "snapshot_"
+	snapshotHeaderWord  = "SNAPSHOT"
+	snapshotTrailerWord = "END"
+	// сколько последних снимков хранить в директории данных
+	keepSnapshots = 2
+)
+
+var ErrCorruptedSnapshot = errors.New("corrupted snapshot")
+
+// SnapshotFile описывает файл снимка в директории данных
+type SnapshotFile struct {
+	LSN  uint64
+	Name string
+	Path string
+}
+
+// ListSnapshotFiles возвращает снимки, отсортированные по LSN
+func ListSnapshotFiles(fs filesystem.FS, dataDirectory string) ([]SnapshotFile, error) {
+	entries, err := fs.ReadDir(dataDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []SnapshotFile
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), snapshotFilePrefix) {
+			continue
+		}
+		lsn, err := strconv.ParseUint(strings.TrimPrefix(entry.Name(), snapshotFilePrefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		files = append(files, SnapshotFile{LSN: lsn, Name: entry.Name(), Path: filepath.Join(dataDirectory, entry.Name())})
+	}
+
+	slices.SortFunc(files, func(a, b SnapshotFile) int {
+		switch {
+		case a.LSN < b.LSN:
+			return -1
+		case a.LSN > b.LSN:
+			return 1
+		}
+		return 0
+	})
+
+	return files, nil
+}
+
+// SnapshotInfo - заголовок снимка. Version заполняется при чтении, снимок всегда записывается в текущей версии.
+type SnapshotInfo struct {
+	LSN       uint64
+	Timestamp time.Time
+	Keys      int
+	Version   int
+}
+
+// WriteSnapshot атомарно записывает снимок состояния на момент lsn в двоичном формате.
+// rangeFn должна перебрать все пары ключ-значение, перед записью они сортируются по ключу.
+func WriteSnapshot(fs filesystem.FS, dataDirectory string, keyring *encryption.Keyring, info SnapshotInfo, rangeFn func(f func(key, val string) bool)) (SnapshotFile, error) {
+	name := fmt.Sprintf("%s%d", snapshotFilePrefix, info.LSN)
+	file := SnapshotFile{LSN: info.LSN, Name: name, Path: filepath.Join(dataDirectory, name)}
+
+	var pairs []snapshotPair
+	rangeFn(func(key, val string) bool {
+		pairs = append(pairs, snapshotPair{key: key, val: val})
+		return true
+	})
+	slices.SortFunc(pairs, func(a, b snapshotPair) int {
+		return strings.Compare(a.key, b.key)
+	})
+
+	content, err := encodeBinarySnapshot(keyring, info, pairs, true)
+	if err != nil {
+		return SnapshotFile{}, err
+	}
+	if err := replaceFile(fs, file.Path, content); err != nil {
+		return SnapshotFile{}, err
+	}
+
+	return file, nil
+}
+
+// ReadSnapshot читает снимок и передаёт пары ключ-значение в f
+func ReadSnapshot(fs filesystem.FS, path string, keyring *encryption.Keyring, f func(key, val string) error) (SnapshotInfo, error) {
+	return readSnapshotBatches(fs, path, keyring, func(keys, vals []string) error {
+		for i := range keys {
+			if err := f(keys[i], vals[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// readSnapshotBatches читает снимок пачками пар. Двоичный снимок отображается в память, и его блоки
+// разбираются параллельно, пачка - один блок. Из текстового снимка пары передаются по одной.
+func readSnapshotBatches(fs filesystem.FS, path string, keyring *encryption.Keyring, restore func(keys, vals []string) error) (SnapshotInfo, error) {
+	data, unmap, err := mapFile(fs, path)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	defer unmap()
+
+	if isBinarySnapshot(data) {
+		snapshot, err := parseBinarySnapshot(data)
+		if err != nil {
+			return SnapshotInfo{}, err
+		}
+		return snapshot.load(keyring, restore)
+	}
+
+	info, err := readTextSnapshot(data, keyring, func(key, val string) error {
+		return restore([]string{key}, []string{val})
+	})
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	return info, nil
+}
+
+// readSnapshotHeader читает только заголовок снимка
+func readSnapshotHeader(fs filesystem.FS, path string, keyring *encryption.Keyring) (SnapshotInfo, error) {
+	data, unmap, err := mapFile(fs, path)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	defer unmap()
+
+	if isBinarySnapshot(data) {
+		snapshot, err := parseBinarySnapshot(data)
+		if err != nil {
+			return SnapshotInfo{}, err
+		}
+		return snapshot.info, nil
+	}
+
+	info, err := readTextSnapshot(data, keyring, func(key, val string) error {
+		return errStopReading
+	})
+	if err != nil && !errors.Is(err, errStopReading) {
+		return SnapshotInfo{}, err
+	}
+	return info, nil
+}
+
+// readTextSnapshot читает снимок текстового формата и возвращает прочитанную часть заголовка даже при ошибке
+func readTextSnapshot(data []byte, keyring *encryption.Keyring, f func(key, val string) error) (SnapshotInfo, error) {
+	var info SnapshotInfo
+	var headerRead, trailerRead bool
+	checksum := crc32.NewIEEE()
+	err := readSegmentData(keyring, data, func(chunk []byte) error {
+		for _, line := range strings.Split(string(bytes.TrimRight(chunk, "\n")), "\n") {
+			if trailerRead {
+				return fmt.Errorf("%w: data after trailer", ErrCorruptedSnapshot)
+			}
+
+			if !headerRead {
+				parts := strings.Fields(line)
+				if (len(parts) != 3 && len(parts) != 4) || parts[0] != snapshotHeaderWord {
+					return fmt.Errorf("%w: bad header", ErrCorruptedSnapshot)
+				}
+				info.Version = legacyFormatVersion
+				if len(parts) == 4 {
+					version, err := strconv.Atoi(parts[3])
+					if err != nil || version <= legacyFormatVersion {
+						return fmt.Errorf("%w: bad version", ErrCorruptedSnapshot)
+					}
+					if err := checkFormatVersion("snapshot", version, SnapshotFormatVersion); err != nil {
+						return err
+					}
+					if version > lastTextSnapshotVersion {
+						return fmt.Errorf("%w: bad version", ErrCorruptedSnapshot)
+					}
+					info.Version = version
+				}
+				lsn, err := strconv.ParseUint(parts[1], 10, 64)
+				if err != nil {
+					return fmt.Errorf("%w: bad lsn", ErrCorruptedSnapshot)
+				}
+				ts, err := strconv.ParseInt(parts[2], 10, 64)
+				if err != nil {
+					return fmt.Errorf("%w: bad timestamp", ErrCorruptedSnapshot)
+				}
+				info.LSN, info.Timestamp, headerRead = lsn, time.Unix(0, ts), true
+				continue
+			}
+
+			if strings.HasPrefix(line, snapshotTrailerWord+" ") {
+				parts := strings.Fields(line)
+				if len(parts) != 3 || parts[1] != strconv.Itoa(info.Keys) || parts[2] != fmt.Sprintf("%08x", checksum.Sum32()) {
+					return fmt.Errorf("%w: checksum mismatch", ErrCorruptedSnapshot)
+				}
+				trailerRead = true
+				continue
+			}
+
+			key, val, ok := strings.Cut(line, " ")
+			if !ok {
+				return fmt.Errorf("%w: bad line", ErrCorruptedSnapshot)
+			}
+			checksum.Write([]byte(line))
+			info.Keys++
+			if err := f(key, val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return info, err
+	}
+	if !trailerRead {
+		return info, fmt.Errorf("%w: missing trailer", ErrCorruptedSnapshot)
+	}
+
+	return info, nil
+}
+
+// removeOldSnapshots оставляет keepSnapshots последних снимков
+func removeOldSnapshots(fs filesystem.FS, dataDirectory string) error {
+	files, err := ListSnapshotFiles(fs, dataDirectory)
+	if err != nil {
+		return err
+	}
+
+	for len(files) > keepSnapshots {
+		if err := fs.Remove(files[0].Path); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+
+	return nil
+}
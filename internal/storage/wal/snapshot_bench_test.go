@@ -0,0 +1,108 @@
+package wal
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"in-memory-db/internal/compute"
+	"in-memory-db/internal/storage/filesystem"
+	inmemory "in-memory-db/internal/storage/in-memory"
+)
+
+// Сравнение загрузки снимка с полным проигрыванием WAL. По умолчанию бенчмарки берут 100 тыс. ключей,
+// чтобы go test -bench . проходил быстро, сравнение на 10 млн ключей запускается явно:
+//   go test ./internal/storage/wal -run '^$' -bench Load -benchtime 1x -bench-keys 10000000
+// Данные готовятся один раз во временной директории и занимают на диске около 1 ГБ для 10 млн ключей.
+
+var benchKeys = flag.Int("bench-keys", 100_000, "number of keys in load benchmarks")
+
+const benchSegmentSize = 64 << 20
+
+func benchKeyValue(i int) (string, string) {
+	return fmt.Sprintf("key%09d", i), fmt.Sprintf("value%d", i)
+}
+
+func BenchmarkLoad_Snapshot(b *testing.B) {
+	dir := b.TempDir()
+	_, err := WriteSnapshot(filesystem.OS{}, dir, nil, SnapshotInfo{LSN: uint64(*benchKeys), Timestamp: time.Now()}, func(f func(key, val string) bool) {
+		for i := 0; i < *benchKeys; i++ {
+			if !f(benchKeyValue(i)) {
+				return
+			}
+		}
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchInit(b, dir, func(engine *inmemory.Engine) Replay {
+			return Replay{Restore: engine.Set, RestoreBatch: engine.SetBatch}
+		})
+	}
+}
+
+func BenchmarkLoad_WalReplay(b *testing.B) {
+	dir := b.TempDir()
+	writeBenchSegments(b, dir)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchInit(b, dir, func(engine *inmemory.Engine) Replay {
+			parser := compute.NewParser()
+			return Replay{
+				Prepare: func(r Record) (any, error) {
+					return parser.Parse(r.Query)
+				},
+				Apply: func(r Record, prepared any) error {
+					args := prepared.(compute.Query).Args()
+					return engine.Set(args[0], args[1])
+				},
+			}
+		})
+	}
+}
+
+// writeBenchSegments записывает по одной команде SET на ключ в сегменты размером около benchSegmentSize
+func writeBenchSegments(b *testing.B, dir string) {
+	ts := time.Now()
+	number := 1
+	content := encodeSegmentVersion()
+	flush := func() {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf(fileNameTemplate, number)), content, 0644); err != nil {
+			b.Fatal(err)
+		}
+		number++
+		content = encodeSegmentVersion()
+	}
+
+	for i := 0; i < *benchKeys; i++ {
+		key, val := benchKeyValue(i)
+		content = append(content, NewRecord(uint64(i+1), ts, "SET "+key+" "+val).Encode()...)
+		if len(content) >= benchSegmentSize {
+			flush()
+		}
+	}
+	flush()
+}
+
+func benchInit(b *testing.B, dir string, replay func(engine *inmemory.Engine) Replay) {
+	engine := inmemory.NewEngine()
+	w := NewWal(context.Background(), 1, time.Hour, NewSegment(benchSegmentSize, dir), zap.NewNop())
+	if err := w.Init(replay(engine)); err != nil {
+		b.Fatal(err)
+	}
+	if err := w.segment.Close(); err != nil {
+		b.Fatal(err)
+	}
+	if w.LastLSN() != uint64(*benchKeys) {
+		b.Fatalf("last lsn %d, want %d", w.LastLSN(), *benchKeys)
+	}
+}
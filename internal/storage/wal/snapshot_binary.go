@@ -0,0 +1,455 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"in-memory-db/internal/storage/encryption"
+	"in-memory-db/internal/storage/filesystem"
+)
+
+// Двоичный снимок (версия формата 3) имеет вид:
+//   заголовок | блок | блок | ... | индекс | окончание
+// заголовок: magic (8 байт) | версия (2 байта) | флаги (2 байта) | lsn (8 байт) | timestamp в наносекундах (8 байт) |
+//   длина id ключа (1 байт) | id ключа | crc32 предыдущих байт заголовка (4 байта)
+// блок: длина данных (4 байта) | crc32 данных (4 байта) | данные
+//   данные - количество пар и сами пары, длины ключа и значения записаны как uvarint. В зашифрованном снимке
+//   данные запечатаны ключом из заголовка, additional data - заголовок и номер блока.
+// индекс (если есть флаг snapshotFlagIndex): количество блоков и для каждого смещение, длина данных и количество пар (uvarint)
+// окончание: смещение индекса (8 байт) | количество блоков (4 байта) | количество пар (8 байт) | crc32 индекса (4 байта) | magic
+// Числа фиксированной длины записаны в big endian. Ключи отсортированы по всему снимку.
+// Без индекса блоки находятся проходом по их длинам, после этого блоки в обоих случаях разбираются параллельно.
+
+var binarySnapshotMagic = []byte("IMDBSNAP")
+
+const (
+	// размер данных блока, после которого начинается следующий блок
+	snapshotBlockSize = 64 << 10
+	// сколько разобранных блоков может ждать загрузки
+	snapshotQueueSize = 64
+
+	snapshotFlagEncrypted = 1 << 0
+	snapshotFlagIndex     = 1 << 1
+
+	snapshotFixedHeaderSize = 29
+	snapshotBlockHeaderSize = 8
+	snapshotFooterSize      = 32
+)
+
+type snapshotPair struct {
+	key, val string
+}
+
+type snapshotBlock struct {
+	// смещение заголовка блока от начала файла и длина данных блока
+	offset int
+	length int
+	keys   int
+}
+
+// encodeBinarySnapshot кодирует пары, отсортированные по ключу
+func encodeBinarySnapshot(keyring *encryption.Keyring, info SnapshotInfo, pairs []snapshotPair, withIndex bool) ([]byte, error) {
+	var flags uint16
+	var keyID string
+	if keyring != nil {
+		flags |= snapshotFlagEncrypted
+		keyID = keyring.ActiveKeyID()
+	}
+	if withIndex {
+		flags |= snapshotFlagIndex
+	}
+
+	header := make([]byte, 0, snapshotFixedHeaderSize+len(keyID)+4)
+	header = append(header, binarySnapshotMagic...)
+	header = binary.BigEndian.AppendUint16(header, SnapshotFormatVersion)
+	header = binary.BigEndian.AppendUint16(header, flags)
+	header = binary.BigEndian.AppendUint64(header, info.LSN)
+	header = binary.BigEndian.AppendUint64(header, uint64(info.Timestamp.UnixNano()))
+	header = append(header, byte(len(keyID)))
+	header = append(header, keyID...)
+	header = binary.BigEndian.AppendUint32(header, crc32.ChecksumIEEE(header))
+
+	content := slices.Clone(header)
+	var blocks []snapshotBlock
+	var block []byte
+	count := 0
+	flush := func() error {
+		if count == 0 {
+			return nil
+		}
+		payload := binary.AppendUvarint(make([]byte, 0, len(block)+binary.MaxVarintLen64), uint64(count))
+		payload = append(payload, block...)
+		if keyring != nil {
+			sealed, err := keyring.Seal(payload, snapshotBlockAD(header, len(blocks)))
+			if err != nil {
+				return err
+			}
+			payload = sealed
+		}
+
+		blocks = append(blocks, snapshotBlock{offset: len(content), length: len(payload), keys: count})
+		content = binary.BigEndian.AppendUint32(content, uint32(len(payload)))
+		content = binary.BigEndian.AppendUint32(content, crc32.ChecksumIEEE(payload))
+		content = append(content, payload...)
+		block, count = block[:0], 0
+		return nil
+	}
+
+	for _, p := range pairs {
+		block = binary.AppendUvarint(block, uint64(len(p.key)))
+		block = append(block, p.key...)
+		block = binary.AppendUvarint(block, uint64(len(p.val)))
+		block = append(block, p.val...)
+		count++
+		if len(block) >= snapshotBlockSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	var indexOffset int
+	var index []byte
+	if withIndex {
+		indexOffset = len(content)
+		index = binary.AppendUvarint(index, uint64(len(blocks)))
+		for _, b := range blocks {
+			index = binary.AppendUvarint(index, uint64(b.offset))
+			index = binary.AppendUvarint(index, uint64(b.length))
+			index = binary.AppendUvarint(index, uint64(b.keys))
+		}
+		content = append(content, index...)
+	}
+
+	content = binary.BigEndian.AppendUint64(content, uint64(indexOffset))
+	content = binary.BigEndian.AppendUint32(content, uint32(len(blocks)))
+	content = binary.BigEndian.AppendUint64(content, uint64(len(pairs)))
+	content = binary.BigEndian.AppendUint32(content, crc32.ChecksumIEEE(index))
+	content = append(content, binarySnapshotMagic...)
+
+	return content, nil
+}
+
+func snapshotBlockAD(header []byte, block int) []byte {
+	return binary.BigEndian.AppendUint32(slices.Clip(header), uint32(block))
+}
+
+func isBinarySnapshot(data []byte) bool {
+	return bytes.HasPrefix(data, binarySnapshotMagic)
+}
+
+type binarySnapshot struct {
+	info   SnapshotInfo
+	header []byte
+	keyID  string
+	// keys - количество пар из окончания снимка
+	keys   uint64
+	blocks []snapshotBlock
+	data   []byte
+}
+
+// parseBinarySnapshot проверяет заголовок, окончание и индекс снимка и находит блоки, не разбирая их
+func parseBinarySnapshot(data []byte) (*binarySnapshot, error) {
+	if len(data) < snapshotFixedHeaderSize {
+		return nil, fmt.Errorf("%w: bad header", ErrCorruptedSnapshot)
+	}
+	// версия проверяется первой: в более новой версии заголовок может быть устроен иначе
+	version := int(binary.BigEndian.Uint16(data[8:]))
+	if err := checkFormatVersion("snapshot", version, SnapshotFormatVersion); err != nil {
+		return nil, err
+	}
+
+	flags := binary.BigEndian.Uint16(data[10:])
+	headerLen := snapshotFixedHeaderSize + int(data[28]) + 4
+	if len(data) < headerLen+snapshotFooterSize {
+		return nil, fmt.Errorf("%w: truncated", ErrCorruptedSnapshot)
+	}
+	header := data[:headerLen]
+	if crc32.ChecksumIEEE(header[:headerLen-4]) != binary.BigEndian.Uint32(header[headerLen-4:]) {
+		return nil, fmt.Errorf("%w: header checksum mismatch", ErrCorruptedSnapshot)
+	}
+
+	footer := data[len(data)-snapshotFooterSize:]
+	if !bytes.Equal(footer[24:], binarySnapshotMagic) {
+		return nil, fmt.Errorf("%w: missing trailer", ErrCorruptedSnapshot)
+	}
+	indexOffset := binary.BigEndian.Uint64(footer)
+	blockCount := int(binary.BigEndian.Uint32(footer[8:]))
+
+	s := &binarySnapshot{
+		info: SnapshotInfo{
+			LSN:       binary.BigEndian.Uint64(data[12:]),
+			Timestamp: time.Unix(0, int64(binary.BigEndian.Uint64(data[20:]))),
+			Keys:      int(binary.BigEndian.Uint64(footer[12:])),
+			Version:   version,
+		},
+		header: header,
+		keys:   binary.BigEndian.Uint64(footer[12:]),
+		data:   data,
+	}
+	if flags&snapshotFlagEncrypted != 0 {
+		s.keyID = string(data[snapshotFixedHeaderSize : headerLen-4])
+		if s.keyID == "" {
+			return nil, fmt.Errorf("%w: missing key id", ErrCorruptedSnapshot)
+		}
+	}
+
+	bodyEnd := len(data) - snapshotFooterSize
+	if flags&snapshotFlagIndex != 0 {
+		if indexOffset < uint64(headerLen) || indexOffset > uint64(bodyEnd) {
+			return nil, fmt.Errorf("%w: bad index offset", ErrCorruptedSnapshot)
+		}
+		index := data[indexOffset:bodyEnd]
+		if crc32.ChecksumIEEE(index) != binary.BigEndian.Uint32(footer[20:]) {
+			return nil, fmt.Errorf("%w: index checksum mismatch", ErrCorruptedSnapshot)
+		}
+		bodyEnd = int(indexOffset)
+
+		var err error
+		if s.blocks, err = decodeSnapshotIndex(index); err != nil {
+			return nil, err
+		}
+	} else {
+		for offset := headerLen; offset < bodyEnd; {
+			if bodyEnd-offset < snapshotBlockHeaderSize {
+				return nil, fmt.Errorf("%w: truncated block", ErrCorruptedSnapshot)
+			}
+			length := int(binary.BigEndian.Uint32(data[offset:]))
+			s.blocks = append(s.blocks, snapshotBlock{offset: offset, length: length})
+			offset += snapshotBlockHeaderSize + length
+		}
+	}
+
+	if len(s.blocks) != blockCount {
+		return nil, fmt.Errorf("%w: block count mismatch", ErrCorruptedSnapshot)
+	}
+	for _, b := range s.blocks {
+		if b.offset < headerLen || b.length < 0 || b.offset+snapshotBlockHeaderSize+b.length > bodyEnd ||
+			int(binary.BigEndian.Uint32(data[b.offset:])) != b.length {
+			return nil, fmt.Errorf("%w: bad block offset", ErrCorruptedSnapshot)
+		}
+	}
+
+	return s, nil
+}
+
+func decodeSnapshotIndex(index []byte) ([]snapshotBlock, error) {
+	next := func() (int, bool) {
+		v, n := binary.Uvarint(index)
+		if n <= 0 || v > math.MaxInt32<<16 {
+			return 0, false
+		}
+		index = index[n:]
+		return int(v), true
+	}
+
+	count, ok := next()
+	if !ok || count > len(index) {
+		return nil, fmt.Errorf("%w: bad index", ErrCorruptedSnapshot)
+	}
+	blocks := make([]snapshotBlock, 0, count)
+	for i := 0; i < count; i++ {
+		var b snapshotBlock
+		var okOffset, okLength, okKeys bool
+		b.offset, okOffset = next()
+		b.length, okLength = next()
+		b.keys, okKeys = next()
+		if !okOffset || !okLength || !okKeys {
+			return nil, fmt.Errorf("%w: bad index", ErrCorruptedSnapshot)
+		}
+		blocks = append(blocks, b)
+	}
+	if len(index) != 0 {
+		return nil, fmt.Errorf("%w: bad index", ErrCorruptedSnapshot)
+	}
+
+	return blocks, nil
+}
+
+// checkKey проверяет, что снимок можно расшифровать
+func (s *binarySnapshot) checkKey(keyring *encryption.Keyring) error {
+	if s.keyID == "" {
+		return nil
+	}
+	if keyring == nil {
+		return fmt.Errorf("%w: key %q", ErrEncryptionNotConfigured, s.keyID)
+	}
+	if !keyring.HasKey(s.keyID) {
+		return fmt.Errorf("%w: %q", encryption.ErrKeyNotFound, s.keyID)
+	}
+	return nil
+}
+
+// decodeBlock проверяет контрольную сумму блока и возвращает его пары. Строки копируются,
+// поэтому остаются корректными после того, как файл снимка перестаёт быть отображён в память.
+func (s *binarySnapshot) decodeBlock(keyring *encryption.Keyring, i int) ([]string, []string, error) {
+	b := s.blocks[i]
+	stored := s.data[b.offset+snapshotBlockHeaderSize : b.offset+snapshotBlockHeaderSize+b.length]
+	if crc32.ChecksumIEEE(stored) != binary.BigEndian.Uint32(s.data[b.offset+4:]) {
+		return nil, nil, fmt.Errorf("%w: block %d checksum mismatch", ErrCorruptedSnapshot, i)
+	}
+
+	payload := stored
+	if s.keyID != "" {
+		var err error
+		if payload, err = keyring.Open(s.keyID, stored, snapshotBlockAD(s.header, i)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	next := func() (string, bool) {
+		l, n := binary.Uvarint(payload)
+		if n <= 0 || l > uint64(len(payload)-n) {
+			return "", false
+		}
+		v := string(payload[n : n+int(l)])
+		payload = payload[n+int(l):]
+		return v, true
+	}
+
+	count, n := binary.Uvarint(payload)
+	if n <= 0 || count > uint64(len(payload)) {
+		return nil, nil, fmt.Errorf("%w: block %d: bad pair count", ErrCorruptedSnapshot, i)
+	}
+	payload = payload[n:]
+	keys := make([]string, 0, count)
+	vals := make([]string, 0, count)
+	for j := uint64(0); j < count; j++ {
+		key, okKey := next()
+		val, okVal := next()
+		if !okKey || !okVal {
+			return nil, nil, fmt.Errorf("%w: block %d: bad pair", ErrCorruptedSnapshot, i)
+		}
+		if len(keys) > 0 && key <= keys[len(keys)-1] {
+			return nil, nil, fmt.Errorf("%w: block %d: keys are not sorted", ErrCorruptedSnapshot, i)
+		}
+		keys = append(keys, key)
+		vals = append(vals, val)
+	}
+	if len(payload) != 0 || (b.keys != 0 && b.keys != len(keys)) {
+		return nil, nil, fmt.Errorf("%w: block %d: pair count mismatch", ErrCorruptedSnapshot, i)
+	}
+
+	return keys, vals, nil
+}
+
+type snapshotBlockResult struct {
+	index      int
+	keys, vals []string
+	err        error
+	done       chan struct{}
+}
+
+// load разбирает блоки в нескольких горутинах и передаёт их пары в restore в порядке блоков
+func (s *binarySnapshot) load(keyring *encryption.Keyring, restore func(keys, vals []string) error) (SnapshotInfo, error) {
+	if err := s.checkKey(keyring); err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	stop := make(chan struct{})
+	ordered := make(chan *snapshotBlockResult, snapshotQueueSize)
+	work := make(chan *snapshotBlockResult, snapshotQueueSize)
+	wg := sync.WaitGroup{}
+	// блоки ссылаются на отображённый файл, поэтому выходим только после остановки всех горутин
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(ordered)
+		defer close(work)
+		for i := range s.blocks {
+			r := &snapshotBlockResult{index: i, done: make(chan struct{})}
+			select {
+			case ordered <- r:
+			case <-stop:
+				return
+			}
+			select {
+			case work <- r:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range work {
+				r.keys, r.vals, r.err = s.decodeBlock(keyring, r.index)
+				close(r.done)
+			}
+		}()
+	}
+
+	var total uint64
+	var lastKey string
+	for r := range ordered {
+		<-r.done
+		if r.err != nil {
+			return SnapshotInfo{}, r.err
+		}
+		if len(r.keys) == 0 {
+			continue
+		}
+		if total > 0 && r.keys[0] <= lastKey {
+			return SnapshotInfo{}, fmt.Errorf("%w: block %d: keys are not sorted", ErrCorruptedSnapshot, r.index)
+		}
+		if err := restore(r.keys, r.vals); err != nil {
+			return SnapshotInfo{}, err
+		}
+		total += uint64(len(r.keys))
+		lastKey = r.keys[len(r.keys)-1]
+	}
+	if total != s.keys {
+		return SnapshotInfo{}, fmt.Errorf("%w: pair count mismatch", ErrCorruptedSnapshot)
+	}
+
+	return s.info, nil
+}
+
+// mapFile отображает файл в память, если fsys - файловая система ОС, иначе читает его целиком.
+// После вызова unmap данные использовать нельзя.
+func mapFile(fsys filesystem.FS, path string) ([]byte, func() error, error) {
+	if _, ok := fsys.(filesystem.OS); !ok {
+		data, err := fsys.ReadFile(path)
+		return data, func() error { return nil }, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if stat.Size() == 0 {
+		return nil, func() error { return nil }, nil
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
@@ -0,0 +1,171 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"in-memory-db/internal/storage/encryption"
+	"in-memory-db/internal/storage/filesystem"
+	"in-memory-db/internal/testingh"
+)
+
+type SnapshotSuite struct {
+	testingh.BaseDirSuite
+}
+
+func TestSnapshotSuite(t *testing.T) {
+	suite.Run(t, new(SnapshotSuite))
+}
+
+func (s *SnapshotSuite) SetupTest() {
+	s.BaseDir = testingh.GetBaseDir(runtime.Caller(0))
+	s.BaseDirSuite.SetupTest()
+}
+
+func rangeMap(data map[string]string) func(f func(key, val string) bool) {
+	return func(f func(key, val string) bool) {
+		for k, v := range data {
+			if !f(k, v) {
+				return
+			}
+		}
+	}
+}
+
+func (s *SnapshotSuite) writeAndRead(keyring *encryption.Keyring, data map[string]string) {
+	ts := time.Unix(0, 1700000000000000000)
+	file, err := WriteSnapshot(filesystem.OS{}, s.BaseDir, keyring, SnapshotInfo{LSN: 15, Timestamp: ts}, rangeMap(data))
+	s.NoError(err)
+	s.Equal("snapshot_15", file.Name)
+
+	read := make(map[string]string)
+	info, err := ReadSnapshot(filesystem.OS{}, file.Path, keyring, func(key, val string) error {
+		read[key] = val
+		return nil
+	})
+	s.NoError(err)
+	s.Equal(data, read)
+	s.Equal(uint64(15), info.LSN)
+	s.True(ts.Equal(info.Timestamp))
+	s.Equal(len(data), info.Keys)
+}
+
+func (s *SnapshotSuite) TestWriteRead() {
+	s.writeAndRead(nil, map[string]string{"a": "1", "b": "2"})
+	s.True(bytes.HasPrefix(s.ReadFile(s.BaseDir+"snapshot_15"), binarySnapshotMagic))
+}
+
+func (s *SnapshotSuite) TestWriteRead_ManyBlocks() {
+	data := make(map[string]string)
+	for i := 0; i < 20000; i++ {
+		data[fmt.Sprintf("key%d", i)] = strings.Repeat("v", 30)
+	}
+	s.writeAndRead(nil, data)
+
+	snapshot, err := parseBinarySnapshot(s.ReadFile(s.BaseDir + "snapshot_15"))
+	s.Require().NoError(err)
+	s.Greater(len(snapshot.blocks), 1)
+}
+
+func (s *SnapshotSuite) TestRead_WithoutIndex() {
+	pairs := []snapshotPair{{"a", "1"}, {"b", "2"}}
+	content, err := encodeBinarySnapshot(nil, SnapshotInfo{LSN: 7}, pairs, false)
+	s.Require().NoError(err)
+	s.NoError(os.WriteFile(s.BaseDir+"snapshot_7", content, 0644))
+
+	read := make(map[string]string)
+	info, err := ReadSnapshot(filesystem.OS{}, s.BaseDir+"snapshot_7", nil, func(key, val string) error {
+		read[key] = val
+		return nil
+	})
+	s.NoError(err)
+	s.Equal(map[string]string{"a": "1", "b": "2"}, read)
+	s.Equal(uint64(7), info.LSN)
+}
+
+func (s *SnapshotSuite) TestRead_Text() {
+	content := fmt.Sprintf("SNAPSHOT 4 0 2\na 1\nb 2\nEND 2 %08x\n", crc32.ChecksumIEEE([]byte("a 1b 2")))
+	s.NoError(os.WriteFile(s.BaseDir+"snapshot_4", []byte(content), 0644))
+
+	read := make(map[string]string)
+	info, err := ReadSnapshot(filesystem.OS{}, s.BaseDir+"snapshot_4", nil, func(key, val string) error {
+		read[key] = val
+		return nil
+	})
+	s.NoError(err)
+	s.Equal(map[string]string{"a": "1", "b": "2"}, read)
+	s.Equal(2, info.Version)
+}
+
+func (s *SnapshotSuite) TestWriteRead_Empty() {
+	s.writeAndRead(nil, map[string]string{})
+}
+
+func (s *SnapshotSuite) TestWriteRead_Encrypted() {
+	keyring, err := encryption.ParseKeyring(testKey1)
+	s.Require().NoError(err)
+
+	// больше одного фрейма
+	data := make(map[string]string)
+	for i := 0; i < 50000; i++ {
+		data[fmt.Sprintf("key%d", i)] = strings.Repeat("v", 30)
+	}
+	s.writeAndRead(keyring, data)
+	s.NotContains(string(s.ReadFile(s.BaseDir+"snapshot_15")), "key1")
+
+	_, err = ReadSnapshot(filesystem.OS{}, s.BaseDir+"snapshot_15", nil, func(key, val string) error { return nil })
+	s.ErrorIs(err, ErrEncryptionNotConfigured)
+}
+
+func (s *SnapshotSuite) TestRead_Corrupted() {
+	file, err := WriteSnapshot(filesystem.OS{}, s.BaseDir, nil, SnapshotInfo{LSN: 3}, rangeMap(map[string]string{"a": "1", "b": "2"}))
+	s.NoError(err)
+
+	content := s.ReadFile(file.Path)
+	snapshot, err := parseBinarySnapshot(content)
+	s.Require().NoError(err)
+	block := snapshot.blocks[0]
+	indexOffset := block.offset + snapshotBlockHeaderSize + block.length
+
+	corrupt := func(offset int) []byte {
+		corrupted := bytes.Clone(content)
+		corrupted[offset] ^= 0xff
+		return corrupted
+	}
+	tests := map[string][]byte{
+		"changed value":   corrupt(indexOffset - 1),
+		"changed header":  corrupt(12),
+		"changed index":   corrupt(indexOffset),
+		"missing trailer": content[:len(content)-1],
+		"truncated":       content[:indexOffset-1],
+	}
+	for name, corrupted := range tests {
+		s.Run(name, func() {
+			s.NoError(os.WriteFile(file.Path, corrupted, 0644))
+			_, err := ReadSnapshot(filesystem.OS{}, file.Path, nil, func(key, val string) error { return nil })
+			s.ErrorIs(err, ErrCorruptedSnapshot)
+		})
+	}
+}
+
+func (s *SnapshotSuite) TestListAndRemoveOld() {
+	for _, lsn := range []uint64{30, 4, 100} {
+		_, err := WriteSnapshot(filesystem.OS{}, s.BaseDir, nil, SnapshotInfo{LSN: lsn}, rangeMap(nil))
+		s.NoError(err)
+	}
+	s.NoError(os.WriteFile(s.BaseDir+"snapshot_x", nil, 0644))
+
+	files, err := ListSnapshotFiles(filesystem.OS{}, s.BaseDir)
+	s.NoError(err)
+	s.Equal([]uint64{4, 30, 100}, []uint64{files[0].LSN, files[1].LSN, files[2].LSN})
+
+	s.NoError(removeOldSnapshots(filesystem.OS{}, s.BaseDir))
+	s.ElementsMatch([]string{"snapshot_30", "snapshot_100", "snapshot_x"}, s.FileNamesInBaseDir())
+}
@@ -0,0 +1,271 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"in-memory-db/internal/storage/encryption"
+)
+
+var ErrLSNNotAvailable = errors.New("lsn is not available in wal")
+
+const tailReadSize = 64 << 10
+
+// Tailer читает записи WAL по порядку LSN, начиная с заданного, и ждёт появления новых.
+// Отдаются только записи, сохранённые на диск. Tailer нельзя использовать из нескольких горутин.
+type Tailer struct {
+	wal     *Wal
+	fromLSN uint64
+	decoder Decoder
+	// номер читаемого сегмента, 0 - чтение ещё не начато
+	segmentNumber int
+	reader        *segmentReader
+	records       []Record
+	checked       bool
+}
+
+// Tail возвращает Tailer, который начинает с записи fromLSN, при fromLSN = 0 - с первой записи в WAL.
+// Если записи с fromLSN уже удалены из WAL, Next вернёт ErrLSNNotAvailable.
+func (w *Wal) Tail(fromLSN uint64) *Tailer {
+	return &Tailer{wal: w, fromLSN: fromLSN}
+}
+
+// Next возвращает следующую запись. Если новых записей нет, ждёт их, пока не завершится ctx.
+func (t *Tailer) Next(ctx context.Context) (Record, error) {
+	for {
+		syncedLSN, written := t.wal.synced()
+		if len(t.records) == 0 {
+			more, err := t.read()
+			if err != nil {
+				return Record{}, err
+			}
+			if more {
+				continue
+			}
+		} else if t.records[0].LSN <= syncedLSN {
+			r := t.records[0]
+			t.records = t.records[1:]
+			return r, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return Record{}, ctx.Err()
+		case <-written:
+		}
+	}
+}
+
+func (t *Tailer) Close() error {
+	if t.reader != nil {
+		return t.reader.file.Close()
+	}
+	return nil
+}
+
+// read дочитывает текущий сегмент или переходит к следующему. Возвращает false, если новых данных нет.
+func (t *Tailer) read() (bool, error) {
+	if t.reader == nil {
+		return t.openNext()
+	}
+
+	// активный сегмент читается только до конца данных, сохранённых на диск: после неудачной записи
+	// её данные удаляются из файла. Номер активного сегмента берётся до чтения: если запись уже идёт
+	// в следующий сегмент, то текущий закрыт и читается до конца файла.
+	active, durableSize := t.wal.segment.DurableEnd()
+	limit := int64(-1)
+	if active == t.segmentNumber {
+		limit = durableSize
+	}
+	batches, err := t.reader.read(limit)
+	if err != nil {
+		return false, fmt.Errorf("read segment %s: %w", t.reader.name, err)
+	}
+	for _, batch := range batches {
+		if err := t.decode(batch); err != nil {
+			return false, fmt.Errorf("read segment %s: %w", t.reader.name, err)
+		}
+	}
+	if len(batches) > 0 {
+		return true, nil
+	}
+
+	if active <= t.segmentNumber {
+		return false, nil
+	}
+	if len(t.reader.buf) > 0 {
+		return false, fmt.Errorf("read segment %s: %w: incomplete record at the end", t.reader.name, ErrCorruptedSegment)
+	}
+	if err := t.reader.file.Close(); err != nil {
+		return false, err
+	}
+	t.reader = nil
+	return true, nil
+}
+
+func (t *Tailer) openNext() (bool, error) {
+	fs := t.wal.segment.fs
+	files, err := ListSegmentFiles(fs, t.wal.segment.DataDirectory)
+	if err != nil {
+		return false, err
+	}
+
+	for _, file := range files {
+		if file.Number <= t.segmentNumber {
+			continue
+		}
+		if t.segmentNumber != 0 && file.Number != t.segmentNumber+1 {
+			return false, fmt.Errorf("%w: segment %d is removed", ErrLSNNotAvailable, t.segmentNumber+1)
+		}
+
+		f, err := fs.Open(file.Path)
+		if err != nil {
+			return false, err
+		}
+		t.segmentNumber = file.Number
+		t.reader = &segmentReader{name: file.Name, file: f, keyring: t.wal.segment.keyring}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (t *Tailer) decode(batch []byte) error {
+	for _, line := range splitBatch(batch) {
+		r, err := t.decoder.Decode(line)
+		if err != nil {
+			return err
+		}
+		if !t.checked {
+			t.checked = true
+			if t.fromLSN > 0 && r.LSN > t.fromLSN {
+				return fmt.Errorf("%w: %d, first record in wal is %d", ErrLSNNotAvailable, t.fromLSN, r.LSN)
+			}
+		}
+		if r.LSN >= t.fromLSN {
+			t.records = append(t.records, r)
+		}
+	}
+
+	return nil
+}
+
+// segmentReader читает сегмент, в который ещё идёт запись, и отдаёт только полностью записанные данные:
+// целые строки обычного сегмента или целые фреймы зашифрованного
+type segmentReader struct {
+	name    string
+	file    io.ReadCloser
+	keyring *encryption.Keyring
+	buf     []byte
+	// offset - сколько байт файла уже прочитано
+	offset int64
+
+	// формат сегмента определяется по первым байтам
+	versionKnown bool
+	formatKnown  bool
+	keyID        string
+	header       []byte
+}
+
+// read читает файл до limit байт от начала, при limit < 0 - до конца файла
+func (s *segmentReader) read(limit int64) ([][]byte, error) {
+	if limit >= 0 && limit < s.offset {
+		// сегмент не становится короче сохранённых на диск данных, а дальше них чтение не заходит
+		return nil, fmt.Errorf("%w: segment is shorter than already read data", ErrCorruptedSegment)
+	}
+	chunk := make([]byte, tailReadSize)
+	for limit < 0 || s.offset < limit {
+		size := int64(len(chunk))
+		if limit >= 0 {
+			size = min(size, limit-s.offset)
+		}
+		n, err := s.file.Read(chunk[:size])
+		s.buf = append(s.buf, chunk[:n]...)
+		s.offset += int64(n)
+		if errors.Is(err, io.EOF) || (n == 0 && err == nil) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !s.formatKnown {
+		ok, err := s.readHeader()
+		if !ok || err != nil {
+			return nil, err
+		}
+	}
+
+	if s.header == nil {
+		i := bytes.LastIndexByte(s.buf, '\n')
+		if i < 0 {
+			return nil, nil
+		}
+		batch := s.buf[:i+1]
+		s.buf = s.buf[i+1:]
+		return [][]byte{batch}, nil
+	}
+
+	var batches [][]byte
+	for len(s.buf) >= frameLengthSize {
+		frameLen := int(binary.BigEndian.Uint32(s.buf))
+		if len(s.buf) < frameLengthSize+frameLen {
+			break
+		}
+		plaintext, err := s.keyring.Open(s.keyID, s.buf[frameLengthSize:frameLengthSize+frameLen], s.header)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, plaintext)
+		s.buf = s.buf[frameLengthSize+frameLen:]
+	}
+	return batches, nil
+}
+
+// readHeader определяет формат сегмента, возвращает false, если заголовок прочитан не полностью
+func (s *segmentReader) readHeader() (bool, error) {
+	if !s.versionKnown {
+		if segmentVersionIncomplete(s.buf) {
+			return false, nil
+		}
+		_, body, err := splitSegmentVersion(s.buf)
+		if err != nil {
+			return false, err
+		}
+		s.versionKnown = true
+		s.buf = body
+	}
+
+	if !isEncryptedSegment(s.buf) {
+		if len(s.buf) < len(encryptedSegmentMagic) && bytes.HasPrefix(encryptedSegmentMagic, s.buf) {
+			return false, nil
+		}
+		s.formatKnown = true
+		return true, nil
+	}
+
+	if len(s.buf) <= len(encryptedSegmentMagic) || len(s.buf) < len(encryptedSegmentMagic)+1+int(s.buf[len(encryptedSegmentMagic)]) {
+		return false, nil
+	}
+	keyID, header, body, err := decodeEncryptedHeader(s.buf)
+	if err != nil {
+		return false, err
+	}
+	if s.keyring == nil {
+		return false, fmt.Errorf("%w: key %q", ErrEncryptionNotConfigured, keyID)
+	}
+	if !s.keyring.HasKey(keyID) {
+		return false, fmt.Errorf("%w: %q", encryption.ErrKeyNotFound, keyID)
+	}
+
+	s.formatKnown = true
+	s.keyID = keyID
+	s.header = bytes.Clone(header)
+	s.buf = body
+	return true, nil
+}
@@ -0,0 +1,187 @@
+package wal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"in-memory-db/internal/storage/encryption"
+	"in-memory-db/internal/storage/filesystem"
+)
+
+func startTailTestWal(t *testing.T, fs filesystem.FS, options ...SegmentOption) *Wal {
+	require.NoError(t, fs.MkdirAll(crashTestDirectory, 0755))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	segment := NewSegment(256, crashTestDirectory, append(options, WithSegmentFileSystem(fs))...)
+	w := NewWal(ctx, 1, time.Hour, segment, zap.NewNop())
+	require.NoError(t, w.Init(replayFunc(func(key, val string) error { return nil }, func(r Record) error { return nil })))
+	go w.Run()
+
+	return w
+}
+
+func writeQueries(t *testing.T, w *Wal, from, to int) {
+	for i := from; i <= to; i++ {
+		require.NoError(t, w.Write(fmt.Sprintf("SET key%d val", i)))
+	}
+}
+
+func nextRecord(t *testing.T, tailer *Tailer) Record {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	r, err := tailer.Next(ctx)
+	require.NoError(t, err)
+	return r
+}
+
+func TestTailer_FollowsWrites(t *testing.T) {
+	keyring, err := encryption.ParseKeyring(testKey1)
+	require.NoError(t, err)
+
+	for name, options := range map[string][]SegmentOption{
+		"plain":     nil,
+		"encrypted": {WithSegmentKeyring(keyring)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := startTailTestWal(t, filesystem.NewMemory(), options...)
+			writeQueries(t, w, 1, 3)
+
+			tailer := w.Tail(2)
+			defer tailer.Close()
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				// записи идут в несколько сегментов
+				writeQueries(t, w, 4, 30)
+			}()
+
+			for lsn := uint64(2); lsn <= 30; lsn++ {
+				r := nextRecord(t, tailer)
+				assert.Equal(t, lsn, r.LSN)
+				assert.Equal(t, fmt.Sprintf("SET key%d val", lsn), r.Query)
+			}
+			<-done
+			assert.Greater(t, w.segment.ActiveFileNumber(), 2)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			_, err := tailer.Next(ctx)
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+		})
+	}
+}
+
+func TestTailer_OnlySyncedRecords(t *testing.T) {
+	fs := &slowFS{FS: filesystem.NewMemory()}
+	w := startTailTestWal(t, fs)
+	tailer := w.Tail(0)
+	defer tailer.Close()
+
+	// запись уже в файле, но fsync ещё не завершён
+	fs.gate.Lock()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- w.Write("SET key val")
+	}()
+	require.Eventually(t, func() bool {
+		data, err := fs.ReadFile(crashTestDirectory + "data_1")
+		return err == nil && len(data) > 0
+	}, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := tailer.Next(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	fs.gate.Unlock()
+	require.NoError(t, <-errs)
+	assert.Equal(t, "SET key val", nextRecord(t, tailer).Query)
+}
+
+func TestTailer_SkipsFailedWrite(t *testing.T) {
+	faulty := filesystem.NewFaulty(filesystem.NewMemory())
+	fs := &slowFS{FS: faulty}
+	w := startTailTestWal(t, fs)
+	writeQueries(t, w, 1, 1)
+	tailer := w.Tail(0)
+	defer tailer.Close()
+	assert.Equal(t, "SET key1 val", nextRecord(t, tailer).Query)
+	data, err := fs.ReadFile(crashTestDirectory + "data_1")
+	require.NoError(t, err)
+
+	// половина записи уже в файле, но ещё не удалена после ошибки
+	faulty.Inject(filesystem.Fault{Op: filesystem.OpWrite, Path: "data_", ShortWrite: true})
+	fs.gate.Lock()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- w.Write("SET key2 val")
+	}()
+	require.Eventually(t, func() bool {
+		written, err := fs.ReadFile(crashTestDirectory + "data_1")
+		return err == nil && len(written) > len(data)
+	}, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = tailer.Next(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	fs.gate.Unlock()
+	require.ErrorIs(t, <-errs, filesystem.ErrInjected)
+	faulty.Clear()
+
+	// следующая запись читается целиком, а не после обрывка неудачной, и получает LSN неудачной
+	writeQueries(t, w, 3, 3)
+	r := nextRecord(t, tailer)
+	assert.Equal(t, uint64(2), r.LSN)
+	assert.Equal(t, "SET key3 val", r.Query)
+}
+
+func TestTailer_ReplicaAfterFailedWrite(t *testing.T) {
+	faulty := filesystem.NewFaulty(filesystem.NewMemory())
+	primary := startTailTestWal(t, faulty)
+	replica := startTailTestWal(t, filesystem.NewMemory())
+
+	writeQueries(t, primary, 1, 1)
+	faulty.Inject(filesystem.Fault{Op: filesystem.OpWrite, Path: "data_"})
+	require.ErrorIs(t, primary.Write("SET lost val"), filesystem.ErrInjected)
+	faulty.Clear()
+	writeQueries(t, primary, 2, 3)
+
+	// реплика получает записи подряд, без записи, о которой клиенту сообщили ошибку
+	tailer := primary.Tail(1)
+	defer tailer.Close()
+	for lsn := uint64(1); lsn <= 3; lsn++ {
+		r := nextRecord(t, tailer)
+		assert.Equal(t, lsn, r.LSN)
+		assert.Equal(t, fmt.Sprintf("SET key%d val", lsn), r.Query)
+		require.NoError(t, replica.WriteRecords([]Record{r}))
+	}
+	assert.Equal(t, uint64(3), replica.LastLSN())
+}
+
+func TestTailer_LSNNotAvailable(t *testing.T) {
+	fs := filesystem.NewMemory()
+	w := startTailTestWal(t, fs)
+	writeQueries(t, w, 1, 10)
+	require.Greater(t, w.segment.ActiveFileNumber(), 1)
+
+	tailer := w.Tail(1)
+	assert.Equal(t, uint64(1), nextRecord(t, tailer).LSN)
+
+	require.NoError(t, fs.Remove(crashTestDirectory+"data_1"))
+	tailer = w.Tail(1)
+	_, err := tailer.Next(context.Background())
+	assert.ErrorIs(t, err, ErrLSNNotAvailable)
+
+	// с первой доступной записи читать можно
+	tailer = w.Tail(0)
+	assert.Greater(t, nextRecord(t, tailer).LSN, uint64(1))
+}
@@ -2,39 +2,181 @@ package wal
 
 import (
 	"context"
-	"strings"
+	"errors"
+	"expvar"
+	"fmt"
 	"sync"
 	"time"
 
 	"go.uber.org/zap"
 )
 
+var (
+	ErrBusy       = errors.New("BUSY wal write queue is full")
+	ErrWalStopped = errors.New("wal is stopped")
+	// ErrLSNOutOfOrder - LSN переданной записи не следует за последним LSN в WAL
+	ErrLSNOutOfOrder = errors.New("record lsn does not follow the last lsn")
+	// ErrWriteAborted - запись принята до неудачной записи пачки и не записывается, чтобы в WAL не было пропуска LSN
+	ErrWriteAborted = errors.New("wal write aborted after a failed write")
+)
+
+// QueuePolicy задаёт, что делать с записью, если очередь WAL заполнена
+type QueuePolicy string
+
+const (
+	// QueueBlock - ждать места в очереди не дольше таймаута, затем вернуть ErrBusy
+	QueueBlock QueuePolicy = "block"
+	// QueueReject - сразу вернуть ErrBusy
+	QueueReject QueuePolicy = "reject"
+)
+
+const (
+	defaultQueueSize    = 1000
+	defaultQueueTimeout = time.Second
+	// запись пачки дольше этого времени пишется в лог
+	slowWriteThreshold = time.Second
+)
+
+// Метрики записи публикуются через expvar в wal
+var writeMetrics = struct {
+	queueDepth    expvar.Int
+	queueCapacity expvar.Int
+	rejected      expvar.Int
+	writeErrors   expvar.Int
+	fsyncCount    expvar.Int
+	fsyncTotalUs  expvar.Int
+	fsyncLastUs   expvar.Int
+	fsyncMaxUs    expvar.Int
+}{}
+
+func init() {
+	m := expvar.NewMap("wal")
+	m.Set("queue_depth", &writeMetrics.queueDepth)
+	m.Set("queue_capacity", &writeMetrics.queueCapacity)
+	m.Set("rejected_writes", &writeMetrics.rejected)
+	m.Set("write_errors", &writeMetrics.writeErrors)
+	m.Set("fsync_count", &writeMetrics.fsyncCount)
+	m.Set("fsync_total_us", &writeMetrics.fsyncTotalUs)
+	m.Set("fsync_last_us", &writeMetrics.fsyncLastUs)
+	m.Set("fsync_max_us", &writeMetrics.fsyncMaxUs)
+	m.Set("disk_free_bytes", &diskMetrics.freeBytes)
+	m.Set("disk_full", &diskMetrics.full)
+	m.Set("disk_full_rejected_writes", &diskMetrics.rejected)
+}
+
+func observeFsync(d time.Duration) {
+	us := d.Microseconds()
+	writeMetrics.fsyncCount.Add(1)
+	writeMetrics.fsyncTotalUs.Add(us)
+	writeMetrics.fsyncLastUs.Set(us)
+	if us > writeMetrics.fsyncMaxUs.Value() {
+		writeMetrics.fsyncMaxUs.Set(us)
+	}
+}
+
+type WalOption func(*Wal)
+
+// WithWalRecoveryTarget ограничивает восстановление при Init записями, входящими в target.
+// Записи после цели переносятся в архив, если dryRun не установлен.
+// В режиме dryRun сегменты только читаются, а запись в WAL запрещена.
+func WithWalRecoveryTarget(target RecoveryTarget, dryRun bool) WalOption {
+	return func(wal *Wal) {
+		wal.report.Target = target
+		wal.report.DryRun = dryRun
+	}
+}
+
+// WithWalQueue задаёт, сколько записей может ждать записи на диск, и поведение при заполненной очереди
+func WithWalQueue(size int, policy QueuePolicy, timeout time.Duration) WalOption {
+	return func(wal *Wal) {
+		wal.queueSize = size
+		wal.queuePolicy = policy
+		wal.queueTimeout = timeout
+	}
+}
+
+// WithWalDiskGuard отклоняет запись с ErrDiskFull, пока guard сообщает о нехватке места
+func WithWalDiskGuard(guard *DiskGuard) WalOption {
+	return func(wal *Wal) {
+		wal.diskGuard = guard
+	}
+}
+
+// пачка записей, которые записываются на диск одним fsync
+type walBatch struct {
+	data    []byte
+	records int
+	// сколько мест в очереди занимают записи пачки
+	slots    int
+	firstLSN uint64
+	lastLSN  uint64
+	// reset выполняется вместо записи data, см. replace
+	reset func() error
+	err   error
+	done  chan struct{}
+}
+
+func newWalBatch() *walBatch {
+	return &walBatch{done: make(chan struct{})}
+}
+
 type Wal struct {
 	ctx                  context.Context
 	FlushingBatchSize    int
 	FlushingBatchTimeout time.Duration
 	logger               *zap.Logger
 
-	queryBuffer strings.Builder
-	segment     *Segment
-	mu          sync.Mutex
+	segment *Segment
+	mu      sync.Mutex
+	batch   *walBatch
+	lastLSN uint64
+	report  RecoveryReport
+	stopped bool
+	// LSN последней записи, сохранённой на диск, и канал, который закрывается после записи следующей пачки
+	syncedLSN uint64
+	written   chan struct{}
+	// failErr - ошибка последней неудачной записи, используется только горутиной записи
+	failErr error
 
-	data          chan []byte
+	queueSize    int
+	queuePolicy  QueuePolicy
+	queueTimeout time.Duration
+	// место в очереди занимает каждый вызов Write и WriteRecords до окончания fsync его пачки,
+	// поэтому в queue никогда не бывает больше queueSize пачек
+	slots         chan struct{}
+	queue         chan *walBatch
 	writeWaitChan chan struct{}
+
+	diskGuard *DiskGuard
+}
+
+// Stats описывает состояние записи в WAL
+type Stats struct {
+	LastLSN       uint64
+	SyncedLSN     uint64
+	QueueDepth    int
+	QueueCapacity int
+	// DiskFull и DiskFreeBytes заполняются, если задан DiskGuard
+	DiskFull      bool
+	DiskFreeBytes int64
 }
 
-func NewWal(ctx context.Context, FlushingBatchSize int, FlushingBatchTimeout time.Duration, segment *Segment, logger *zap.Logger) *Wal {
+func NewWal(ctx context.Context, FlushingBatchSize int, FlushingBatchTimeout time.Duration, segment *Segment, logger *zap.Logger, options ...WalOption) *Wal {
 	wal := Wal{
 		ctx:                  ctx,
 		FlushingBatchSize:    FlushingBatchSize,
 		FlushingBatchTimeout: FlushingBatchTimeout,
-		queryBuffer:          strings.Builder{},
 		segment:              segment,
-		data:                 make(chan []byte),
+		batch:                newWalBatch(),
+		written:              make(chan struct{}),
 		writeWaitChan:        make(chan struct{}),
 		logger:               logger,
 	}
 
+	for _, o := range options {
+		o(&wal)
+	}
+
 	if wal.FlushingBatchSize <= 0 {
 		wal.FlushingBatchSize = 100
 	}
@@ -43,48 +185,200 @@ func NewWal(ctx context.Context, FlushingBatchSize int, FlushingBatchTimeout tim
 		wal.FlushingBatchTimeout = 200 * time.Millisecond
 	}
 
+	if wal.queueSize <= 0 {
+		wal.queueSize = defaultQueueSize
+	}
+	if wal.queuePolicy == "" {
+		wal.queuePolicy = QueueBlock
+	}
+	if wal.queueTimeout <= 0 {
+		wal.queueTimeout = defaultQueueTimeout
+	}
+	wal.slots = make(chan struct{}, wal.queueSize)
+	wal.queue = make(chan *walBatch, wal.queueSize)
+	writeMetrics.queueCapacity.Set(int64(wal.queueSize))
+
 	return &wal
 }
 
-func (w *Wal) Init(f func([]byte) error) error {
-	return w.segment.Init(f)
+// Init восстанавливает состояние: передаёт в replay.Restore содержимое последнего снимка,
+// а затем в replay.Apply записи WAL, сделанные после снимка, в порядке LSN
+func (w *Wal) Init(replay Replay) error {
+	snapshotLSN, err := w.loadSnapshot(replay)
+	if err != nil {
+		return err
+	}
+
+	if w.report.Target.IsSet() && !w.report.DryRun {
+		if err := w.cutAtRecoveryTarget(snapshotLSN); err != nil {
+			return err
+		}
+	}
+
+	files, infos, err := listManifestSegments(w.segment.fs, w.segment.DataDirectory)
+	if err != nil {
+		return err
+	}
+	lastLSN, err := w.replay(files, infos, snapshotLSN, replay)
+	if err != nil {
+		return err
+	}
+
+	// в режиме dryRun сегменты только читаются
+	if w.report.DryRun {
+		return nil
+	}
+	if err := w.segment.Open(); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.lastLSN = max(lastLSN, snapshotLSN)
+	w.syncedLSN = w.lastLSN
+	w.mu.Unlock()
+
+	return nil
+}
+
+// WriteSnapshot записывает снимок состояния на момент записи lsn и удаляет старые снимки.
+// Вызывающий должен гарантировать, что rangeFn перебирает состояние, соответствующее lsn.
+func (w *Wal) WriteSnapshot(lsn uint64, rangeFn func(f func(key, val string) bool)) error {
+	if w.report.DryRun {
+		return ErrDryRun
+	}
+
+	file, err := WriteSnapshot(w.segment.fs, w.segment.DataDirectory, w.segment.keyring, SnapshotInfo{LSN: lsn, Timestamp: time.Now()}, rangeFn)
+	if err != nil {
+		return err
+	}
+	w.logger.Info("snapshot written", zap.String("file", file.Name), zap.Uint64("lsn", lsn))
+
+	return removeOldSnapshots(w.segment.fs, w.segment.DataDirectory)
 }
 
+// Reset заменяет содержимое директории данных снимком состояния на момент lsn: все сегменты и снимки
+// удаляются, записывается снимок snapshot_<lsn>, и следующая запись получит LSN lsn+1. Используется репликой
+// при полной синхронизации с primary. Сегменты удаляются до записи снимка, а снимки новее lsn - до записи
+// нового, поэтому после сбоя восстанавливается либо прежний снимок, либо новый. Читатели WAL получают
+// ErrLSNNotAvailable. Вызывающий должен гарантировать, что одновременно с Reset в WAL ничего не пишется.
+func (w *Wal) Reset(lsn uint64, rangeFn func(f func(key, val string) bool)) error {
+	if w.report.DryRun {
+		return ErrDryRun
+	}
+	return w.replace(lsn, func() error {
+		return w.reset(lsn, rangeFn)
+	})
+}
+
+// TruncateAfter удаляет из WAL записи с LSN больше lsn, и следующая запись получит LSN lsn+1. Используется
+// в режиме Raft, чтобы удалить записи, которые расходятся с логом лидера. Читатели WAL могли успеть прочитать
+// удалённые записи и должны начать чтение заново. Вызывающий должен гарантировать, что lsn не меньше
+// LSN последнего снимка и что одновременно с TruncateAfter в WAL ничего не пишется.
+func (w *Wal) TruncateAfter(lsn uint64) error {
+	if w.report.DryRun {
+		return ErrDryRun
+	}
+	if w.LastLSN() <= lsn {
+		return nil
+	}
+	return w.replace(lsn, func() error {
+		return w.segment.truncateAfter(lsn)
+	})
+}
+
+// replace выполняет f в горутине записи вместо записи пачки, после успешного f последний LSN в WAL - lsn
+func (w *Wal) replace(lsn uint64, f func() error) error {
+	if err := w.acquire(); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		<-w.slots
+		writeMetrics.queueDepth.Add(-1)
+		return ErrWalStopped
+	}
+	// сегменты меняет только горутина записи, поэтому сброс выполняется после уже принятых пачек
+	w.flushLocked()
+	batch := newWalBatch()
+	batch.slots = 1
+	batch.lastLSN = lsn
+	batch.reset = f
+	w.queue <- batch
+	w.mu.Unlock()
+
+	<-batch.done
+	return batch.err
+}
+
+func (w *Wal) reset(lsn uint64, rangeFn func(f func(key, val string) bool)) error {
+	fs, dir := w.segment.fs, w.segment.DataDirectory
+	if err := w.segment.clear(); err != nil {
+		return err
+	}
+
+	snapshots, err := ListSnapshotFiles(fs, dir)
+	if err != nil {
+		return err
+	}
+	// снимки новее lsn нельзя оставлять: после сбоя восстановление загрузило бы их вместо нового
+	for _, snapshot := range snapshots {
+		if snapshot.LSN >= lsn {
+			if err := fs.Remove(snapshot.Path); err != nil {
+				return err
+			}
+		}
+	}
+
+	file, err := WriteSnapshot(fs, dir, w.segment.keyring, SnapshotInfo{LSN: lsn, Timestamp: time.Now()}, rangeFn)
+	if err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.LSN < lsn {
+			if err := fs.Remove(snapshot.Path); err != nil {
+				return err
+			}
+		}
+	}
+	if err := fs.SyncDir(dir); err != nil {
+		return err
+	}
+	w.logger.Info("wal reset", zap.String("snapshot", file.Name), zap.Uint64("lsn", lsn))
+
+	return w.segment.restart()
+}
+
+// RecoveryReport возвращает результат чтения WAL в Init
+func (w *Wal) RecoveryReport() RecoveryReport {
+	return w.report
+}
+
+// Run записывает пачки на диск и сбрасывает неполную пачку раз в FlushingBatchTimeout.
+// После завершения ctx записываются уже принятые записи, новые получают ErrWalStopped.
 func (w *Wal) Run() error {
 	ticker := time.NewTicker(w.FlushingBatchTimeout)
 	defer ticker.Stop()
 
-	writeCtx, writeCancel := context.WithCancel(context.Background())
 	go func() {
 		defer func() {
 			w.segment.Close()
 			close(w.writeWaitChan)
 		}()
-		for d := range w.data {
-			if err := w.segment.Write(d); err != nil {
-				w.logger.Error("write segment", zap.Error(err))
-			}
-			select {
-			case <-writeCtx.Done():
-				//убедимся что больше нечего записывать
-				select {
-				case d := <-w.data:
-					if err := w.segment.Write(d); err != nil {
-						w.logger.Error("write segment", zap.Error(err))
-					}
-				default:
-				}
-				return
-			default:
-			}
+		for batch := range w.queue {
+			w.writeBatch(batch)
 		}
 	}()
 
 	for {
 		select {
 		case <-w.ctx.Done():
-			w.Flush()
-			writeCancel()
+			w.mu.Lock()
+			w.flushLocked()
+			w.stopped = true
+			close(w.queue)
+			w.mu.Unlock()
 			return nil
 		case <-ticker.C:
 			w.Flush()
@@ -92,30 +386,244 @@ func (w *Wal) Run() error {
 	}
 }
 
+// writeBatch записывает пачку на диск. LSN получают при постановке в пачку, поэтому после неудачной записи
+// LSN её записей освобождаются, а пачки, которые уже получили LSN после них, отклоняются с ErrWriteAborted:
+// следующая записанная пачка должна начинаться сразу за последней записью на диске.
+func (w *Wal) writeBatch(batch *walBatch) {
+	started := time.Now()
+	w.mu.Lock()
+	syncedLSN := w.syncedLSN
+	w.mu.Unlock()
+
+	aborted := false
+	switch {
+	case batch.reset != nil:
+		batch.err = batch.reset()
+	case batch.firstLSN != syncedLSN+1:
+		aborted = true
+		batch.err = fmt.Errorf("%w: %w", ErrWriteAborted, w.failErr)
+	default:
+		batch.err = w.segment.Write(batch.data)
+	}
+	if batch.err != nil && !aborted {
+		writeMetrics.writeErrors.Add(1)
+		w.logger.Error("write segment", zap.Error(batch.err))
+		if w.diskGuard != nil {
+			w.diskGuard.writeFailed(batch.err)
+		}
+		if batch.reset == nil {
+			w.failErr = batch.err
+			w.mu.Lock()
+			// неполная пачка тоже получила LSN после неудачной и отправляется в очередь, чтобы быть отклонённой,
+			// очередь не переполнится: места этой пачки ещё заняты
+			w.lastLSN = syncedLSN
+			if !w.stopped {
+				w.flushLocked()
+			}
+			w.mu.Unlock()
+		}
+	} else if batch.err == nil {
+		w.mu.Lock()
+		if batch.reset != nil {
+			w.lastLSN = batch.lastLSN
+		}
+		w.syncedLSN = batch.lastLSN
+		close(w.written)
+		w.written = make(chan struct{})
+		w.mu.Unlock()
+	}
+	if elapsed := time.Since(started); elapsed > slowWriteThreshold {
+		w.logger.Warn("slow wal write", zap.Duration("duration", elapsed), zap.Int("records", batch.records))
+	}
+
+	for i := 0; i < batch.slots; i++ {
+		<-w.slots
+	}
+	writeMetrics.queueDepth.Add(-int64(batch.slots))
+	close(batch.done)
+}
+
+// Write добавляет запись в текущую пачку и ждёт, пока пачка будет записана на диск.
+// Если очередь заполнена, возвращает ErrBusy в соответствии с политикой очереди,
+// если на диске не хватает места - ErrDiskFull.
 func (w *Wal) Write(query string) error {
+	_, err := w.WriteLSN(query)
+	return err
+}
+
+// WriteLSN работает как Write и возвращает LSN записи
+func (w *Wal) WriteLSN(query string) (uint64, error) {
+	if w.report.DryRun {
+		return 0, ErrDryRun
+	}
+	if w.diskGuard != nil && w.diskGuard.Full() {
+		diskMetrics.rejected.Add(1)
+		return 0, ErrDiskFull
+	}
+	if err := w.acquire(); err != nil {
+		return 0, err
+	}
+
 	w.mu.Lock()
-	var data []byte
-	if w.queryBuffer.Len() > w.FlushingBatchSize {
-		data = []byte(w.queryBuffer.String())
-		w.queryBuffer.Reset()
+	if w.stopped {
+		w.mu.Unlock()
+		<-w.slots
+		writeMetrics.queueDepth.Add(-1)
+		return 0, ErrWalStopped
+	}
+	w.lastLSN++
+	lsn := w.lastLSN
+	batch := w.batch
+	if batch.records == 0 {
+		batch.firstLSN = lsn
 	}
+	batch.data = append(batch.data, NewRecord(w.lastLSN, time.Now(), query).Encode()...)
+	batch.records++
+	batch.slots++
+	batch.lastLSN = w.lastLSN
+	if len(batch.data) >= w.FlushingBatchSize {
+		w.flushLocked()
+	}
+	w.mu.Unlock()
+
+	<-batch.done
+	return lsn, batch.err
+}
 
-	w.queryBuffer.WriteString(query + "\n")
+// WriteRecords записывает готовые записи с их LSN и временем, например полученные от другого сервера,
+// и ждёт, пока они будут записаны на диск. Записи с LSN не больше последнего пропускаются,
+// первая из остальных должна идти сразу за последним LSN, иначе возвращается ErrLSNOutOfOrder.
+// Записи отправляются на диск сразу, не дожидаясь заполнения пачки, и занимают одно место в очереди.
+func (w *Wal) WriteRecords(records []Record) error {
+	if w.report.DryRun {
+		return ErrDryRun
+	}
+	if w.diskGuard != nil && w.diskGuard.Full() {
+		diskMetrics.rejected.Add(1)
+		return ErrDiskFull
+	}
+	if err := w.acquire(); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	release := func() {
+		w.mu.Unlock()
+		<-w.slots
+		writeMetrics.queueDepth.Add(-1)
+	}
+	if w.stopped {
+		release()
+		return ErrWalStopped
+	}
+	for len(records) > 0 && records[0].LSN <= w.lastLSN {
+		records = records[1:]
+	}
+	if len(records) == 0 {
+		release()
+		return nil
+	}
+
+	for i, r := range records {
+		if r.LSN != w.lastLSN+uint64(i)+1 {
+			release()
+			return fmt.Errorf("%w: got %d after %d", ErrLSNOutOfOrder, r.LSN, w.lastLSN+uint64(i))
+		}
+	}
+
+	batch := w.batch
+	if batch.records == 0 {
+		batch.firstLSN = records[0].LSN
+	}
+	for _, r := range records {
+		batch.data = append(batch.data, r.Encode()...)
+	}
+	w.lastLSN = records[len(records)-1].LSN
+	batch.records += len(records)
+	batch.lastLSN = w.lastLSN
+	batch.slots++
+	w.flushLocked()
 	w.mu.Unlock()
 
-	if len(data) > 0 {
-		w.data <- data
+	<-batch.done
+	return batch.err
+}
+
+// acquire занимает место в очереди для одной записи
+func (w *Wal) acquire() error {
+	select {
+	case w.slots <- struct{}{}:
+		writeMetrics.queueDepth.Add(1)
+		return nil
+	default:
+	}
+
+	if w.queuePolicy == QueueReject {
+		writeMetrics.rejected.Add(1)
+		return ErrBusy
+	}
+
+	timer := time.NewTimer(w.queueTimeout)
+	defer timer.Stop()
+	select {
+	case w.slots <- struct{}{}:
+		writeMetrics.queueDepth.Add(1)
+		return nil
+	case <-timer.C:
+		writeMetrics.rejected.Add(1)
+		return ErrBusy
 	}
-	return nil
 }
 
+// Flush отправляет на запись неполную пачку
 func (w *Wal) Flush() {
 	w.mu.Lock()
-	data := []byte(w.queryBuffer.String())
-	w.queryBuffer.Reset()
+	defer w.mu.Unlock()
+
+	if !w.stopped {
+		w.flushLocked()
+	}
+}
+
+func (w *Wal) flushLocked() {
+	if w.batch.records == 0 {
+		return
+	}
+	// не блокируется: у каждой пачки в очереди есть хотя бы одна запись с занятым местом
+	w.queue <- w.batch
+	w.batch = newWalBatch()
+}
+
+// synced возвращает LSN последней записи, сохранённой на диск, и канал, который закроется после записи следующей пачки
+func (w *Wal) synced() (uint64, <-chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.syncedLSN, w.written
+}
+
+// LastLSN возвращает LSN последней принятой записи
+func (w *Wal) LastLSN() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lastLSN
+}
+
+// Stats возвращает текущее состояние записи
+func (w *Wal) Stats() Stats {
+	w.mu.Lock()
+	stats := Stats{
+		LastLSN:       w.lastLSN,
+		SyncedLSN:     w.syncedLSN,
+		QueueDepth:    len(w.slots),
+		QueueCapacity: w.queueSize,
+	}
 	w.mu.Unlock()
 
-	w.data <- data
+	if w.diskGuard != nil {
+		stats.DiskFull = w.diskGuard.Full()
+		stats.DiskFreeBytes = w.diskGuard.FreeBytes()
+	}
+	return stats
 }
 
 func (w *Wal) Close() error {
@@ -0,0 +1,287 @@
+package wal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"in-memory-db/internal/storage/filesystem"
+)
+
+// slowFS задерживает fsync и усечение файлов, пока тест держит gate
+type slowFS struct {
+	filesystem.FS
+	gate sync.RWMutex
+}
+
+func (f *slowFS) OpenFile(name string, flag int, perm os.FileMode) (filesystem.File, error) {
+	file, err := f.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &slowFile{File: file, fs: f}, nil
+}
+
+type slowFile struct {
+	filesystem.File
+	fs *slowFS
+}
+
+func (f *slowFile) Sync() error {
+	f.fs.gate.RLock()
+	defer f.fs.gate.RUnlock()
+	return f.File.Sync()
+}
+
+func (f *slowFile) Truncate(size int64) error {
+	f.fs.gate.RLock()
+	defer f.fs.gate.RUnlock()
+	return f.File.Truncate(size)
+}
+
+func startTestWal(t *testing.T, fs filesystem.FS, options ...WalOption) (*Wal, context.CancelFunc) {
+	require.NoError(t, fs.MkdirAll(crashTestDirectory, 0755))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	// каждая запись отправляется на диск отдельной пачкой
+	w := NewWal(ctx, 1, time.Hour, NewSegment(4096, crashTestDirectory, WithSegmentFileSystem(fs)), zap.NewNop(), options...)
+	require.NoError(t, w.Init(replayFunc(func(key, val string) error { return nil }, func(r Record) error { return nil })))
+	go w.Run()
+
+	return w, cancel
+}
+
+func TestWal_QueueFull(t *testing.T) {
+	for _, policy := range []QueuePolicy{QueueReject, QueueBlock} {
+		t.Run(string(policy), func(t *testing.T) {
+			fs := &slowFS{FS: filesystem.NewMemory()}
+			w, cancel := startTestWal(t, fs, WithWalQueue(2, policy, 50*time.Millisecond))
+
+			fs.gate.Lock()
+			errs := make(chan error, 2)
+			for i := 0; i < 2; i++ {
+				go func() {
+					errs <- w.Write(fmt.Sprintf("SET key%d val", i))
+				}()
+			}
+			require.Eventually(t, func() bool { return len(w.slots) == 2 }, time.Second, time.Millisecond)
+
+			rejected := writeMetrics.rejected.Value()
+			started := time.Now()
+			assert.ErrorIs(t, w.Write("SET key3 val"), ErrBusy)
+			if policy == QueueBlock {
+				assert.GreaterOrEqual(t, time.Since(started), 50*time.Millisecond)
+			}
+			assert.Equal(t, rejected+1, writeMetrics.rejected.Value())
+
+			// после fsync очередь освобождается
+			fs.gate.Unlock()
+			for i := 0; i < 2; i++ {
+				assert.NoError(t, <-errs)
+			}
+			assert.NoError(t, w.Write("SET key4 val"))
+			assert.Equal(t, uint64(3), w.LastLSN(), "rejected write does not get lsn")
+
+			cancel()
+			w.WaitWrite()
+			assert.ErrorIs(t, w.Write("SET key5 val"), ErrWalStopped)
+		})
+	}
+}
+
+func TestWal_WriteError(t *testing.T) {
+	fs := filesystem.NewFaulty(filesystem.NewMemory())
+	w, _ := startTestWal(t, fs)
+	require.NoError(t, w.Write("SET key1 val"))
+
+	writeErrors := writeMetrics.writeErrors.Value()
+	fs.Inject(filesystem.Fault{Op: filesystem.OpSync, Path: "data_", Err: syscall.EIO})
+	err := w.Write("SET key2 val")
+	assert.ErrorIs(t, err, ErrSegmentFailed)
+	assert.ErrorIs(t, err, syscall.EIO)
+
+	// после неудачного fsync запись невозможна до перезапуска
+	fs.Clear()
+	assert.ErrorIs(t, w.Write("SET key3 val"), ErrSegmentFailed)
+	assert.Equal(t, writeErrors+2, writeMetrics.writeErrors.Value())
+}
+
+func TestWal_FailedWriteReleasesLSN(t *testing.T) {
+	faulty := filesystem.NewFaulty(filesystem.NewMemory())
+	fs := &slowFS{FS: faulty}
+	w, cancel := startTestWal(t, fs)
+	require.NoError(t, w.Write("SET key1 val"))
+	data, err := fs.ReadFile(crashTestDirectory + "data_1")
+	require.NoError(t, err)
+
+	// key2 не записывается, key3 уже получила LSN после неё
+	faulty.Inject(filesystem.Fault{Op: filesystem.OpWrite, Path: "data_", Err: syscall.ENOSPC, ShortWrite: true})
+	fs.gate.Lock()
+	failed, aborted := make(chan error, 1), make(chan error, 1)
+	go func() {
+		failed <- w.Write("SET key2 val")
+	}()
+	require.Eventually(t, func() bool {
+		written, err := fs.ReadFile(crashTestDirectory + "data_1")
+		return err == nil && len(written) > len(data)
+	}, time.Second, time.Millisecond)
+	go func() {
+		aborted <- w.Write("SET key3 val")
+	}()
+	require.Eventually(t, func() bool { return w.LastLSN() == 3 }, time.Second, time.Millisecond)
+	faulty.Clear()
+	fs.gate.Unlock()
+
+	assert.ErrorIs(t, <-failed, syscall.ENOSPC)
+	err = <-aborted
+	assert.ErrorIs(t, err, ErrWriteAborted)
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+	assert.Equal(t, uint64(1), w.LastLSN())
+
+	lsn, err := w.WriteLSN("SET key4 val")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), lsn)
+	cancel()
+	w.WaitWrite()
+
+	var queries []string
+	require.NoError(t, ReadSegmentFile(fs, crashTestDirectory+"data_1", nil, &Decoder{}, func(index int, r Record) error {
+		assert.Equal(t, uint64(index+1), r.LSN)
+		queries = append(queries, r.Query)
+		return nil
+	}))
+	assert.Equal(t, []string{"SET key1 val", "SET key4 val"}, queries)
+}
+
+func TestWal_WriteRecords(t *testing.T) {
+	fs := filesystem.NewMemory()
+	w, cancel := startTestWal(t, fs)
+	ts := time.Unix(0, 1700000000000000000)
+
+	require.NoError(t, w.WriteRecords([]Record{NewRecord(1, ts, "SET a 1"), NewRecord(2, ts, "SET b 2")}))
+	// уже записанные записи пропускаются
+	require.NoError(t, w.WriteRecords([]Record{NewRecord(2, ts, "SET b 2"), NewRecord(3, ts, "DEL a")}))
+	assert.ErrorIs(t, w.WriteRecords([]Record{NewRecord(5, ts, "SET c 3")}), ErrLSNOutOfOrder)
+	assert.ErrorIs(t, w.WriteRecords([]Record{NewRecord(4, ts, "SET c 3"), NewRecord(6, ts, "SET d 4")}), ErrLSNOutOfOrder)
+	assert.Equal(t, uint64(3), w.LastLSN())
+	assert.Empty(t, w.slots)
+
+	// запросы продолжают нумерацию
+	lsn, err := w.WriteLSN("SET c 3")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), lsn)
+	cancel()
+	w.WaitWrite()
+
+	var records []Record
+	require.NoError(t, ReadSegmentFile(fs, crashTestDirectory+"/data_1", nil, &Decoder{}, func(index int, r Record) error {
+		records = append(records, r)
+		return nil
+	}))
+	require.Len(t, records, 4)
+	assert.Equal(t, NewRecord(3, ts, "DEL a"), records[2])
+	assert.Equal(t, uint64(4), records[3].LSN)
+}
+
+func TestWal_TruncateAfter(t *testing.T) {
+	fs := filesystem.NewMemory()
+	w, cancel := startTestWal(t, fs)
+	for i := range 200 {
+		require.NoError(t, w.Write(fmt.Sprintf("SET key%d val", i)))
+	}
+	files, err := ListSegmentFiles(fs, crashTestDirectory)
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+
+	require.NoError(t, w.TruncateAfter(200))
+	// записи до 100 лежат в первых двух сегментах, третий сегмент удаляется целиком
+	require.NoError(t, w.TruncateAfter(100))
+	assert.Equal(t, uint64(100), w.LastLSN())
+	assert.Equal(t, 2, w.segment.ActiveFileNumber())
+
+	lsn, err := w.WriteLSN("SET leader val")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(101), lsn)
+	cancel()
+	w.WaitWrite()
+
+	var queries []string
+	w = NewWal(context.Background(), 1, time.Hour, NewSegment(4096, crashTestDirectory, WithSegmentFileSystem(fs)), zap.NewNop())
+	require.NoError(t, w.Init(replayFunc(
+		func(key, val string) error { return nil },
+		func(r Record) error {
+			assert.Equal(t, uint64(len(queries)+1), r.LSN)
+			queries = append(queries, r.Query)
+			return nil
+		},
+	)))
+	require.Len(t, queries, 101)
+	assert.Equal(t, "SET key99 val", queries[99])
+	assert.Equal(t, "SET leader val", queries[100])
+	assert.Equal(t, 2, w.segment.ActiveFileNumber())
+	require.NoError(t, w.segment.Close())
+}
+
+func TestWal_Reset(t *testing.T) {
+	fs := filesystem.NewMemory()
+	w, cancel := startTestWal(t, fs)
+	for _, q := range []string{"SET a 1", "SET b 2", "DEL a"} {
+		require.NoError(t, w.Write(q))
+	}
+	_, err := WriteSnapshot(fs, crashTestDirectory, nil, SnapshotInfo{LSN: 2}, rangeMap(map[string]string{"a": "1", "b": "2"}))
+	require.NoError(t, err)
+	// снимок расходящейся истории новее lsn сброса
+	_, err = WriteSnapshot(fs, crashTestDirectory, nil, SnapshotInfo{LSN: 9}, rangeMap(map[string]string{"c": "3"}))
+	require.NoError(t, err)
+
+	tailer := w.Tail(1)
+	defer tailer.Close()
+	ctx, cancelTail := context.WithTimeout(context.Background(), time.Second)
+	defer cancelTail()
+	for i := 0; i < 3; i++ {
+		_, err := tailer.Next(ctx)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, w.Reset(7, rangeMap(map[string]string{"x": "1"})))
+	assert.Equal(t, uint64(7), w.LastLSN())
+	_, err = tailer.Next(ctx)
+	assert.ErrorIs(t, err, ErrLSNNotAvailable)
+
+	lsn, err := w.WriteLSN("SET y 2")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(8), lsn)
+	cancel()
+	w.WaitWrite()
+
+	snapshots, err := ListSnapshotFiles(fs, crashTestDirectory)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+	assert.Equal(t, uint64(7), snapshots[0].LSN)
+
+	restored := map[string]string{}
+	var lsns []uint64
+	w = NewWal(context.Background(), 1, time.Hour, NewSegment(4096, crashTestDirectory, WithSegmentFileSystem(fs)), zap.NewNop())
+	require.NoError(t, w.Init(replayFunc(
+		func(key, val string) error {
+			restored[key] = val
+			return nil
+		},
+		func(r Record) error {
+			lsns = append(lsns, r.LSN)
+			return nil
+		},
+	)))
+	assert.Equal(t, map[string]string{"x": "1"}, restored)
+	assert.Equal(t, []uint64{8}, lsns)
+	assert.Equal(t, 3, w.segment.ActiveFileNumber())
+	require.NoError(t, w.segment.Close())
+}
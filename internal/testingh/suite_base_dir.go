@@ -43,6 +43,13 @@ func (s *BaseDirSuite) ReadFileToSlice(filePath string) []string {
 	return fileLines
 }
 
+func (s *BaseDirSuite) ReadFile(filePath string) []byte {
+	data, err := os.ReadFile(filePath)
+	s.NoError(err)
+
+	return data
+}
+
 func (s *BaseDirSuite) FileNamesInBaseDir() []string {
 	files, err := os.ReadDir(s.BaseDir)
 	s.NoError(err)